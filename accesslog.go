@@ -0,0 +1,149 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Access log formats.
+const (
+	AccessLogCommon = "common"
+	AccessLogJSON   = "json"
+)
+
+// accessLog writes a line per request to a rotated file.
+type accessLog struct {
+	file   *lumberjack.Logger
+	format string
+}
+
+func newAccessLog(cfg *Config) (*accessLog, error) {
+	format := cfg.AccessLogFormat
+	switch format {
+	case "":
+		format = AccessLogCommon
+	case AccessLogCommon, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q (common or json)", format)
+	}
+	return &accessLog{
+		file: &lumberjack.Logger{
+			Filename:   cfg.AccessLogFile,
+			MaxSize:    cfg.AccessLogMaxSize,
+			MaxBackups: cfg.AccessLogMaxBackups,
+			LocalTime:  true,
+		},
+		format: format,
+	}, nil
+}
+
+// accessLogEntry is a line of the JSON access log.
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	RemoteAddr string  `json:"remoteAddr"`
+	Host       string  `json:"host"`
+	Method     string  `json:"method"`
+	URI        string  `json:"uri"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	Latency    float64 `json:"latencySeconds"`
+	UserAgent  string  `json:"userAgent,omitempty"`
+}
+
+func (l *accessLog) write(r *http.Request, start time.Time, status, bytes int) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if host == "" || host == "@" {
+		// unix sockets and named pipes
+		host = "-"
+	}
+	uri := redact(r.URL.RequestURI())
+	var line []byte
+	if l.format == AccessLogJSON {
+		line, _ = json.Marshal(accessLogEntry{
+			Time:       start.Format(time.RFC3339Nano),
+			RemoteAddr: host,
+			Host:       r.Host,
+			Method:     r.Method,
+			URI:        uri,
+			Proto:      r.Proto,
+			Status:     status,
+			Bytes:      bytes,
+			Latency:    time.Since(start).Seconds(),
+			UserAgent:  r.UserAgent(),
+		})
+	} else {
+		size := "-"
+		if bytes > 0 {
+			size = strconv.Itoa(bytes)
+		}
+		line = []byte(fmt.Sprintf("%s - - [%s] %q %d %s", host, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+uri+" "+r.Proto, status, size))
+	}
+	line = append(line, '\n')
+	if _, err := l.file.Write(line); err != nil {
+		logger.Errorf("Unable to write access log %s: %v", l.file.Filename, err)
+	}
+}
+
+// rotate starts a new file every interval until stop is closed.
+func (l *accessLog) rotate(interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if err := l.file.Rotate(); err != nil {
+				logger.Errorf("Unable to rotate access log %s: %v", l.file.Filename, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (l *accessLog) close() {
+	if l == nil {
+		return
+	}
+	l.file.Close()
+}
+
+// logRequests writes each request to the access log.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	if s.accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		s.accessLog.write(r, start, sw.status, sw.bytes)
+	})
+}
@@ -0,0 +1,485 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// ServiceAccountConfig describes a service account served in addition to the
+// default one.  Its tokens come from Credentials, CredentialsFile, JWTs
+// signed by Signer or, if none is set, from impersonating Email with
+// application default credentials.
+type ServiceAccountConfig struct {
+	Email           string
+	CredentialsFile string
+	Credentials     *google.Credentials
+	Signer          crypto.Signer
+	SignerKeyID     string
+	// Scopes defaults to Config.TokenScopes
+	Scopes []string
+	// Aliases are other names the account is listed and served under in
+	// /instance/service-accounts/, like default for the default account.
+	Aliases []string
+}
+
+// account holds the credentials of one service account listed under
+// /instance/service-accounts/.
+type account struct {
+	email       string
+	scopes      []string
+	aliases     []string
+	impersonate bool
+	delegates   []string
+	lifetime    time.Duration
+	// keyID is the id of the key held by signer, if known
+	keyID string
+	// quotaProject is billed for the IAM calls made for the account
+	quotaProject string
+
+	mu    sync.Mutex
+	creds *google.Credentials
+	// credType is the type of the credentials JSON, if any (eg service_account)
+	credType string
+	// signer, if set, holds the service account key used to sign JWTs
+	signer crypto.Signer
+	// external, if set, is the command or webhook tokens are read from
+	external *externalCredential
+	// fake, if set, mints the account's tokens locally
+	fake *fakeIssuer
+	// selfSignedJWT is set if access tokens are self-signed JWTs for
+	// jwtAudience (or the scopes)
+	selfSignedJWT bool
+	jwtAudience   string
+	// maxLifetime, if set, caps the lifetime of self-signed JWTs, see
+	// Config.MaxTokenLifetime
+	maxLifetime time.Duration
+	// skew shifts the iat and exp claims of self-signed JWTs, see
+	// Config.ClockSkew
+	skew time.Duration
+	// accessBoundary, if set, is the Credential Access Boundary access
+	// tokens are downscoped with
+	accessBoundary string
+	// outbound bounds the concurrent calls fetching the account's tokens
+	outbound *outboundLimiter
+	// cache, if set, persists the account's tokens
+	cache *tokenCache
+	// idTokens holds the ID tokens in use by audience
+	idTokens idTokenCache
+	// scopedTokenSources caches the token sources for scopes requested
+	// with ?scopes=, keyed by the sorted scope list
+	scopedTokenSources map[string]oauth2.TokenSource
+	// invalidated is set once the cached tokens were dropped, after which
+	// the account's own scopes are served from a new scoped source as well
+	invalidated bool
+	// issued are the last access tokens returned by scopes, for the metrics
+	// and to serve them again without waiting for a fetch slot
+	issued map[string]*oauth2.Token
+	// fetches dedupes concurrent fetches of access tokens by cache key
+	fetches singleflight.Group
+}
+
+// newAccount resolves the credentials of an additional service account.
+// lifetime is that of its impersonated tokens, the default 1h if 0.
+func newAccount(ctx context.Context, c ServiceAccountConfig, scopes []string, quotaProject string, lifetime time.Duration) (*account, error) {
+	if c.Email == "" {
+		return nil, errors.New("email must be set for each additional service account")
+	}
+	a := &account{
+		email:        c.Email,
+		scopes:       c.Scopes,
+		aliases:      c.Aliases,
+		lifetime:     lifetime,
+		quotaProject: quotaProject,
+	}
+	if len(a.scopes) == 0 {
+		a.scopes = scopes
+	}
+	switch {
+	case c.Credentials != nil:
+		a.creds = c.Credentials
+	case c.Signer != nil:
+		a.keyID = c.SignerKeyID
+		if err := a.useSigner(ctx, c.Signer); err != nil {
+			return nil, err
+		}
+	case c.CredentialsFile != "":
+		data, err := ioutil.ReadFile(c.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials for %s: %v", c.Email, err)
+		}
+		a.creds, err = google.CredentialsFromJSON(ctx, data, a.scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse credentials for %s: %v", c.Email, err)
+		}
+	default:
+		a.impersonate = true
+		ts, err := a.impersonatedTokenSource(ctx, a.scopes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create Impersonated TokenSource for %s: %v", c.Email, err)
+		}
+		a.creds = &google.Credentials{TokenSource: ts}
+	}
+	if _, err := a.parseCredentials(); err != nil {
+		return nil, err
+	}
+	logger.Infof("Serving additional service account %s", a.email)
+	return a, nil
+}
+
+// useSigner mints the account's tokens with JWTs signed by signer, which must
+// hold an RSA key since service account assertions are RS256.
+func (a *account) useSigner(ctx context.Context, signer crypto.Signer) error {
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		return fmt.Errorf("the key of %s must be an RSA key, got %T", a.email, signer.Public())
+	}
+	a.signer = signer
+	a.creds = &google.Credentials{
+		TokenSource: oauth2.ReuseTokenSource(nil, &signerTokenSource{
+			ctx:    ctx,
+			email:  a.email,
+			keyID:  a.keyID,
+			scopes: a.scopes,
+			signer: signer,
+		}),
+	}
+	return nil
+}
+
+// applyTokenOptions makes newly set credentials serve self-signed JWTs or
+// downscoped access tokens if configured.  Must be called with mu held or
+// before the account is in use.
+func (a *account) applyTokenOptions() error {
+	if a.selfSignedJWT {
+		return a.useSelfSignedJWT()
+	}
+	if a.accessBoundary != "" {
+		creds := *a.creds
+		creds.TokenSource = a.downscoped(creds.TokenSource)
+		a.creds = &creds
+	}
+	return nil
+}
+
+// parseCredentials records the type of the credentials JSON, if any, and
+// returns the file.
+func (a *account) parseCredentials() (*credentialsFile, error) {
+	if a.creds == nil || len(a.creds.JSON) == 0 {
+		return nil, nil
+	}
+	f, err := parseCredentialsFile(a.creds.JSON)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse credentials JSON %v", err)
+	}
+	a.credType = f.Type
+	return f, nil
+}
+
+// impersonatedTokenSource returns access tokens for the account with the
+// given scopes using impersonation.
+func (a *account) impersonatedTokenSource(ctx context.Context, scopes []string) (oauth2.TokenSource, error) {
+	return impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: a.email,
+		Scopes:          scopes,
+		Delegates:       a.delegates,
+		Lifetime:        a.lifetime,
+	}, a.iamOptions()...)
+}
+
+// cappedLifetime returns the token lifetime d, 0 standing for the default,
+// capped to max if it is set.
+func cappedLifetime(d, max time.Duration) time.Duration {
+	if max > 0 && (d <= 0 || d > max) {
+		return max
+	}
+	return d
+}
+
+// iamOptions returns the client options of the IAM calls made for the
+// account.
+func (a *account) iamOptions(opts ...option.ClientOption) []option.ClientOption {
+	if a.quotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(a.quotaProject))
+	}
+	return opts
+}
+
+// scopedTokenSource returns the token source for scopes requested by a
+// client.  A source is created for each distinct set and reused.  Accounts
+// which can't mint tokens for arbitrary scopes (eg authorized_user
+// credentials) ignore them.  Must be called with mu held.
+func (a *account) scopedTokenSource(scopes []string) (oauth2.TokenSource, error) {
+	if len(scopes) == 0 && a.invalidated {
+		scopes = a.scopes
+	}
+	if len(scopes) == 0 || !a.canScope() {
+		return a.creds.TokenSource, nil
+	}
+	sorted := append([]string{}, scopes...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, ",")
+	if ts, ok := a.scopedTokenSources[key]; ok {
+		return ts, nil
+	}
+	ctx := context.Background()
+	var ts oauth2.TokenSource
+	switch {
+	case a.fake != nil:
+		ts = oauth2.ReuseTokenSource(nil, &fakeTokenSource{
+			issuer: a.fake,
+			email:  a.email,
+			scopes: sorted,
+		})
+	case a.selfSignedJWT:
+		signer, keyID := a.signer, a.keyID
+		if signer == nil {
+			var err error
+			signer, keyID, err = a.privateKey()
+			if err != nil {
+				return nil, err
+			}
+		}
+		ts = oauth2.ReuseTokenSource(nil, &selfSignedTokenSource{
+			email:       a.email,
+			keyID:       keyID,
+			scopes:      sorted,
+			signer:      signer,
+			maxLifetime: a.maxLifetime,
+			skew:        a.skew,
+		})
+	case a.external != nil:
+		ts = a.external.tokenSource(sorted)
+	case a.impersonate:
+		var err error
+		ts, err = a.impersonatedTokenSource(ctx, sorted)
+		if err != nil {
+			return nil, err
+		}
+	case a.signer != nil:
+		ts = oauth2.ReuseTokenSource(nil, &signerTokenSource{
+			ctx:    ctx,
+			email:  a.email,
+			keyID:  a.keyID,
+			scopes: sorted,
+			signer: a.signer,
+		})
+	default:
+		creds, err := google.CredentialsFromJSON(ctx, a.creds.JSON, sorted...)
+		if err != nil {
+			return nil, err
+		}
+		ts = creds.TokenSource
+	}
+	ts = a.downscoped(ts)
+	if a.scopedTokenSources == nil {
+		a.scopedTokenSources = map[string]oauth2.TokenSource{}
+	}
+	a.scopedTokenSources[key] = ts
+	return ts, nil
+}
+
+// invalidate drops the account's cached tokens so the next requests get new
+// ones.  Accounts which can't mint tokens for arbitrary scopes keep serving
+// the token of their credentials until it expires.
+func (a *account) invalidate() {
+	a.mu.Lock()
+	a.scopedTokenSources = nil
+	a.invalidated = true
+	a.issued = nil
+	a.mu.Unlock()
+	accessTokenMetrics.Add("invalidations", 1)
+	a.cache.drop(a.email)
+	a.idTokens.purge()
+}
+
+// canScope reports whether the account can mint access tokens for scopes
+// requested by clients.
+func (a *account) canScope() bool {
+	switch {
+	case a.selfSignedJWT:
+		// JWTs for an audience have no scopes
+		return a.jwtAudience == ""
+	case a.fake != nil, a.external != nil, a.impersonate, a.signer != nil:
+		return true
+	}
+	return a.credType == serviceAccountKey || a.credType == externalAccountKey
+}
+
+// accessToken returns an access token with the requested scopes, or the
+// account's scopes if none are requested.  mu isn't held while tokens are
+// fetched, and concurrent requests for the same scopes share one fetch.
+func (a *account) accessToken(ctx context.Context, scopes []string) (tok *oauth2.Token, err error) {
+	ctx, sp := startSpan(ctx, "accessToken", spanInternal)
+	defer func() { sp.finish(err) }()
+	sp.set("serviceAccount", a.email)
+	cacheScopes := scopes
+	if len(cacheScopes) == 0 {
+		cacheScopes = a.scopes
+	}
+	sp.set("scopes", strings.Join(cacheScopes, " "))
+	key := tokenCacheKey(a.email, "access_token", cacheScopes)
+	tok = a.cache.get(key)
+	a.mu.Lock()
+	if tok == nil {
+		if t := a.issued[strings.Join(cacheScopes, " ")]; t.Valid() {
+			tok = t
+		}
+	}
+	if tok != nil {
+		a.recordAccessToken(cacheScopes, tok)
+		a.mu.Unlock()
+		sp.set("cached", true)
+		return tok, nil
+	}
+	ts, err := a.scopedTokenSource(scopes)
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	sp.set("cached", false)
+	v, err, _ := a.fetches.Do(key, func() (interface{}, error) {
+		release, err := a.acquireOutbound(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, fetch := startSpan(ctx, "fetchAccessToken", spanClient)
+		tok, err := ts.Token()
+		fetch.finish(err)
+		release()
+		if err != nil {
+			accessTokenMetrics.Add("errors", 1)
+			return nil, err
+		}
+		a.cache.put(key, tok)
+		return tok, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	tok = v.(*oauth2.Token)
+	a.mu.Lock()
+	a.recordAccessToken(cacheScopes, tok)
+	a.mu.Unlock()
+	return tok, nil
+}
+
+// idToken returns an ID token for the account with the given audience.
+func (a *account) idToken(ctx context.Context, targetAudience string) (tok string, err error) {
+	ctx, sp := startSpan(ctx, "idToken", spanInternal)
+	defer func() { sp.finish(err) }()
+	sp.set("serviceAccount", a.email)
+	sp.set("audience", targetAudience)
+	return a.idTokens.get(targetAudience, func() (*oauth2.Token, error) {
+		return a.fetchIDToken(ctx, targetAudience)
+	})
+}
+
+// fetchIDToken returns a new ID token, or one persisted in the token cache.
+func (a *account) fetchIDToken(ctx context.Context, targetAudience string) (*oauth2.Token, error) {
+	key := tokenCacheKey(a.email, "id_token", []string{targetAudience})
+	if tok := a.cache.get(key); tok != nil {
+		return tok, nil
+	}
+	// some sources already fetch a token when they are created
+	release, err := a.acquireOutbound(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idTokenSource, err := a.idTokenSource(targetAudience)
+	if err != nil {
+		release()
+		logger.Errorln(err)
+		return nil, errors.New("unable to get id_token")
+	}
+	_, fetch := startSpan(ctx, "fetchIDToken", spanClient)
+	tok, err := idTokenSource.Token()
+	fetch.finish(err)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	if tok.Expiry.IsZero() {
+		// not every source sets it
+		if exp, err := jwtExpiry(tok.AccessToken); err == nil {
+			tok.Expiry = exp
+		}
+	}
+	a.cache.put(key, tok)
+	return tok, nil
+}
+
+// acquireOutbound waits for a slot of the outbound limiter to fetch a token.
+// Fake accounts mint their tokens locally and don't wait.
+func (a *account) acquireOutbound(ctx context.Context) (func(), error) {
+	if a.fake != nil {
+		return func() {}, nil
+	}
+	return a.outbound.acquire(ctx)
+}
+
+// idTokenSource returns a source of ID tokens for the audience.  It only
+// reads fields set when the account is created, so mu isn't held while
+// sources which fetch a token right away are created.
+func (a *account) idTokenSource(targetAudience string) (oauth2.TokenSource, error) {
+	ctx := context.Background()
+	switch {
+	case a.fake != nil:
+		return &fakeTokenSource{issuer: a.fake, email: a.email, audience: targetAudience}, nil
+	case a.signer != nil:
+		return &signerTokenSource{
+			ctx:      ctx,
+			email:    a.email,
+			keyID:    a.keyID,
+			audience: targetAudience,
+			signer:   a.signer,
+		}, nil
+	case a.external != nil:
+		return a.external.idTokenSource(targetAudience), nil
+	case a.impersonate:
+		return impersonate.IDTokenSource(ctx,
+			impersonate.IDTokenConfig{
+				TargetPrincipal: a.email,
+				Audience:        targetAudience,
+				IncludeEmail:    true,
+				Delegates:       a.delegates,
+			},
+			a.iamOptions()...,
+		)
+	case a.credType == externalAccountKey, a.credType == userCredentialsKey:
+		return a.federatedIDTokenSource(ctx, targetAudience)
+	case len(a.creds.JSON) == 0:
+		// only an access token is available (eg vault or Config.Credentials
+		// built from a TokenSource)
+		return a.iamIDTokenSource(ctx, a.creds.TokenSource, targetAudience)
+	default:
+		return idtoken.NewTokenSource(ctx, targetAudience, idtoken.WithCredentialsJSON(a.creds.JSON))
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// adminPrefix is the path of the admin API on AdminListen.
+const adminPrefix = "/admin/v1"
+
+// InvalidateTokens drops the cached access and ID tokens of every service
+// account, including persisted ones, so the next requests get new tokens.
+func (s *Server) InvalidateTokens() {
+	primary := s.defaultAccount()
+	primary.invalidate()
+	if primary != s.configured {
+		s.configured.invalidate()
+	}
+	for _, a := range s.accounts {
+		a.invalidate()
+	}
+	s.mu.Lock()
+	s.publish(ChangeEvent{Kind: ChangeTokensInvalidated})
+	s.mu.Unlock()
+	logger.Infoln("Cached tokens invalidated")
+}
+
+// unmappedTree returns the metadata the way it is served to callers without
+// a client mapping.
+func (s *Server) unmappedTree() map[string]interface{} {
+	return s.metadataTree(&http.Request{})
+}
+
+// loadAdminAuth reads the admin token and TLS configuration.
+func (s *Server) loadAdminAuth() error {
+	if s.cfg.AdminToken != "" && s.cfg.AdminTokenFile != "" {
+		return errors.New("only one of AdminToken and AdminTokenFile may be set")
+	}
+	s.adminToken = s.cfg.AdminToken
+	if s.cfg.AdminTokenFile != "" {
+		token, err := ioutil.ReadFile(s.cfg.AdminTokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read admin token file: %v", err)
+		}
+		s.adminToken = strings.TrimSpace(string(token))
+		if s.adminToken == "" {
+			return fmt.Errorf("admin token file %s is empty", s.cfg.AdminTokenFile)
+		}
+	}
+	var err error
+	s.adminTLS, err = loadTLSConfig("AdminTLS", s.cfg.AdminTLSCertFile, s.cfg.AdminTLSKeyFile, s.cfg.AdminTLSClientCAFile)
+	if err != nil {
+		return err
+	}
+	if s.adminToken != "" || s.cfg.AdminTLSClientCAFile != "" {
+		return nil
+	}
+	// without credentials only local processes may reach the APIs
+	for name, addr := range map[string]string{"AdminListen": s.cfg.AdminListen, "ControlListen": s.cfg.ControlListen} {
+		if addr != "" && !isLoopbackAddress(addr) {
+			return fmt.Errorf("%s %s must be a loopback address unless AdminToken, AdminTokenFile or AdminTLSClientCAFile is set", name, addr)
+		}
+	}
+	return nil
+}
+
+// isLoopbackAddress reports whether a listen address (host:port) only
+// accepts connections from the local host.
+func isLoopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminAuthorized reports whether the Authorization header (or gRPC
+// metadata) carries the admin token, if one is required.
+func (s *Server) adminAuthorized(authorization string) bool {
+	if s.adminToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return token != authorization && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+// adminAuth rejects admin API requests without the admin token.
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminAuthorized(r.Header.Get("Authorization")) {
+			logger.Warnf("Unauthorized admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startAdmin serves the admin API on AdminListen.
+func (s *Server) startAdmin() error {
+	l, err := net.Listen("tcp", s.cfg.AdminListen)
+	if err != nil {
+		return fmt.Errorf("admin listen: %v", err)
+	}
+	if s.adminTLS != nil {
+		l = tls.NewListener(l, s.adminTLS)
+	}
+	r := mux.NewRouter()
+	a := r.PathPrefix(adminPrefix).Subrouter()
+	a.Use(s.adminAuth)
+	a.HandleFunc("/metadata/{path:.*}", s.adminGetMetadata).Methods("GET")
+	a.HandleFunc("/metadata/{path:.+}", s.adminSetMetadata).Methods("PUT")
+	a.HandleFunc("/maintenance-event", s.adminMaintenanceEvent).Methods("POST")
+	a.HandleFunc("/preempt", s.adminPreempt).Methods("POST")
+	a.HandleFunc("/invalidate-tokens", s.adminInvalidateTokens).Methods("POST")
+	a.HandleFunc("/reload", s.adminReload).Methods("POST")
+	a.HandleFunc("/service-account", s.adminSwitchServiceAccount).Methods("PUT")
+	a.HandleFunc("/service-account", s.adminRestoreServiceAccount).Methods("DELETE")
+	a.HandleFunc("/faults", s.adminFaults).Methods("GET")
+	a.HandleFunc("/faults", s.adminInjectFault).Methods("POST")
+	a.HandleFunc("/faults", s.adminClearFaults).Methods("DELETE")
+	if s.cfg.AdminPprof {
+		p := r.PathPrefix("/debug/pprof/").Subrouter()
+		p.Use(s.adminAuth)
+		p.HandleFunc("/cmdline", pprof.Cmdline)
+		p.HandleFunc("/profile", pprof.Profile)
+		p.HandleFunc("/symbol", pprof.Symbol)
+		p.HandleFunc("/trace", pprof.Trace)
+		// the index and the named profiles, eg /debug/pprof/heap
+		p.PathPrefix("/").HandlerFunc(pprof.Index)
+	}
+	s.adminSrv = &http.Server{
+		Handler: s.limitRequests(r, func(w http.ResponseWriter, r *http.Request, code int, _ string) {
+			http.Error(w, http.StatusText(code), code)
+		}),
+		ConnContext:       withConn,
+		MaxHeaderBytes:    s.maxHeaderBytes(),
+		ReadHeaderTimeout: s.requestReadTimeout(),
+	}
+	go func() {
+		if err := s.adminSrv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("admin serve: %s", err)
+		}
+	}()
+	logger.Infof("Serving the admin API on %s%s/", l.Addr(), adminPrefix)
+	return nil
+}
+
+// adminGetMetadata returns the metadata at a path, or all of it, as JSON the
+// way it is served to callers without a client mapping.
+func (s *Server) adminGetMetadata(w http.ResponseWriter, r *http.Request) {
+	v, ok := lookupPath(s.unmappedTree(), strings.Split(mux.Vars(r)["path"], "/"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	js, err := renderJSON(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// adminSetMetadata sets the value at a path (eg instance/attributes/foo) to
+// the request body, which is decoded if the content type is JSON.
+func (s *Server) adminSetMetadata(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var value interface{} = string(body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid json: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	path := mux.Vars(r)["path"]
+	if err := s.SetValue(path, value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Infof("Admin set %s", path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminMaintenanceEvent sets the maintenance event named in the body, or
+// toggles it if the body is empty, and returns the new event.
+func (s *Server) adminMaintenanceEvent(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event := strings.TrimSpace(string(body))
+	if event == "" {
+		event = s.ToggleMaintenanceEvent()
+	} else if err := s.SetMaintenanceEvent(event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, event)
+}
+
+func (s *Server) adminPreempt(w http.ResponseWriter, r *http.Request) {
+	s.Preempt()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminInvalidateTokens(w http.ResponseWriter, r *http.Request) {
+	s.InvalidateTokens()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminReload(w http.ResponseWriter, r *http.Request) {
+	if err := s.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminSwitchServiceAccount switches the default service account to the one
+// in the SwitchServiceAccountRequest body.  The token sources of the account
+// outlive the request, so they don't get its context.
+func (s *Server) adminSwitchServiceAccount(w http.ResponseWriter, r *http.Request) {
+	var req SwitchServiceAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid json: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.switchServiceAccount(context.Background(), &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, s.getServiceAccountEmail())
+}
+
+func (s *Server) adminRestoreServiceAccount(w http.ResponseWriter, r *http.Request) {
+	s.RestoreServiceAccount()
+	fmt.Fprintln(w, s.getServiceAccountEmail())
+}
+
+func (s *Server) adminFaults(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Faults())
+}
+
+// adminInjectFault injects the fault of the FaultRequest body.
+func (s *Server) adminInjectFault(w http.ResponseWriter, r *http.Request) {
+	var req FaultRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid json: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.injectFault(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminClearFaults clears the fault of the path query parameter, or all.
+func (s *Server) adminClearFaults(w http.ResponseWriter, r *http.Request) {
+	s.ClearFaults(r.URL.Query().Get("path"))
+	w.WriteHeader(http.StatusNoContent)
+}
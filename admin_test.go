@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tc := range []struct {
+		name, token, authorization string
+		want                       int
+	}{
+		{"no token required", "", "", http.StatusOK},
+		{"valid", "secret", "Bearer secret", http.StatusOK},
+		{"missing", "secret", "", http.StatusUnauthorized},
+		{"wrong", "secret", "Bearer other", http.StatusUnauthorized},
+		{"not bearer", "secret", "secret", http.StatusUnauthorized},
+		{"prefix", "secret", "Bearer secre", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{adminToken: tc.token}
+			r := httptest.NewRequest("POST", adminPrefix+"/invalidate-tokens", nil)
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			s.adminAuth(ok).ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d", w.Code, tc.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAdminListenAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"loopback", Config{AdminListen: "127.0.0.1:0", ControlListen: "[::1]:0"}, true},
+		{"localhost", Config{AdminListen: "localhost:0"}, true},
+		{"all interfaces", Config{AdminListen: ":0"}, false},
+		{"control on all interfaces", Config{AdminListen: "127.0.0.1:0", ControlListen: "0.0.0.0:0"}, false},
+		{"token", Config{AdminListen: ":0", AdminToken: "secret"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{cfg: tc.cfg}
+			if err := s.loadAdminAuth(); (err == nil) != tc.ok {
+				t.Errorf("loadAdminAuth() = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestAdminUnauthenticated(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	newTestServer(t, Config{AdminListen: addr, AdminToken: "secret"})
+
+	for _, tc := range []struct {
+		name, authorization string
+		want                int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer other", http.StatusUnauthorized},
+		{"valid", "Bearer secret", http.StatusOK},
+	} {
+		req, err := http.NewRequest("GET", "http://"+addr+adminPrefix+"/metadata/project/project-id", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord is a line of the token audit log.
+type auditRecord struct {
+	Time           string   `json:"time"`
+	Kind           string   `json:"kind"`
+	ServiceAccount string   `json:"serviceAccount"`
+	Scopes         []string `json:"scopes,omitempty"`
+	Audience       string   `json:"audience,omitempty"`
+	ClientAddr     string   `json:"clientAddr"`
+	PID            int      `json:"pid,omitempty"`
+	UID            *uint32  `json:"uid,omitempty"`
+	Executable     string   `json:"executable,omitempty"`
+	Container      string   `json:"container,omitempty"`
+}
+
+// tokenAudit appends a JSON line for every token handed out to a file.
+type tokenAudit struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openTokenAudit(path string) (*tokenAudit, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open token audit log: %v", err)
+	}
+	return &tokenAudit{f: f}, nil
+}
+
+func (t *tokenAudit) close() {
+	if t == nil {
+		return
+	}
+	t.f.Close()
+}
+
+// auditToken records that a token of a was issued to the caller of r.
+// scopes are set for access tokens, audience for ID tokens.
+func (s *Server) auditToken(r *http.Request, a *account, scopes []string, audience string) {
+	if s.audit == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:           time.Now().UTC().Format(time.RFC3339Nano),
+		ServiceAccount: a.email,
+		ClientAddr:     r.RemoteAddr,
+	}
+	if audience != "" {
+		rec.Kind, rec.Audience = "id_token", audience
+	} else {
+		rec.Kind, rec.Scopes = "access_token", scopes
+		if len(scopes) == 0 {
+			rec.Scopes = a.scopes
+		}
+	}
+	if cred, ok := r.Context().Value(peerCredKey{}).(*peerCred); ok {
+		rec.PID, rec.UID = int(cred.pid), &cred.uid
+	} else if pid, err := requestPeerPID(r); err == nil {
+		rec.PID = pid
+	} else {
+		logger.Debugf("Unable to find the process of %s: %v", r.RemoteAddr, err)
+	}
+	if rec.PID != 0 {
+		rec.Executable, _ = pidExecutable(rec.PID)
+	}
+	if ctr, ok := r.Context().Value(containerKey{}).(*container); ok {
+		rec.Container = ctr.name
+		if rec.Container == "" {
+			rec.Container = ctr.id
+		}
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logger.Errorf("Unable to encode token audit record: %v", err)
+		return
+	}
+	s.audit.mu.Lock()
+	defer s.audit.mu.Unlock()
+	if _, err := s.audit.f.Write(append(line, '\n')); err != nil {
+		logger.Errorf("Unable to write token audit log: %v", err)
+	}
+}
+
+// requestPeerPID finds the process on the other end of a request's tcp
+// connection.
+func requestPeerPID(r *http.Request) (int, error) {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return 0, fmt.Errorf("not a tcp connection")
+	}
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return 0, err
+	}
+	return tcpPeerPID(local, remote)
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latency delays the requests for a path by a fixed, uniformly distributed
+// or normally distributed time.
+type latency struct {
+	path string
+	// min alone is a fixed delay, min and max bound a uniform one
+	min, max time.Duration
+	// mean and stddev describe a normal distribution
+	mean, stddev time.Duration
+}
+
+// parseLatencies parses Latencies.  A delay is a duration (2s), a range
+// (2s-5s) or a mean and standard deviation (3s~500ms).
+func parseLatencies(m map[string]string) ([]latency, error) {
+	var latencies []latency
+	for path, spec := range m {
+		l := latency{path: faultPath(path)}
+		var err error
+		switch {
+		case strings.Contains(spec, "~"):
+			f := strings.SplitN(spec, "~", 2)
+			if l.mean, err = time.ParseDuration(f[0]); err == nil {
+				l.stddev, err = time.ParseDuration(f[1])
+			}
+		case strings.Contains(spec, "-"):
+			f := strings.SplitN(spec, "-", 2)
+			if l.min, err = time.ParseDuration(f[0]); err == nil {
+				l.max, err = time.ParseDuration(f[1])
+			}
+			if err == nil && l.max < l.min {
+				err = fmt.Errorf("%v is less than %v", l.max, l.min)
+			}
+		default:
+			l.min, err = time.ParseDuration(spec)
+		}
+		if err == nil && (l.min < 0 || l.mean < 0 || l.stddev < 0) {
+			err = fmt.Errorf("negative delay")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency %q for %s (eg 2s, 2s-5s or 3s~500ms): %v", spec, path, err)
+		}
+		latencies = append(latencies, l)
+	}
+	return latencies, nil
+}
+
+// lockedRand is a math/rand source safe for concurrent requests.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand() *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (l *lockedRand) float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) normFloat64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.NormFloat64()
+}
+
+func (l *latency) delay(rnd *lockedRand) time.Duration {
+	switch {
+	case l.mean > 0 || l.stddev > 0:
+		if d := l.mean + time.Duration(rnd.normFloat64()*float64(l.stddev)); d > 0 {
+			return d
+		}
+		return 0
+	case l.max > l.min:
+		return l.min + time.Duration(rnd.float64()*float64(l.max-l.min))
+	}
+	return l.min
+}
+
+// delay holds the request for the latency of the longest matching path, or
+// until the client gives up.
+func (s *Server) delay(r *http.Request) {
+	var match *latency
+	for i, l := range s.latencies {
+		if pathMatches(l.path, r.URL.Path) && (match == nil || len(l.path) > len(match.path)) {
+			match = &s.latencies[i]
+		}
+	}
+	if match == nil {
+		return
+	}
+	d := match.delay(s.rand)
+	s.requestLogger(r).Debugf("Delaying %s by %v", r.URL.Path, d)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
+
+// errorRate fails a share of the requests for a path.
+type errorRate struct {
+	path     string
+	outcomes []errorOutcome
+}
+
+// errorOutcome answers a share p (0 to 1) of the requests with status or, if
+// reset is set, by resetting the connection.
+type errorOutcome struct {
+	p      float64
+	status int
+	reset  bool
+}
+
+// parseErrorRates parses ErrorRates: comma separated percentages of the
+// requests and what they get, eg 10%:503,5%:reset.  The status defaults to
+// 500.
+func parseErrorRates(m map[string]string) ([]errorRate, error) {
+	var rates []errorRate
+	for path, spec := range m {
+		e := errorRate{path: faultPath(path)}
+		var total float64
+		for _, item := range strings.Split(spec, ",") {
+			f := strings.SplitN(strings.TrimSpace(item), ":", 2)
+			pct, err := strconv.ParseFloat(strings.TrimSuffix(f[0], "%"), 64)
+			if err != nil || !strings.HasSuffix(f[0], "%") || pct < 0 {
+				return nil, fmt.Errorf("invalid error rate %q for %s (eg 10%%:503,5%%:reset)", spec, path)
+			}
+			o := errorOutcome{p: pct / 100, status: http.StatusInternalServerError}
+			if len(f) == 2 {
+				if f[1] == "reset" {
+					o.reset = true
+				} else if o.status, err = strconv.Atoi(f[1]); err != nil || o.status < 100 || o.status > 599 {
+					return nil, fmt.Errorf("invalid error rate %q for %s: %q is not an HTTP status or reset", spec, path, f[1])
+				}
+			}
+			total += pct
+			e.outcomes = append(e.outcomes, o)
+		}
+		if total > 100 {
+			return nil, fmt.Errorf("invalid error rate %q for %s: more than 100%%", spec, path)
+		}
+		rates = append(rates, e)
+	}
+	return rates, nil
+}
+
+// injectError fails the request if the error rate of the longest matching
+// path says so, and reports whether it did.
+func (s *Server) injectError(w http.ResponseWriter, r *http.Request) bool {
+	var match *errorRate
+	for i, e := range s.errorRates {
+		if pathMatches(e.path, r.URL.Path) && (match == nil || len(e.path) > len(match.path)) {
+			match = &s.errorRates[i]
+		}
+	}
+	if match == nil {
+		return false
+	}
+	roll := s.rand.float64()
+	for _, o := range match.outcomes {
+		if roll -= o.p; roll >= 0 {
+			continue
+		}
+		if o.reset {
+			s.requestLogger(r).Debugf("Resetting the connection of %s", r.URL.Path)
+			resetConnection(w)
+			return true
+		}
+		s.requestLogger(r).Debugf("Failing %s with %d", r.URL.Path, o.status)
+		s.writeError(w, r, o.status, "")
+		return true
+	}
+	return false
+}
+
+// resetConnection drops the connection of a request with a TCP RST, or
+// aborts the stream if the connection can't be taken over (eg HTTP/2).
+func resetConnection(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if c, _, err := hj.Hijack(); err == nil {
+			if tc, ok := c.(*net.TCPConn); ok {
+				tc.SetLinger(0)
+			}
+			c.Close()
+			return
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLatencies(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want latency
+	}{
+		{"2s", latency{min: 2 * time.Second}},
+		{"2s-5s", latency{min: 2 * time.Second, max: 5 * time.Second}},
+		{"3s~500ms", latency{mean: 3 * time.Second, stddev: 500 * time.Millisecond}},
+	} {
+		l, err := parseLatencies(map[string]string{"instance/id": tc.spec})
+		if err != nil {
+			t.Errorf("parseLatencies(%q): %v", tc.spec, err)
+			continue
+		}
+		tc.want.path = "/computeMetadata/v1/instance/id"
+		if len(l) != 1 || l[0] != tc.want {
+			t.Errorf("parseLatencies(%q) = %+v, want %+v", tc.spec, l, tc.want)
+		}
+	}
+	for _, spec := range []string{"soon", "5s-2s", "-1s", "1s~x"} {
+		if _, err := parseLatencies(map[string]string{"instance/id": spec}); err == nil {
+			t.Errorf("parseLatencies(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestLatencyDelay(t *testing.T) {
+	rnd := newLockedRand()
+	fixed := latency{min: time.Second}
+	uniform := latency{min: time.Second, max: 2 * time.Second}
+	normal := latency{mean: time.Second, stddev: 100 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		if d := fixed.delay(rnd); d != time.Second {
+			t.Fatalf("fixed delay = %v", d)
+		}
+		if d := uniform.delay(rnd); d < time.Second || d > 2*time.Second {
+			t.Fatalf("uniform delay = %v, want 1s-2s", d)
+		}
+		if d := normal.delay(rnd); d < 0 {
+			t.Fatalf("normal delay = %v, want >= 0", d)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	s := newTestServer(t, Config{Latencies: map[string]string{
+		"project/*":          "200ms",
+		"project/project-id": "0s",
+	}})
+	start := time.Now()
+	get(t, s, "/computeMetadata/v1/project/numeric-project-id", "metadata", "Google")
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("request with a 200ms latency took %v", d)
+	}
+	// the longest matching path wins
+	start = time.Now()
+	get(t, s, "/computeMetadata/v1/project/project-id", "metadata", "Google")
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Errorf("request with no latency took %v", d)
+	}
+}
+
+func TestParseErrorRates(t *testing.T) {
+	rates, err := parseErrorRates(map[string]string{"instance/*": "10%:503, 5%:reset,1.5%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []errorOutcome{
+		{p: 0.10, status: http.StatusServiceUnavailable},
+		{p: 0.05, status: http.StatusInternalServerError, reset: true},
+		{p: 0.015, status: http.StatusInternalServerError},
+	}
+	if len(rates) != 1 || rates[0].path != "/computeMetadata/v1/instance/*" || !reflect.DeepEqual(rates[0].outcomes, want) {
+		t.Errorf("parseErrorRates = %+v, want %+v", rates, want)
+	}
+	for _, spec := range []string{"10", "x%", "-1%", "10%:600", "10%:oops", "60%,50%"} {
+		if _, err := parseErrorRates(map[string]string{"instance/id": spec}); err == nil {
+			t.Errorf("parseErrorRates(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestInjectError(t *testing.T) {
+	s := newTestServer(t, Config{ErrorRates: map[string]string{
+		"project/*":          "100%:503",
+		"project/project-id": "0%",
+		"instance/id":        "100%:reset",
+	}})
+	if resp, _ := get(t, s, "/computeMetadata/v1/project/numeric-project-id", "metadata", "Google"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status with a 100%% error rate = %d, want 503", resp.StatusCode)
+	}
+	// the longest matching path wins
+	if resp, _ := get(t, s, "/computeMetadata/v1/project/project-id", "metadata", "Google"); resp.StatusCode != http.StatusOK {
+		t.Errorf("status with a 0%% error rate = %d, want 200", resp.StatusCode)
+	}
+	req, err := http.NewRequest("GET", "http://"+s.Addr().String()+"/computeMetadata/v1/instance/id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "metadata"
+	req.Header.Set("Metadata-Flavor", "Google")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Errorf("request with a reset got %d, want a connection error", resp.StatusCode)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ClientMapping serves ServiceAccount, as the default account, to callers
+// matching Source: an IP address or CIDR, uid:<uid or name> for callers on a
+// unix socket, or container:<name or id> and label:<key>[=<value>] for
+// callers in a docker container (linux only).  Deny serves no service account
+// at all instead.
+type ClientMapping struct {
+	Source         string `json:"source"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	Deny           bool   `json:"deny,omitempty"`
+}
+
+// LoadClientMappingsFile reads a JSON or YAML list of ClientMappings.  YAML is
+// selected by a .yaml or .yml extension.
+func LoadClientMappingsFile(path string) ([]ClientMapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client mappings file %s: %v", path, err)
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse client mappings file %s: %v", path, err)
+		}
+	}
+	var m []ClientMapping
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("unable to parse client mappings file %s: %v", path, err)
+	}
+	return m, nil
+}
+
+const uidPrefix = "uid:"
+
+// clientMapping matches callers by source network, by the peer uid of a unix
+// socket if uid is set, or by their container.  A nil account denies access.
+type clientMapping struct {
+	source    *net.IPNet
+	uid       *uint32
+	container string
+	label     string
+	account   *account
+}
+
+// loadClientMappings resolves the configured mappings against the served
+// accounts.
+func (s *Server) loadClientMappings() ([]clientMapping, error) {
+	m := s.cfg.ClientMappings
+	if s.cfg.ClientMappingsFile != "" {
+		var err error
+		m, err = LoadClientMappingsFile(s.cfg.ClientMappingsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var mappings []clientMapping
+	for _, c := range m {
+		var cm clientMapping
+		var err error
+		switch {
+		case strings.HasPrefix(c.Source, uidPrefix):
+			cm.uid, err = parseUID(strings.TrimPrefix(c.Source, uidPrefix))
+		case strings.HasPrefix(c.Source, containerPrefix):
+			cm.container = strings.TrimPrefix(c.Source, containerPrefix)
+		case strings.HasPrefix(c.Source, labelPrefix):
+			cm.label = strings.TrimPrefix(c.Source, labelPrefix)
+		default:
+			cm.source, err = parseSource(c.Source)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c.Deny {
+			if c.ServiceAccount != "" {
+				return nil, fmt.Errorf("client mapping for %s: only one of serviceAccount and deny may be set", c.Source)
+			}
+			mappings = append(mappings, cm)
+			continue
+		}
+		a, ok := s.accountByEmail(c.ServiceAccount)
+		if !ok {
+			return nil, fmt.Errorf("client mapping for %s: service account %s is not configured", c.Source, c.ServiceAccount)
+		}
+		cm.account = a
+		mappings = append(mappings, cm)
+	}
+	return mappings, nil
+}
+
+// accountByEmail returns the default or an additional service account.  The
+// configured default account's email names the default account even if it
+// was switched.
+func (s *Server) accountByEmail(email string) (*account, bool) {
+	if email == s.getServiceAccountEmail() || email == s.configured.email {
+		return s.defaultAccount(), true
+	}
+	a, ok := s.accounts[email]
+	return a, ok
+}
+
+// parseSource parses a CIDR or a single IP address.
+func parseSource(source string) (*net.IPNet, error) {
+	if strings.Contains(source, "/") {
+		_, n, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client mapping source %s: %v", source, err)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client mapping source %s", source)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// peerCred identifies the process on the other end of a unix socket.
+type peerCred struct {
+	pid      int32
+	uid, gid uint32
+}
+
+// peerCredKey is the request context key of the caller's *peerCred.
+type peerCredKey struct{}
+
+// connContext records the connection, the peer credentials of unix socket
+// connections for uid mappings and, if there are container mappings, the
+// caller's container.
+func (s *Server) connContext(ctx context.Context, c net.Conn) context.Context {
+	ctx = withConn(ctx, c)
+	var cred *peerCred
+	if uc, ok := c.(*net.UnixConn); ok {
+		var err error
+		cred, err = peerCredentials(uc)
+		if err != nil {
+			logger.Debugf("Unable to get peer credentials: %v", err)
+		} else {
+			ctx = context.WithValue(ctx, peerCredKey{}, cred)
+		}
+	}
+	if !s.hasContainerMappings() {
+		return ctx
+	}
+	ctr, err := s.containers.peer(c, cred)
+	switch {
+	case err != nil:
+		ctx = context.WithValue(ctx, containerErrKey{}, err)
+	case ctr != nil:
+		ctx = context.WithValue(ctx, containerKey{}, ctr)
+	}
+	return ctx
+}
+
+func (s *Server) hasContainerMappings() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return hasContainerMappings(s.clientMappings)
+}
+
+func hasContainerMappings(mappings []clientMapping) bool {
+	for _, m := range mappings {
+		if m.container != "" || m.label != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUID parses a numeric uid or a user name.
+func parseUID(name string) (*uint32, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client mapping source %s%s: %v", uidPrefix, name, err)
+		}
+		name = u.Uid
+	}
+	uid, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client mapping source %s%s: %v", uidPrefix, name, err)
+	}
+	u := uint32(uid)
+	return &u, nil
+}
+
+// clientAccount returns the account mapped to the caller and whether a
+// mapping applies; a nil account means the caller is denied.  Unix socket
+// callers are matched by uid, then callers in containers by the first
+// matching container or label, others by the most specific matching source,
+// or else by looking up the caller's pod in kubernetes mode, which denies
+// pods that aren't mapped.  Callers whose container can't be found are
+// denied if there are container mappings.
+func (s *Server) clientAccount(r *http.Request) (*account, bool) {
+	s.mu.RLock()
+	mappings := s.clientMappings
+	s.mu.RUnlock()
+
+	cred, unix := r.Context().Value(peerCredKey{}).(*peerCred)
+	if unix {
+		for _, m := range mappings {
+			if m.uid != nil && *m.uid == cred.uid {
+				return m.account, true
+			}
+		}
+	}
+	if err, ok := r.Context().Value(containerErrKey{}).(error); ok && hasContainerMappings(mappings) {
+		logger.Warnf("Denying %s: unable to find its container: %v", r.RemoteAddr, err)
+		return nil, true
+	}
+	if ctr, ok := r.Context().Value(containerKey{}).(*container); ok {
+		for i := range mappings {
+			if mappings[i].matchesContainer(ctr) {
+				return mappings[i].account, true
+			}
+		}
+	}
+	if unix {
+		return nil, false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, false
+	}
+	var match *clientMapping
+	best := -1
+	for i, m := range mappings {
+		if m.source == nil {
+			continue
+		}
+		if ones, _ := m.source.Mask.Size(); m.source.Contains(ip) && ones > best {
+			match, best = &mappings[i], ones
+		}
+	}
+	if match != nil {
+		return match.account, true
+	}
+	if s.kube != nil {
+		return s.podAccount(ip)
+	}
+	return nil, false
+}
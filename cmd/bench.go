@@ -0,0 +1,203 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	mds "github.com/salrashid123/gce_metadata_server"
+)
+
+// benchPaths are requested by default: static values, a recursive listing
+// and the (cached) token endpoints.
+var benchPaths = []string{
+	"instance/id",
+	"project/project-id",
+	"instance/?recursive=true",
+	"instance/service-accounts/default/token",
+	"instance/service-accounts/default/identity?audience=https://bench.example.com",
+}
+
+// benchResult holds the latencies of one path's successful requests.
+type benchResult struct {
+	latencies []time.Duration
+	errors    int
+}
+
+// runBench implements the bench subcommand: it requests paths from a
+// running emulator, or a fake one started in-process if there is no
+// -target, with -concurrency workers and reports the latency percentiles by
+// path, so performance regressions of the emulator are caught.
+//
+//	gce_metadata_server bench -target 127.0.0.1:8080 -concurrency 50 -duration 30s
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "", "emulator address, in the same form as -listen (default a fake emulator started in-process)")
+	concurrency := fs.Int("concurrency", 10, "number of concurrent clients")
+	duration := fs.Duration("duration", 10*time.Second, "how long to run")
+	requests := fs.Int("requests", 0, "stop after this many requests instead of -duration")
+	var paths urls
+	fs.Var(&paths, "path", "path to request, relative to /computeMetadata/v1/ (default a mix of values and tokens); may be repeated")
+	fs.Parse(args)
+	if *concurrency < 1 {
+		logger.Fatalf("Invalid Argument error: concurrency must be at least 1")
+	}
+	if len(paths) == 0 {
+		paths = benchPaths
+	}
+
+	addr := *target
+	if addr == "" {
+		s, err := mds.NewMetadataServer(context.Background(), mds.Config{
+			Listen:              "127.0.0.1:0",
+			Fake:                true,
+			ServiceAccountEmail: "bench@bench-project.iam.gserviceaccount.com",
+			ProjectID:           "bench-project",
+			NumericProjectID:    "123456789",
+			TokenScopes:         []string{"https://www.googleapis.com/auth/cloud-platform"},
+		})
+		if err != nil {
+			logger.Fatalf("Unable to create the emulator: %v", err)
+		}
+		if err := s.Start(); err != nil {
+			logger.Fatalf("Unable to start the emulator: %v", err)
+		}
+		defer s.Shutdown()
+		addr = s.Addr().String()
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return mds.Dial(addr)
+			},
+			MaxIdleConnsPerHost: *concurrency,
+		},
+	}
+
+	deadline := time.Now().Add(*duration)
+	var sent int64
+	results := make([]map[string]*benchResult, *concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		results[i] = map[string]*benchResult{}
+		wg.Add(1)
+		go func(res map[string]*benchResult, next int) {
+			defer wg.Done()
+			for {
+				n := atomic.AddInt64(&sent, 1)
+				if *requests > 0 && n > int64(*requests) || *requests == 0 && time.Now().After(deadline) {
+					return
+				}
+				path := paths[next%len(paths)]
+				next++
+				r, ok := res[path]
+				if !ok {
+					r = &benchResult{}
+					res[path] = r
+				}
+				d, err := benchRequest(client, path)
+				if err != nil {
+					logger.Debugf("%s: %v", path, err)
+					r.errors++
+					continue
+				}
+				r.latencies = append(r.latencies, d)
+			}
+		}(results[i], i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := map[string]*benchResult{}
+	var count int
+	for _, res := range results {
+		for path, r := range res {
+			t, ok := total[path]
+			if !ok {
+				t = &benchResult{}
+				total[path] = t
+			}
+			t.latencies = append(t.latencies, r.latencies...)
+			t.errors += r.errors
+			count += len(r.latencies) + r.errors
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "path\trequests\terrors\tp50\tp90\tp99\tmax")
+	for _, path := range paths {
+		r, ok := total[path]
+		if !ok {
+			continue
+		}
+		l := r.latencies
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Fprintf(w, "%s\t%d\t%d\t%v\t%v\t%v\t%v\n", path, len(l)+r.errors, r.errors,
+			percentile(l, 50), percentile(l, 90), percentile(l, 99), percentile(l, 100))
+	}
+	w.Flush()
+	fmt.Printf("%d requests in %v (%.0f/s) with %d clients\n", count, elapsed.Round(time.Millisecond), float64(count)/elapsed.Seconds(), *concurrency)
+}
+
+// benchRequest requests a path and returns how long it took.  Responses
+// other than 200 are errors.
+func benchRequest(client *http.Client, path string) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	d := time.Since(start)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s", resp.Status)
+	}
+	return d, nil
+}
+
+// percentile returns the pth percentile of the sorted latencies.
+func percentile(l []time.Duration, p int) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	i := (len(l)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return l[i].Round(time.Microsecond)
+}
@@ -0,0 +1,276 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ctlUsage = `usage: gce_metadata_server ctl [flags] command (or mdsctl [flags] command)
+
+commands:
+  get metadata [path]                 metadata at the path (or all of it) as JSON
+  get token [account]                 access token of the account (default: default)
+  get identity audience [account]     ID token of the account for the audience
+  set attribute key=value             instance attribute
+  set project-attribute key=value     project attribute
+  set metadata path=value             any value, eg instance/scheduling/preemptible=TRUE
+  set service-account key-file|email  serve a key file's account, or impersonate email, as default
+  reset service-account               serve the configured default account again
+  trigger maintenance [event]         start or end (or set) a maintenance event
+  fail path status [duration]         fail requests for the path (eg /instance/id 503 30s)
+  get faults                          faults in effect as JSON
+  clear faults [path]                 remove the fault for the path, or all faults
+  trigger preemption                  preempt the instance
+  invalidate tokens                   drop the cached tokens of all accounts
+  reload                              reload the config files
+
+flags:
+`
+
+// runCtl implements the ctl subcommand, also run when the binary is called
+// mdsctl: it drives a running emulator through its admin API so test scripts
+// don't need to know the endpoints.
+//
+//	mdsctl set attribute foo=bar
+//	mdsctl trigger preemption
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	admin := fs.String("admin", "127.0.0.1:8081", "address of the emulator's admin API (-adminListen)")
+	metadata := fs.String("metadata", "", "address of the emulator for get token and get identity (default: GCE_METADATA_HOST or 127.0.0.1:8080)")
+	scopes := fs.String("scopes", "", "comma separated scopes of get token")
+	token := fs.String("token", os.Getenv("MDSCTL_TOKEN"), "bearer token of the admin API (-adminTokenFile) (default: MDSCTL_TOKEN)")
+	cacert := fs.String("cacert", "", "CA certificates (PEM) to verify the admin API's TLS certificate with; enables https")
+	cert := fs.String("cert", "", "client certificate (PEM) for an admin API with mTLS; enables https")
+	key := fs.String("key", "", "private key (PEM) for -cert")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), ctlUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *metadata == "" {
+		*metadata = os.Getenv("GCE_METADATA_HOST")
+	}
+	if *metadata == "" {
+		*metadata = "127.0.0.1:8080"
+	}
+
+	c := &ctl{admin: "http://" + *admin + "/admin/v1", metadata: "http://" + *metadata + "/computeMetadata/v1", token: *token}
+	if *cacert != "" || *cert != "" {
+		tlsConfig, err := ctlTLSConfig(*cacert, *cert, *key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mdsctl: %v\n", err)
+			os.Exit(1)
+		}
+		c.admin = "https://" + *admin + "/admin/v1"
+		c.adminTLS = tlsConfig
+	}
+	a := fs.Args()
+	arg := func(i int) string {
+		if i < len(a) {
+			return a[i]
+		}
+		return ""
+	}
+	var err error
+	command := strings.Join(a[:min(len(a), 2)], " ")
+	if arg(0) == "fail" {
+		command = "fail"
+	}
+	switch command {
+	case "get metadata":
+		err = c.do(http.MethodGet, c.admin+"/metadata/"+arg(2), "")
+	case "get token":
+		q := url.Values{}
+		if *scopes != "" {
+			q.Set("scopes", *scopes)
+		}
+		err = c.do(http.MethodGet, c.account(arg(2))+"/token?"+q.Encode(), "")
+	case "get identity":
+		if arg(2) == "" {
+			err = fmt.Errorf("get identity requires an audience")
+			break
+		}
+		q := url.Values{"audience": {arg(2)}}
+		err = c.do(http.MethodGet, c.account(arg(3))+"/identity?"+q.Encode(), "")
+	case "set attribute":
+		err = c.set("instance/attributes/", arg(2))
+	case "set project-attribute":
+		err = c.set("project/attributes/", arg(2))
+	case "set metadata":
+		err = c.set("", arg(2))
+	case "set service-account":
+		err = c.switchServiceAccount(arg(2))
+	case "reset service-account":
+		err = c.do(http.MethodDelete, c.admin+"/service-account", "")
+	case "trigger maintenance":
+		err = c.do(http.MethodPost, c.admin+"/maintenance-event", arg(2))
+	case "fail":
+		err = c.fail(arg(1), arg(2), arg(3))
+	case "get faults":
+		err = c.do(http.MethodGet, c.admin+"/faults", "")
+	case "clear faults":
+		err = c.do(http.MethodDelete, c.admin+"/faults?"+url.Values{"path": {arg(2)}}.Encode(), "")
+	case "trigger preemption":
+		err = c.do(http.MethodPost, c.admin+"/preempt", "")
+	case "invalidate tokens":
+		err = c.do(http.MethodPost, c.admin+"/invalidate-tokens", "")
+	case "reload":
+		err = c.do(http.MethodPost, c.admin+"/reload", "")
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mdsctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ctlTLSConfig returns the TLS configuration of admin API requests.
+func ctlTLSConfig(cacert, cert, key string) (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cacert != "" {
+		pem, err := ioutil.ReadFile(cacert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %v", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cacert)
+		}
+	}
+	if cert != "" {
+		kp, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{kp}
+	}
+	return c, nil
+}
+
+// ctl holds the base URLs of the emulator and the admin API's credentials.
+type ctl struct {
+	admin, metadata string
+	token           string
+	adminTLS        *tls.Config
+}
+
+func (c *ctl) account(name string) string {
+	if name == "" {
+		name = "default"
+	}
+	return c.metadata + "/instance/service-accounts/" + url.PathEscape(name)
+}
+
+// set sets a path=value below prefix.
+func (c *ctl) set(prefix, kv string) error {
+	i := strings.Index(kv, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value: %q", kv)
+	}
+	return c.do(http.MethodPut, c.admin+"/metadata/"+prefix+kv[:i], kv[i+1:])
+}
+
+// fail injects a fault.
+func (c *ctl) fail(path, status, duration string) error {
+	code, err := strconv.Atoi(status)
+	if path == "" || err != nil {
+		return fmt.Errorf("fail requires a path and an HTTP status")
+	}
+	body, err := json.Marshal(map[string]interface{}{"path": path, "status": code, "duration": duration})
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, c.admin+"/faults", string(body))
+}
+
+// switchServiceAccount switches to the key file, which is sent to the
+// emulator, or else impersonates the email.
+func (c *ctl) switchServiceAccount(keyOrEmail string) error {
+	if keyOrEmail == "" {
+		return fmt.Errorf("set service-account requires a key file or an email")
+	}
+	req := map[string]interface{}{"email": keyOrEmail}
+	if _, err := os.Stat(keyOrEmail); err == nil {
+		key, err := ioutil.ReadFile(keyOrEmail)
+		if err != nil {
+			return err
+		}
+		req = map[string]interface{}{"credentials": json.RawMessage(key)}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, c.admin+"/service-account", string(body))
+}
+
+// do sends a request and prints the response body, or returns it as the
+// error for a non-2xx status.
+func (c *ctl) do(method, u, body string) error {
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	if strings.HasPrefix(u, c.metadata) {
+		req.Host = "metadata.google.internal"
+		req.Header.Set("Metadata-Flavor", "Google")
+	} else {
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if c.adminTLS != nil {
+			client.Transport = &http.Transport{TLSClientConfig: c.adminTLS}
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s %s", method, u, resp.Status, strings.TrimSpace(string(out)))
+	}
+	os.Stdout.Write(out)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		fmt.Println()
+	}
+	return nil
+}
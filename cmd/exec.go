@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"strings"
+
+	mds "github.com/salrashid123/gce_metadata_server"
+)
+
+const metadataHost = "metadata.google.internal"
+
+// runExec implements the exec subcommand: it runs a program with
+// GCE_METADATA_HOST pointing at the emulator.  Client libraries only speak
+// tcp, so for a named pipe or unix socket a loopback port is opened and
+// proxied to it for the lifetime of the program.
+//
+//	gce_metadata_server exec -to npipe:\\.\pipe\gce-metadata -- python app.py
+func runExec(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	to := fs.String("to", `npipe:\\.\pipe\gce-metadata`, "emulator address, in the same form as -listen")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.PrintDefaults()
+		logger.Errorf("Invalid Argument error: exec requires a program to run")
+		os.Exit(-1)
+	}
+
+	host := strings.TrimPrefix(*to, "tcp:")
+	if strings.HasPrefix(host, ":") {
+		host = "127.0.0.1" + host
+	}
+	if strings.HasPrefix(*to, "npipe:") || strings.HasPrefix(*to, "unix:") {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			logger.Fatalf("Unable to listen on loopback: %v", err)
+		}
+		defer l.Close()
+		go forward(l, *to)
+		host = l.Addr().String()
+	}
+
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), "GCE_METADATA_HOST="+host)
+	logger.Debugf("Running %s with GCE_METADATA_HOST=%s", fs.Arg(0), host)
+	if err := cmd.Run(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			os.Exit(e.ExitCode())
+		}
+		logger.Fatalf("Unable to run %s: %v", fs.Arg(0), err)
+	}
+}
+
+// forward proxies the requests accepted on l to the emulator at addr.  The
+// program sends the loopback port as the Host, which the emulator doesn't
+// listen on, so requests are sent for metadata.google.internal instead.
+func forward(l net.Listener, addr string) {
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = metadataHost
+			r.Host = metadataHost
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return mds.Dial(addr)
+			},
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Errorf("Unable to forward %s to %s: %v", r.URL.Path, addr, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	http.Serve(l, proxy)
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	mds "github.com/salrashid123/gce_metadata_server"
+	"go.uber.org/zap"
+)
+
+func TestForward(t *testing.T) {
+	mds.SetLogger(zap.NewNop())
+	sock := "unix:" + filepath.Join(t.TempDir(), "mds.sock")
+	s, err := mds.NewMetadataServer(context.Background(), mds.Config{
+		Listen:              sock,
+		Fake:                true,
+		ServiceAccountEmail: "test@project.iam.gserviceaccount.com",
+		ProjectID:           "project",
+		NumericProjectID:    "123456789",
+	})
+	if err != nil {
+		t.Fatalf("NewMetadataServer: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Shutdown()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go forward(l, sock)
+
+	// client libraries send GCE_METADATA_HOST, the loopback port, as the Host
+	req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/computeMetadata/v1/project/project-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "project" {
+		t.Errorf("GET = %d %q, want 200 project", resp.StatusCode, body)
+	}
+}
+
+func TestForwardUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go forward(l, "unix:"+filepath.Join(t.TempDir(), "missing.sock"))
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/computeMetadata/v1/project/project-id")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+}
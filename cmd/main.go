@@ -0,0 +1,621 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	mds "github.com/salrashid123/gce_metadata_server"
+	"go.uber.org/zap"
+)
+
+var (
+	flPort                = flag.String("port", ":8080", "port...")
+	flListen              = flag.String("listen", "", "listen address, overrides port; use unix:/path/to.sock for a unix domain socket")
+	flSocketMode          = flag.String("socketMode", "", "file mode of the unix socket (eg 0660)")
+	flSocketGroup         = flag.String("socketGroup", "", "group name or gid owning the unix socket")
+	flSetupInterface      = flag.Bool("setupInterface", false, "create a dummy interface with 169.254.169.254 and listen on it (linux, requires CAP_NET_ADMIN)")
+	flInterfaceName       = flag.String("interfaceName", "gcemetadata0", "name of the interface created by setupInterface")
+	flTLSCert             = flag.String("tlsCert", "", "TLS certificate (PEM) to serve HTTPS with")
+	flTLSKey              = flag.String("tlsKey", "", "TLS private key (PEM) for tlsCert")
+	flTLSClientCA         = flag.String("tlsClientCA", "", "CA certificates (PEM) client certificates must be signed by; enables mTLS")
+	flMaxHeaderBytes      = flag.Int("maxHeaderBytes", 64<<10, "maximum size of request headers (431 if larger)")
+	flMaxBodyBytes        = flag.Int64("maxRequestBodyBytes", 1<<20, "maximum size of request bodies (413 if larger)")
+	flReadTimeout         = flag.Duration("requestReadTimeout", 10*time.Second, "time allowed to send request headers and bodies (408 for slow bodies)")
+	flRunAsUser           = flag.String("runAsUser", "", "user (name or uid) to switch to after binding the listener")
+	flRunAsGroup          = flag.String("runAsGroup", "", "group (name or gid) to switch to after binding the listener")
+	flnumericProjectID    = flag.String("numericProjectId", "", "numericProjectId...")
+	fltokenScopes         = flag.String("tokenScopes", "https://www.googleapis.com/auth/userinfo.email", "tokenScopes")
+	flprojectID           = flag.String("projectId", "", "projectId...")
+	flserviceAccountEmail = flag.String("serviceAccountEmail", "", "serviceAccountEmail...")
+	flserviAccountFile    = flag.String("serviceAccountFile", "", "serviceAccountFile...")
+	flCredentialsFile     = flag.String("credentialsFile", "", "credentials JSON (service_account, external_account or authorized_user); alias for serviceAccountFile")
+	flcustomAttributeFile = flag.String("customAttributeFile", "", "customAttributeFile - json of custom attributes ({ key:val}) - OPTIONAL ")
+	flInstanceAttrFile    = flag.String("instanceAttributeFile", "", "json of instance attributes ({ key:val}) served under /instance/attributes/ - OPTIONAL")
+	flSSHKeys             = flag.String("sshKeys", "", "file of project ssh keys, one username:key per line - OPTIONAL")
+	flInstanceSSHKeys     = flag.String("instanceSshKeys", "", "file of instance ssh keys, one username:key per line - OPTIONAL")
+	flBlockProjectSSHKeys = flag.Bool("blockProjectSshKeys", false, "set the instance's block-project-ssh-keys attribute")
+	flOSLogin             = flag.Bool("enableOslogin", false, "set the enable-oslogin project attribute")
+	flOSLogin2FA          = flag.Bool("enableOslogin2fa", false, "set the enable-oslogin-2fa project attribute")
+	flStartupScript       = flag.String("startupScript", "", "file served as the startup-script instance attribute - OPTIONAL")
+	flStartupScriptURL    = flag.String("startupScriptUrl", "", "served as the startup-script-url instance attribute, eg gs://bucket/script.sh - OPTIONAL")
+	flShutdownScript      = flag.String("shutdownScript", "", "file served as the shutdown-script instance attribute - OPTIONAL")
+	flClusterName         = flag.String("clusterName", "", "serve the instance as a node of this GKE cluster - OPTIONAL")
+	flClusterLocation     = flag.String("clusterLocation", "", "location of the GKE cluster (default: the instance's zone)")
+	flClusterUID          = flag.String("clusterUid", "", "uid of the GKE cluster (default: derived from the project, location and name)")
+	flKubeEnv             = flag.String("kubeEnv", "", "file served as the kube-env instance attribute of a GKE node - OPTIONAL")
+	flKubeLabels          = flag.String("kubeLabels", "", "comma separated key=value node labels served as the kube-labels instance attribute")
+	flContainerDecl       = flag.String("containerDeclaration", "", "file served as the gce-container-declaration instance attribute of Container-Optimized OS - OPTIONAL")
+	flUserData            = flag.String("userData", "", "cloud-init file served as the user-data instance attribute - OPTIONAL")
+	flCOSMetrics          = flag.Bool("cosMetricsEnabled", false, "set the cos-metrics-enabled instance attribute")
+	flImpersonate         = flag.Bool("impersonate", false, "Impersonate a service Account instead of using the keyfile")
+	flDelegates           = flag.String("delegates", "", "comma separated service accounts to impersonate through on the way to serviceAccountEmail")
+	flTokenLifetime       = flag.Duration("impersonatedTokenLifetime", 0, "lifetime of impersonated access tokens (default 1h)")
+	flTPMPath             = flag.String("tpmPath", "", "TPM device holding the service account key (eg /dev/tpmrm0)")
+	flTPMKeyHandle        = flag.String("tpmKeyHandle", "0x81008000", "persistent handle of the service account key in the TPM")
+	flTPMKeyID            = flag.String("tpmKeyId", "", "key id of the service account key in the TPM - OPTIONAL")
+	flVaultAddr           = flag.String("vaultAddr", os.Getenv("VAULT_ADDR"), "vault server address; the token is read from VAULT_TOKEN")
+	flVaultPath           = flag.String("vaultPath", "", "vault GCP secrets engine token path (eg gcp/roleset/my-roleset/token)")
+	flExecCredential      = flag.String("execCredential", "", "command (and space separated arguments) printing access and ID tokens as JSON, like a kubectl exec plugin")
+	flWebhookURL          = flag.String("webhookURL", "", "HTTPS endpoint access and ID tokens are POSTed for")
+	flWebhookCert         = flag.String("webhookCert", "", "client certificate (PEM) presented to webhookURL - OPTIONAL")
+	flWebhookKey          = flag.String("webhookKey", "", "private key (PEM) for webhookCert - OPTIONAL")
+	flWebhookCA           = flag.String("webhookCA", "", "CA certificates (PEM) to verify webhookURL with instead of the system roots - OPTIONAL")
+	flSelfSignedJWT       = flag.Bool("selfSignedJwt", false, "serve self-signed service account JWTs instead of access tokens")
+	flJWTAudience         = flag.String("selfSignedJwtAudience", "", "audience of self-signed JWTs, eg https://storage.googleapis.com/ (default: use tokenScopes) - OPTIONAL")
+	flBoundary            = flag.String("credentialAccessBoundary", "", "JSON Credential Access Boundary file access tokens are downscoped with - OPTIONAL")
+	flSTSAudience         = flag.String("stsAudience", "", "workload or workforce identity pool provider to exchange a subject token with using STS")
+	flSTSTokenFile        = flag.String("stsSubjectTokenFile", "", "file the subject token for stsAudience is read from")
+	flSTSTokenCommand     = flag.String("stsSubjectTokenCommand", "", "command printing the subject token for stsAudience")
+	flSTSTokenType        = flag.String("stsSubjectTokenType", "urn:ietf:params:oauth:token-type:jwt", "type of the subject token (eg urn:ietf:params:oauth:token-type:id_token, urn:ietf:params:oauth:token-type:saml2)")
+	flSTSUserProject      = flag.String("stsUserProject", "", "workforce pool user project - OPTIONAL")
+	flQuotaProject        = flag.String("quotaProject", "", "project billed for API calls (default: quota_project_id of the credentials) - OPTIONAL")
+	flAdminListen         = flag.String("adminListen", "", "address serving the admin API at /admin/v1/ (eg 127.0.0.1:8081) - OPTIONAL")
+	flAdminPprof          = flag.Bool("adminPprof", false, "also serve the pprof profiles at /debug/pprof/ on adminListen")
+	flControlListen       = flag.String("controlListen", "", "address serving the gRPC control API (eg 127.0.0.1:8082) - OPTIONAL")
+	flAdminTokenFile      = flag.String("adminTokenFile", "", "file with the bearer token required by the admin and control APIs")
+	flAdminTLSCert        = flag.String("adminTlsCert", "", "TLS certificate (PEM) to serve the admin and control APIs with")
+	flAdminTLSKey         = flag.String("adminTlsKey", "", "TLS private key (PEM) for adminTlsCert")
+	flAdminTLSClientCA    = flag.String("adminTlsClientCA", "", "CA certificates (PEM) admin client certificates must be signed by; enables mTLS")
+	flMetricsListen       = flag.String("metricsListen", "", "address serving metrics at /debug/vars (eg 127.0.0.1:9090) - OPTIONAL")
+	flPrefetchTokens      = flag.Bool("prefetchTokens", true, "fetch access tokens on startup and refresh them in the background before they expire")
+	flTokenCache          = flag.String("tokenCache", "", "encrypted file tokens are persisted in across restarts; the passphrase is read from TOKEN_CACHE_PASSPHRASE - OPTIONAL")
+	flTokenCacheKeyring   = flag.Bool("tokenCacheKeyring", false, "keep the tokenCache passphrase in the OS keyring (linux and macOS) instead")
+	flFake                = flag.Bool("fake", false, "mint locally signed JWT access and ID tokens without ever contacting Google (hermetic tests)")
+	flFakeKey             = flag.String("fakeKey", "", "PEM RSA private key fake tokens are signed with (default: generated on startup)")
+	flFakeIssuer          = flag.String("fakeIssuer", "", "issuer of fake tokens (default https://accounts.google.com)")
+	flFakeTokenLifetime   = flag.Duration("fakeTokenLifetime", time.Hour, "lifetime of fake tokens")
+	flFakeClaims          = flag.String("fakeClaims", "", "json object of claims added to fake ID tokens - OPTIONAL")
+	flFakeClaimsFile      = flag.String("fakeClaimsFile", "", "file with a json object of claims added to fake ID tokens, instead of fakeClaims - OPTIONAL")
+	flFakeJWKSPath        = flag.String("fakeJwksPath", "/oauth2/v3/certs", "path the fake token signing keys are served at as a JWK set")
+	flDeterministic       = flag.Bool("deterministic", false, "fake tokens, token expirations and instance identifiers that are the same on every run, for golden-file tests")
+	flDeterministicSeed   = flag.String("deterministicSeed", "", "seed the deterministic key and instance identifiers are derived from")
+	flMaxTokenLifetime    = flag.Duration("maxTokenLifetime", 0, "cap the expires_in of served tokens and the lifetime of fake, self-signed and impersonated tokens (eg 60s)")
+	flMaxOutboundCalls    = flag.Int("maxOutboundCalls", 0, "maximum concurrent calls to Google fetching tokens (default unlimited)")
+	flClockSkew           = flag.Duration("clockSkew", 0, "shift the expires_in of served tokens and the iat/exp claims of locally signed tokens by this (eg 5m or -5m)")
+	flSecret              = flag.String("serviceAccountSecret", "", "Secret Manager secret version holding the service account key (eg projects/p/secrets/s/versions/latest)")
+	flSecretRefresh       = flag.Duration("secretRefreshInterval", time.Hour, "how often to check serviceAccountSecret for a rotated key; 0 disables")
+	flClientMappings      = flag.String("clientMappings", "", "json or yaml file mapping caller IPs or CIDRs to the service account they are served - OPTIONAL")
+	flKubernetes          = flag.Bool("kubernetes", false, "serve the service account mapped to the calling pod's kubernetes service account, like GKE Workload Identity (in-cluster only)")
+	flKubernetesSAs       = flag.String("kubernetesServiceAccounts", "", "comma separated namespace/name=email mappings of kubernetes to google service accounts; overrides the iam.gke.io/gcp-service-account annotation")
+	flConfig              = flag.String("config", "", "config - json or yaml file describing the instance and project metadata - OPTIONAL ")
+	flInstanceID          = flag.String("instanceId", "", "numeric instance id (default: derived from the project and instance name)")
+	flInstanceName        = flag.String("instanceName", "", "instance name (default: the local host name)")
+	flInstanceHostname    = flag.String("instanceHostname", "", "instance hostname (default: <instanceName>.c.<projectId>.internal)")
+	flZone                = flag.String("zone", "", "zone of the instance, eg us-central1-a (default: us-central1-a)")
+	flMachineType         = flag.String("machineType", "", "machine type of the instance, eg n2-standard-4 (default: e2-medium)")
+	flCPUPlatform         = flag.String("cpuPlatform", "", "cpu platform of the instance, eg \"AMD Milan\" (default: Intel Broadwell)")
+	flTags                = flag.String("tags", "", "comma separated network tags of the instance")
+	flLicenses            = flag.String("licenses", "", "comma separated license ids of the instance")
+	flPreemptible         = flag.Bool("preemptible", false, "serve the instance as a preemptible VM")
+	flPreemptAfter        = flag.Duration("preemptAfter", 0, "preempt the instance this long after starting, eg 5m; 0 disables")
+	flStatePath           = flag.String("statePath", "", "database the values set, events and faults are saved to so they survive a restart")
+	flOTLPEndpoint        = flag.String("otlpEndpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OpenTelemetry collector URL spans are exported to with OTLP/HTTP (eg http://localhost:4318)")
+	flTraceServiceName    = flag.String("traceServiceName", "gce-metadata-server", "service.name of the exported spans")
+	flAccessLog           = flag.String("accessLog", "", "file every request is logged to, apart from the application log")
+	flAccessLogFormat     = flag.String("accessLogFormat", "common", "access log format: common (Common Log Format) or json")
+	flAccessLogMaxSize    = flag.Int("accessLogMaxSize", 100, "size in megabytes at which the access log is rotated")
+	flAccessLogMaxBackups = flag.Int("accessLogMaxBackups", 0, "rotated access logs to keep (default all)")
+	flAccessLogRotate     = flag.Duration("accessLogRotate", 0, "also rotate the access log at this interval, eg 24h")
+	flTokenAudit          = flag.String("tokenAudit", "", "file a JSON line is appended to for every token served, with the caller's address, pid and executable")
+	flScenario            = flag.String("scenario", "", "YAML timeline of events (maintenance, preemption, faults, values) replayed after starting")
+	flImage               = flag.String("image", "", "image the instance was created from (default: projects/debian-cloud/global/images/family/debian-12)")
+	flStaticIDTokens      = flag.String("staticIdTokens", "", "comma separated audience=file ID tokens to serve instead of minting them - OPTIONAL")
+	flStaticIDTokenStatus = flag.Int("staticIdTokenStatus", 400, "HTTP status returned for audiences not in staticIdTokens")
+	flAllowedAudiences    = flag.String("allowedAudiences", "", "comma separated audiences (* is a wildcard) ID tokens may be issued for; others get 403")
+	flDeniedAudiences     = flag.String("deniedAudiences", "", "comma separated audiences (* is a wildcard) ID tokens are never issued for")
+	flAllowedScopes       = flag.String("allowedScopes", "", "comma separated scopes (* is a wildcard) access tokens may be issued with; others get 403")
+	flTenants             = flag.String("tenants", "", "json or yaml file of additional projects/instances selected by the Host header (or tenantHeader) - OPTIONAL")
+	flTenantHeader        = flag.String("tenantHeader", "", "request header selecting the tenant instead of the Host header")
+	flFlavor              = flag.String("flavor", "gce", "metadata server to behave like: gce, gke or cloudrun")
+	flLegacyEndpoints     = flag.String("legacyEndpoints", "", "serve the legacy v1beta1 and 0.1 endpoints (serve) or return 403 for them (deny); not found by default")
+	flStrict              = flag.Bool("strict", false, "Match the production metadata server's error pages, content types and headers")
+	flCompatTrailingSlash = flag.Bool("compatTrailingSlash", false, "Redirect directories requested without a trailing slash and 404 leaf values requested with one, like the real metadata server")
+	flLogFormat           = flag.String("logFormat", "json", "log format: json or text")
+	flLogLevel            = flag.String("logLevel", "info", "lowest level logged: debug, info, warn or error")
+	flVerbosity           = flag.Int("v", 0, "deprecated: any verbosity above 0 logs at the debug level")
+	_                     = flag.Bool("logtostderr", true, "deprecated: logs are always written to stderr")
+	_                     = flag.Bool("alsologtostderr", false, "deprecated: logs are always written to stderr")
+)
+
+// logger is the log of the commands; it is set up from the flags.
+var logger = zap.NewNop().Sugar()
+
+// setupLogging creates the log selected by the flags for the commands and the
+// server.
+func setupLogging() error {
+	level := *flLogLevel
+	if *flVerbosity > 0 {
+		level = "debug"
+	}
+	l, err := mds.NewLogger(*flLogFormat, level)
+	if err != nil {
+		return err
+	}
+	mds.SetLogger(l)
+	logger = l.Sugar()
+	return nil
+}
+
+// serviceAccounts collects the repeatable -serviceAccount flag.
+type serviceAccounts []mds.ServiceAccountConfig
+
+func (a *serviceAccounts) String() string {
+	return ""
+}
+
+// Set parses email or email=credentialsFile; without a file the account is
+// impersonated.
+func (a *serviceAccounts) Set(v string) error {
+	c := mds.ServiceAccountConfig{Email: v}
+	if i := strings.Index(v, "="); i >= 0 {
+		c.Email, c.CredentialsFile = v[:i], v[i+1:]
+	}
+	*a = append(*a, c)
+	return nil
+}
+
+// index returns the position of the account with the email, or -1.
+func (a serviceAccounts) index(email string) int {
+	for i, c := range a {
+		if c.Email == email {
+			return i
+		}
+	}
+	return -1
+}
+
+// accountLists collects the repeatable -serviceAccountScopes and
+// -serviceAccountAliases flags by service account email.
+type accountLists map[string][]string
+
+func (l accountLists) String() string {
+	return ""
+}
+
+// Set parses email=value,value.
+func (l accountLists) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("must be email=value,value: %s", v)
+	}
+	l[v[:i]] = append(l[v[:i]], splitList(v[i+1:])...)
+	return nil
+}
+
+// attributes collects the repeatable -instanceAttribute flag.
+type attributes map[string]string
+
+func (a attributes) String() string {
+	return ""
+}
+
+// Set parses key=value.
+func (a attributes) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("attribute must be key=value: %s", v)
+	}
+	a[v[:i]] = v[i+1:]
+	return nil
+}
+
+// headers collects the repeatable -webhookHeader flag.
+type headers map[string]string
+
+func (h headers) String() string {
+	return ""
+}
+
+// Set parses "Name: value".
+func (h headers) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i < 0 {
+		return fmt.Errorf("header must be \"Name: value\": %s", v)
+	}
+	h[strings.TrimSpace(v[:i])] = strings.TrimSpace(v[i+1:])
+	return nil
+}
+
+// urls collects the repeatable -eventWebhook flag.
+type urls []string
+
+func (u *urls) String() string {
+	return ""
+}
+
+func (u *urls) Set(v string) error {
+	*u = append(*u, v)
+	return nil
+}
+
+// commands collects the repeatable -plugin flag.
+type commands [][]string
+
+func (c *commands) String() string {
+	return ""
+}
+
+// Set splits a command line on spaces.
+func (c *commands) Set(v string) error {
+	f := strings.Fields(v)
+	if len(f) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	*c = append(*c, f)
+	return nil
+}
+
+// splitList splits a comma separated flag value; an empty value is an empty
+// list.
+func splitList(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+func main() {
+	ctx := context.Background()
+	var flServiceAccounts serviceAccounts
+	flag.Var(&flServiceAccounts, "serviceAccount", "additional service account to serve, as email (impersonated) or email=credentialsFile; may be repeated")
+	flAccountScopes := accountLists{}
+	flag.Var(flAccountScopes, "serviceAccountScopes", "scopes of an additional service account, as email=scope,scope (default tokenScopes); may be repeated")
+	flAccountAliases := accountLists{}
+	flag.Var(flAccountAliases, "serviceAccountAliases", "names an additional service account is also listed under, as email=alias,alias; may be repeated")
+	flInstanceAttributes := attributes{}
+	flag.Var(flInstanceAttributes, "instanceAttribute", "instance attribute as key=value; may be repeated")
+	var flEventWebhooks urls
+	flag.Var(&flEventWebhooks, "eventWebhook", "URL each change (maintenance event, preemption, value set...) is POSTed to as JSON; may be repeated")
+	flWebhookHeaders := headers{}
+	flag.Var(flWebhookHeaders, "webhookHeader", "header (\"Name: value\") sent to webhookURL; may be repeated")
+	var flPlugins commands
+	flag.Var(&flPlugins, "plugin", "command of a credential or attribute plugin, with arguments; may be repeated")
+	flLatencies := attributes{}
+	flag.Var(flLatencies, "latency", "delay of the requests for a path (* matches a prefix) as path=2s, path=2s-5s (uniform) or path=3s~500ms (normal); may be repeated")
+	flErrorRates := attributes{}
+	flag.Var(flErrorRates, "errorRate", "share of the requests for a path (* matches a prefix) that fail, as path=10%:503,5%:reset; may be repeated")
+	flRateLimits := attributes{}
+	flag.Var(flRateLimits, "rateLimit", "requests per client IP allowed for a path (* matches a prefix) before 429, as path=10/s or path=600/m:20 (burst); may be repeated")
+	flPathLogLevels := attributes{}
+	flag.Var(flPathLogLevels, "pathLogLevel", "log level of the requests for a path (* matches a prefix) as path=level, eg instance/service-accounts/*=off; may be repeated")
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") == "mdsctl" {
+		runCtl(os.Args[1:])
+		return
+	}
+	flag.Parse()
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	switch flag.Arg(0) {
+	case "redirect":
+		runRedirect(flag.Args()[1:])
+		return
+	case "exec":
+		runExec(flag.Args()[1:])
+		return
+	case "probe":
+		runProbe(flag.Args()[1:])
+		return
+	case "bench":
+		runBench(flag.Args()[1:])
+		return
+	case "ctl":
+		runCtl(flag.Args()[1:])
+		return
+	}
+
+	argError := func(s string, v ...interface{}) {
+		flag.PrintDefaults()
+		logger.Errorf("Invalid Argument error: "+s, v...)
+		os.Exit(-1)
+	}
+
+	var socketMode os.FileMode
+	if *flSocketMode != "" {
+		m, err := strconv.ParseUint(*flSocketMode, 8, 32)
+		if err != nil {
+			argError("socketMode must be an octal file mode: %v", err)
+		}
+		socketMode = os.FileMode(m)
+	}
+
+	var fakeClaims map[string]interface{}
+	if *flFakeClaims != "" {
+		if err := json.Unmarshal([]byte(*flFakeClaims), &fakeClaims); err != nil {
+			argError("fakeClaims must be a json object: %v", err)
+		}
+	}
+
+	tpmKeyHandle, err := strconv.ParseUint(*flTPMKeyHandle, 0, 32)
+	if err != nil {
+		argError("tpmKeyHandle must be a number (eg 0x81008000): %v", err)
+	}
+
+	for email, scopes := range flAccountScopes {
+		i := flServiceAccounts.index(email)
+		if i < 0 {
+			argError("serviceAccountScopes: %s is not an additional serviceAccount", email)
+		}
+		flServiceAccounts[i].Scopes = scopes
+	}
+	for email, aliases := range flAccountAliases {
+		i := flServiceAccounts.index(email)
+		if i < 0 {
+			argError("serviceAccountAliases: %s is not an additional serviceAccount", email)
+		}
+		flServiceAccounts[i].Aliases = aliases
+	}
+
+	var delegates []string
+	if *flDelegates != "" {
+		delegates = strings.Split(*flDelegates, ",")
+	}
+
+	kubernetesSAs := map[string]string{}
+	if *flKubernetesSAs != "" {
+		for _, m := range strings.Split(*flKubernetesSAs, ",") {
+			i := strings.Index(m, "=")
+			if i < 0 {
+				argError("kubernetesServiceAccounts must be namespace/name=email: %s", m)
+			}
+			kubernetesSAs[m[:i]] = m[i+1:]
+		}
+	}
+
+	kubeLabels := map[string]string{}
+	for _, l := range splitList(*flKubeLabels) {
+		i := strings.Index(l, "=")
+		if i <= 0 {
+			argError("kubeLabels must be key=value: %s", l)
+		}
+		kubeLabels[l[:i]] = l[i+1:]
+	}
+
+	var staticIDTokens map[string]string
+	if *flStaticIDTokens != "" {
+		staticIDTokens = map[string]string{}
+		for _, m := range strings.Split(*flStaticIDTokens, ",") {
+			i := strings.LastIndex(m, "=")
+			if i < 0 {
+				argError("staticIdTokens must be audience=file: %s", m)
+			}
+			staticIDTokens[m[:i]] = m[i+1:]
+		}
+	}
+
+	credentialsFile := *flserviAccountFile
+	if *flCredentialsFile != "" {
+		if credentialsFile != "" {
+			argError("only one of serviceAccountFile and credentialsFile may be set")
+		}
+		credentialsFile = *flCredentialsFile
+	}
+	// the key may be injected as a secret environment variable instead; it
+	// is removed so credential commands and plugins don't inherit it
+	credentialsJSON := os.Getenv("GOOGLE_SERVICE_ACCOUNT_JSON")
+	os.Unsetenv("GOOGLE_SERVICE_ACCOUNT_JSON")
+	if credentialsJSON != "" && credentialsFile != "" {
+		argError("only one of serviceAccountFile and GOOGLE_SERVICE_ACCOUNT_JSON may be set")
+	}
+
+	f, err := mds.NewMetadataServer(ctx, mds.Config{
+		Port:                      *flPort,
+		Listen:                    *flListen,
+		SocketMode:                socketMode,
+		SocketGroup:               *flSocketGroup,
+		SetupInterface:            *flSetupInterface,
+		InterfaceName:             *flInterfaceName,
+		TLSCertFile:               *flTLSCert,
+		TLSKeyFile:                *flTLSKey,
+		TLSClientCAFile:           *flTLSClientCA,
+		MaxHeaderBytes:            *flMaxHeaderBytes,
+		MaxRequestBodyBytes:       *flMaxBodyBytes,
+		RequestReadTimeout:        *flReadTimeout,
+		RunAsUser:                 *flRunAsUser,
+		RunAsGroup:                *flRunAsGroup,
+		NumericProjectID:          *flnumericProjectID,
+		TokenScopes:               strings.Split(*fltokenScopes, ","),
+		ProjectID:                 *flprojectID,
+		ServiceAccountEmail:       *flserviceAccountEmail,
+		ServiceAccountFile:        credentialsFile,
+		ServiceAccountJSON:        []byte(credentialsJSON),
+		CustomAttributeFile:       *flcustomAttributeFile,
+		CustomAttributes:          map[string]string{"k1": "v1", "k2": "v2"},
+		InstanceAttributeFile:     *flInstanceAttrFile,
+		InstanceAttributes:        flInstanceAttributes,
+		SSHKeysFile:               *flSSHKeys,
+		InstanceSSHKeysFile:       *flInstanceSSHKeys,
+		BlockProjectSSHKeys:       *flBlockProjectSSHKeys,
+		OSLogin:                   *flOSLogin,
+		OSLogin2FA:                *flOSLogin2FA,
+		StartupScriptFile:         *flStartupScript,
+		StartupScriptURL:          *flStartupScriptURL,
+		ShutdownScriptFile:        *flShutdownScript,
+		ClusterName:               *flClusterName,
+		ClusterLocation:           *flClusterLocation,
+		ClusterUID:                *flClusterUID,
+		KubeEnvFile:               *flKubeEnv,
+		KubeLabels:                kubeLabels,
+		ContainerDeclarationFile:  *flContainerDecl,
+		UserDataFile:              *flUserData,
+		COSMetrics:                *flCOSMetrics,
+		Impersonate:               *flImpersonate,
+		Delegates:                 delegates,
+		ImpersonatedTokenLifetime: *flTokenLifetime,
+		TPMPath:                   *flTPMPath,
+		TPMKeyHandle:              uint32(tpmKeyHandle),
+		TPMKeyID:                  *flTPMKeyID,
+		VaultAddr:                 *flVaultAddr,
+		VaultToken:                os.Getenv("VAULT_TOKEN"),
+		VaultPath:                 *flVaultPath,
+		ExecCredential:            strings.Fields(*flExecCredential),
+		WebhookURL:                *flWebhookURL,
+		WebhookHeaders:            flWebhookHeaders,
+		WebhookCertFile:           *flWebhookCert,
+		WebhookKeyFile:            *flWebhookKey,
+		WebhookCAFile:             *flWebhookCA,
+		Plugins:                   flPlugins,
+		STSAudience:               *flSTSAudience,
+		STSSubjectTokenFile:       *flSTSTokenFile,
+		STSSubjectTokenCommand:    strings.Fields(*flSTSTokenCommand),
+		STSSubjectTokenType:       *flSTSTokenType,
+		STSUserProject:            *flSTSUserProject,
+		SelfSignedJWT:             *flSelfSignedJWT,
+		SelfSignedJWTAudience:     *flJWTAudience,
+		AccessBoundaryFile:        *flBoundary,
+		QuotaProject:              *flQuotaProject,
+		MetricsListen:             *flMetricsListen,
+		AdminListen:               *flAdminListen,
+		AdminPprof:                *flAdminPprof,
+		ControlListen:             *flControlListen,
+		AdminTokenFile:            *flAdminTokenFile,
+		AdminTLSCertFile:          *flAdminTLSCert,
+		AdminTLSKeyFile:           *flAdminTLSKey,
+		AdminTLSClientCAFile:      *flAdminTLSClientCA,
+		PrefetchTokens:            *flPrefetchTokens,
+		TokenCacheFile:            *flTokenCache,
+		TokenCachePassphrase:      os.Getenv("TOKEN_CACHE_PASSPHRASE"),
+		TokenCacheKeyring:         *flTokenCacheKeyring,
+		Fake:                      *flFake,
+		FakeKeyFile:               *flFakeKey,
+		FakeIssuer:                *flFakeIssuer,
+		FakeTokenLifetime:         *flFakeTokenLifetime,
+		FakeClaims:                fakeClaims,
+		FakeClaimsFile:            *flFakeClaimsFile,
+		FakeJWKSPath:              *flFakeJWKSPath,
+		Deterministic:             *flDeterministic,
+		DeterministicSeed:         *flDeterministicSeed,
+		ClockSkew:                 *flClockSkew,
+		MaxTokenLifetime:          *flMaxTokenLifetime,
+		MaxOutboundCalls:          *flMaxOutboundCalls,
+		ServiceAccountSecret:      *flSecret,
+		SecretRefreshInterval:     *flSecretRefresh,
+		ServiceAccounts:           flServiceAccounts,
+		ClientMappingsFile:        *flClientMappings,
+		Kubernetes:                *flKubernetes,
+		KubernetesServiceAccounts: kubernetesSAs,
+		MetadataFile:              *flConfig,
+		InstanceID:                *flInstanceID,
+		InstanceName:              *flInstanceName,
+		InstanceHostname:          *flInstanceHostname,
+		Zone:                      *flZone,
+		MachineType:               *flMachineType,
+		CPUPlatform:               *flCPUPlatform,
+		Image:                     *flImage,
+		Tags:                      splitList(*flTags),
+		Licenses:                  splitList(*flLicenses),
+		Preemptible:               *flPreemptible,
+		PreemptAfter:              *flPreemptAfter,
+		ScenarioFile:              *flScenario,
+		StatePath:                 *flStatePath,
+		OTLPEndpoint:              *flOTLPEndpoint,
+		TraceServiceName:          *flTraceServiceName,
+		AccessLogFile:             *flAccessLog,
+		AccessLogFormat:           *flAccessLogFormat,
+		AccessLogMaxSize:          *flAccessLogMaxSize,
+		AccessLogMaxBackups:       *flAccessLogMaxBackups,
+		AccessLogRotateInterval:   *flAccessLogRotate,
+		TokenAuditFile:            *flTokenAudit,
+		PathLogLevels:             flPathLogLevels,
+		Latencies:                 flLatencies,
+		ErrorRates:                flErrorRates,
+		RateLimits:                flRateLimits,
+		EventWebhooks:             flEventWebhooks,
+		StaticIDTokens:            staticIDTokens,
+		StaticIDTokenStatus:       *flStaticIDTokenStatus,
+		AllowedAudiences:          splitList(*flAllowedAudiences),
+		DeniedAudiences:           splitList(*flDeniedAudiences),
+		AllowedScopes:             splitList(*flAllowedScopes),
+		TenantsFile:               *flTenants,
+		TenantHeader:              *flTenantHeader,
+		Flavor:                    *flFlavor,
+		LegacyEndpoints:           *flLegacyEndpoints,
+		CompatTrailingSlash:       *flCompatTrailingSlash,
+		Strict:                    *flStrict,
+	})
+	if err != nil {
+		argError("%v", err)
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	// SIGHUP reloads the config and custom attribute files
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	// SIGUSR1 starts or ends a maintenance event, SIGUSR2 preempts the
+	// instance
+	maintenance := make(chan os.Signal, 1)
+	preempt := make(chan os.Signal, 1)
+	notifyEvents(maintenance, preempt)
+
+	if err := f.Start(); err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	for running := true; running; {
+		select {
+		case <-reload:
+			if err := f.Reload(); err != nil {
+				logger.Errorf("Unable to reload metadata %v", err)
+			}
+		case <-maintenance:
+			f.ToggleMaintenanceEvent()
+		case <-preempt:
+			f.Preempt()
+		case <-done:
+			running = false
+		}
+	}
+
+	if err := f.Shutdown(); err != nil {
+		logger.Fatalf("Server Shutdown Failed:%+v", err)
+	}
+	logger.Infoln("Server Exited Properly")
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// runProbe implements the probe subcommand: it exits 0 if the emulator's
+// readiness (or, with -live, health) endpoint answers ok, for docker
+// HEALTHCHECK in images without curl.
+//
+//	gce_metadata_server probe -addr 127.0.0.1:8080
+func runProbe(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "emulator address")
+	live := fs.Bool("live", false, "check /healthz instead of /readyz")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for the emulator")
+	fs.Parse(args)
+
+	path := "/readyz"
+	if *live {
+		path = "/healthz"
+	}
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get("http://" + *addr + path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, resp.Status)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// runRedirect implements the redirect subcommand: it adds an iptables nat rule
+// sending connections for 169.254.169.254:80 in the current network namespace
+// to the emulator and removes it again on SIGINT/SIGTERM.
+//
+//	gce_metadata_server -logtostderr redirect -to :8080
+//	gce_metadata_server -logtostderr redirect -to 172.17.0.1:8080
+func runRedirect(args []string) {
+	fs := flag.NewFlagSet("redirect", flag.ExitOnError)
+	to := fs.String("to", ":8080", "emulator address; a bare port (:8080) redirects to this host, host:port is DNATed")
+	iptables := fs.String("iptables", "iptables", "iptables binary")
+	fs.Parse(args)
+
+	rule, err := redirectRule(*to)
+	if err != nil {
+		fs.PrintDefaults()
+		logger.Errorf("Invalid Argument error: %v", err)
+		os.Exit(-1)
+	}
+
+	// -C fails if the rule isn't there; only remove the rule on exit if we
+	// added it.
+	if err := iptablesRun(*iptables, "-C", rule); err == nil {
+		logger.Infof("Redirect rule already present: %s", strings.Join(rule, " "))
+	} else {
+		if err := iptablesRun(*iptables, "-A", rule); err != nil {
+			logger.Fatalf("Unable to add redirect rule: %v", err)
+		}
+		logger.Infof("Added redirect rule: %s", strings.Join(rule, " "))
+		defer func() {
+			if err := iptablesRun(*iptables, "-D", rule); err != nil {
+				logger.Errorf("Unable to remove redirect rule: %v", err)
+				return
+			}
+			logger.Infoln("Removed redirect rule")
+		}()
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	<-done
+}
+
+// redirectRule returns the nat OUTPUT rule for the target address.
+func redirectRule(to string) ([]string, error) {
+	host, port, err := net.SplitHostPort(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -to address %q: %v", to, err)
+	}
+	rule := []string{"OUTPUT", "-d", "169.254.169.254/32", "-p", "tcp", "--dport", "80"}
+	if host == "" {
+		return append(rule, "-j", "REDIRECT", "--to-ports", port), nil
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid -to address %q: host must be an IP address", to)
+	}
+	return append(rule, "-j", "DNAT", "--to-destination", net.JoinHostPort(host, port)), nil
+}
+
+func iptablesRun(iptables, action string, rule []string) error {
+	args := append([]string{"-w", "-t", "nat", action}, rule...)
+	out, err := exec.Command(iptables, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v %s", iptables, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
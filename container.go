@@ -0,0 +1,196 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	containerPrefix = "container:"
+	labelPrefix     = "label:"
+
+	defaultDockerSocket = "/var/run/docker.sock"
+
+	// containerCacheTTL is how long the container found for a tcp caller's
+	// IP is reused, including finding none; container IPs are recycled so
+	// this is kept short.
+	containerCacheTTL = 30 * time.Second
+	// containerErrorTTL is how long a failed lookup is reused.
+	containerErrorTTL = 5 * time.Second
+	// containerCacheSize is the number of cached lookups above which
+	// expired ones are dropped.
+	containerCacheSize = 1000
+)
+
+// errNoContainer is returned for callers which don't run in a container.
+var errNoContainer = errors.New("not running in a container")
+
+// container describes the container a caller runs in.
+type container struct {
+	id     string
+	name   string
+	labels map[string]string
+}
+
+// containerKey is the request context key of the caller's *container.
+type containerKey struct{}
+
+// containerErrKey is the request context key of the error of a failed
+// lookup of the caller's container.
+type containerErrKey struct{}
+
+// containerCache caches the containers of tcp callers by IP, which is each
+// container's own on a bridge network, so that /proc isn't searched for
+// every connection.
+type containerCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedContainer
+}
+
+type cachedContainer struct {
+	ctr     *container
+	err     error
+	expires time.Time
+}
+
+// dockerSocket is the docker API socket, taken from DOCKER_HOST if it is a
+// unix:// address.
+func dockerSocket() string {
+	if h := os.Getenv("DOCKER_HOST"); strings.HasPrefix(h, "unix://") {
+		return strings.TrimPrefix(h, "unix://")
+	}
+	return defaultDockerSocket
+}
+
+// inspectContainer reads the name and labels of a container from the docker
+// API.
+func inspectContainer(id string) (*container, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", dockerSocket())
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/" + id + "/json")
+	if err != nil {
+		return nil, fmt.Errorf("unable to inspect container %s: %v", id, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to inspect container %s: %v", id, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to inspect container %s: %s %s", id, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var c struct {
+		Name   string `json:"Name"`
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+	if err := json.Unmarshal(body, &c); err != nil {
+		return nil, fmt.Errorf("unable to parse container %s: %v", id, err)
+	}
+	return &container{id: id, name: strings.TrimPrefix(c.Name, "/"), labels: c.Config.Labels}, nil
+}
+
+// peer finds the container the process at the other end of the connection
+// runs in, or nil if it doesn't run in one.  Lookups of tcp callers,
+// failures included, are cached by IP.
+func (cc *containerCache) peer(c net.Conn, cred *peerCred) (*container, error) {
+	if cred != nil {
+		return pidContainer(int(cred.pid))
+	}
+	local, lok := c.LocalAddr().(*net.TCPAddr)
+	remote, rok := c.RemoteAddr().(*net.TCPAddr)
+	if !lok || !rok {
+		return nil, fmt.Errorf("unable to find the peer of a %s connection", c.LocalAddr().Network())
+	}
+	ip := remote.IP.String()
+	cc.mu.Lock()
+	e, ok := cc.entries[ip]
+	cc.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ctr, e.err
+	}
+
+	e = cachedContainer{expires: time.Now().Add(containerCacheTTL)}
+	pid, err := containerPeerPID(local, remote)
+	if err == nil {
+		e.ctr, e.err = pidContainer(pid)
+	} else if err != errNoContainer {
+		e.err = err
+	}
+	if e.err != nil {
+		e.expires = time.Now().Add(containerErrorTTL)
+	}
+	cc.mu.Lock()
+	if cc.entries == nil {
+		cc.entries = map[string]cachedContainer{}
+	}
+	if len(cc.entries) >= containerCacheSize {
+		now := time.Now()
+		for ip, c := range cc.entries {
+			if !now.Before(c.expires) {
+				delete(cc.entries, ip)
+			}
+		}
+	}
+	cc.entries[ip] = e
+	cc.mu.Unlock()
+	return e.ctr, e.err
+}
+
+// pidContainer returns the container a process runs in, or nil if it
+// doesn't run in one.  Its name and labels are read from docker.
+func pidContainer(pid int) (*container, error) {
+	id, err := pidContainerID(pid)
+	if err == errNoContainer {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return inspectContainer(id)
+}
+
+// matchesContainer reports whether a container: or label: mapping applies to
+// the container.
+func (m *clientMapping) matchesContainer(c *container) bool {
+	switch {
+	case m.container != "":
+		return c.name == m.container || (len(m.container) >= 12 && strings.HasPrefix(c.id, m.container))
+	case m.label != "":
+		kv := strings.SplitN(m.label, "=", 2)
+		v, ok := c.labels[kv[0]]
+		return ok && (len(kv) == 1 || v == kv[1])
+	}
+	return false
+}
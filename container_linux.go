@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package mds
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// containerIDPattern matches the container id in a cgroup path, eg
+// /docker/<id> or /system.slice/docker-<id>.scope.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// tcpPeerPID finds the process owning the other end of a tcp connection made
+// from this host, possibly from another network namespace (eg a container on
+// a bridge network).  This needs to read other processes' /proc entries so in
+// practice it needs root.
+func tcpPeerPID(local, remote *net.TCPAddr) (int, error) {
+	return findTCPPeer(local, remote, false)
+}
+
+// containerPeerPID is tcpPeerPID for callers in containers.  Only the
+// processes of other network namespaces are searched, so that the host's
+// processes aren't walked for every connection; callers in the emulator's
+// own namespace, host network containers included, get errNoContainer.
+func containerPeerPID(local, remote *net.TCPAddr) (int, error) {
+	return findTCPPeer(local, remote, true)
+}
+
+func findTCPPeer(local, remote *net.TCPAddr, otherNetns bool) (int, error) {
+	// the peer's socket has the peer's address as local_address
+	want := procNetAddr(remote) + " " + procNetAddr(local)
+	table := "tcp"
+	if remote.IP.To4() == nil {
+		table = "tcp6"
+	}
+	var self string
+	if otherNetns {
+		var err error
+		if self, err = os.Readlink("/proc/self/ns/net"); err != nil {
+			return 0, err
+		}
+		inode, err := findSocketInode("/proc/self/net/"+table, want)
+		if err != nil {
+			return 0, err
+		}
+		if inode != "" {
+			return 0, errNoContainer
+		}
+	}
+	pids, err := procPIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	netns := map[string][]int{}
+	var order []string
+	for _, pid := range pids {
+		ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pid))
+		if err != nil || (otherNetns && ns == self) {
+			continue
+		}
+		if _, ok := netns[ns]; !ok {
+			order = append(order, ns)
+		}
+		netns[ns] = append(netns[ns], pid)
+	}
+	for _, ns := range order {
+		inode, err := findSocketInode(fmt.Sprintf("/proc/%d/net/%s", netns[ns][0], table), want)
+		if err != nil || inode == "" {
+			continue
+		}
+		target := "socket:[" + inode + "]"
+		for _, pid := range netns[ns] {
+			fds, _ := filepath.Glob(fmt.Sprintf("/proc/%d/fd/*", pid))
+			for _, fd := range fds {
+				if l, err := os.Readlink(fd); err == nil && l == target {
+					return pid, nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no process found for tcp connection from %s", remote)
+}
+
+func procPIDs() ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, e := range entries {
+		if pid, err := strconv.Atoi(e.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// findSocketInode returns the inode of the socket in a /proc/net/tcp{,6}
+// table whose "local_address rem_address" columns are addrs.
+func findSocketInode(path, addrs string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if fields[1]+" "+fields[2] == addrs {
+			return fields[9], nil
+		}
+	}
+	return "", sc.Err()
+}
+
+// procNetAddr formats an address as in /proc/net/tcp: the address as 32 bit
+// words in host (little endian) order followed by the port.
+func procNetAddr(a *net.TCPAddr) string {
+	ip := a.IP.To4()
+	if ip == nil {
+		ip = a.IP.To16()
+	}
+	b := make([]byte, len(ip))
+	for i := 0; i < len(ip); i += 4 {
+		binary.LittleEndian.PutUint32(b[i:], binary.BigEndian.Uint32(ip[i:]))
+	}
+	return strings.ToUpper(hex.EncodeToString(b)) + fmt.Sprintf(":%04X", a.Port)
+}
+
+// pidContainerID returns the id of the container a process runs in, taken
+// from its cgroup, or errNoContainer.
+func pidContainerID(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	ids := containerIDPattern.FindAllString(string(data), -1)
+	if len(ids) == 0 {
+		return "", errNoContainer
+	}
+	return ids[len(ids)-1], nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package mds
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoContainers = errors.New("container identity is only supported on linux")
+
+func tcpPeerPID(local, remote *net.TCPAddr) (int, error) {
+	return 0, errNoContainers
+}
+
+func containerPeerPID(local, remote *net.TCPAddr) (int, error) {
+	return 0, errNoContainers
+}
+
+func pidContainerID(pid int) (string, error) {
+	return "", errNoContainers
+}
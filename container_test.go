@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMatchesContainer(t *testing.T) {
+	ctr := &container{
+		id:     "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		name:   "billing-api",
+		labels: map[string]string{"com.example.identity": "reader", "tier": ""},
+	}
+	for _, tc := range []struct {
+		name string
+		m    clientMapping
+		want bool
+	}{
+		{"name", clientMapping{container: "billing-api"}, true},
+		{"other name", clientMapping{container: "billing"}, false},
+		{"id prefix", clientMapping{container: "0123456789ab"}, true},
+		{"short id prefix", clientMapping{container: "0123456789a"}, false},
+		{"label value", clientMapping{label: "com.example.identity=reader"}, true},
+		{"other label value", clientMapping{label: "com.example.identity=writer"}, false},
+		{"label key", clientMapping{label: "tier"}, true},
+		{"missing label", clientMapping{label: "team"}, false},
+		{"ip mapping", clientMapping{source: &net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.m.matchesContainer(ctr); got != tc.want {
+				t.Errorf("matchesContainer = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientAccountContainer(t *testing.T) {
+	billing := &account{email: "billing@project.iam.gserviceaccount.com"}
+	network := &account{email: "network@project.iam.gserviceaccount.com"}
+	ipMapping := clientMapping{source: &net.IPNet{IP: net.IPv4(172, 17, 0, 0), Mask: net.CIDRMask(16, 32)}, account: network}
+	lookupErr := errors.New("permission denied")
+	for _, tc := range []struct {
+		name     string
+		mappings []clientMapping
+		ctr      *container
+		err      error
+		want     *account
+		mapped   bool
+	}{
+		{
+			name:     "container mapping",
+			mappings: []clientMapping{{container: "billing-api", account: billing}, ipMapping},
+			ctr:      &container{name: "billing-api"},
+			want:     billing,
+			mapped:   true,
+		},
+		{
+			name:     "container deny",
+			mappings: []clientMapping{{container: "billing-api"}, ipMapping},
+			ctr:      &container{name: "billing-api"},
+			mapped:   true,
+		},
+		{
+			name:     "unmapped container falls back to ip",
+			mappings: []clientMapping{{container: "billing-api", account: billing}, ipMapping},
+			ctr:      &container{name: "other"},
+			want:     network,
+			mapped:   true,
+		},
+		{
+			name:     "not in a container falls back to ip",
+			mappings: []clientMapping{{container: "billing-api", account: billing}, ipMapping},
+			want:     network,
+			mapped:   true,
+		},
+		{
+			name:     "failed lookup is denied",
+			mappings: []clientMapping{{label: "tier=batch", account: billing}, ipMapping},
+			err:      lookupErr,
+			mapped:   true,
+		},
+		{
+			name:     "failed lookup without container mappings",
+			mappings: []clientMapping{ipMapping},
+			err:      lookupErr,
+			want:     network,
+			mapped:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{clientMappings: tc.mappings}
+			r := httptest.NewRequest("GET", "/computeMetadata/v1/", nil)
+			r.RemoteAddr = "172.17.0.2:40000"
+			ctx := r.Context()
+			if tc.ctr != nil {
+				ctx = context.WithValue(ctx, containerKey{}, tc.ctr)
+			}
+			if tc.err != nil {
+				ctx = context.WithValue(ctx, containerErrKey{}, tc.err)
+			}
+			a, mapped := s.clientAccount(r.WithContext(ctx))
+			if a != tc.want || mapped != tc.mapped {
+				t.Errorf("clientAccount = %v, %v, want %v, %v", a, mapped, tc.want, tc.mapped)
+			}
+		})
+	}
+}
+
+func TestContainerCache(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cached := &container{name: "cached"}
+	cc := containerCache{entries: map[string]cachedContainer{
+		"127.0.0.1": {ctr: cached, expires: time.Now().Add(time.Minute)},
+	}}
+	// the dialing side's peer is the listener's address
+	if ctr, err := cc.peer(c, nil); err != nil || ctr != cached {
+		t.Errorf("peer = %v, %v, want the cached container", ctr, err)
+	}
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	if _, err := cc.peer(p1, nil); err == nil {
+		t.Error("peer of a pipe succeeded, want an error")
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	mdspb "github.com/salrashid123/gce_metadata_server/mds/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Kinds of ChangeEvent.
+const (
+	ChangeSet               = "set"
+	ChangeReload            = "reload"
+	ChangeMaintenanceEvent  = "maintenance-event"
+	ChangePreempted         = "preempted"
+	ChangeTokensInvalidated = "tokens-invalidated"
+	ChangeServiceAccount    = "service-account"
+	ChangeFault             = "fault"
+)
+
+// ChangeEvent describes a change of the emulator's state.
+type ChangeEvent struct {
+	Kind string `json:"kind"`
+	// Path and Value are the metadata path and its new value, if any
+	Path  string    `json:"path,omitempty"`
+	Value string    `json:"value,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// watchBuffer is how many events a slow watcher may fall behind before
+// events are dropped.
+const watchBuffer = 64
+
+// Watch returns the changes made from now on until ctx is done, when the
+// channel is closed.
+func (s *Server) Watch(ctx context.Context) <-chan ChangeEvent {
+	c := make(chan ChangeEvent, watchBuffer)
+	s.mu.Lock()
+	if s.watchers == nil {
+		s.watchers = map[chan ChangeEvent]struct{}{}
+	}
+	s.watchers[c] = struct{}{}
+	s.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.watchers, c)
+		s.mu.Unlock()
+		close(c)
+	}()
+	return c
+}
+
+// publish sends an event to the watchers.  It must be called with mu held.
+func (s *Server) publish(ev ChangeEvent) {
+	ev.Time = time.Now()
+	for c := range s.watchers {
+		select {
+		case c <- ev:
+		default:
+			logger.Debugf("Dropped %s event for a slow watcher", ev.Kind)
+		}
+	}
+}
+
+// controlServer implements the gRPC control service defined in
+// mds/v1/control.proto.
+type controlServer struct {
+	mdspb.UnimplementedControlServer
+	s *Server
+}
+
+func (c *controlServer) GetMetadata(ctx context.Context, req *mdspb.GetMetadataRequest) (*mdspb.GetMetadataResponse, error) {
+	v, ok := lookupPath(c.s.unmappedTree(), strings.Split(req.Path, "/"))
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s not found", req.Path)
+	}
+	js, err := renderJSON(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &mdspb.GetMetadataResponse{Value: string(js)}, nil
+}
+
+func (c *controlServer) SetValue(ctx context.Context, req *mdspb.SetValueRequest) (*emptypb.Empty, error) {
+	var value interface{}
+	dec := json.NewDecoder(strings.NewReader(req.Value))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid value: %v", err)
+	}
+	if err := c.s.SetValue(req.Path, value); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (c *controlServer) SetMaintenanceEvent(ctx context.Context, req *mdspb.MaintenanceEventRequest) (*mdspb.MaintenanceEventResponse, error) {
+	if req.Event == "" {
+		return &mdspb.MaintenanceEventResponse{Event: c.s.ToggleMaintenanceEvent()}, nil
+	}
+	if err := c.s.SetMaintenanceEvent(req.Event); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &mdspb.MaintenanceEventResponse{Event: req.Event}, nil
+}
+
+func (c *controlServer) Preempt(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
+	c.s.Preempt()
+	return &emptypb.Empty{}, nil
+}
+
+func (c *controlServer) InvalidateTokens(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
+	c.s.InvalidateTokens()
+	return &emptypb.Empty{}, nil
+}
+
+func (c *controlServer) Reload(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
+	if err := c.s.Reload(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// SwitchServiceAccount doesn't pass ctx on since the token sources of the
+// account outlive the call.
+func (c *controlServer) SwitchServiceAccount(ctx context.Context, req *mdspb.SwitchServiceAccountRequest) (*emptypb.Empty, error) {
+	r := &SwitchServiceAccountRequest{CredentialsFile: req.CredentialsFile, Email: req.Email}
+	if req.Credentials != "" {
+		r.Credentials = json.RawMessage(req.Credentials)
+	}
+	if err := c.s.switchServiceAccount(context.Background(), r); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (c *controlServer) RestoreServiceAccount(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
+	c.s.RestoreServiceAccount()
+	return &emptypb.Empty{}, nil
+}
+
+func (c *controlServer) InjectFault(ctx context.Context, req *mdspb.FaultRequest) (*emptypb.Empty, error) {
+	var d time.Duration
+	if req.Duration != nil {
+		if err := req.Duration.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid fault duration: %v", err)
+		}
+		d = req.Duration.AsDuration()
+	}
+	if err := c.s.InjectFault(req.Path, int(req.Status), d); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (c *controlServer) ClearFaults(ctx context.Context, req *mdspb.ClearFaultsRequest) (*emptypb.Empty, error) {
+	c.s.ClearFaults(req.Path)
+	return &emptypb.Empty{}, nil
+}
+
+func (c *controlServer) ListFaults(ctx context.Context, req *emptypb.Empty) (*mdspb.ListFaultsResponse, error) {
+	resp := &mdspb.ListFaultsResponse{}
+	for _, f := range c.s.Faults() {
+		pf := &mdspb.Fault{Path: f.Path, Status: int32(f.Status)}
+		if f.Expires != nil {
+			pf.Expires = timestamppb.New(*f.Expires)
+		}
+		resp.Faults = append(resp.Faults, pf)
+	}
+	return resp, nil
+}
+
+func (c *controlServer) Watch(req *emptypb.Empty, stream mdspb.Control_WatchServer) error {
+	for ev := range c.s.Watch(stream.Context()) {
+		if err := stream.Send(&mdspb.ChangeEvent{
+			Kind:  ev.Kind,
+			Path:  ev.Path,
+			Value: ev.Value,
+			Time:  timestamppb.New(ev.Time),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// controlAuthorized checks the admin token sent with ControlToken.
+func (s *Server) controlAuthorized(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, authorization := range md.Get("authorization") {
+		if s.adminAuthorized(authorization) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+func (s *Server) controlUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.controlAuthorized(ctx); err != nil {
+		logger.Warnf("Unauthorized control call %s", info.FullMethod)
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) controlStreamAuth(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.controlAuthorized(stream.Context()); err != nil {
+		logger.Warnf("Unauthorized control call %s", info.FullMethod)
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// startControl serves the gRPC control service on ControlListen.
+func (s *Server) startControl() error {
+	l, err := net.Listen("tcp", s.cfg.ControlListen)
+	if err != nil {
+		return fmt.Errorf("control listen: %v", err)
+	}
+	var opts []grpc.ServerOption
+	if s.adminTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.adminTLS)))
+	}
+	if s.adminToken != "" {
+		opts = append(opts, grpc.UnaryInterceptor(s.controlUnaryAuth), grpc.StreamInterceptor(s.controlStreamAuth))
+	}
+	s.controlSrv = grpc.NewServer(opts...)
+	mdspb.RegisterControlServer(s.controlSrv, &controlServer{s: s})
+	go func() {
+		if err := s.controlSrv.Serve(l); err != nil {
+			logger.Errorf("control serve: %s", err)
+		}
+	}()
+	logger.Infof("Serving the gRPC control API on %s", l.Addr())
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	mdspb "github.com/salrashid123/gce_metadata_server/mds/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// newControlClient serves the control service of s in memory, with the
+// admin token interceptors like startControl.
+func newControlClient(t *testing.T, s *Server, opts ...grpc.DialOption) mdspb.ControlClient {
+	t.Helper()
+	l := bufconn.Listen(1 << 20)
+	g := grpc.NewServer(grpc.UnaryInterceptor(s.controlUnaryAuth), grpc.StreamInterceptor(s.controlStreamAuth))
+	mdspb.RegisterControlServer(g, &controlServer{s: s})
+	go g.Serve(l)
+	t.Cleanup(g.Stop)
+	opts = append(opts, grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return l.Dial()
+	}))
+	conn, err := grpc.Dial("bufnet", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return mdspb.NewControlClient(conn)
+}
+
+func TestControl(t *testing.T) {
+	s := newTestServer(t, Config{AdminToken: "secret"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := newControlClient(t, s).Preempt(ctx, &emptypb.Empty{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Preempt without the token = %v, want Unauthenticated", err)
+	}
+
+	c := newControlClient(t, s, grpc.WithPerRPCCredentials(ControlToken("secret")))
+	w, err := c.Watch(ctx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the watch to be registered
+	for {
+		s.mu.Lock()
+		n := len(s.watchers)
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := c.SetValue(ctx, &mdspb.SetValueRequest{Path: "instance/attributes/foo", Value: `"bar"`}); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := w.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Kind != ChangeSet || ev.Path != "instance/attributes/foo" || ev.Value != "bar" || ev.Time == nil {
+		t.Errorf("Watch = %v, want the set of instance/attributes/foo", ev)
+	}
+	resp, err := c.GetMetadata(ctx, &mdspb.GetMetadataRequest{Path: "instance/attributes/foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Value != `"bar"` {
+		t.Errorf("GetMetadata = %s, want \"bar\"", resp.Value)
+	}
+	if _, err := c.GetMetadata(ctx, &mdspb.GetMetadataRequest{Path: "instance/missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetMetadata(instance/missing) = %v, want NotFound", err)
+	}
+	if _, err := c.SetValue(ctx, &mdspb.SetValueRequest{Path: "instance/attributes/foo", Value: "bar"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SetValue with a value that isn't JSON = %v, want InvalidArgument", err)
+	}
+
+	m, err := c.SetMaintenanceEvent(ctx, &mdspb.MaintenanceEventRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Event != MaintenanceMigrate {
+		t.Errorf("SetMaintenanceEvent toggled to %s, want %s", m.Event, MaintenanceMigrate)
+	}
+	if ev, err := w.Recv(); err != nil || ev.Kind != ChangeMaintenanceEvent || ev.Value != MaintenanceMigrate {
+		t.Errorf("Watch = %v, %v, want the maintenance event", ev, err)
+	}
+	if _, err := c.SetMaintenanceEvent(ctx, &mdspb.MaintenanceEventRequest{Event: "REBOOT"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SetMaintenanceEvent(REBOOT) = %v, want InvalidArgument", err)
+	}
+
+	if _, err := c.InjectFault(ctx, &mdspb.FaultRequest{Path: "instance/id", Status: 503, Duration: durationpb.New(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	faults, err := c.ListFaults(ctx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(faults.Faults) != 1 || faults.Faults[0].Path != "/computeMetadata/v1/instance/id" || faults.Faults[0].Status != 503 || faults.Faults[0].Expires == nil {
+		t.Errorf("ListFaults = %v, want one expiring 503 fault for instance/id", faults.Faults)
+	}
+	if _, err := c.InjectFault(ctx, &mdspb.FaultRequest{Path: "instance/id", Status: 503, Duration: durationpb.New(-time.Minute)}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("InjectFault with a negative duration = %v, want InvalidArgument", err)
+	}
+	if _, err := c.ClearFaults(ctx, &mdspb.ClearFaultsRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if faults := s.Faults(); len(faults) != 0 {
+		t.Errorf("Faults after ClearFaults = %+v", faults)
+	}
+}
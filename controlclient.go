@@ -0,0 +1,42 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// ControlToken sends the admin token with control API calls made with the
+// client generated from mds/v1/control.proto:
+//
+//	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithPerRPCCredentials(mds.ControlToken(token)))
+//	c := mdspb.NewControlClient(conn)
+func ControlToken(token string) credentials.PerRPCCredentials {
+	return controlToken(token)
+}
+
+type controlToken string
+
+func (t controlToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity is false so the token can be used on loopback
+// listeners without TLS.
+func (t controlToken) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Instance attributes of Container-Optimized OS.
+const (
+	containerDeclarationAttribute = "gce-container-declaration"
+	userDataAttribute             = "user-data"
+	cosMetricsAttribute           = "cos-metrics-enabled"
+)
+
+// cosAttributes serves the Container-Optimized OS instance attributes of the
+// Config unless the metadata config already sets them.  The files are read
+// every time so edits are picked up on Reload.
+func (s *Server) cosAttributes(t map[string]interface{}) error {
+	attributes := subTree(subTree(t, "instance"), "attributes")
+	if file := s.cfg.ContainerDeclarationFile; file != "" {
+		declaration, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read container declaration %s: %v", file, err)
+		}
+		// catch mistakes here rather than in konlet
+		var spec struct {
+			Spec struct {
+				Containers []interface{} `yaml:"containers"`
+			} `yaml:"spec"`
+		}
+		if err := yaml.Unmarshal(declaration, &spec); err != nil {
+			return fmt.Errorf("unable to parse container declaration %s: %v", file, err)
+		}
+		if len(spec.Spec.Containers) == 0 {
+			return fmt.Errorf("container declaration %s has no spec.containers", file)
+		}
+		setAttribute(attributes, containerDeclarationAttribute, string(declaration), true)
+	}
+	if file := s.cfg.UserDataFile; file != "" {
+		userData, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read user-data %s: %v", file, err)
+		}
+		setAttribute(attributes, userDataAttribute, string(userData), true)
+	}
+	setAttribute(attributes, cosMetricsAttribute, "true", s.cfg.COSMetrics)
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const (
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	serviceAccountKey  = "service_account"
+	externalAccountKey = "external_account"
+	userCredentialsKey = "authorized_user"
+)
+
+// credentialsFile holds the fields of a credentials JSON file used to
+// describe the identity behind it.
+type credentialsFile struct {
+	Type                           string `json:"type"`
+	ClientID                       string `json:"client_id"`
+	ClientEmail                    string `json:"client_email"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	PrivateKey                     string `json:"private_key"`
+	PrivateKeyID                   string `json:"private_key_id"`
+	QuotaProjectID                 string `json:"quota_project_id"`
+}
+
+func parseCredentialsFile(data []byte) (*credentialsFile, error) {
+	f := &credentialsFile{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// email returns the service account the credentials act as: the key's
+// client_email, or for external_account credentials the service account named
+// in service_account_impersonation_url
+// (.../serviceAccounts/{email}:generateAccessToken).
+func (f *credentialsFile) email() string {
+	if f.ClientEmail != "" {
+		return f.ClientEmail
+	}
+	u := f.ServiceAccountImpersonationURL
+	i := strings.LastIndex(u, "/serviceAccounts/")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(u[i+len("/serviceAccounts/"):], ":generateAccessToken")
+}
+
+// federatedIDTokenSource returns ID tokens for the service account using
+// credentials which can't sign them directly (external_account and
+// authorized_user).
+func (a *account) federatedIDTokenSource(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+	creds, err := google.CredentialsFromJSON(ctx, a.creds.JSON, cloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	return a.iamIDTokenSource(ctx, creds.TokenSource, audience)
+}
+
+// iamIDTokenSource returns ID tokens for the service account by calling
+// iamcredentials generateIdToken with ts, which needs the cloud-platform
+// scope and roles/iam.serviceAccountOpenIdTokenCreator on the service
+// account.
+func (a *account) iamIDTokenSource(ctx context.Context, ts oauth2.TokenSource, audience string) (oauth2.TokenSource, error) {
+	return impersonate.IDTokenSource(ctx,
+		impersonate.IDTokenConfig{
+			TargetPrincipal: a.email,
+			Audience:        audience,
+			IncludeEmail:    true,
+		},
+		a.iamOptions(option.WithTokenSource(ts))...,
+	)
+}
+
+// decodeCredentialsJSON returns credentials JSON which may be base64
+// encoded.
+func decodeCredentialsJSON(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		return data, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("credentials JSON is neither JSON nor base64: %v", err)
+	}
+	return decoded, nil
+}
+
+// credentialsError explains why the service account email couldn't be found.
+func credentialsError(f *credentialsFile) error {
+	switch f.Type {
+	case externalAccountKey:
+		return fmt.Errorf("serviceAccountEmail must be set for external_account credentials without service_account_impersonation_url")
+	case userCredentialsKey:
+		return fmt.Errorf("serviceAccountEmail must be set for authorized_user credentials; ID tokens are minted by impersonating it")
+	}
+	return fmt.Errorf("unable to get serviceAccountEmail from %s credentials", f.Type)
+}
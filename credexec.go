@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// execTimeout bounds each run of the credential command.
+const execTimeout = 30 * time.Second
+
+// execProvider gets tokens by running a command, like a kubectl exec
+// credential plugin.  The command is told what to return through the
+// environment:
+//
+//	GCE_METADATA_TOKEN_TYPE       access_token or id_token
+//	GCE_METADATA_SERVICE_ACCOUNT  the service account email
+//	GCE_METADATA_SCOPES           comma separated scopes (access_token)
+//	GCE_METADATA_AUDIENCE         the audience (id_token)
+//
+// and prints a TokenResponse JSON document on stdout.
+type execProvider struct {
+	command []string
+}
+
+func (p *execProvider) fetchToken(req *TokenRequest) (*TokenResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GCE_METADATA_TOKEN_TYPE="+req.TokenType,
+		"GCE_METADATA_SERVICE_ACCOUNT="+req.ServiceAccount,
+		"GCE_METADATA_SCOPES="+strings.Join(req.Scopes, ","),
+		"GCE_METADATA_AUDIENCE="+req.Audience,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential command %s failed: %v %s", p.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	out := &TokenResponse{}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return nil, fmt.Errorf("unable to parse the output of credential command %s: %v", p.command[0], err)
+	}
+	if out.Token == "" {
+		return nil, fmt.Errorf("credential command %s did not return a token", p.command[0])
+	}
+	return out, nil
+}
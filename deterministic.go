@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+// In deterministic mode tokens are issued, and the instance was created, at
+// deterministicEpoch and tokens expire at deterministicExpiry so they never
+// need to be refreshed.
+var (
+	deterministicEpoch  = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	deterministicExpiry = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// seedReader is an endless stream of bytes derived from a seed: the SHA-256
+// of the seed, a label and a counter.
+type seedReader struct {
+	seed    string
+	label   string
+	counter uint64
+	buf     []byte
+}
+
+func newSeedReader(seed, label string) *seedReader {
+	return &seedReader{seed: seed, label: label}
+}
+
+func (r *seedReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			h := sha256.New()
+			fmt.Fprintf(h, "%s\x00%s\x00%d", r.seed, r.label, r.counter)
+			r.buf = h.Sum(nil)
+			r.counter++
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// deterministicKey derives an RSA key from the seed.  rsa.GenerateKey can't
+// be used since it deliberately doesn't depend on its random source alone.
+func deterministicKey(seed string) (*rsa.PrivateKey, error) {
+	r := newSeedReader(seed, "fake-key")
+	one, two := big.NewInt(1), big.NewInt(2)
+	e := big.NewInt(65537)
+	var primes []*big.Int
+	for len(primes) < 2 {
+		b := make([]byte, fakeKeyBits/16)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		// the top two bits give the modulus its full length
+		b[0] |= 0xc0
+		b[len(b)-1] |= 1
+		p := new(big.Int).SetBytes(b)
+		for !p.ProbablyPrime(20) || new(big.Int).GCD(nil, nil, e, new(big.Int).Sub(p, one)).Cmp(one) != 0 {
+			p.Add(p, two)
+		}
+		if len(primes) == 1 && p.Cmp(primes[0]) == 0 {
+			continue
+		}
+		primes = append(primes, p)
+	}
+	n := new(big.Int).Mul(primes[0], primes[1])
+	phi := new(big.Int).Mul(new(big.Int).Sub(primes[0], one), new(big.Int).Sub(primes[1], one))
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+		D:         new(big.Int).ModInverse(e, phi),
+		Primes:    primes,
+	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("unable to derive a key from the seed: %v", err)
+	}
+	key.Precompute()
+	return key, nil
+}
+
+// deterministicInstance fills in the instance's id and name, if they aren't
+// configured, with values derived from the seed.
+func (s *Server) deterministicInstance(instance map[string]interface{}) {
+	if _, ok := instance["id"]; !ok {
+		instance["id"] = instanceID(s.cfg.DeterministicSeed + "\x00instance")
+	}
+	if _, ok := instance["name"]; !ok {
+		h := sha256.Sum256([]byte(s.cfg.DeterministicSeed + "\x00instance"))
+		instance["name"] = "instance-" + hex.EncodeToString(h[8:11])
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// maxAccessBoundaryRules is the limit of the STS API
+const maxAccessBoundaryRules = 10
+
+// accessBoundary is a Credential Access Boundary
+// (https://cloud.google.com/iam/docs/downscoping-short-lived-credentials).
+type accessBoundary struct {
+	AccessBoundary struct {
+		AccessBoundaryRules []accessBoundaryRule `json:"accessBoundaryRules"`
+	} `json:"accessBoundary"`
+}
+
+type accessBoundaryRule struct {
+	AvailableResource     string                 `json:"availableResource"`
+	AvailablePermissions  []string               `json:"availablePermissions"`
+	AvailabilityCondition *availabilityCondition `json:"availabilityCondition,omitempty"`
+}
+
+type availabilityCondition struct {
+	Expression  string `json:"expression"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// loadAccessBoundary reads and checks a Credential Access Boundary file and
+// returns it in the form sent to STS.
+func loadAccessBoundary(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read credential access boundary %s: %v", path, err)
+	}
+	b := &accessBoundary{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return "", fmt.Errorf("unable to parse credential access boundary %s: %v", path, err)
+	}
+	rules := b.AccessBoundary.AccessBoundaryRules
+	if len(rules) == 0 || len(rules) > maxAccessBoundaryRules {
+		return "", fmt.Errorf("credential access boundary %s must have between 1 and %d accessBoundaryRules", path, maxAccessBoundaryRules)
+	}
+	for i, r := range rules {
+		if r.AvailableResource == "" || len(r.AvailablePermissions) == 0 {
+			return "", fmt.Errorf("credential access boundary %s: rule %d must set availableResource and availablePermissions", path, i)
+		}
+		if r.AvailabilityCondition != nil && r.AvailabilityCondition.Expression == "" {
+			return "", fmt.Errorf("credential access boundary %s: rule %d has an availabilityCondition without an expression", path, i)
+		}
+	}
+	options, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+	return string(options), nil
+}
+
+// downscopedTokenSource exchanges the tokens of base for tokens restricted by
+// a Credential Access Boundary using the STS token exchange.
+type downscopedTokenSource struct {
+	ctx     context.Context
+	base    oauth2.TokenSource
+	options string
+}
+
+func (d *downscopedTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := d.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	r, err := stsExchange(d.ctx, url.Values{
+		"subject_token_type": {accessTokenType},
+		"subject_token":      {tok.AccessToken},
+		"options":            {d.options},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to downscope token: %v", err)
+	}
+	out := &oauth2.Token{AccessToken: r.AccessToken, TokenType: r.TokenType, Expiry: tok.Expiry}
+	// the downscoped token expires with the source token unless told otherwise
+	if r.ExpiresIn > 0 {
+		out.Expiry = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+	return out, nil
+}
+
+// downscoped restricts the tokens of ts by the account's access boundary, if
+// any.
+func (a *account) downscoped(ts oauth2.TokenSource) oauth2.TokenSource {
+	if a.accessBoundary == "" {
+		return ts
+	}
+	d := &downscopedTokenSource{
+		ctx:     context.Background(),
+		base:    ts,
+		options: a.accessBoundary,
+	}
+	return &reusedDownscopedTokenSource{TokenSource: oauth2.ReuseTokenSource(nil, d), downscoped: d}
+}
+
+// reusedDownscopedTokenSource reuses the tokens of a downscopedTokenSource,
+// which it keeps so that newToken can reach the source behind it.
+type reusedDownscopedTokenSource struct {
+	oauth2.TokenSource
+	downscoped *downscopedTokenSource
+}
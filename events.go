@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Maintenance events served at instance/maintenance-event.
+const (
+	MaintenanceNone      = "NONE"
+	MaintenanceMigrate   = "MIGRATE_ON_HOST_MAINTENANCE"
+	MaintenanceTerminate = "TERMINATE_ON_HOST_MAINTENANCE"
+)
+
+// SetMaintenanceEvent changes instance/maintenance-event, waking up
+// wait_for_change requests like the live migration notices of GCE.  The
+// event outlasts Reload.
+func (s *Server) SetMaintenanceEvent(event string) error {
+	switch event {
+	case MaintenanceNone, MaintenanceMigrate, MaintenanceTerminate:
+	default:
+		return fmt.Errorf("unknown maintenance event %q (%s, %s or %s)", event, MaintenanceNone, MaintenanceMigrate, MaintenanceTerminate)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maintenanceEvent = event
+	s.applyEvents()
+	s.state.put(stateEvents, "maintenanceEvent", event)
+	s.notifyChange()
+	s.publish(ChangeEvent{Kind: ChangeMaintenanceEvent, Path: "instance/maintenance-event", Value: event})
+	logger.Infof("Maintenance event set to %s", event)
+	return nil
+}
+
+// ToggleMaintenanceEvent starts a maintenance event, or ends the one in
+// progress, and returns the new event.  The event started is the instance's
+// on-host-maintenance policy: TERMINATE or, by default, MIGRATE.
+func (s *Server) ToggleMaintenanceEvent() string {
+	s.mu.RLock()
+	current, _ := lookupPath(s.tree, []string{"instance", "maintenance-event"})
+	policy, _ := lookupPath(s.tree, []string{"instance", "scheduling", "on-host-maintenance"})
+	s.mu.RUnlock()
+
+	event := MaintenanceNone
+	if current == MaintenanceNone {
+		event = MaintenanceMigrate
+		if p, ok := policy.(string); ok && strings.EqualFold(p, "TERMINATE") {
+			event = MaintenanceTerminate
+		}
+	}
+	// the event is always valid
+	_ = s.SetMaintenanceEvent(event)
+	return event
+}
+
+// Preempt sets instance/preempted to TRUE, waking up wait_for_change
+// requests, so shutdown handlers of preemptible and spot VMs can be
+// rehearsed.  Like on GCE there is no way back short of a restart.
+func (s *Server) Preempt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.preempted {
+		return
+	}
+	s.preempted = true
+	s.applyEvents()
+	s.state.put(stateEvents, "preempted", true)
+	s.notifyChange()
+	s.publish(ChangeEvent{Kind: ChangePreempted, Path: "instance/preempted", Value: "TRUE"})
+	logger.Infoln("Instance preempted")
+}
+
+// preemptAfter preempts the instance once the delay has passed unless the
+// server is shut down first.
+func (s *Server) preemptAfter(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		s.Preempt()
+	case <-s.stop:
+	}
+}
+
+// applyEvents sets the triggered events in the metadata, which must be
+// done again whenever it is reloaded.  It must be called with mu held.
+func (s *Server) applyEvents() {
+	instance := subTree(s.tree, "instance")
+	if s.maintenanceEvent != "" {
+		instance["maintenanceEvent"] = s.maintenanceEvent
+	}
+	if s.preempted {
+		instance["preempted"] = "TRUE"
+	}
+}
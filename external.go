@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenRequest describes the token an external credential source (a command,
+// webhook or plugin) is asked for.
+type TokenRequest struct {
+	// TokenType is access_token or id_token
+	TokenType      string   `json:"token_type"`
+	ServiceAccount string   `json:"service_account"`
+	Scopes         []string `json:"scopes,omitempty"`
+	Audience       string   `json:"audience,omitempty"`
+}
+
+// TokenResponse is the token returned by an external credential source.
+type TokenResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	// Expiry (RFC 3339) or ExpiresIn (seconds) set how long the token is
+	// reused; without either the source is asked for every request.
+	Expiry    time.Time `json:"expiry"`
+	ExpiresIn int64     `json:"expires_in"`
+}
+
+// tokenProvider is an external credential source, eg a command, webhook or
+// plugin.
+type tokenProvider interface {
+	fetchToken(req *TokenRequest) (*TokenResponse, error)
+}
+
+// externalCredential gets the tokens of an account from a tokenProvider.
+// Access tokens are reused until they expire; ID tokens are cached by the
+// account.
+type externalCredential struct {
+	provider tokenProvider
+	email    string
+}
+
+// externalTokenSource asks the provider for one kind of token.
+type externalTokenSource struct {
+	provider tokenProvider
+	req      *TokenRequest
+}
+
+func (e *externalCredential) tokenSource(scopes []string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &externalTokenSource{provider: e.provider, req: &TokenRequest{
+		TokenType:      "access_token",
+		ServiceAccount: e.email,
+		Scopes:         scopes,
+	}})
+}
+
+func (e *externalCredential) idTokenSource(audience string) oauth2.TokenSource {
+	return &externalTokenSource{provider: e.provider, req: &TokenRequest{
+		TokenType:      "id_token",
+		ServiceAccount: e.email,
+		Audience:       audience,
+	}}
+}
+
+func (t *externalTokenSource) Token() (*oauth2.Token, error) {
+	out, err := t.provider.fetchToken(t.req)
+	if err != nil {
+		return nil, err
+	}
+	tok := &oauth2.Token{AccessToken: out.Token, TokenType: out.TokenType, Expiry: out.Expiry}
+	if tok.TokenType == "" {
+		tok.TokenType = "Bearer"
+	}
+	switch {
+	case out.ExpiresIn > 0:
+		tok.Expiry = time.Now().Add(time.Duration(out.ExpiresIn) * time.Second)
+	case out.Expiry.IsZero():
+		// a zero expiry would be reused forever
+		tok.Expiry = time.Now()
+	}
+	return tok, nil
+}
@@ -0,0 +1,302 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	defaultFakeIssuer   = "https://accounts.google.com"
+	defaultFakeLifetime = time.Hour
+	fakeKeyBits         = 2048
+)
+
+// fakeIssuer mints locally signed JWT access and ID tokens in fake mode so
+// nothing ever calls Google.
+type fakeIssuer struct {
+	issuer   string
+	lifetime time.Duration
+	// claims are added to every ID token and may replace the standard ones;
+	// they are a template expanded with expandClaims
+	claims map[string]interface{}
+	key    *rsa.PrivateKey
+	keyID  string
+	// vars, if set, returns the instance's template variables
+	vars func() map[string]interface{}
+	// frozen issues every token at deterministicEpoch
+	frozen bool
+	// skew shifts the iat and exp claims, see Config.ClockSkew
+	skew time.Duration
+}
+
+// newFakeIssuer loads the FakeKeyFile, or generates a key that lasts as long
+// as the process.
+func newFakeIssuer(cfg Config) (*fakeIssuer, error) {
+	f := &fakeIssuer{
+		issuer:   cfg.FakeIssuer,
+		lifetime: cfg.FakeTokenLifetime,
+		claims:   cfg.FakeClaims,
+		frozen:   cfg.Deterministic,
+		skew:     cfg.ClockSkew,
+	}
+	if f.issuer == "" {
+		f.issuer = defaultFakeIssuer
+	}
+	if f.lifetime <= 0 {
+		f.lifetime = defaultFakeLifetime
+	}
+	f.lifetime = cappedLifetime(f.lifetime, cfg.MaxTokenLifetime)
+	if cfg.FakeClaimsFile != "" {
+		data, err := ioutil.ReadFile(cfg.FakeClaimsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read fake claims file %s: %v", cfg.FakeClaimsFile, err)
+		}
+		f.claims = nil
+		if err := json.Unmarshal(data, &f.claims); err != nil {
+			return nil, fmt.Errorf("unable to parse fake claims file %s: %v", cfg.FakeClaimsFile, err)
+		}
+	}
+	var err error
+	if cfg.FakeKeyFile != "" {
+		f.key, err = loadRSAKey(cfg.FakeKeyFile)
+	} else if cfg.Deterministic {
+		f.key, err = deterministicKey(cfg.DeterministicSeed)
+	} else {
+		logger.Infoln("Generating a fake token signing key")
+		f.key, err = rsa.GenerateKey(rand.Reader, fakeKeyBits)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&f.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(der)
+	f.keyID = hex.EncodeToString(sum[:])
+	return f, nil
+}
+
+// loadRSAKey reads a PEM encoded PKCS#8 or PKCS#1 RSA private key.
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key %s: %v", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse key %s: %v", path, err)
+		}
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the key in %s must be an RSA key, got %T", path, key)
+	}
+	return rsaKey, nil
+}
+
+// fakeSubject returns a stable numeric id for the account, like the unique
+// id Google uses as the sub of its tokens.
+func fakeSubject(email string) string {
+	sum := sha256.Sum256([]byte(email))
+	return "1" + strconv.FormatUint(binary.BigEndian.Uint64(sum[:8]), 10)
+}
+
+// times returns when a token minted now is issued and expires by the
+// issuer's skewed clock.
+func (f *fakeIssuer) times() (time.Time, time.Time) {
+	if f.frozen {
+		return deterministicEpoch.Add(f.skew), deterministicExpiry.Add(f.skew)
+	}
+	iat := time.Now().Add(f.skew)
+	return iat, iat.Add(f.lifetime)
+}
+
+// accessToken returns a JWT access token for the scopes.
+func (f *fakeIssuer) accessToken(email string, scopes []string) (*oauth2.Token, error) {
+	iat, exp := f.times()
+	jwt, err := f.sign(map[string]interface{}{
+		"iss":   f.issuer,
+		"sub":   fakeSubject(email),
+		"azp":   fakeSubject(email),
+		"email": email,
+		"scope": strings.Join(scopes, " "),
+		"iat":   iat.Unix(),
+		"exp":   exp.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: jwt, TokenType: "Bearer", Expiry: exp.Add(-f.skew)}, nil
+}
+
+// idToken returns an ID token for the audience with the issuer's claims and
+// then extra added.
+func (f *fakeIssuer) idToken(email, audience string, extra map[string]interface{}) (*oauth2.Token, error) {
+	iat, exp := f.times()
+	claims := map[string]interface{}{
+		"iss":            f.issuer,
+		"aud":            audience,
+		"sub":            fakeSubject(email),
+		"azp":            fakeSubject(email),
+		"email":          email,
+		"email_verified": true,
+		"iat":            iat.Unix(),
+		"exp":            exp.Unix(),
+	}
+	if len(f.claims) > 0 {
+		vars := map[string]interface{}{}
+		if f.vars != nil {
+			vars = f.vars()
+		}
+		for _, k := range []string{"iss", "aud", "sub", "email", "iat", "exp"} {
+			vars[k] = claims[k]
+		}
+		for k, v := range expandClaims(f.claims, vars).(map[string]interface{}) {
+			claims[k] = v
+		}
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	jwt, err := f.sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: jwt, TokenType: "Bearer", Expiry: exp.Add(-f.skew)}, nil
+}
+
+// claimVar matches the ${name} variables of a claims template.
+var claimVar = regexp.MustCompile(`\$\{([a-z_]+)\}`)
+
+// expandClaims substitutes ${name} variables in the string values of a claims
+// template; unknown variables are kept.  A string that is a single variable
+// takes the variable's type, so "${iat}" is a number.
+func expandClaims(v interface{}, vars map[string]interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		if m := claimVar.FindStringSubmatch(t); m != nil && m[0] == t {
+			if val, ok := vars[m[1]]; ok {
+				return val
+			}
+		}
+		return claimVar.ReplaceAllStringFunc(t, func(s string) string {
+			if val, ok := vars[s[2:len(s)-1]]; ok {
+				return fmt.Sprint(val)
+			}
+			return s
+		})
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = expandClaims(e, vars)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = expandClaims(e, vars)
+		}
+		return l
+	}
+	return v
+}
+
+// sign encodes and signs an RS256 JWT.
+func (f *fakeIssuer) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": f.keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode claims: %v", err)
+	}
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(data))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign token: %v", err)
+	}
+	return data + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// fakeTokenSource mints access tokens for the scopes, or ID tokens if
+// audience is set.
+type fakeTokenSource struct {
+	issuer   *fakeIssuer
+	email    string
+	scopes   []string
+	audience string
+}
+
+func (ts *fakeTokenSource) Token() (*oauth2.Token, error) {
+	if ts.audience != "" {
+		return ts.issuer.idToken(ts.email, ts.audience, nil)
+	}
+	return ts.issuer.accessToken(ts.email, ts.scopes)
+}
+
+// useFake makes the account serve tokens minted by the fake issuer.
+func (a *account) useFake(f *fakeIssuer) {
+	a.fake = f
+	a.creds = &google.Credentials{
+		TokenSource: oauth2.ReuseTokenSource(nil, &fakeTokenSource{
+			issuer: f,
+			email:  a.email,
+			scopes: a.scopes,
+		}),
+	}
+}
+
+// newFakeAccount returns an additional service account served in fake mode.
+func newFakeAccount(c ServiceAccountConfig, scopes []string, f *fakeIssuer) (*account, error) {
+	if c.Email == "" {
+		return nil, errors.New("email must be set for each additional service account")
+	}
+	a := &account{email: c.Email, scopes: c.Scopes, aliases: c.Aliases}
+	if len(a.scopes) == 0 {
+		a.scopes = scopes
+	}
+	a.useFake(f)
+	return a, nil
+}
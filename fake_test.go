@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// verifyJWT checks the RS256 signature of a JWT with key and returns its
+// header and claims.
+func verifyJWT(t *testing.T, jwt string, key *rsa.PublicKey) (header, claims map[string]interface{}) {
+	t.Helper()
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("%q isn't a JWT", jwt)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig); err != nil {
+		t.Fatalf("invalid signature: %v", err)
+	}
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return header, claims
+}
+
+func TestFakeTokens(t *testing.T) {
+	s := newTestServer(t, Config{FakeClaims: map[string]interface{}{"hd": "example.com"}})
+	key := &s.fake.key.PublicKey
+
+	resp, body := get(t, s, "/computeMetadata/v1/instance/service-accounts/default/token?scopes=https://www.googleapis.com/auth/devstorage.read_only", "metadata", "Google")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET token = %d %q", resp.StatusCode, body)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(body), &tok); err != nil {
+		t.Fatal(err)
+	}
+	header, claims := verifyJWT(t, tok.AccessToken, key)
+	if header["kid"] != s.fake.keyID {
+		t.Errorf("kid = %v, want %s", header["kid"], s.fake.keyID)
+	}
+	for k, want := range map[string]interface{}{
+		"iss":   defaultFakeIssuer,
+		"email": "test@project.iam.gserviceaccount.com",
+		"scope": "https://www.googleapis.com/auth/devstorage.read_only",
+	} {
+		if claims[k] != want {
+			t.Errorf("access token %s = %v, want %v", k, claims[k], want)
+		}
+	}
+	if tok.ExpiresIn <= 0 || tok.ExpiresIn > 3600 {
+		t.Errorf("expires_in = %d, want up to 1h", tok.ExpiresIn)
+	}
+
+	resp, body = get(t, s, "/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://example.com", "metadata", "Google")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET identity = %d %q", resp.StatusCode, body)
+	}
+	_, claims = verifyJWT(t, body, key)
+	for k, want := range map[string]interface{}{
+		"aud":            "https://example.com",
+		"email":          "test@project.iam.gserviceaccount.com",
+		"email_verified": true,
+		"sub":            fakeSubject("test@project.iam.gserviceaccount.com"),
+		"hd":             "example.com",
+	} {
+		if claims[k] != want {
+			t.Errorf("ID token %s = %v, want %v", k, claims[k], want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fault makes requests for a path fail with Status, eg so a test can check
+// a client's retries, until Expires or, if it isn't set, until cleared.
+type Fault struct {
+	// Path is a request path like /computeMetadata/v1/instance/id; one
+	// ending in * matches all paths with that prefix
+	Path    string     `json:"path"`
+	Status  int        `json:"status"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// FaultRequest is the admin and control API request to inject a fault.
+type FaultRequest struct {
+	// Path may be relative to /computeMetadata/v1/
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	// Duration is how long the fault lasts (eg 30s), forever if empty
+	Duration string `json:"duration,omitempty"`
+}
+
+// faultPath qualifies a path relative to /computeMetadata/v1/.
+func faultPath(path string) string {
+	if strings.HasPrefix(path, "/computeMetadata/") || strings.HasPrefix(path, "/0.1/") {
+		return path
+	}
+	return "/computeMetadata/v1/" + strings.TrimPrefix(path, "/")
+}
+
+// pathMatches reports whether a fault (or latency, log level...) path
+// applies to a request path: it is the same or ends with * and is a prefix.
+func pathMatches(pattern, path string) bool {
+	prefix := strings.TrimSuffix(pattern, "*")
+	return pattern == path || (prefix != pattern && strings.HasPrefix(path, prefix))
+}
+
+// InjectFault fails requests for the path, which may be relative to
+// /computeMetadata/v1/, with the HTTP status for d or, if d is 0, until
+// ClearFaults.  It replaces an earlier fault for the same path.
+func (s *Server) InjectFault(path string, status int, d time.Duration) error {
+	if path == "" {
+		return fmt.Errorf("the path of the fault must be set")
+	}
+	if status < 100 || status > 599 {
+		return fmt.Errorf("invalid HTTP status %d", status)
+	}
+	if d < 0 {
+		return fmt.Errorf("invalid fault duration %v", d)
+	}
+	f := Fault{Path: faultPath(path), Status: status}
+	if d > 0 {
+		expires := time.Now().Add(d)
+		f.Expires = &expires
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.faults == nil {
+		s.faults = map[string]Fault{}
+	}
+	s.pruneFaults(time.Now())
+	s.faults[f.Path] = f
+	s.state.put(stateFaults, f.Path, f)
+	s.publish(ChangeEvent{Kind: ChangeFault, Path: f.Path, Value: strconv.Itoa(status)})
+	logger.Infof("Failing %s with %d for %v", f.Path, status, d)
+	return nil
+}
+
+// pruneFaults drops the faults which expired by now.  It must be called
+// with mu held.
+func (s *Server) pruneFaults(now time.Time) {
+	for path, f := range s.faults {
+		if f.Expires != nil && !now.Before(*f.Expires) {
+			delete(s.faults, path)
+			s.state.delete(stateFaults, path)
+		}
+	}
+}
+
+// injectFault handles a FaultRequest.
+func (s *Server) injectFault(r *FaultRequest) error {
+	var d time.Duration
+	if r.Duration != "" {
+		var err error
+		d, err = time.ParseDuration(r.Duration)
+		if err != nil {
+			return fmt.Errorf("invalid fault duration: %v", err)
+		}
+	}
+	return s.InjectFault(r.Path, r.Status, d)
+}
+
+// ClearFaults removes the fault for the path, or all faults if path is empty.
+func (s *Server) ClearFaults(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if path == "" {
+		s.faults = nil
+		s.state.clear(stateFaults)
+	} else {
+		path = faultPath(path)
+		delete(s.faults, path)
+		s.state.delete(stateFaults, path)
+	}
+	s.publish(ChangeEvent{Kind: ChangeFault, Path: path})
+	if path == "" {
+		path = "(all)"
+	}
+	logger.Infof("Cleared faults %s", path)
+}
+
+// Faults returns the faults in effect by path.
+func (s *Server) Faults() []Fault {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	faults := []Fault{}
+	for _, f := range s.faults {
+		if f.Expires == nil || now.Before(*f.Expires) {
+			faults = append(faults, f)
+		}
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i].Path < faults[j].Path })
+	return faults
+}
+
+// fault fails the request if a fault matches its path and reports whether
+// it did.  The longest matching path wins.
+func (s *Server) fault(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.RLock()
+	if len(s.faults) == 0 {
+		s.mu.RUnlock()
+		return false
+	}
+	now := time.Now()
+	var match *Fault
+	for _, f := range s.faults {
+		f := f
+		if f.Expires != nil && !now.Before(*f.Expires) {
+			continue
+		}
+		if pathMatches(f.Path, r.URL.Path) && (match == nil || len(f.Path) > len(match.Path)) {
+			match = &f
+		}
+	}
+	s.mu.RUnlock()
+	if match == nil {
+		return false
+	}
+	s.requestLogger(r).Debugf("Injected fault: %s %d", r.URL.Path, match.Status)
+	s.writeError(w, r, match.Status, "")
+	return true
+}
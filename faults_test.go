@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPathMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/computeMetadata/v1/instance/id", "/computeMetadata/v1/instance/id", true},
+		{"/computeMetadata/v1/instance/id", "/computeMetadata/v1/instance/id/", false},
+		{"/computeMetadata/v1/instance/*", "/computeMetadata/v1/instance/id", true},
+		{"/computeMetadata/v1/instance/*", "/computeMetadata/v1/project/project-id", false},
+		{"/computeMetadata/v1/instance", "/computeMetadata/v1/instance/id", false},
+	} {
+		if got := pathMatches(tc.pattern, tc.path); got != tc.want {
+			t.Errorf("pathMatches(%s, %s) = %v, want %v", tc.pattern, tc.path, got, tc.want)
+		}
+	}
+	if got := faultPath("instance/id"); got != "/computeMetadata/v1/instance/id" {
+		t.Errorf("faultPath = %s", got)
+	}
+}
+
+func TestInjectFault(t *testing.T) {
+	s := newTestServer(t, Config{})
+	const path = "/computeMetadata/v1/project/project-id"
+	status := func() int {
+		t.Helper()
+		resp, _ := get(t, s, path, "metadata", "Google")
+		return resp.StatusCode
+	}
+
+	for _, bad := range []struct {
+		path   string
+		status int
+		d      time.Duration
+	}{
+		{"", 503, 0},
+		{"project/project-id", 42, 0},
+		{"project/project-id", 503, -time.Second},
+	} {
+		if err := s.InjectFault(bad.path, bad.status, bad.d); err == nil {
+			t.Errorf("InjectFault(%q, %d, %v) succeeded", bad.path, bad.status, bad.d)
+		}
+	}
+
+	if err := s.InjectFault("project/*", http.StatusServiceUnavailable, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("status with a prefix fault = %d, want 503", got)
+	}
+	// the longest matching path wins
+	if err := s.InjectFault(path, http.StatusInternalServerError, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != http.StatusInternalServerError {
+		t.Errorf("status with an exact fault = %d, want 500", got)
+	}
+	if faults := s.Faults(); len(faults) != 2 || faults[0].Path != "/computeMetadata/v1/project/*" {
+		t.Errorf("Faults = %+v", faults)
+	}
+	s.ClearFaults("project/project-id")
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("status after clearing the exact fault = %d, want 503", got)
+	}
+	s.ClearFaults("")
+	if got := status(); got != http.StatusOK {
+		t.Errorf("status after clearing all faults = %d, want 200", got)
+	}
+
+	if err := s.InjectFault(path, http.StatusServiceUnavailable, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("status with a timed fault = %d, want 503", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := status(); got != http.StatusOK {
+		t.Errorf("status after the fault expired = %d, want 200", got)
+	}
+	if faults := s.Faults(); len(faults) != 0 {
+		t.Errorf("Faults after expiry = %+v", faults)
+	}
+}
+
+func TestInjectFaultRequest(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if err := s.injectFault(&FaultRequest{Path: "instance/id", Status: 404, Duration: "soon"}); err == nil {
+		t.Error("injectFault accepted an invalid duration")
+	}
+	if err := s.injectFault(&FaultRequest{Path: "instance/id", Status: 404, Duration: "1m"}); err != nil {
+		t.Fatal(err)
+	}
+	faults := s.Faults()
+	if len(faults) != 1 || faults[0].Expires == nil || faults[0].Status != 404 {
+		t.Errorf("Faults = %+v, want one 404 expiring fault", faults)
+	}
+}
+
+func TestPruneFaults(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if err := s.InjectFault("instance/id", http.StatusServiceUnavailable, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := s.InjectFault("instance/name", http.StatusServiceUnavailable, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.RLock()
+	_, ok := s.faults["/computeMetadata/v1/instance/id"]
+	n := len(s.faults)
+	s.mu.RUnlock()
+	if ok || n != 1 {
+		t.Errorf("%d faults after injecting another, want the expired one dropped", n)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Flavors select which metadata server the emulator behaves like.
+const (
+	// FlavorGCE is the Compute Engine metadata server (the default).
+	FlavorGCE = "gce"
+	// FlavorGKE is the GKE metadata server run on nodes with Workload
+	// Identity: only the pod's service account is listed, legacy endpoints
+	// and kube-env are concealed.
+	FlavorGKE = "gke"
+	// FlavorCloudRun is the metadata server of Cloud Run and Cloud
+	// Functions: the instance has a region instead of a zone, only the
+	// default service account is listed and there are no attributes.
+	FlavorCloudRun = "cloudrun"
+)
+
+// serverHeaders are the Server response headers of each flavor.
+var serverHeaders = map[string]string{
+	FlavorGCE:      "Metadata Server for VM",
+	FlavorGKE:      "GKE Metadata Server",
+	FlavorCloudRun: "Metadata Server for Serverless",
+}
+
+func validFlavor(flavor string) error {
+	if _, ok := serverHeaders[flavor]; !ok {
+		return fmt.Errorf("unknown flavor %q (gce, gke or cloudrun)", flavor)
+	}
+	return nil
+}
+
+// routeFlavor registers the routes specific to the flavor.  They must take
+// precedence over the generic handlers.
+func (s *Server) routeFlavor(r *mux.Router) {
+	if s.cfg.Flavor != FlavorGKE {
+		return
+	}
+	concealed := s.checkMetadataHeaders(http.HandlerFunc(s.concealed))
+	r.PathPrefix("/computeMetadata/v1beta1/").Handler(concealed).Methods("GET")
+	r.PathPrefix("/0.1/").Handler(concealed).Methods("GET")
+	r.Handle("/computeMetadata/v1/instance/attributes/kube-env", concealed).Methods("GET")
+}
+
+// concealed rejects requests for endpoints the GKE metadata server hides from
+// pods.
+func (s *Server) concealed(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, r, http.StatusForbidden, "This metadata endpoint is concealed.")
+}
+
+// serverlessTree reshapes the instance and project metadata like the Cloud
+// Run metadata server: the instance only has an id, which is a hex string,
+// its region and its service accounts, and the project has no attributes.
+func serverlessTree(t map[string]interface{}) {
+	instance := subTree(t, "instance")
+	if _, ok := instance["region"]; !ok {
+		// projects/<n>/zones/us-central1-a is in projects/<n>/regions/us-central1
+		zone, _ := instance["zone"].(string)
+		region := path.Base(zone)
+		if i := strings.LastIndex(region, "-"); i > 0 {
+			region = region[:i]
+		}
+		if i := strings.Index(zone, "/zones/"); i >= 0 {
+			region = zone[:i] + "/regions/" + region
+		}
+		instance["region"] = region
+	}
+	if id, ok := instance["id"]; ok {
+		s, _ := renderLeaf(id)
+		h := sha256.Sum256([]byte(s))
+		instance["id"] = hex.EncodeToString(h[:])
+	}
+	for k := range instance {
+		switch k {
+		case "id", "region", "serviceAccounts":
+		default:
+			delete(instance, k)
+		}
+	}
+	delete(subTree(t, "project"), "attributes")
+}
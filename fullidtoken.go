@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/jws"
+)
+
+// errNoSigningKey is returned for format=full ID tokens of accounts without
+// a key the emulator can sign with.
+var errNoSigningKey = errors.New("format=full ID tokens need a service account key or signer")
+
+// computeEngineClaims are the google.compute_engine claims of ID tokens
+// requested with format=full.
+type computeEngineClaims struct {
+	InstanceCreationTimestamp int64    `json:"instance_creation_timestamp"`
+	InstanceID                string   `json:"instance_id"`
+	InstanceName              string   `json:"instance_name"`
+	LicenseID                 []string `json:"license_id,omitempty"`
+	ProjectID                 string   `json:"project_id"`
+	ProjectNumber             int64    `json:"project_number"`
+	Zone                      string   `json:"zone"`
+}
+
+// computeEngineClaims returns the instance's claims, with the ids of its
+// instance/licenses if licenses is set.  The instance is reported as created
+// when the server was.
+func (s *Server) computeEngineClaims(licenses bool) *computeEngineClaims {
+	zone := s.configuredValue("instance", "zone")
+	ce := &computeEngineClaims{
+		InstanceCreationTimestamp: s.created.Unix(),
+		InstanceID:                s.configuredValue("instance", "id"),
+		InstanceName:              s.configuredValue("instance", "name"),
+		ProjectID:                 s.getProjectID(),
+		Zone:                      zone[strings.LastIndex(zone, "/")+1:],
+	}
+	ce.ProjectNumber, _ = strconv.ParseInt(s.getNumericProjectID(), 10, 64)
+	if !licenses {
+		return ce
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, _ := lookupPath(s.tree, []string{"instance", "licenses"})
+	list, _ := l.([]interface{})
+	for _, e := range list {
+		if id, ok := lookupPath(e, []string{"id"}); ok {
+			v, _ := renderLeaf(id)
+			ce.LicenseID = append(ce.LicenseID, v)
+		}
+	}
+	return ce
+}
+
+// getFullIDToken returns an ID token for the audience carrying the instance's
+// compute_engine claims.
+func (s *Server) getFullIDToken(a *account, targetAudience string, licenses bool) (string, error) {
+	if a == s.configured && isEnvironmentOverrideSet() {
+		return os.Getenv(googleIDToken), nil
+	}
+	tok, err := a.fullIDToken(targetAudience, s.computeEngineClaims(licenses), s.cfg.ClockSkew)
+	if err != nil && err != errNoSigningKey {
+		logger.Error(err)
+	}
+	return tok, err
+}
+
+// fullIDToken returns an ID token with the given compute_engine claims.
+// Google only adds them to tokens minted for VMs, so the token is signed with
+// the account's own key (or the fake issuer's) instead; verifiers must trust
+// its public keys.  The tokens are not cached since the claims follow the metadata.
+// Their iat and exp claims are shifted by skew.
+func (a *account) fullIDToken(audience string, ce *computeEngineClaims, skew time.Duration) (string, error) {
+	if a.fake != nil {
+		tok, err := a.fake.idToken(a.email, audience, map[string]interface{}{
+			"google": map[string]interface{}{"compute_engine": ce},
+		})
+		if err != nil {
+			return "", err
+		}
+		return tok.AccessToken, nil
+	}
+	a.mu.Lock()
+	signer, keyID, sub := a.signer, a.keyID, a.email
+	var err error
+	if signer == nil {
+		if a.credType != serviceAccountKey {
+			a.mu.Unlock()
+			return "", errNoSigningKey
+		}
+		signer, keyID, err = a.privateKey()
+		if f, _ := parseCredentialsFile(a.creds.JSON); f != nil && f.ClientID != "" {
+			sub = f.ClientID
+		}
+	}
+	a.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	iat := time.Now().Add(skew)
+	claims := &jws.ClaimSet{
+		Iss: "https://accounts.google.com",
+		Sub: sub,
+		Aud: audience,
+		Iat: iat.Unix(),
+		Exp: iat.Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{
+			"azp":            sub,
+			"email":          a.email,
+			"email_verified": true,
+			"google": map[string]interface{}{
+				"compute_engine": ce,
+			},
+		},
+	}
+	header := &jws.Header{Algorithm: "RS256", Typ: "JWT", KeyID: keyID}
+	jwt, err := jws.EncodeWithSigner(header, claims, func(data []byte) ([]byte, error) {
+		h := sha256.Sum256(data)
+		return signer.Sign(rand.Reader, h[:], crypto.SHA256)
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to sign ID token: %v", err)
+	}
+	return jwt, nil
+}
+
+// fakeClaimVars returns the instance's variables for fake claims templates.
+func (s *Server) fakeClaimVars() map[string]interface{} {
+	ce := s.computeEngineClaims(true)
+	return map[string]interface{}{
+		"instance_creation_timestamp": ce.InstanceCreationTimestamp,
+		"instance_id":                 ce.InstanceID,
+		"instance_name":               ce.InstanceName,
+		"license_id":                  ce.LicenseID,
+		"project_id":                  ce.ProjectID,
+		"project_number":              ce.ProjectNumber,
+		"zone":                        ce.Zone,
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// gkeAttributes serves the instance attributes of a GKE node if
+// Config.ClusterName is set, unless the metadata config already sets them.
+// The cluster location defaults to the instance's zone and the uid to one
+// derived from the project, location and name.
+func (s *Server) gkeAttributes(t map[string]interface{}) error {
+	if s.cfg.ClusterName == "" {
+		return nil
+	}
+	instance := subTree(t, "instance")
+	attributes := subTree(instance, "attributes")
+	location := s.cfg.ClusterLocation
+	if location == "" {
+		zone, _ := instance["zone"].(string)
+		location = path.Base(zone)
+	}
+	uid := s.cfg.ClusterUID
+	if uid == "" {
+		h := sha256.Sum256([]byte(s.getProjectID() + "/" + location + "/" + s.cfg.ClusterName))
+		uid = hex.EncodeToString(h[:])
+	}
+	setAttribute(attributes, "cluster-name", s.cfg.ClusterName, true)
+	setAttribute(attributes, "cluster-location", location, true)
+	setAttribute(attributes, "cluster-uid", uid, true)
+	if s.cfg.KubeEnvFile != "" {
+		env, err := ioutil.ReadFile(s.cfg.KubeEnvFile)
+		if err != nil {
+			return fmt.Errorf("unable to read kube-env %s: %v", s.cfg.KubeEnvFile, err)
+		}
+		setAttribute(attributes, "kube-env", string(env), true)
+	}
+	if len(s.cfg.KubeLabels) > 0 {
+		labels := make([]string, 0, len(s.cfg.KubeLabels))
+		for k, v := range s.cfg.KubeLabels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		setAttribute(attributes, "kube-labels", strings.Join(labels, ","), true)
+	}
+	return nil
+}
@@ -1,15 +1,37 @@
 module github.com/salrashid123/gce_metadata_server
 
-go 1.15
+go 1.19
 
 require (
-	github.com/coreos/go-oidc v2.1.0+incompatible // indirect
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/Microsoft/go-winio v0.4.12
+	github.com/golang/protobuf v1.4.3
+	github.com/google/go-tpm v0.3.3
 	github.com/gorilla/mux v1.7.3
-	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
+	github.com/hashicorp/golang-lru v0.5.1
 	github.com/salrashid123/oauth2 v0.0.0-20190826032145-209a73f76d79
+	go.etcd.io/bbolt v1.3.5
+	go.uber.org/zap v1.27.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	golang.org/x/oauth2 v0.0.0-20210313182246-cd4f82c27b84
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	google.golang.org/api v0.44.0-impersonate-preview
+	google.golang.org/grpc v1.36.0
+	google.golang.org/protobuf v1.25.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v2 v2.2.2
+)
+
+require (
+	cloud.google.com/go v0.79.0 // indirect
+	github.com/coreos/go-oidc v2.1.0+incompatible // indirect
+	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
+	github.com/googleapis/gax-go/v2 v2.0.5 // indirect
+	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
+	go.opencensus.io v0.23.0 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sys v0.0.0-20210629170331-7dc0b73dc9fb // indirect
+	golang.org/x/text v0.3.5 // indirect
+	google.golang.org/genproto v0.0.0-20210319143718-93e7006c17a6 // indirect
 	gopkg.in/square/go-jose.v2 v2.3.1 // indirect
 )
@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Probe endpoints, served without the Metadata-Flavor checks.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// readiness is whether the server is ready to serve tokens, and why not.
+type readiness struct {
+	mu     sync.Mutex
+	ready  bool
+	reason string
+}
+
+func (r *readiness) set(ready bool, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready, r.reason = ready, reason
+}
+
+func (r *readiness) get() (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready, r.reason
+}
+
+// warmUp gets an access token of the default account, which validates the
+// credentials and fills the token cache, retrying until it succeeds, then
+// marks the server ready.
+func (s *Server) warmUp() {
+	if isEnvironmentOverrideSet() {
+		s.readiness.set(true, "")
+		return
+	}
+	retry := prefetchRetry
+	for {
+		a := s.defaultAccount()
+		_, err := a.accessToken(context.Background(), nil)
+		if err == nil {
+			break
+		}
+		logger.Errorf("Not ready, unable to get an access token of %s: %v", a.email, err)
+		s.readiness.set(false, fmt.Sprintf("unable to get an access token of %s", a.email))
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > prefetchMaxRetry {
+			retry = prefetchMaxRetry
+		}
+	}
+	s.readiness.set(true, "")
+	logger.Infoln("Server Ready")
+}
+
+// probes serves /healthz, which is ok while the process serves requests, and
+// /readyz, which is ok once the credentials work, for Kubernetes probes and
+// docker HEALTHCHECK.  Neither needs the Metadata-Flavor header.
+func (s *Server) probes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case healthzPath:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, "ok")
+		case readyzPath:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if ready, reason := s.readiness.get(); !ready {
+				if reason == "" {
+					reason = "starting"
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "not ready: %s\n", reason)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
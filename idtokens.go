@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+// idTokenCacheSize bounds the audiences whose ID tokens are kept per account.
+const idTokenCacheSize = 1000
+
+// idTokenMetrics counts ID token cache hits, misses, requests whose fetch was
+// shared with concurrent ones, evictions and fetch errors.
+var idTokenMetrics = expvar.NewMap("id_token_cache")
+
+// idTokenCache keeps the ID tokens of an account by audience until shortly
+// before they expire, bounded to the most recently used audiences.
+// Concurrent requests for an audience share one fetch.
+type idTokenCache struct {
+	once   sync.Once
+	tokens *lru.Cache
+	group  singleflight.Group
+}
+
+// get returns the cached ID token for audience or one from fetch.
+func (c *idTokenCache) get(audience string, fetch func() (*oauth2.Token, error)) (string, error) {
+	c.init()
+	if v, ok := c.tokens.Get(audience); ok {
+		if tok := v.(*oauth2.Token); time.Until(tok.Expiry) > tokenCacheLeeway {
+			idTokenMetrics.Add("hits", 1)
+			return tok.AccessToken, nil
+		}
+	}
+	idTokenMetrics.Add("misses", 1)
+	v, err, shared := c.group.Do(audience, func() (interface{}, error) {
+		tok, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		if !tok.Expiry.IsZero() {
+			c.tokens.Add(audience, tok)
+		}
+		return tok, nil
+	})
+	if shared {
+		idTokenMetrics.Add("shared", 1)
+	}
+	if err != nil {
+		idTokenMetrics.Add("errors", 1)
+		return "", err
+	}
+	return v.(*oauth2.Token).AccessToken, nil
+}
+
+// purge drops every cached ID token.
+func (c *idTokenCache) purge() {
+	c.init()
+	c.tokens.Purge()
+}
+
+func (c *idTokenCache) init() {
+	c.once.Do(func() {
+		c.tokens, _ = lru.NewWithEvict(idTokenCacheSize, func(key, value interface{}) {
+			idTokenMetrics.Add("evictions", 1)
+		})
+	})
+}
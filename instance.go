@@ -0,0 +1,282 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultInstanceName = "instance-1"
+	defaultZone         = "us-central1-a"
+	defaultMachineType  = "e2-medium"
+	defaultCPUPlatform  = "Intel Broadwell"
+	defaultImage        = "projects/debian-cloud/global/images/family/debian-12"
+	// defaultIP is the first VM address of the default network's
+	// us-central1 subnet
+	defaultIP         = "10.128.0.2"
+	defaultSubnetmask = "255.255.240.0"
+	defaultMTU        = "1460"
+)
+
+// instanceDefaults applies the Config overrides of the instance values and
+// fills in those clients read before anything else, so they don't get a 404
+// if the metadata config leaves them out.
+func (s *Server) instanceDefaults(t map[string]interface{}) {
+	instance := subTree(t, "instance")
+	if s.cfg.InstanceID != "" {
+		instance["id"] = json.Number(s.cfg.InstanceID)
+	}
+	if s.cfg.InstanceName != "" {
+		instance["name"] = s.cfg.InstanceName
+	}
+	if s.cfg.InstanceHostname != "" {
+		instance["hostname"] = s.cfg.InstanceHostname
+	}
+	if s.cfg.Zone != "" {
+		instance["zone"] = s.cfg.Zone
+	}
+	if s.cfg.MachineType != "" {
+		instance["machineType"] = s.cfg.MachineType
+	}
+	if s.cfg.CPUPlatform != "" {
+		instance["cpuPlatform"] = s.cfg.CPUPlatform
+	}
+	if s.cfg.Image != "" {
+		instance["image"] = s.cfg.Image
+	}
+	if s.cfg.Tags != nil {
+		instance["tags"] = s.cfg.Tags
+	}
+	if len(s.cfg.Licenses) > 0 {
+		licenses := make([]interface{}, len(s.cfg.Licenses))
+		for i, id := range s.cfg.Licenses {
+			licenses[i] = map[string]interface{}{"id": id}
+		}
+		instance["licenses"] = licenses
+	}
+	if s.cfg.Deterministic {
+		s.deterministicInstance(instance)
+	}
+
+	name, ok := instance["name"].(string)
+	if !ok {
+		name = localInstanceName()
+		instance["name"] = name
+	}
+	if _, ok := instance["hostname"]; !ok {
+		hostname := name
+		if project := s.getProjectID(); project != "" {
+			hostname += ".c." + project + ".internal"
+		}
+		instance["hostname"] = hostname
+	}
+	if _, ok := instance["id"]; !ok {
+		instance["id"] = instanceID(s.getProjectID() + "/" + name)
+	}
+	s.qualify(instance, "zone", "zones", defaultZone)
+	s.qualify(instance, "machineType", "machineTypes", defaultMachineType)
+	if _, ok := instance["cpuPlatform"]; !ok {
+		instance["cpuPlatform"] = defaultCPUPlatform
+	}
+	if _, ok := instance["image"]; !ok {
+		instance["image"] = defaultImage
+	}
+	tags, ok := instance["tags"]
+	if !ok {
+		tags = []string{}
+	}
+	instance["tags"] = jsonLeaf{tags}
+	diskDefaults(instance)
+	s.networkDefaults(instance)
+	s.schedulingDefaults(instance)
+	if _, ok := instance["maintenanceEvent"]; !ok {
+		instance["maintenanceEvent"] = MaintenanceNone
+	}
+	if _, ok := instance["preempted"]; !ok {
+		instance["preempted"] = "FALSE"
+	}
+}
+
+// schedulingDefaults fills in instance/scheduling/.  GCE serves the booleans
+// as TRUE or FALSE strings, which is what a bool in the config is turned into.
+func (s *Server) schedulingDefaults(instance map[string]interface{}) {
+	scheduling := subTree(instance, "scheduling")
+	if s.cfg.Preemptible {
+		scheduling["preemptible"] = true
+	}
+	for k, v := range scheduling {
+		if b, ok := v.(bool); ok {
+			scheduling[k], _ = renderLeaf(b)
+		}
+	}
+	preemptible, _ := scheduling["preemptible"].(string)
+	restart, maintenance := "TRUE", "MIGRATE"
+	if strings.EqualFold(preemptible, "TRUE") {
+		// preemptible VMs can't be restarted or live migrated
+		restart, maintenance = "FALSE", "TERMINATE"
+	} else {
+		scheduling["preemptible"] = "FALSE"
+	}
+	if _, ok := scheduling["automaticRestart"]; !ok {
+		scheduling["automaticRestart"] = restart
+	}
+	if _, ok := scheduling["onHostMaintenance"]; !ok {
+		scheduling["onHostMaintenance"] = maintenance
+	}
+}
+
+// networkDefaults fills in the unset fields of the instance's network
+// interfaces the way GCE sets them up, and gives an instance without any an
+// interface on the default network.
+func (s *Server) networkDefaults(instance map[string]interface{}) {
+	nics, ok := instance["networkInterfaces"].([]interface{})
+	if !ok || len(nics) == 0 {
+		nics = []interface{}{map[string]interface{}{"ip": defaultIP}}
+	}
+	for _, n := range nics {
+		nic, ok := n.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		s.qualify(nic, "network", "networks", "default")
+		if _, ok := nic["subnetmask"]; !ok {
+			nic["subnetmask"] = defaultSubnetmask
+		}
+		if _, ok := nic["dnsServers"]; !ok {
+			nic["dnsServers"] = []string{metadataIP}
+		}
+		if _, ok := nic["mtu"]; !ok {
+			nic["mtu"] = json.Number(defaultMTU)
+		}
+		if acs, ok := nic["accessConfigs"].([]interface{}); ok {
+			for _, a := range acs {
+				if ac, ok := a.(map[string]interface{}); ok {
+					if _, ok := ac["type"]; !ok {
+						ac["type"] = "ONE_TO_ONE_NAT"
+					}
+				}
+			}
+		}
+		// both are served, if empty, as on GCE
+		nic["forwardedIps"] = stringList(nic["forwardedIps"])
+		nic["ipAliases"] = stringList(nic["ipAliases"])
+		ip, _ := nic["ip"].(string)
+		mask, _ := nic["subnetmask"].(string)
+		ip4, mask4 := net.ParseIP(ip).To4(), net.ParseIP(mask).To4()
+		if ip4 == nil {
+			continue
+		}
+		if _, ok := nic["mac"]; !ok {
+			// GCE MAC addresses are 42:01 followed by the internal IP
+			nic["mac"] = fmt.Sprintf("42:01:%02x:%02x:%02x:%02x", ip4[0], ip4[1], ip4[2], ip4[3])
+		}
+		if _, ok := nic["gateway"]; !ok && mask4 != nil {
+			// the gateway is the first address of the subnet
+			gw := ip4.Mask(net.IPMask(mask4))
+			gw[3]++
+			nic["gateway"] = gw.String()
+		}
+	}
+	instance["networkInterfaces"] = nics
+}
+
+// stringList converts a configured list to an indexedList.
+func stringList(v interface{}) indexedList {
+	l := indexedList{}
+	switch t := v.(type) {
+	case []interface{}:
+		for _, e := range t {
+			if s, ok := renderLeaf(e); ok {
+				l = append(l, s)
+			}
+		}
+	case []string:
+		l = append(l, t...)
+	case indexedList:
+		l = append(l, t...)
+	}
+	return l
+}
+
+// diskDefaults fills in the unset fields of the instance's disks and gives
+// an instance without any a boot disk.
+func diskDefaults(instance map[string]interface{}) {
+	disks, ok := instance["disks"].([]interface{})
+	if !ok || len(disks) == 0 {
+		disks = []interface{}{map[string]interface{}{}}
+	}
+	for i, d := range disks {
+		disk, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		defaults := map[string]interface{}{
+			"deviceName": "persistent-disk-" + strconv.Itoa(i),
+			"index":      json.Number(strconv.Itoa(i)),
+			"interface":  "SCSI",
+			"mode":       "READ_WRITE",
+			"type":       "PERSISTENT",
+		}
+		for k, v := range defaults {
+			if _, ok := disk[k]; !ok {
+				disk[k] = v
+			}
+		}
+	}
+	instance["disks"] = disks
+}
+
+// qualify turns a short resource name (eg us-central1-a) into the full
+// projects/<number>/<collection>/<name> form the metadata server returns,
+// using def if the value isn't set.
+func (s *Server) qualify(instance map[string]interface{}, key, collection, def string) {
+	v, ok := instance[key].(string)
+	if !ok || v == "" {
+		v = def
+	}
+	project := s.getNumericProjectID()
+	if project == "" {
+		project = s.getProjectID()
+	}
+	if !strings.Contains(v, "/") && project != "" {
+		v = "projects/" + project + "/" + collection + "/" + v
+	}
+	instance[key] = v
+}
+
+// localInstanceName returns the first label of the local host name, which a
+// VM's instance name would match.
+func localInstanceName() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return defaultInstanceName
+	}
+	return strings.ToLower(strings.SplitN(h, ".", 2)[0])
+}
+
+// instanceID derives a stable 19 digit instance id from a string.
+func instanceID(from string) json.Number {
+	h := sha256.Sum256([]byte(from))
+	id := binary.BigEndian.Uint64(h[:8])%9e18 + 1e18
+	return json.Number(strconv.FormatUint(id, 10))
+}
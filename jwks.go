@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultJWKSPath is where the fake issuer's keys are served by default,
+// matching Google's https://www.googleapis.com/oauth2/v3/certs.
+const defaultJWKSPath = "/oauth2/v3/certs"
+
+// discoveryPath is the OpenID Connect discovery document of an issuer,
+// relative to its URL.
+const discoveryPath = "/.well-known/openid-configuration"
+
+// jwk is an RSA JSON Web Key (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwks returns the fake issuer's public keys as a JWK set.
+func (f *fakeIssuer) jwks() map[string][]jwk {
+	pub := f.key.PublicKey
+	return map[string][]jwk{"keys": {{
+		Kty: "RSA",
+		Alg: "RS256",
+		Use: "sig",
+		Kid: f.keyID,
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}}
+}
+
+// jwksPath returns the path the fake issuer's keys are served at.
+func (s *Server) jwksPath() string {
+	if s.cfg.FakeJWKSPath != "" {
+		return s.cfg.FakeJWKSPath
+	}
+	return defaultJWKSPath
+}
+
+// routeFake registers the endpoints services under test verify fake tokens
+// with: the JWK set and the issuer's OpenID Connect discovery document.  Like Google's they don't need the Metadata-Flavor header.
+func (s *Server) routeFake(r *mux.Router) {
+	if s.fake == nil {
+		return
+	}
+	r.HandleFunc(s.jwksPath(), s.jwksHandler).Methods("GET")
+	r.HandleFunc(s.discoveryPath(), s.discoveryHandler).Methods("GET")
+}
+
+// discoveryPath returns where the issuer's discovery document is served: the
+// path of the issuer URL (if it is one) followed by discoveryPath.
+func (s *Server) discoveryPath() string {
+	u, err := url.Parse(s.fake.issuer)
+	if err != nil {
+		return discoveryPath
+	}
+	return strings.TrimSuffix(u.Path, "/") + discoveryPath
+}
+
+// discoveryHandler serves the OpenID Connect discovery document of the fake
+// issuer.  The JWKS URL uses the host the document was requested from so it
+// is reachable by the caller.
+func (s *Server) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	js, err := json.Marshal(map[string]interface{}{
+		"issuer":                                s.fake.issuer,
+		"jwks_uri":                              scheme + "://" + r.Host + s.jwksPath(),
+		"response_types_supported":              []string{"id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"claims_supported": []string{
+			"aud", "azp", "email", "email_verified", "exp", "google", "iat", "iss", "sub",
+		},
+	})
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(js)
+}
+
+func (s *Server) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	js, err := json.Marshal(s.fake.jwks())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(js)
+}
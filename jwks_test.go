@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fetchJWKS returns the keys served by s at path by key id.
+func fetchJWKS(t *testing.T, s *Server, path string) map[string]*rsa.PublicKey {
+	t.Helper()
+	resp, body := get(t, s, path, "metadata", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s = %d %q", path, resp.StatusCode, body)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal([]byte(body), &set); err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || k.Alg != "RS256" || k.Use != "sig" {
+			t.Errorf("key %s is %s/%s/%s, want an RS256 signing key", k.Kid, k.Kty, k.Alg, k.Use)
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys
+}
+
+func TestJWKS(t *testing.T) {
+	for _, path := range []string{"", "/keys"} {
+		s := newTestServer(t, Config{FakeJWKSPath: path})
+		if path == "" {
+			path = defaultJWKSPath
+		}
+		keys := fetchJWKS(t, s, path)
+
+		resp, body := get(t, s, "/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://example.com", "metadata", "Google")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET identity = %d %q", resp.StatusCode, body)
+		}
+		var header struct {
+			Kid string `json:"kid"`
+		}
+		data, err := base64.RawURLEncoding.DecodeString(strings.SplitN(body, ".", 2)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &header); err != nil {
+			t.Fatal(err)
+		}
+		key, ok := keys[header.Kid]
+		if !ok {
+			t.Fatalf("the JWKS at %s has no key %s", path, header.Kid)
+		}
+		// the ID token checks against the served key
+		verifyJWT(t, body, key)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	const issuer = "https://issuer.example.com/tenant"
+	s := newTestServer(t, Config{FakeIssuer: issuer})
+	resp, body := get(t, s, "/tenant"+discoveryPath, s.Addr().String(), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET discovery = %d %q", resp.StatusCode, body)
+	}
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Issuer != issuer {
+		t.Errorf("issuer = %s, want %s", doc.Issuer, issuer)
+	}
+	// the jwks_uri points at the keys served by the emulator
+	want := "http://" + s.Addr().String() + defaultJWKSPath
+	if doc.JWKSURI != want {
+		t.Fatalf("jwks_uri = %s, want %s", doc.JWKSURI, want)
+	}
+	keys := fetchJWKS(t, s, defaultJWKSPath)
+
+	_, body = get(t, s, "/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://example.com", "metadata", "Google")
+	_, claims := verifyJWT(t, body, keys[s.fake.keyID])
+	if claims["iss"] != issuer {
+		t.Errorf("ID token iss = %v, want %s", claims["iss"], issuer)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const (
+	keyringService = "gce_metadata_server"
+	keyringAccount = "token-cache"
+)
+
+// errKeyringNotFound is returned by keyringLookup if the keyring has no
+// passphrase yet.
+var errKeyringNotFound = errors.New("no token cache passphrase in the keyring")
+
+// keyringPassphrase reads the token cache passphrase from the OS keyring, and
+// stores a random one there on first use.  It uses secret-tool (libsecret) on
+// linux and security (the login keychain) on macOS.
+func keyringPassphrase() ([]byte, error) {
+	var lookup, store *exec.Cmd
+	// notFound reports whether the exit status and stderr of a failed
+	// lookup mean there is no passphrase yet
+	var notFound func(code int, stderr string) bool
+	pass := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, pass); err != nil {
+		return nil, err
+	}
+	newPass := base64.StdEncoding.EncodeToString(pass)
+	switch runtime.GOOS {
+	case "linux":
+		lookup = exec.Command("secret-tool", "lookup", "service", keyringService, "account", keyringAccount)
+		store = exec.Command("secret-tool", "store", "--label", "GCE metadata server token cache", "service", keyringService, "account", keyringAccount)
+		store.Stdin = strings.NewReader(newPass)
+		// secret-tool exits 1 silently if nothing matches, and explains
+		// any other failure (eg no secret service)
+		notFound = func(code int, stderr string) bool { return code == 1 && stderr == "" }
+	case "darwin":
+		lookup = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", keyringAccount, "-w")
+		// security -i reads the command from stdin, which keeps the
+		// passphrase out of the argument list other users can see
+		store = exec.Command("security", "-i")
+		store.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -s %s -a %s -w %s\n", keyringService, keyringAccount, newPass))
+		// 44 is errSecItemNotFound
+		notFound = func(code int, stderr string) bool { return code == 44 }
+	default:
+		return nil, fmt.Errorf("the OS keyring is not supported on %s", runtime.GOOS)
+	}
+	// only a missing passphrase is replaced, a locked or unreachable
+	// keyring must not lose the key of an existing token cache
+	if pass, err := keyringLookup(lookup, notFound); err != errKeyringNotFound {
+		return pass, err
+	}
+	var stderr bytes.Buffer
+	store.Stderr = &stderr
+	err := store.Run()
+	if err == nil && runtime.GOOS == "darwin" && stderr.Len() > 0 {
+		// security -i exits 0 and only reports failed commands on stderr
+		err = errors.New("add-generic-password failed")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to store the token cache passphrase in the keyring: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return []byte(newPass), nil
+}
+
+// keyringLookup returns the passphrase printed by lookup, or
+// errKeyringNotFound if there is none.
+func keyringLookup(lookup *exec.Cmd, notFound func(code int, stderr string) bool) ([]byte, error) {
+	var stderr bytes.Buffer
+	lookup.Stderr = &stderr
+	out, err := lookup.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && notFound(exitErr.ExitCode(), strings.TrimSpace(stderr.String())) {
+		return nil, errKeyringNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the token cache passphrase from the keyring: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if pass := bytes.TrimSpace(out); len(pass) > 0 {
+		return pass, nil
+	}
+	return nil, errKeyringNotFound
+}
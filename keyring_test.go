@@ -0,0 +1,48 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+func TestKeyringLookup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	notFound := func(code int, stderr string) bool { return code == 1 && stderr == "" }
+	for _, tc := range []struct {
+		script string
+		want   string
+		err    error
+	}{
+		{"echo secret", "secret", nil},
+		{"exit 1", "", errKeyringNotFound},
+		{"true", "", errKeyringNotFound},
+	} {
+		pass, err := keyringLookup(exec.Command("sh", "-c", tc.script), notFound)
+		if string(pass) != tc.want || err != tc.err {
+			t.Errorf("keyringLookup(%q) = %q, %v, want %q, %v", tc.script, pass, err, tc.want, tc.err)
+		}
+	}
+	// other failures, eg a locked keyring, must not replace the passphrase
+	for _, script := range []string{"echo locked >&2; exit 1", "exit 2"} {
+		if _, err := keyringLookup(exec.Command("sh", "-c", script), notFound); err == nil || err == errKeyringNotFound {
+			t.Errorf("keyringLookup(%q) = %v, want an error", script, err)
+		}
+	}
+}
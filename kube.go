@@ -0,0 +1,238 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kubeTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	// gkeServiceAccountAnnotation names the Google service account of a
+	// Kubernetes service account with GKE Workload Identity.
+	gkeServiceAccountAnnotation = "iam.gke.io/gcp-service-account"
+
+	// kubeCacheTTL is how long a pod lookup is reused, including one that
+	// found no pod; pod IPs are recycled so this is kept short.
+	kubeCacheTTL = 30 * time.Second
+	// kubeErrorTTL is how long a failed lookup is reused so an API server
+	// outage isn't hit by every request.
+	kubeErrorTTL = 5 * time.Second
+	// kubeCacheSize is the number of cached lookups above which expired
+	// ones are dropped.
+	kubeCacheSize = 1000
+)
+
+// errNoPod is returned for IPs which are no pod's, eg the node's or a
+// hostNetwork pod's.
+var errNoPod = errors.New("no pod found")
+
+// kubeClient finds the Kubernetes service account of a pod by its IP using
+// the in-cluster credentials of the emulator's own pod.
+type kubeClient struct {
+	host   string
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]kubePod
+}
+
+// kubePod is a cached pod lookup.
+type kubePod struct {
+	namespace      string
+	serviceAccount string
+	// gsa is the gkeServiceAccountAnnotation on the service account, if any
+	gsa string
+	// err is the error of a failed lookup, or errNoPod
+	err     error
+	expires time.Time
+}
+
+func newKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes mode must run inside a cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	ca, err := ioutil.ReadFile(kubeCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kubernetes CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", kubeCAFile)
+	}
+	return &kubeClient{
+		host: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		cache: map[string]kubePod{},
+	}, nil
+}
+
+// get reads a Kubernetes API object.  The token is re-read on every request
+// since projected service account tokens are rotated.
+func (k *kubeClient) get(path string, v interface{}) error {
+	token, err := ioutil.ReadFile(kubeTokenFile)
+	if err != nil {
+		return fmt.Errorf("unable to read kubernetes token: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, k.host+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to query kubernetes: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to query kubernetes: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubernetes GET %s: %s %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// pod returns the service account of the running pod with the given IP, or
+// errNoPod.  Results, failures included, are cached.
+func (k *kubeClient) pod(ip string) (kubePod, error) {
+	k.mu.Lock()
+	p, ok := k.cache[ip]
+	k.mu.Unlock()
+	if !ok || !time.Now().Before(p.expires) {
+		p = k.lookupPod(ip)
+		k.mu.Lock()
+		if len(k.cache) >= kubeCacheSize {
+			now := time.Now()
+			for ip, c := range k.cache {
+				if !now.Before(c.expires) {
+					delete(k.cache, ip)
+				}
+			}
+		}
+		k.cache[ip] = p
+		k.mu.Unlock()
+	}
+	return p, p.err
+}
+
+// lookupPod queries the API server for the pod with the given IP.
+func (k *kubeClient) lookupPod(ip string) kubePod {
+	failed := func(err error) kubePod {
+		ttl := kubeErrorTTL
+		if err == errNoPod {
+			ttl = kubeCacheTTL
+		}
+		return kubePod{err: err, expires: time.Now().Add(ttl)}
+	}
+	var pods struct {
+		Items []struct {
+			Metadata struct {
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+			Spec struct {
+				ServiceAccountName string `json:"serviceAccountName"`
+				HostNetwork        bool   `json:"hostNetwork"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	selector := url.QueryEscape("status.podIP=" + ip + ",status.phase=Running")
+	if err := k.get("/api/v1/pods?fieldSelector="+selector, &pods); err != nil {
+		return failed(err)
+	}
+	var p kubePod
+	for _, item := range pods.Items {
+		// hostNetwork pods share the node's IP and can't be told apart
+		if item.Spec.HostNetwork {
+			continue
+		}
+		if p.namespace != "" {
+			return failed(fmt.Errorf("more than one pod has IP %s", ip))
+		}
+		p.namespace, p.serviceAccount = item.Metadata.Namespace, item.Spec.ServiceAccountName
+	}
+	if p.namespace == "" {
+		return failed(errNoPod)
+	}
+	if p.serviceAccount == "" {
+		p.serviceAccount = "default"
+	}
+
+	var sa struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := k.get(fmt.Sprintf("/api/v1/namespaces/%s/serviceaccounts/%s", p.namespace, p.serviceAccount), &sa); err != nil {
+		return failed(err)
+	}
+	p.gsa = sa.Metadata.Annotations[gkeServiceAccountAnnotation]
+	p.expires = time.Now().Add(kubeCacheTTL)
+	return p
+}
+
+// podAccount returns the account mapped to the Kubernetes service account of
+// the pod with the given IP: KubernetesServiceAccounts["namespace/name"] or
+// the service account's iam.gke.io/gcp-service-account annotation.  Like
+// with Workload Identity, a pod whose service account isn't mapped, or
+// whose lookup failed, gets no account at all (nil and true).  IPs which
+// are no pod's, like the node's, aren't subject to it (false).
+func (s *Server) podAccount(ip net.IP) (*account, bool) {
+	p, err := s.kube.pod(ip.String())
+	if err == errNoPod {
+		return nil, false
+	}
+	if err != nil {
+		logger.Errorf("Unable to find the kubernetes service account of %s: %v", ip, err)
+		return nil, true
+	}
+	ksa := p.namespace + "/" + p.serviceAccount
+	gsa, ok := s.cfg.KubernetesServiceAccounts[ksa]
+	if !ok {
+		gsa = p.gsa
+	}
+	if gsa == "" {
+		logger.Debugf("Kubernetes service account %s is not mapped to a service account", ksa)
+		return nil, true
+	}
+	a, ok := s.accountByEmail(gsa)
+	if !ok {
+		logger.Errorf("Kubernetes service account %s is mapped to %s which is not configured", ksa, gsa)
+		return nil, true
+	}
+	logger.Debugf("Serving %s to %s (%s)", gsa, ip, ksa)
+	return a, true
+}
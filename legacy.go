@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Settings of Config.LegacyEndpoints.  By default the legacy endpoints are
+// not found, like on VMs created since they were turned down.
+const (
+	// LegacyServe serves /computeMetadata/v1beta1/ like v1 but without
+	// requiring the Metadata-Flavor header, and the /0.1/ token endpoint.
+	LegacyServe = "serve"
+	// LegacyDeny returns 403 like on VMs with disable-legacy-endpoints.
+	LegacyDeny = "deny"
+)
+
+const (
+	legacyPrefix     = "/computeMetadata/v1beta1/"
+	legacy01Prefix   = "/0.1/"
+	legacyDisabled   = "Legacy metadata endpoints are disabled. Please use the /v1/ endpoint."
+	legacyTokenRoute = "/0.1/meta-data/service-accounts/{acct}/acquire"
+)
+
+func validLegacyEndpoints(v string) error {
+	switch v {
+	case "", LegacyServe, LegacyDeny:
+		return nil
+	}
+	return fmt.Errorf("unknown legacy endpoints setting %q (%s or %s)", v, LegacyServe, LegacyDeny)
+}
+
+// routeLegacy registers the legacy endpoints if they are enabled.  v1beta1
+// requests are served by the handlers of the v1 routes of r, which were
+// already checked by legacyHeaders.
+func (s *Server) routeLegacy(r *mux.Router) {
+	switch s.cfg.LegacyEndpoints {
+	case LegacyServe:
+		r.Handle(legacyTokenRoute, s.legacyHeaders(http.HandlerFunc(s.legacyTokenHandler))).Methods("GET")
+		r.PathPrefix(legacyPrefix).Handler(s.legacyHeaders(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			v1 := req.Clone(req.Context())
+			v1.URL.Path = "/computeMetadata/v1/" + strings.TrimPrefix(req.URL.Path, legacyPrefix)
+			v1.URL.RawPath = ""
+			var match mux.RouteMatch
+			if !r.Match(v1, &match) {
+				s.notFound(w, req)
+				return
+			}
+			h := match.Handler
+			if c, ok := h.(checkedHandler); ok {
+				h = c.next
+			}
+			h.ServeHTTP(w, mux.SetURLVars(v1, match.Vars))
+		}))).Methods("GET")
+	case LegacyDeny:
+		denied := s.legacyHeaders(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.writeError(w, req, http.StatusForbidden, legacyDisabled)
+		}))
+		r.PathPrefix(legacyPrefix).Handler(denied).Methods("GET")
+		r.PathPrefix(legacy01Prefix).Handler(denied).Methods("GET")
+	}
+}
+
+// legacyHeaders checks requests like checkMetadataHeaders except that the
+// legacy endpoints never required the Metadata-Flavor header.
+func (s *Server) legacyHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") == "" {
+			r = r.Clone(r.Context())
+			r.Header.Set("Metadata-Flavor", "Google")
+		}
+		s.checkMetadataHeaders(next).ServeHTTP(w, r)
+	})
+}
+
+// legacyToken is the access token response of the 0.1 endpoint.
+type legacyToken struct {
+	AccessToken string `json:"accessToken"`
+	ExpiresAt   int64  `json:"expiresAt"`
+}
+
+// legacyTokenHandler serves the 0.1 acquire endpoint, which takes the scopes
+// as a query parameter and returns when the token expires rather than its
+// lifetime.
+func (s *Server) legacyTokenHandler(w http.ResponseWriter, r *http.Request) {
+	acct := mux.Vars(r)["acct"]
+	s.requestLogger(r).Infof("/0.1/meta-data/service-accounts/%v/acquire called", acct)
+
+	if _, ok := lookupPath(s.metadataTree(r), []string{"instance", "service-accounts", acct}); !ok {
+		s.notFound(w, r)
+		return
+	}
+	scopes := requestedScopes(r)
+	if err := s.scopes.check(scopes); err != nil {
+		s.writeError(w, r, http.StatusForbidden, err.Error())
+		return
+	}
+	a := s.account(r, acct)
+	tok, err := s.getAccessToken(r.Context(), a, scopes)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	s.auditToken(r, a, scopes, "")
+	js, err := json.Marshal(legacyToken{
+		AccessToken: tok.AccessToken,
+		ExpiresAt:   time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second).Unix(),
+	})
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLegacyServe(t *testing.T) {
+	s := newTestServer(t, Config{LegacyEndpoints: LegacyServe})
+	// v1beta1 never required the Metadata-Flavor header
+	resp, body := get(t, s, "/computeMetadata/v1beta1/project/project-id", "metadata", "")
+	if resp.StatusCode != http.StatusOK || body != "project" {
+		t.Fatalf("GET v1beta1 = %d %q, want 200 project", resp.StatusCode, body)
+	}
+	// the checks of the v1 route must not run again
+	for _, h := range []string{"Metadata-Flavor", "Server", "X-Xss-Protection", "X-Frame-Options"} {
+		if v := resp.Header.Values(h); len(v) != 1 {
+			t.Errorf("%s = %q, want one value", h, v)
+		}
+	}
+
+	resp, _ = get(t, s, "/computeMetadata/v1beta1/instance/service-accounts/default/token", "metadata", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET v1beta1 token = %d, want 200", resp.StatusCode)
+	}
+	resp, _ = get(t, s, "/computeMetadata/v1beta1/no/such/path", "metadata", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET v1beta1 unknown path = %d, want 404", resp.StatusCode)
+	}
+	resp, _ = get(t, s, "/computeMetadata/v1beta1/project/project-id", "evil.example.com", "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET v1beta1 with another Host = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestLegacyDefault(t *testing.T) {
+	for _, tc := range []struct {
+		setting string
+		want    int
+	}{
+		{"", http.StatusNotFound},
+		{LegacyDeny, http.StatusForbidden},
+	} {
+		s := newTestServer(t, Config{LegacyEndpoints: tc.setting})
+		resp, _ := get(t, s, "/computeMetadata/v1beta1/project/project-id", "metadata", "Google")
+		if resp.StatusCode != tc.want {
+			t.Errorf("LegacyEndpoints %q: GET v1beta1 = %d, want %d", tc.setting, resp.StatusCode, tc.want)
+		}
+	}
+}
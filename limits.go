@@ -0,0 +1,108 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMaxHeaderBytes      = 64 << 10
+	defaultMaxRequestBodyBytes = 1 << 20
+	defaultRequestReadTimeout  = 10 * time.Second
+)
+
+// connKey is the request context key of the request's net.Conn.
+type connKey struct{}
+
+// withConn records the connection in the request context so the body can
+// be read with a deadline.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+func (s *Server) maxHeaderBytes() int {
+	if s.cfg.MaxHeaderBytes > 0 {
+		return s.cfg.MaxHeaderBytes
+	}
+	return defaultMaxHeaderBytes
+}
+
+func (s *Server) maxRequestBodyBytes() int64 {
+	if s.cfg.MaxRequestBodyBytes > 0 {
+		return s.cfg.MaxRequestBodyBytes
+	}
+	return defaultMaxRequestBodyBytes
+}
+
+func (s *Server) requestReadTimeout() time.Duration {
+	if s.cfg.RequestReadTimeout > 0 {
+		return s.cfg.RequestReadTimeout
+	}
+	return defaultRequestReadTimeout
+}
+
+// limitRequests reads request bodies up front, answering 413 if they are
+// larger than MaxRequestBodyBytes and 408 if they aren't sent within
+// RequestReadTimeout, before passing them on to next.  Oversized and slow
+// headers are dealt with by the http.Server itself.  fail writes the error.
+func (s *Server) limitRequests(next http.Handler, fail func(w http.ResponseWriter, r *http.Request, code int, detail string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		max := s.maxRequestBodyBytes()
+		if r.ContentLength > max {
+			s.requestLogger(r).Debugf("Rejecting a %d byte request body", r.ContentLength)
+			w.Header().Set("Connection", "close")
+			fail(w, r, http.StatusRequestEntityTooLarge, "")
+			return
+		}
+		// an HTTP/2 stream's body can't be timed out without the others
+		c, ok := r.Context().Value(connKey{}).(net.Conn)
+		if ok && r.ProtoMajor == 1 {
+			c.SetReadDeadline(time.Now().Add(s.requestReadTimeout()))
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+		if ok && r.ProtoMajor == 1 {
+			c.SetReadDeadline(time.Time{})
+		}
+		switch {
+		case err != nil:
+			w.Header().Set("Connection", "close")
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				s.requestLogger(r).Debugf("Timed out reading the request body of %s", r.URL.Path)
+				fail(w, r, http.StatusRequestTimeout, "")
+				return
+			}
+			fail(w, r, http.StatusBadRequest, "")
+			return
+		case int64(len(body)) > max:
+			s.requestLogger(r).Debugf("Rejecting a request body over %d bytes", max)
+			w.Header().Set("Connection", "close")
+			fail(w, r, http.StatusRequestEntityTooLarge, "")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
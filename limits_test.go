@@ -0,0 +1,114 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// do sends a metadata request with a body to s.
+func do(t *testing.T, s *Server, req *http.Request) int {
+	t.Helper()
+	req.Host = "metadata"
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	s := newTestServer(t, Config{MaxHeaderBytes: 1024})
+	url := "http://" + s.Addr().String() + "/computeMetadata/v1/instance/id"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the http.Server allows 4KiB on top of MaxHeaderBytes
+	req.Header.Set("X-Padding", strings.Repeat("x", 8<<10))
+	if got := do(t, s, req); got != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status with large headers = %d, want 431", got)
+	}
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	s := newTestServer(t, Config{MaxRequestBodyBytes: 1024})
+	url := "http://" + s.Addr().String() + "/computeMetadata/v1/instance/id"
+	for _, tc := range []struct {
+		name string
+		body io.Reader
+		want int
+	}{
+		{"small", strings.NewReader("{}"), http.StatusOK},
+		{"content length", strings.NewReader(strings.Repeat("x", 2048)), http.StatusRequestEntityTooLarge},
+		// without a Content-Length the body is sent chunked
+		{"chunked", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 2048))), http.StatusRequestEntityTooLarge},
+	} {
+		req, err := http.NewRequest("GET", url, tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := do(t, s, req); got != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRequestReadTimeout(t *testing.T) {
+	s := newTestServer(t, Config{RequestReadTimeout: 200 * time.Millisecond})
+
+	// a body that never arrives gets 408
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET /computeMetadata/v1/instance/id HTTP/1.1\r\nHost: metadata\r\nMetadata-Flavor: Google\r\nContent-Length: 10\r\n\r\n{}")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("status with a slow body = %d, want 408", resp.StatusCode)
+	}
+
+	// nor do headers, which closes the connection
+	c, err = net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET /computeMetadata/v1/instance/id HTTP/1.1\r\nHost: metadata\r\n")
+	start := time.Now()
+	if _, err := ioutil.ReadAll(c); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= 5*time.Second {
+		t.Errorf("connection with slow headers was kept open for %v", d)
+	}
+}
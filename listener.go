@@ -0,0 +1,195 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	unixPrefix  = "unix:"
+	npipePrefix = "npipe:"
+)
+
+// listen creates the listener for Config.Listen, which is either a tcp address
+// (eg ":8080"), a unix socket path prefixed with "unix:" or a windows named
+// pipe prefixed with "npipe:".  Config.Port is used if Listen isn't set.  A
+// socket passed by systemd socket activation takes precedence over both.
+func (s *Server) listen() (net.Listener, error) {
+	l, err := systemdListener()
+	if err != nil {
+		return nil, fmt.Errorf("unable to use systemd socket: %v", err)
+	}
+	if l != nil {
+		logger.Infof("Using socket %v passed by systemd", l.Addr())
+		return l, nil
+	}
+
+	addr := s.cfg.Listen
+	if addr == "" {
+		addr = s.cfg.Port
+	}
+	if strings.HasPrefix(addr, npipePrefix) {
+		return listenPipe(strings.TrimPrefix(addr, npipePrefix))
+	}
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", strings.TrimPrefix(addr, "tcp:"))
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	// remove a socket left behind by a previous run that didn't shut down cleanly
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket %s: %v", path, err)
+		}
+	}
+	return s.listenUnix(path)
+}
+
+// listenUnix creates the socket in a new 0700 directory next to path, so no
+// one else can connect before SocketMode and SocketGroup are applied, and
+// then moves it to path.
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".mds")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create socket directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+	// the socket moves, so the listener removes it from path itself
+	ul.SetUnlinkOnClose(false)
+	fail := func(err error) (net.Listener, error) {
+		l.Close()
+		return nil, err
+	}
+
+	if s.cfg.SocketMode != 0 {
+		if err := os.Chmod(tmp, s.cfg.SocketMode); err != nil {
+			return fail(fmt.Errorf("unable to set socket mode: %v", err))
+		}
+	}
+	if s.cfg.SocketGroup != "" {
+		gid, err := lookupGroup(s.cfg.SocketGroup)
+		if err != nil {
+			return fail(err)
+		}
+		if err := os.Chown(tmp, -1, gid); err != nil {
+			return fail(fmt.Errorf("unable to set socket group: %v", err))
+		}
+	}
+	// unlike a rename, a link fails rather than replace an existing file
+	if err := os.Link(tmp, path); err != nil {
+		return fail(fmt.Errorf("unable to move socket to %s: %v", path, err))
+	}
+	return &unixListener{UnixListener: ul, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// unixListener is a unix socket listener moved to addr, whose socket file is
+// removed when it is closed on Shutdown.
+type unixListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+	once sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() { os.Remove(l.addr.Name) })
+	return err
+}
+
+// Dial connects to a metadata server listening on addr, which takes the same
+// forms as Config.Listen.
+func Dial(addr string) (net.Conn, error) {
+	switch {
+	case strings.HasPrefix(addr, npipePrefix):
+		return dialPipe(strings.TrimPrefix(addr, npipePrefix))
+	case strings.HasPrefix(addr, unixPrefix):
+		return net.Dial("unix", strings.TrimPrefix(addr, unixPrefix))
+	}
+	return net.Dial("tcp", strings.TrimPrefix(addr, "tcp:"))
+}
+
+// tlsConfig returns the server's TLS configuration, or nil if TLS isn't
+// enabled.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	return loadTLSConfig("TLS", s.cfg.TLSCertFile, s.cfg.TLSKeyFile, s.cfg.TLSClientCAFile)
+}
+
+// loadTLSConfig returns a server TLS configuration which requires client
+// certificates if clientCAFile is set, or nil if certFile and keyFile aren't
+// set.  Errors name the Config fields with the prefix.
+func loadTLSConfig(prefix, certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("%[1]sClientCAFile requires %[1]sCertFile and %[1]sKeyFile", prefix)
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both %[1]sCertFile and %[1]sKeyFile must be set", prefix)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %v", err)
+	}
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA file: %v", err)
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", clientCAFile)
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// lookupGroup resolves a group name or numeric gid.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("unable to find group %s: %v", group, err)
+	}
+	return strconv.Atoi(g.Gid)
+}
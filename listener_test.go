@@ -0,0 +1,67 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket modes")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mds.sock")
+	s := &Server{cfg: Config{Listen: unixPrefix + path, SocketMode: 0660}}
+	l, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Addr().String() != path {
+		t.Errorf("Addr = %s, want %s", l.Addr(), path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode = %v, want a 0660 socket", fi.Mode())
+	}
+	c, err := Dial(unixPrefix + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("the socket directory wasn't removed: %d entries", len(entries))
+	}
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on Close: %v", err)
+	}
+
+	// a file that isn't a socket isn't replaced
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := s.listen(); err == nil {
+		l.Close()
+		t.Error("listen replaced a regular file")
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logger is the server's log.  It is replaced with SetLogger.
+var logger = defaultLogger()
+
+// NewLogger returns a logger writing to stderr in the format, json or text,
+// from the level on: debug, info, warn or error.
+func NewLogger(format, level string) (*zap.Logger, error) {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q (debug, info, warn or error)", level)
+	}
+	ec := zap.NewProductionEncoderConfig()
+	ec.TimeKey = "time"
+	ec.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	var enc zapcore.Encoder
+	switch format {
+	case "json":
+		enc = zapcore.NewJSONEncoder(ec)
+	case "text":
+		ec.EncodeLevel = zapcore.CapitalLevelEncoder
+		enc = zapcore.NewConsoleEncoder(ec)
+	default:
+		return nil, fmt.Errorf("invalid log format %q (json or text)", format)
+	}
+	core := zapcore.NewCore(enc, zapcore.Lock(os.Stderr), lvl)
+	return zap.New(core, zap.AddCaller()), nil
+}
+
+func defaultLogger() *zap.SugaredLogger {
+	l, _ := NewLogger("json", "info")
+	return redactLogger(l)
+}
+
+// SetLogger replaces the log of the servers, eg with one from NewLogger or
+// a test's logger.  Credentials in the messages and fields, such as access
+// and ID tokens, are redacted.
+func SetLogger(l *zap.Logger) {
+	logger = redactLogger(l)
+}
+
+func redactLogger(l *zap.Logger) *zap.SugaredLogger {
+	return l.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return redactCore{c}
+	})).Sugar()
+}
+
+// secretPattern matches OAuth2 access tokens, JWTs (ID tokens, self-signed
+// access tokens and assertions) and bearer credentials.
+var secretPattern = regexp.MustCompile(`ya29\.[\w-]+|eyJ[\w-]*\.[\w-]*\.[\w-]*|(?i:bearer)\s+[\w.~+/-]+=*`)
+
+const redacted = "REDACTED"
+
+func redact(s string) string {
+	return secretPattern.ReplaceAllString(s, redacted)
+}
+
+// redactCore scrubs credentials from the messages and fields of a Core.
+type redactCore struct {
+	zapcore.Core
+}
+
+func (c redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactCore{c.Core.With(redactFields(fields))}
+}
+
+func (c redactCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c redactCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	e.Message = redact(e.Message)
+	return c.Core.Write(e, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case zapcore.StringType:
+			f.String = redact(f.String)
+		case zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok {
+				f = zap.String(f.Key, redact(err.Error()))
+			}
+		case zapcore.StringerType:
+			f = zap.String(f.Key, redact(fmt.Sprint(f.Interface)))
+		case zapcore.ReflectType:
+			if b, err := json.Marshal(f.Interface); err == nil {
+				f = zap.Reflect(f.Key, json.RawMessage(redact(string(b))))
+			} else {
+				f = zap.String(f.Key, redact(fmt.Sprint(f.Interface)))
+			}
+		}
+		out[i] = f
+	}
+	return out
+}
+
+// sensitiveHeaders are not logged.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// logHeaders renders request headers for the log without credentials.
+func logHeaders(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, v := range h {
+		if sensitiveHeaders[k] {
+			m[k] = redacted
+			continue
+		}
+		m[k] = strings.Join(v, ", ")
+	}
+	return m
+}
+
+// levelOff silences a path entirely.
+const levelOff = zapcore.FatalLevel + 1
+
+// pathLogLevel is the log level of the requests for a path, which ends with
+// * to match a prefix.
+type pathLogLevel struct {
+	path  string
+	level zapcore.Level
+}
+
+// parsePathLogLevels parses PathLogLevels.
+func parsePathLogLevels(m map[string]string) ([]pathLogLevel, error) {
+	var levels []pathLogLevel
+	for path, level := range m {
+		var lvl zapcore.Level
+		if level == "off" {
+			lvl = levelOff
+		} else if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q for %s (debug, info, warn, error or off)", level, path)
+		}
+		levels = append(levels, pathLogLevel{path: faultPath(path), level: lvl})
+	}
+	return levels, nil
+}
+
+// requestLogger returns the log for a request: the server's log at the
+// level of the longest PathLogLevels path matching the request, if any.
+func (s *Server) requestLogger(r *http.Request) *zap.SugaredLogger {
+	var match *pathLogLevel
+	for i, p := range s.pathLogLevels {
+		if pathMatches(p.path, r.URL.Path) && (match == nil || len(p.path) > len(match.path)) {
+			match = &s.pathLogLevels[i]
+		}
+	}
+	if match == nil {
+		return logger
+	}
+	return logger.Desugar().WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return levelCore{c, match.level}
+	})).Sugar()
+}
+
+// levelCore logs from its own level on, which may be below the level of the
+// Core it wraps.
+type levelCore struct {
+	zapcore.Core
+	level zapcore.Level
+}
+
+func (c levelCore) Enabled(l zapcore.Level) bool {
+	return c.level.Enabled(l)
+}
+
+func (c levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return levelCore{c.Core.With(fields), c.level}
+}
+
+func (c levelCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		// the wrapped Core's Check would apply its own level
+		return ce.AddCore(e, c.Core)
+	}
+	return ce
+}
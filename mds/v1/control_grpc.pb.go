@@ -0,0 +1,552 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package mdspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ControlClient is the client API for Control service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlClient interface {
+	// GetMetadata returns the metadata at a path, or all of it.
+	GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*GetMetadataResponse, error)
+	// SetValue sets the value at a metadata path like instance/attributes/foo.
+	SetValue(ctx context.Context, in *SetValueRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// SetMaintenanceEvent sets the maintenance event, or toggles it if the
+	// event is empty.
+	SetMaintenanceEvent(ctx context.Context, in *MaintenanceEventRequest, opts ...grpc.CallOption) (*MaintenanceEventResponse, error)
+	// Preempt preempts the instance.
+	Preempt(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// InvalidateTokens drops the cached tokens of all accounts.
+	InvalidateTokens(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Reload reloads the config files.
+	Reload(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// SwitchServiceAccount serves another default service account.
+	SwitchServiceAccount(ctx context.Context, in *SwitchServiceAccountRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// RestoreServiceAccount serves the configured default service account again.
+	RestoreServiceAccount(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// InjectFault fails the requests for a path.
+	InjectFault(ctx context.Context, in *FaultRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// ClearFaults removes the fault for a path, or all faults.
+	ClearFaults(ctx context.Context, in *ClearFaultsRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// ListFaults returns the faults in effect.
+	ListFaults(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListFaultsResponse, error)
+	// Watch streams the changes made to the emulator.
+	Watch(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (Control_WatchClient, error)
+}
+
+type controlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlClient(cc grpc.ClientConnInterface) ControlClient {
+	return &controlClient{cc}
+}
+
+func (c *controlClient) GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*GetMetadataResponse, error) {
+	out := new(GetMetadataResponse)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/GetMetadata", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) SetValue(ctx context.Context, in *SetValueRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/SetValue", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) SetMaintenanceEvent(ctx context.Context, in *MaintenanceEventRequest, opts ...grpc.CallOption) (*MaintenanceEventResponse, error) {
+	out := new(MaintenanceEventResponse)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/SetMaintenanceEvent", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) Preempt(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/Preempt", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) InvalidateTokens(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/InvalidateTokens", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) Reload(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/Reload", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) SwitchServiceAccount(ctx context.Context, in *SwitchServiceAccountRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/SwitchServiceAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) RestoreServiceAccount(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/RestoreServiceAccount", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) InjectFault(ctx context.Context, in *FaultRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/InjectFault", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) ClearFaults(ctx context.Context, in *ClearFaultsRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/ClearFaults", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) ListFaults(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ListFaultsResponse, error) {
+	out := new(ListFaultsResponse)
+	err := c.cc.Invoke(ctx, "/mds.v1.Control/ListFaults", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) Watch(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (Control_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Control_ServiceDesc.Streams[0], "/mds.v1.Control/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controlWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Control_WatchClient interface {
+	Recv() (*ChangeEvent, error)
+	grpc.ClientStream
+}
+
+type controlWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *controlWatchClient) Recv() (*ChangeEvent, error) {
+	m := new(ChangeEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ControlServer is the server API for Control service.
+// All implementations must embed UnimplementedControlServer
+// for forward compatibility
+type ControlServer interface {
+	// GetMetadata returns the metadata at a path, or all of it.
+	GetMetadata(context.Context, *GetMetadataRequest) (*GetMetadataResponse, error)
+	// SetValue sets the value at a metadata path like instance/attributes/foo.
+	SetValue(context.Context, *SetValueRequest) (*emptypb.Empty, error)
+	// SetMaintenanceEvent sets the maintenance event, or toggles it if the
+	// event is empty.
+	SetMaintenanceEvent(context.Context, *MaintenanceEventRequest) (*MaintenanceEventResponse, error)
+	// Preempt preempts the instance.
+	Preempt(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	// InvalidateTokens drops the cached tokens of all accounts.
+	InvalidateTokens(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	// Reload reloads the config files.
+	Reload(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	// SwitchServiceAccount serves another default service account.
+	SwitchServiceAccount(context.Context, *SwitchServiceAccountRequest) (*emptypb.Empty, error)
+	// RestoreServiceAccount serves the configured default service account again.
+	RestoreServiceAccount(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	// InjectFault fails the requests for a path.
+	InjectFault(context.Context, *FaultRequest) (*emptypb.Empty, error)
+	// ClearFaults removes the fault for a path, or all faults.
+	ClearFaults(context.Context, *ClearFaultsRequest) (*emptypb.Empty, error)
+	// ListFaults returns the faults in effect.
+	ListFaults(context.Context, *emptypb.Empty) (*ListFaultsResponse, error)
+	// Watch streams the changes made to the emulator.
+	Watch(*emptypb.Empty, Control_WatchServer) error
+	mustEmbedUnimplementedControlServer()
+}
+
+// UnimplementedControlServer must be embedded to have forward compatible implementations.
+type UnimplementedControlServer struct {
+}
+
+func (UnimplementedControlServer) GetMetadata(context.Context, *GetMetadataRequest) (*GetMetadataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMetadata not implemented")
+}
+func (UnimplementedControlServer) SetValue(context.Context, *SetValueRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetValue not implemented")
+}
+func (UnimplementedControlServer) SetMaintenanceEvent(context.Context, *MaintenanceEventRequest) (*MaintenanceEventResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetMaintenanceEvent not implemented")
+}
+func (UnimplementedControlServer) Preempt(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Preempt not implemented")
+}
+func (UnimplementedControlServer) InvalidateTokens(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InvalidateTokens not implemented")
+}
+func (UnimplementedControlServer) Reload(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reload not implemented")
+}
+func (UnimplementedControlServer) SwitchServiceAccount(context.Context, *SwitchServiceAccountRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SwitchServiceAccount not implemented")
+}
+func (UnimplementedControlServer) RestoreServiceAccount(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreServiceAccount not implemented")
+}
+func (UnimplementedControlServer) InjectFault(context.Context, *FaultRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InjectFault not implemented")
+}
+func (UnimplementedControlServer) ClearFaults(context.Context, *ClearFaultsRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClearFaults not implemented")
+}
+func (UnimplementedControlServer) ListFaults(context.Context, *emptypb.Empty) (*ListFaultsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFaults not implemented")
+}
+func (UnimplementedControlServer) Watch(*emptypb.Empty, Control_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedControlServer) mustEmbedUnimplementedControlServer() {}
+
+// UnsafeControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlServer will
+// result in compilation errors.
+type UnsafeControlServer interface {
+	mustEmbedUnimplementedControlServer()
+}
+
+func RegisterControlServer(s grpc.ServiceRegistrar, srv ControlServer) {
+	s.RegisterService(&Control_ServiceDesc, srv)
+}
+
+func _Control_GetMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).GetMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/GetMetadata",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).GetMetadata(ctx, req.(*GetMetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_SetValue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetValueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).SetValue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/SetValue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).SetValue(ctx, req.(*SetValueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_SetMaintenanceEvent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MaintenanceEventRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).SetMaintenanceEvent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/SetMaintenanceEvent",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).SetMaintenanceEvent(ctx, req.(*MaintenanceEventRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_Preempt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).Preempt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/Preempt",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).Preempt(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_InvalidateTokens_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).InvalidateTokens(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/InvalidateTokens",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).InvalidateTokens(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_Reload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).Reload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/Reload",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).Reload(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_SwitchServiceAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SwitchServiceAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).SwitchServiceAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/SwitchServiceAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).SwitchServiceAccount(ctx, req.(*SwitchServiceAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_RestoreServiceAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).RestoreServiceAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/RestoreServiceAccount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).RestoreServiceAccount(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_InjectFault_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FaultRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).InjectFault(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/InjectFault",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).InjectFault(ctx, req.(*FaultRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_ClearFaults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClearFaultsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).ClearFaults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/ClearFaults",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).ClearFaults(ctx, req.(*ClearFaultsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_ListFaults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).ListFaults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mds.v1.Control/ListFaults",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).ListFaults(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(emptypb.Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlServer).Watch(m, &controlWatchServer{stream})
+}
+
+type Control_WatchServer interface {
+	Send(*ChangeEvent) error
+	grpc.ServerStream
+}
+
+type controlWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *controlWatchServer) Send(m *ChangeEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Control_ServiceDesc is the grpc.ServiceDesc for Control service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Control_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mds.v1.Control",
+	HandlerType: (*ControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetMetadata",
+			Handler:    _Control_GetMetadata_Handler,
+		},
+		{
+			MethodName: "SetValue",
+			Handler:    _Control_SetValue_Handler,
+		},
+		{
+			MethodName: "SetMaintenanceEvent",
+			Handler:    _Control_SetMaintenanceEvent_Handler,
+		},
+		{
+			MethodName: "Preempt",
+			Handler:    _Control_Preempt_Handler,
+		},
+		{
+			MethodName: "InvalidateTokens",
+			Handler:    _Control_InvalidateTokens_Handler,
+		},
+		{
+			MethodName: "Reload",
+			Handler:    _Control_Reload_Handler,
+		},
+		{
+			MethodName: "SwitchServiceAccount",
+			Handler:    _Control_SwitchServiceAccount_Handler,
+		},
+		{
+			MethodName: "RestoreServiceAccount",
+			Handler:    _Control_RestoreServiceAccount_Handler,
+		},
+		{
+			MethodName: "InjectFault",
+			Handler:    _Control_InjectFault_Handler,
+		},
+		{
+			MethodName: "ClearFaults",
+			Handler:    _Control_ClearFaults_Handler,
+		},
+		{
+			MethodName: "ListFaults",
+			Handler:    _Control_ListFaults_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Control_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "mds/v1/control.proto",
+}
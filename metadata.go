@@ -0,0 +1,207 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Metadata describes the instance and project metadata served by the emulator.
+// The field names follow the output of the real metadata server for
+// /computeMetadata/v1/?recursive=true so a dump taken on a VM can be used as a
+// config file with minimal edits.
+type Metadata struct {
+	Instance InstanceMetadata `json:"instance"`
+	Project  ProjectMetadata  `json:"project"`
+
+	// Extra holds any other values in the same nested form, eg
+	// {"instance": {"foo": {"bar": "baz"}}} is served at /instance/foo/bar.
+	// Keys may be camelCase like the typed fields or kebab-case like the
+	// paths they are served at ({"instance": {"my-key": ...}} and
+	// {"instance": {"myKey": ...}} are both served at /instance/my-key).
+	// Typed fields above take precedence over Extra.
+	Extra map[string]interface{} `json:"-"`
+}
+
+// InstanceMetadata is served under /computeMetadata/v1/instance/
+type InstanceMetadata struct {
+	ID                json.Number                       `json:"id,omitempty"`
+	Name              string                            `json:"name,omitempty"`
+	Hostname          string                            `json:"hostname,omitempty"`
+	Zone              string                            `json:"zone,omitempty"`
+	MachineType       string                            `json:"machineType,omitempty"`
+	CPUPlatform       string                            `json:"cpuPlatform,omitempty"`
+	Image             string                            `json:"image,omitempty"`
+	Tags              []string                          `json:"tags,omitempty"`
+	Licenses          []License                         `json:"licenses,omitempty"`
+	Disks             []Disk                            `json:"disks,omitempty"`
+	Attributes        map[string]string                 `json:"attributes,omitempty"`
+	ServiceAccounts   map[string]ServiceAccountMetadata `json:"serviceAccounts,omitempty"`
+	NetworkInterfaces []NetworkInterface                `json:"networkInterfaces,omitempty"`
+}
+
+// ServiceAccountMetadata is served under /computeMetadata/v1/instance/service-accounts/{acct}/
+type ServiceAccountMetadata struct {
+	Aliases []string `json:"aliases,omitempty"`
+	Email   string   `json:"email,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+}
+
+// License is served under /computeMetadata/v1/instance/licenses/{n}/
+type License struct {
+	ID string `json:"id"`
+}
+
+// Disk is served under /computeMetadata/v1/instance/disks/{n}/.  Unset fields
+// default to a persistent-disk-{n} READ_WRITE PERSISTENT SCSI disk at index n.
+type Disk struct {
+	DeviceName string      `json:"deviceName,omitempty"`
+	Index      json.Number `json:"index,omitempty"`
+	Interface  string      `json:"interface,omitempty"`
+	Mode       string      `json:"mode,omitempty"`
+	Type       string      `json:"type,omitempty"`
+}
+
+// NetworkInterface is served under /computeMetadata/v1/instance/network-interfaces/{n}/.
+// Unset fields get GCE's defaults: the default network, a /20 subnet whose
+// first address is the gateway, the metadata server as DNS server, an MTU of
+// 1460 and a 42:01 MAC address derived from the IP.
+type NetworkInterface struct {
+	IP         string      `json:"ip,omitempty"`
+	Mac        string      `json:"mac,omitempty"`
+	Network    string      `json:"network,omitempty"`
+	Subnetmask string      `json:"subnetmask,omitempty"`
+	Gateway    string      `json:"gateway,omitempty"`
+	DNSServers []string    `json:"dnsServers,omitempty"`
+	MTU        json.Number `json:"mtu,omitempty"`
+	// AccessConfigs are served under access-configs/{n}/; the type
+	// defaults to ONE_TO_ONE_NAT.
+	AccessConfigs []AccessConfig `json:"accessConfigs,omitempty"`
+	// ForwardedIPs are the load balancer IPs forwarded to the interface,
+	// served under forwarded-ips/{n}.
+	ForwardedIPs []string `json:"forwardedIps,omitempty"`
+	// IPAliases are the alias IP ranges of the interface, served under
+	// ip-aliases/{n}.
+	IPAliases []string `json:"ipAliases,omitempty"`
+}
+
+// AccessConfig is an external IP of a network interface.
+type AccessConfig struct {
+	ExternalIP string `json:"externalIp,omitempty"`
+	Type       string `json:"type,omitempty"`
+}
+
+// ProjectMetadata is served under /computeMetadata/v1/project/
+type ProjectMetadata struct {
+	ProjectID        string            `json:"projectId,omitempty"`
+	NumericProjectID json.Number       `json:"numericProjectId,omitempty"`
+	Attributes       map[string]string `json:"attributes,omitempty"`
+}
+
+// LoadMetadataFile reads a Metadata document from a JSON or YAML file.  YAML is
+// selected by a .yaml or .yml extension.
+func LoadMetadataFile(path string) (*Metadata, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file %s: %v", path, err)
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse config file %s: %v", path, err)
+		}
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %v", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&m.Extra); err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// yamlToJSON converts a YAML document to JSON so only the json struct tags
+// need to be maintained.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := normalizeYAML(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func normalizeYAML(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			ks, ok := k.(string)
+			if !ok {
+				ks = fmt.Sprintf("%v", k)
+			}
+			n, err := normalizeYAML(e)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = n
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range t {
+			n, err := normalizeYAML(e)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = n
+		}
+		return t, nil
+	}
+	return v, nil
+}
+
+// tree returns the metadata as nested maps keyed the same way as the
+// recursive json output.
+func (m *Metadata) tree() (map[string]interface{}, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var t map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&t); err != nil {
+		return nil, err
+	}
+	extra, err := camelKeys(m.Extra, "")
+	if err != nil {
+		return nil, err
+	}
+	return mergeTree(extra, t), nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package mds
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// iflaInfoKind is IFLA_INFO_KIND from linux/if_link.h; it isn't defined in
+// package syscall.
+const iflaInfoKind = 1
+
+// setupInterface creates a dummy interface holding the link-local metadata
+// address so clients that connect to 169.254.169.254 directly reach the
+// emulator.  This requires CAP_NET_ADMIN.  The returned func removes it.
+func setupInterface(name string, ip net.IP) (func() error, error) {
+	nl, err := newNetlink()
+	if err != nil {
+		return nil, err
+	}
+	defer nl.close()
+
+	// RTM_NEWLINK with IFLA_LINKINFO{IFLA_INFO_KIND=dummy}
+	kind := nlAttr(iflaInfoKind, append([]byte("dummy"), 0))
+	msg := ifInfomsg(0, 0, 0)
+	msg = append(msg, nlAttr(syscall.IFLA_IFNAME, append([]byte(name), 0))...)
+	msg = append(msg, nlAttr(syscall.IFLA_LINKINFO, kind)...)
+	if err := nl.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, msg); err != nil {
+		return nil, fmt.Errorf("unable to create interface %s: %v", name, err)
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	teardown := func() error {
+		nl, err := newNetlink()
+		if err != nil {
+			return err
+		}
+		defer nl.close()
+		if err := nl.request(syscall.RTM_DELLINK, 0, ifInfomsg(iface.Index, 0, 0)); err != nil {
+			return fmt.Errorf("unable to remove interface %s: %v", name, err)
+		}
+		return nil
+	}
+
+	// RTM_NEWADDR ip/32
+	ip4 := ip.To4()
+	addr := []byte{syscall.AF_INET, 32, 0, syscall.RT_SCOPE_LINK, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(addr[4:], uint32(iface.Index))
+	addr = append(addr, nlAttr(syscall.IFA_LOCAL, ip4)...)
+	addr = append(addr, nlAttr(syscall.IFA_ADDRESS, ip4)...)
+	if err := nl.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, addr); err != nil {
+		teardown()
+		return nil, fmt.Errorf("unable to add %s to interface %s: %v", ip, name, err)
+	}
+
+	// RTM_NEWLINK to bring the interface up
+	if err := nl.request(syscall.RTM_NEWLINK, 0, ifInfomsg(iface.Index, syscall.IFF_UP, syscall.IFF_UP)); err != nil {
+		teardown()
+		return nil, fmt.Errorf("unable to bring up interface %s: %v", name, err)
+	}
+	return teardown, nil
+}
+
+// netlink is a minimal NETLINK_ROUTE client.  Messages are encoded little
+// endian which matches the host byte order of the platforms we build for.
+type netlink struct {
+	fd  int
+	seq uint32
+}
+
+func newNetlink() (*netlink, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open netlink socket: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("unable to bind netlink socket: %v", err)
+	}
+	return &netlink{fd: fd}, nil
+}
+
+func (n *netlink) close() {
+	syscall.Close(n.fd)
+}
+
+// request sends a single message and waits for the kernel's ack.
+func (n *netlink) request(typ int, flags int, data []byte) error {
+	n.seq++
+	b := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(data))
+	binary.LittleEndian.PutUint32(b[0:], uint32(syscall.NLMSG_HDRLEN+len(data)))
+	binary.LittleEndian.PutUint16(b[4:], uint16(typ))
+	binary.LittleEndian.PutUint16(b[6:], uint16(syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags))
+	binary.LittleEndian.PutUint32(b[8:], n.seq)
+	b = append(b, data...)
+	if err := syscall.Sendto(n.fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	rb := make([]byte, syscall.Getpagesize())
+	for {
+		nr, _, err := syscall.Recvfrom(n.fd, rb, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rb[:nr])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != n.seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			errno := int32(binary.LittleEndian.Uint32(m.Data[0:4]))
+			if errno == 0 {
+				return nil
+			}
+			return syscall.Errno(-errno)
+		}
+	}
+}
+
+// ifInfomsg returns a struct ifinfomsg for AF_UNSPEC.
+func ifInfomsg(index int, flags, change uint32) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b[0] = syscall.AF_UNSPEC
+	binary.LittleEndian.PutUint32(b[4:], uint32(index))
+	binary.LittleEndian.PutUint32(b[8:], flags)
+	binary.LittleEndian.PutUint32(b[12:], change)
+	return b
+}
+
+// nlAttr encodes a route attribute padded to the netlink alignment.
+func nlAttr(typ int, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	b := make([]byte, rtaAlign(l))
+	binary.LittleEndian.PutUint16(b[0:], uint16(l))
+	binary.LittleEndian.PutUint16(b[2:], uint16(typ))
+	copy(b[syscall.SizeofRtAttr:], data)
+	return b
+}
+
+func rtaAlign(l int) int {
+	return (l + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// eventWebhookAttempts is how often an event is posted to a webhook
+	// which fails, doubling eventWebhookRetry in between.
+	eventWebhookAttempts = 3
+	eventWebhookRetry    = time.Second
+)
+
+// startEventWebhooks posts every ChangeEvent to each of the EventWebhooks,
+// in order, until the server is shut down.  Each webhook has its own watcher
+// so one that is down doesn't hold up the others.
+func (s *Server) startEventWebhooks() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.stop
+		cancel()
+	}()
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, u := range s.cfg.EventWebhooks {
+		go func(u string, events <-chan ChangeEvent) {
+			for ev := range events {
+				body, err := json.Marshal(ev)
+				if err != nil {
+					logger.Errorf("Unable to encode %s event: %v", ev.Kind, err)
+					continue
+				}
+				if err := postEvent(ctx, client, u, body); err != nil {
+					logger.Errorf("Unable to post %s event to %s: %v", ev.Kind, u, err)
+				}
+			}
+		}(u, s.Watch(ctx))
+	}
+	logger.Infof("Posting events to %d webhooks", len(s.cfg.EventWebhooks))
+}
+
+// postEvent posts an event, retrying on errors.
+func postEvent(ctx context.Context, client *http.Client, u string, body []byte) error {
+	retry := eventWebhookRetry
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = postEventOnce(ctx, client, u, body)
+		if err == nil || attempt == eventWebhookAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retry):
+		}
+		retry *= 2
+	}
+}
+
+func postEventOnce(ctx context.Context, client *http.Client, u string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"expvar"
+)
+
+// outboundMetrics reports the calls to Google's token endpoints in flight
+// and waiting for a slot, and how many had to wait.
+var outboundMetrics = expvar.NewMap("outbound_calls")
+
+// outboundLimiter bounds the concurrent token and impersonation calls to
+// Google, so a burst of client requests for different scopes, audiences or
+// accounts doesn't turn into as many simultaneous calls.  A nil
+// outboundLimiter doesn't limit anything.
+type outboundLimiter struct {
+	slots chan struct{}
+}
+
+// newOutboundLimiter returns a limiter of n concurrent calls, or nil if n
+// isn't positive.
+func newOutboundLimiter(n int) *outboundLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &outboundLimiter{slots: make(chan struct{}, n)}
+}
+
+// acquire waits for a free slot, or until ctx is done, and returns the
+// function releasing it.
+func (l *outboundLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		outboundMetrics.Add("waited", 1)
+		outboundMetrics.Add("waiting", 1)
+		select {
+		case l.slots <- struct{}{}:
+			outboundMetrics.Add("waiting", -1)
+		case <-ctx.Done():
+			outboundMetrics.Add("waiting", -1)
+			return nil, ctx.Err()
+		}
+	}
+	outboundMetrics.Add("in_flight", 1)
+	return func() {
+		outboundMetrics.Add("in_flight", -1)
+		<-l.slots
+	}, nil
+}
+
+// shareOutbound makes the server and its accounts use l, eg the limiter of
+// the server a tenant belongs to.
+func (s *Server) shareOutbound(l *outboundLimiter) {
+	s.outbound = l
+	s.primary.outbound = l
+	for _, a := range s.accounts {
+		a.outbound = l
+	}
+}
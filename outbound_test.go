@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+func TestOutboundLimiter(t *testing.T) {
+	if l := newOutboundLimiter(0); l != nil {
+		t.Errorf("newOutboundLimiter(0) = %v, want nil", l)
+	}
+	var unlimited *outboundLimiter
+	if _, err := unlimited.acquire(context.Background()); err != nil {
+		t.Errorf("acquire without a limit: %v", err)
+	}
+
+	l := newOutboundLimiter(2)
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("acquire over the limit = %v, want %v", err, context.DeadlineExceeded)
+	}
+	release()
+	if _, err := l.acquire(context.Background()); err != nil {
+		t.Errorf("acquire after a release: %v", err)
+	}
+}
+
+func TestMaxOutboundCalls(t *testing.T) {
+	s, err := NewMetadataServer(context.Background(), Config{
+		Credentials: &google.Credentials{
+			TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}),
+		},
+		ServiceAccountEmail: "test@project.iam.gserviceaccount.com",
+		ProjectID:           "project",
+		NumericProjectID:    "123456789",
+		Port:                "127.0.0.1:0",
+		MaxOutboundCalls:    1,
+	})
+	if err != nil {
+		t.Fatalf("NewMetadataServer: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Shutdown()
+
+	// take the only slot so the token request has to wait for it
+	release, err := s.outbound.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "http://"+s.Addr().String()+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "metadata"
+	req.Header.Set("Metadata-Flavor", "Google")
+	done := make(chan int)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	select {
+	case code := <-done:
+		t.Fatalf("token request answered %d without a free slot", code)
+	case <-time.After(200 * time.Millisecond):
+	}
+	release()
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Errorf("token request = %d, want 200", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("token request still waiting after the slot was released")
+	}
+}
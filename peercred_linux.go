@@ -0,0 +1,49 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package mds
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// peerCredentials returns the SO_PEERCRED credentials of a unix socket peer.
+func peerCredentials(c *net.UnixConn) (*peerCred, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var uerr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, uerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if uerr != nil {
+		return nil, uerr
+	}
+	return &peerCred{pid: ucred.Pid, uid: ucred.Uid, gid: ucred.Gid}, nil
+}
+
+// pidExecutable returns the path of the program a process runs.
+func pidExecutable(pid int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+}
@@ -0,0 +1,264 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// pluginProtocolVersion is bumped on incompatible changes to the plugin
+	// RPC interface.
+	pluginProtocolVersion = 1
+
+	// pluginTimeout bounds each call to a plugin.
+	pluginTimeout = 30 * time.Second
+)
+
+// Plugin is implemented by out-of-tree credential and metadata providers.  A
+// plugin is its own executable whose main calls ServePlugin; the server starts
+// it (Config.Plugins) and calls it over net/rpc on its stdin and stdout, so
+// plugins are added without rebuilding the server.
+type Plugin interface {
+	// Info describes what the plugin provides.  It is called once at
+	// startup.
+	Info() (*PluginInfo, error)
+	// Token returns an access or ID token for the default service account.
+	// It is only called if PluginInfo.Credentials is set.
+	Token(req *TokenRequest) (*TokenResponse, error)
+	// Attributes returns custom project attributes.  It is only called if
+	// PluginInfo.Attributes is set, at startup and on every Reload.
+	Attributes() (map[string]string, error)
+}
+
+// PluginInfo describes a plugin.
+type PluginInfo struct {
+	// Name is used in logs; it defaults to the executable's name
+	Name string
+	// Credentials is set if the plugin mints tokens
+	Credentials bool
+	// Attributes is set if the plugin provides attributes
+	Attributes bool
+	// ProtocolVersion is set by ServePlugin
+	ProtocolVersion int
+}
+
+// ServePlugin serves p to the metadata server that started the process.  It
+// returns once the server closes the connection, eg on Shutdown.  Anything
+// the plugin writes to os.Stdout goes to stderr instead since stdout carries
+// the RPC stream.
+func ServePlugin(p Plugin) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Plugin", &pluginServer{p: p}); err != nil {
+		return err
+	}
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	srv.ServeConn(&stdioConn{r: os.Stdin, w: out})
+	return nil
+}
+
+// pluginServer adapts a Plugin to net/rpc.  Arguments carry the protocol
+// version of the server since gob can't send empty structs.
+type pluginServer struct {
+	p Plugin
+}
+
+func (s *pluginServer) Info(version int, reply *PluginInfo) error {
+	if version != pluginProtocolVersion {
+		return fmt.Errorf("plugin protocol version %d is not supported (want %d)", version, pluginProtocolVersion)
+	}
+	info, err := s.p.Info()
+	if err != nil {
+		return err
+	}
+	*reply = *info
+	reply.ProtocolVersion = pluginProtocolVersion
+	return nil
+}
+
+func (s *pluginServer) Token(req *TokenRequest, reply *TokenResponse) error {
+	tok, err := s.p.Token(req)
+	if err != nil {
+		return err
+	}
+	*reply = *tok
+	return nil
+}
+
+func (s *pluginServer) Attributes(version int, reply *map[string]string) error {
+	attributes, err := s.p.Attributes()
+	if err != nil {
+		return err
+	}
+	*reply = attributes
+	return nil
+}
+
+// stdioConn joins a process's stdout and stdin (or the reverse) into one
+// connection.
+type stdioConn struct {
+	r io.ReadCloser
+	w io.WriteCloser
+}
+
+func (c *stdioConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *stdioConn) Close() error {
+	werr := c.w.Close()
+	if err := c.r.Close(); err != nil {
+		return err
+	}
+	return werr
+}
+
+// pluginClient is a running plugin.
+type pluginClient struct {
+	info   PluginInfo
+	cmd    *exec.Cmd
+	client *rpc.Client
+	done   chan struct{}
+}
+
+// startPlugins starts each command and reads its PluginInfo.
+func startPlugins(commands [][]string) ([]*pluginClient, error) {
+	var plugins []*pluginClient
+	for _, command := range commands {
+		p, err := startPlugin(command)
+		if err != nil {
+			closePlugins(plugins)
+			return nil, err
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+func startPlugin(command []string) (*pluginClient, error) {
+	if len(command) == 0 {
+		return nil, errors.New("plugin command must not be empty")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start plugin %s: %v", command[0], err)
+	}
+	p := &pluginClient{
+		cmd:    cmd,
+		client: rpc.NewClient(&stdioConn{r: stdout, w: stdin}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		close(p.done)
+	}()
+	if err := p.call("Plugin.Info", pluginProtocolVersion, &p.info); err != nil {
+		p.close()
+		return nil, fmt.Errorf("unable to start plugin %s: %v", command[0], err)
+	}
+	if p.info.ProtocolVersion != pluginProtocolVersion {
+		p.close()
+		return nil, fmt.Errorf("plugin %s speaks protocol version %d, want %d", command[0], p.info.ProtocolVersion, pluginProtocolVersion)
+	}
+	if p.info.Name == "" {
+		p.info.Name = filepath.Base(command[0])
+	}
+	logger.Infof("Started plugin %s (credentials: %t, attributes: %t)", p.info.Name, p.info.Credentials, p.info.Attributes)
+	return p, nil
+}
+
+// call invokes a plugin method, giving up after pluginTimeout.
+func (p *pluginClient) call(method string, args interface{}, reply interface{}) error {
+	c := p.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		return c.Error
+	case <-time.After(pluginTimeout):
+		return fmt.Errorf("%s timed out", method)
+	}
+}
+
+func (p *pluginClient) fetchToken(req *TokenRequest) (*TokenResponse, error) {
+	out := &TokenResponse{}
+	if err := p.call("Plugin.Token", req, out); err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", p.info.Name, err)
+	}
+	if out.Token == "" {
+		return nil, fmt.Errorf("plugin %s did not return a token", p.info.Name)
+	}
+	return out, nil
+}
+
+func (p *pluginClient) attributes() (map[string]string, error) {
+	var attributes map[string]string
+	if err := p.call("Plugin.Attributes", pluginProtocolVersion, &attributes); err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", p.info.Name, err)
+	}
+	return attributes, nil
+}
+
+// close ends the connection, which makes ServePlugin return, and kills the
+// plugin if it doesn't exit.
+func (p *pluginClient) close() {
+	p.client.Close()
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+func closePlugins(plugins []*pluginClient) {
+	for _, p := range plugins {
+		p.close()
+	}
+}
+
+// credentialPlugin returns the plugin providing credentials, if any.
+func credentialPlugin(plugins []*pluginClient) (*pluginClient, error) {
+	var found *pluginClient
+	for _, p := range plugins {
+		if !p.info.Credentials {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("plugins %s and %s both provide credentials", found.info.Name, p.info.Name)
+		}
+		found = p
+	}
+	return found, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// audiencePolicy restricts the audiences ID tokens are issued for.
+type audiencePolicy struct {
+	allowed []*regexp.Regexp
+	denied  []*regexp.Regexp
+}
+
+// newAudiencePolicy compiles the audience patterns, in which * matches any
+// run of characters (eg https://*.a.run.app).  A nil policy allows every
+// audience.
+func newAudiencePolicy(allowed, denied []string) (*audiencePolicy, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	p := &audiencePolicy{}
+	var err error
+	if p.allowed, err = compilePatterns(allowed); err != nil {
+		return nil, err
+	}
+	if p.denied, err = compilePatterns(denied); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// compilePatterns compiles patterns in which * matches any run of
+// characters.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		quoted := strings.Replace(regexp.QuoteMeta(p), `\*`, ".*", -1)
+		re, err := regexp.Compile("^" + quoted + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// check returns why ID tokens may not be issued for the audience, or nil.
+// Denied audiences take precedence over allowed ones.
+func (p *audiencePolicy) check(audience string) error {
+	if p == nil {
+		return nil
+	}
+	for _, re := range p.denied {
+		if re.MatchString(audience) {
+			return fmt.Errorf("ID tokens for audience %q are denied by this metadata server", audience)
+		}
+	}
+	if len(p.allowed) == 0 {
+		return nil
+	}
+	for _, re := range p.allowed {
+		if re.MatchString(audience) {
+			return nil
+		}
+	}
+	return fmt.Errorf("audience %q is not in the allowed audiences of this metadata server", audience)
+}
+
+// scopePolicy restricts the scopes access tokens are issued with.  A nil
+// policy allows every scope.
+type scopePolicy []*regexp.Regexp
+
+// newScopePolicy compiles the allowed scope patterns, in which * matches any
+// run of characters (eg https://www.googleapis.com/auth/devstorage.*).
+func newScopePolicy(allowed []string) (scopePolicy, error) {
+	return compilePatterns(allowed)
+}
+
+// check returns why access tokens may not be issued with the scopes, or nil.
+func (p scopePolicy) check(scopes []string) error {
+	if len(p) == 0 {
+		return nil
+	}
+	for _, sc := range scopes {
+		allowed := false
+		for _, re := range p {
+			if re.MatchString(sc) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("scope %q is not in the allowed scopes of this metadata server", sc)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import "testing"
+
+func TestAudiencePolicy(t *testing.T) {
+	p, err := newAudiencePolicy(
+		[]string{"https://*.example.com", "https://api.test"},
+		[]string{"https://admin.example.com"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		audience string
+		ok       bool
+	}{
+		{"https://foo.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://api.test", true},
+		// denied audiences take precedence over allowed ones
+		{"https://admin.example.com", false},
+		// the dots of a pattern aren't wildcards
+		{"https://evilexample.com", false},
+		{"https://fooXexample.com", false},
+		{"https://api.test.evil.com", false},
+		{"http://foo.example.com", false},
+	} {
+		if err := p.check(tc.audience); (err == nil) != tc.ok {
+			t.Errorf("check(%s) = %v, want allowed %v", tc.audience, err, tc.ok)
+		}
+	}
+
+	deny, err := newAudiencePolicy(nil, []string{"*.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deny.check("https://example.com"); err != nil {
+		t.Errorf("a deny list rejected an audience it doesn't match: %v", err)
+	}
+	if err := deny.check("https://service.internal"); err == nil {
+		t.Error("a deny list allowed an audience it matches")
+	}
+}
+
+func TestAudiencePolicyEmpty(t *testing.T) {
+	for _, patterns := range [][]string{nil, {}} {
+		p, err := newAudiencePolicy(patterns, patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.check("https://anything.example.com"); err != nil {
+			t.Errorf("an empty policy rejected an audience: %v", err)
+		}
+	}
+	// blank patterns are ignored
+	p, err := newAudiencePolicy([]string{" "}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.check("https://anything.example.com"); err != nil {
+		t.Errorf("a policy of blank patterns rejected an audience: %v", err)
+	}
+}
+
+func TestScopePolicy(t *testing.T) {
+	p, err := newScopePolicy([]string{
+		"https://www.googleapis.com/auth/devstorage.*",
+		"https://www.googleapis.com/auth/userinfo.email",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		scopes []string
+		ok     bool
+	}{
+		{nil, true},
+		{[]string{"https://www.googleapis.com/auth/devstorage.read_only"}, true},
+		{[]string{"https://www.googleapis.com/auth/devstorage.read_only", "https://www.googleapis.com/auth/userinfo.email"}, true},
+		// every scope must be allowed
+		{[]string{"https://www.googleapis.com/auth/devstorage.read_only", "https://www.googleapis.com/auth/cloud-platform"}, false},
+		// the dot before the wildcard isn't one
+		{[]string{"https://www.googleapis.com/auth/devstorageXread_only"}, false},
+		{[]string{"https://www.googleapis.com/auth/userinfo.email.evil"}, false},
+	} {
+		if err := p.check(tc.scopes); (err == nil) != tc.ok {
+			t.Errorf("check(%q) = %v, want allowed %v", tc.scopes, err, tc.ok)
+		}
+	}
+
+	empty, err := newScopePolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := empty.check([]string{"https://www.googleapis.com/auth/cloud-platform"}); err != nil {
+		t.Errorf("an empty policy rejected a scope: %v", err)
+	}
+}
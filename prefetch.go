@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// prefetchTimeout bounds how long Start waits for the first tokens.
+	prefetchTimeout = 10 * time.Second
+	// prefetchRetry is the delay after a failed fetch; it doubles up to
+	// prefetchMaxRetry.
+	prefetchRetry    = 5 * time.Second
+	prefetchMaxRetry = time.Minute
+	// refreshFraction is the part of a token's remaining lifetime after
+	// which it is refreshed, eg 45m into a 1h token.
+	refreshFraction = 0.75
+)
+
+// prefetchTokens fetches the default access token of every account before
+// the server starts serving, then keeps them fresh in the background so no
+// request waits for a round trip to Google.
+func (s *Server) prefetchTokens() {
+	accounts := []*account{s.defaultAccount()}
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	ready := make(chan struct{}, len(accounts))
+	for _, a := range accounts {
+		go s.refreshTokens(a, ready)
+	}
+	timeout := time.After(prefetchTimeout)
+	for range accounts {
+		select {
+		case <-ready:
+		case <-timeout:
+			logger.Warnln("Serving before all tokens were prefetched")
+			return
+		}
+	}
+}
+
+// refreshTokens fetches the default access token of a, and a new one once
+// refreshFraction of its lifetime has passed, until the server is shut down.  ready is signalled after
+// the first attempt.
+func (s *Server) refreshTokens(a *account, ready chan<- struct{}) {
+	retry := prefetchRetry
+	for first := true; ; first = false {
+		if !first {
+			accessTokenMetrics.Add("refreshes", 1)
+		}
+		var tok *oauth2.Token
+		var err error
+		if first {
+			tok, err = a.accessToken(context.Background(), nil)
+		} else {
+			tok, err = a.refreshAccessToken(context.Background())
+		}
+		if first {
+			ready <- struct{}{}
+		}
+		var wait time.Duration
+		if err != nil {
+			logger.Errorf("Unable to prefetch the access token of %s: %v", a.email, err)
+			wait = retry
+			if retry *= 2; retry > prefetchMaxRetry {
+				retry = prefetchMaxRetry
+			}
+		} else {
+			retry = prefetchRetry
+			wait = time.Duration(float64(time.Until(tok.Expiry)) * refreshFraction)
+			if tok.Expiry.IsZero() || wait <= 0 {
+				// tokens that never expire or aren't reused (eg from
+				// a credential command without an expiry) aren't kept
+				logger.Debugf("Not refreshing the access token of %s", a.email)
+				return
+			}
+			logger.Debugf("Refreshing the access token of %s in %v", a.email, wait.Round(time.Second))
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refreshAccessToken fetches a new access token for the account's scopes and
+// serves it from then on.  The account's token sources reuse their token
+// until seconds before it expires, so it is fetched with newToken.
+func (a *account) refreshAccessToken(ctx context.Context) (*oauth2.Token, error) {
+	a.mu.Lock()
+	ts, err := a.scopedTokenSource(nil)
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	release, err := a.acquireOutbound(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := newToken(ts)
+	release()
+	if err != nil {
+		accessTokenMetrics.Add("errors", 1)
+		return nil, err
+	}
+	a.cache.put(tokenCacheKey(a.email, "access_token", a.scopes), tok)
+	a.mu.Lock()
+	a.recordAccessToken(a.scopes, tok)
+	a.mu.Unlock()
+	return tok, nil
+}
+
+// newToken fetches a new token from the source behind ts rather than the
+// token it reuses: oauth2.ReuseTokenSource unwraps a reusing source and the
+// empty token it is given is never valid.  Downscoped tokens are exchanged
+// for a new token of the source they restrict, which reuses its own.
+func newToken(ts oauth2.TokenSource) (*oauth2.Token, error) {
+	if r, ok := ts.(*reusedDownscopedTokenSource); ok {
+		d := *r.downscoped
+		d.base = newTokenSource{r.downscoped.base}
+		return d.Token()
+	}
+	return oauth2.ReuseTokenSource(&oauth2.Token{}, ts).Token()
+}
+
+// newTokenSource fetches every token with newToken.
+type newTokenSource struct {
+	ts oauth2.TokenSource
+}
+
+func (s newTokenSource) Token() (*oauth2.Token, error) {
+	return newToken(s.ts)
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// countingTokenSource returns a new 1h token on every call.
+type countingTokenSource struct{ n int }
+
+func (ts *countingTokenSource) Token() (*oauth2.Token, error) {
+	ts.n++
+	return &oauth2.Token{AccessToken: fmt.Sprintf("token-%d", ts.n), Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func TestRefreshAccessToken(t *testing.T) {
+	src := &countingTokenSource{}
+	a := &account{
+		email:  "test@project.iam.gserviceaccount.com",
+		scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+		creds:  &google.Credentials{TokenSource: oauth2.ReuseTokenSource(nil, src)},
+	}
+	ctx := context.Background()
+	tok, err := a.accessToken(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "token-1" {
+		t.Fatalf("accessToken = %s, want token-1", tok.AccessToken)
+	}
+	// the reused token is still valid for an hour, but a refresh gets a new one
+	if tok, err = a.refreshAccessToken(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "token-2" {
+		t.Errorf("refreshAccessToken = %s, want token-2", tok.AccessToken)
+	}
+	if tok, err = a.accessToken(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "token-2" {
+		t.Errorf("accessToken after a refresh = %s, want token-2", tok.AccessToken)
+	}
+	if src.n != 2 {
+		t.Errorf("%d tokens fetched, want 2", src.n)
+	}
+}
+
+// stsTransport answers token exchanges with the subject token prefixed by
+// downscoped- and passes other requests on.
+type stsTransport struct {
+	next http.RoundTripper
+}
+
+func (t stsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.String() != stsTokenURL {
+		return t.next.RoundTrip(r)
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"access_token":"downscoped-%s","token_type":"Bearer"}`, r.PostForm.Get("subject_token"))
+	return w.Result(), nil
+}
+
+func TestRefreshDownscopedAccessToken(t *testing.T) {
+	transport := http.DefaultTransport
+	http.DefaultTransport = stsTransport{next: transport}
+	t.Cleanup(func() { http.DefaultTransport = transport })
+
+	src := &countingTokenSource{}
+	a := &account{
+		email:          "test@project.iam.gserviceaccount.com",
+		scopes:         []string{"https://www.googleapis.com/auth/cloud-platform"},
+		creds:          &google.Credentials{TokenSource: oauth2.ReuseTokenSource(nil, src)},
+		accessBoundary: `{"accessBoundary":{}}`,
+	}
+	if err := a.applyTokenOptions(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tok, err := a.accessToken(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "downscoped-token-1" {
+		t.Fatalf("accessToken = %s, want downscoped-token-1", tok.AccessToken)
+	}
+	// the token being downscoped is refreshed too, not only the exchange
+	if tok, err = a.refreshAccessToken(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "downscoped-token-2" {
+		t.Errorf("refreshAccessToken = %s, want downscoped-token-2", tok.AccessToken)
+	}
+	if tok, err = a.accessToken(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "downscoped-token-2" {
+		t.Errorf("accessToken after a refresh = %s, want downscoped-token-2", tok.AccessToken)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package mds
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the given user and/or group once the
+// listener is bound.  The user's primary group is used unless group is set,
+// and supplementary groups are cleared.
+func dropPrivileges(runAsUser, runAsGroup string) error {
+	uid, gid := -1, -1
+	if runAsUser != "" {
+		u, err := lookupUser(runAsUser)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if runAsGroup != "" {
+		g, err := lookupGroup(runAsGroup)
+		if err != nil {
+			return err
+		}
+		gid = g
+	}
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{}); err != nil {
+			return fmt.Errorf("unable to clear supplementary groups: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("unable to set group %d: %v", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("unable to set user %d: %v", uid, err)
+		}
+	}
+	return nil
+}
+
+// lookupUser resolves a user name or numeric uid.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		u, err := user.LookupId(name)
+		if err != nil {
+			// a uid without a passwd entry keeps the current group
+			return &user.User{Uid: name, Gid: "-1"}, nil
+		}
+		return u, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find user %s: %v", name, err)
+	}
+	return u, nil
+}
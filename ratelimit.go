@@ -0,0 +1,160 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitMaxBuckets bounds the buckets kept before idle ones are dropped.
+const rateLimitMaxBuckets = 10000
+
+// rateLimit throttles each client's requests for a path with a token bucket
+// like the production metadata server throttles aggressive clients.
+type rateLimit struct {
+	path string
+	// rate is the requests per second refilled, burst the bucket size
+	rate  float64
+	burst float64
+}
+
+// parseRateLimits parses RateLimits: a rate (10/s, 600/m) and optionally
+// the burst, eg 10/s:20.  The burst defaults to one second's worth.
+func parseRateLimits(m map[string]string) ([]rateLimit, error) {
+	var limits []rateLimit
+	for path, spec := range m {
+		l, err := parseRateLimit(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit %q for %s (eg 10/s or 600/m:20): %v", spec, path, err)
+		}
+		l.path = faultPath(path)
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+func parseRateLimit(spec string) (rateLimit, error) {
+	var l rateLimit
+	f := strings.SplitN(spec, ":", 2)
+	rate := strings.SplitN(f[0], "/", 2)
+	n, err := strconv.ParseFloat(rate[0], 64)
+	if err != nil || n <= 0 {
+		return l, fmt.Errorf("invalid rate %q", f[0])
+	}
+	per := time.Second
+	if len(rate) == 2 {
+		switch rate[1] {
+		case "s":
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			if per, err = time.ParseDuration(rate[1]); err != nil || per <= 0 {
+				return l, fmt.Errorf("invalid period %q", rate[1])
+			}
+		}
+	}
+	l.rate = n / per.Seconds()
+	l.burst = math.Max(1, math.Ceil(l.rate))
+	if len(f) == 2 {
+		if l.burst, err = strconv.ParseFloat(f[1], 64); err != nil || l.burst < 1 {
+			return l, fmt.Errorf("invalid burst %q", f[1])
+		}
+	}
+	return l, nil
+}
+
+// bucket is a client's token bucket for a rate limit.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the buckets by rate limit path and client.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// take takes a token from the client's bucket for l, or returns how long
+// until there will be one.
+func (rl *rateLimiter) take(l *rateLimit, client string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.buckets == nil {
+		rl.buckets = map[string]*bucket{}
+	}
+	key := l.path + " " + client
+	b, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) >= rateLimitMaxBuckets {
+			rl.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune drops the buckets that haven't been used for a minute, which for
+// any useful rate are full again.  Must be called with mu held.
+func (rl *rateLimiter) prune(now time.Time) {
+	for k, b := range rl.buckets {
+		if now.Sub(b.last) > time.Minute {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// throttle answers 429 with Retry-After if the caller exceeded the rate
+// limit of the longest matching path, and reports whether it did.
+func (s *Server) throttle(w http.ResponseWriter, r *http.Request) bool {
+	var match *rateLimit
+	for i, l := range s.rateLimits {
+		if pathMatches(l.path, r.URL.Path) && (match == nil || len(l.path) > len(match.path)) {
+			match = &s.rateLimits[i]
+		}
+	}
+	if match == nil {
+		return false
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	ok, wait := s.limiter.take(match, client, time.Now())
+	if ok {
+		return false
+	}
+	retry := int(math.Ceil(wait.Seconds()))
+	s.requestLogger(r).Debugf("Throttling %s for %s, retry after %ds", r.URL.Path, client, retry)
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	s.writeError(w, r, http.StatusTooManyRequests, "")
+	return true
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want rateLimit
+	}{
+		{"10/s", rateLimit{rate: 10, burst: 10}},
+		{"10", rateLimit{rate: 10, burst: 10}},
+		{"600/m:20", rateLimit{rate: 10, burst: 20}},
+		{"1/h", rateLimit{rate: 1.0 / 3600, burst: 1}},
+		{"3/30s:5", rateLimit{rate: 0.1, burst: 5}},
+	} {
+		l, err := parseRateLimits(map[string]string{"instance/*": tc.spec})
+		if err != nil {
+			t.Errorf("parseRateLimits(%q): %v", tc.spec, err)
+			continue
+		}
+		tc.want.path = "/computeMetadata/v1/instance/*"
+		if len(l) != 1 || l[0] != tc.want {
+			t.Errorf("parseRateLimits(%q) = %+v, want %+v", tc.spec, l, tc.want)
+		}
+	}
+	for _, spec := range []string{"", "x/s", "0/s", "-1/s", "10/d", "10/0s", "10/s:0", "10/s:x"} {
+		if _, err := parseRateLimits(map[string]string{"instance/id": spec}); err == nil {
+			t.Errorf("parseRateLimits(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	var rl rateLimiter
+	l := &rateLimit{path: "/computeMetadata/v1/instance/id", rate: 1, burst: 2}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.take(l, "10.0.0.1", now); !ok {
+			t.Fatalf("request %d within the burst was throttled", i)
+		}
+	}
+	if ok, wait := rl.take(l, "10.0.0.1", now); ok || wait != time.Second {
+		t.Errorf("take after the burst = %v %v, want false 1s", ok, wait)
+	}
+	// buckets are per client
+	if ok, _ := rl.take(l, "10.0.0.2", now); !ok {
+		t.Error("another client was throttled")
+	}
+	// the bucket refills at the rate
+	if ok, wait := rl.take(l, "10.0.0.1", now.Add(500*time.Millisecond)); ok || wait != 500*time.Millisecond {
+		t.Errorf("take half a token later = %v %v, want false 500ms", ok, wait)
+	}
+	if ok, _ := rl.take(l, "10.0.0.1", now.Add(time.Second)); !ok {
+		t.Error("take a token later was throttled")
+	}
+	// but never beyond the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.take(l, "10.0.0.1", later); !ok {
+			t.Fatalf("request %d after refilling was throttled", i)
+		}
+	}
+	if ok, _ := rl.take(l, "10.0.0.1", later); ok {
+		t.Error("the bucket refilled beyond the burst")
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	var rl rateLimiter
+	l := &rateLimit{path: "/computeMetadata/v1/instance/id", rate: 1, burst: 1}
+	now := time.Now()
+	for i := 0; i < rateLimitMaxBuckets; i++ {
+		rl.take(l, strconv.Itoa(i), now)
+	}
+	// a recently used bucket is kept
+	rl.take(l, "0", now.Add(time.Minute))
+	if len(rl.buckets) != rateLimitMaxBuckets {
+		t.Fatalf("%d buckets, want %d", len(rl.buckets), rateLimitMaxBuckets)
+	}
+	rl.take(l, "new", now.Add(time.Minute+time.Second))
+	if len(rl.buckets) != 2 {
+		t.Errorf("%d buckets after pruning, want 2", len(rl.buckets))
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	s := newTestServer(t, Config{RateLimits: map[string]string{
+		"project/*":          "1/h",
+		"project/project-id": "1000/s",
+	}})
+	const path = "/computeMetadata/v1/project/numeric-project-id"
+	if resp, _ := get(t, s, path, "metadata", "Google"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request = %d, want 200", resp.StatusCode)
+	}
+	resp, _ := get(t, s, path, "metadata", "Google")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second request = %d, want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "3600" {
+		t.Errorf("Retry-After = %q, want 3600", got)
+	}
+	// the longest matching path wins
+	for i := 0; i < 5; i++ {
+		if resp, _ := get(t, s, "/computeMetadata/v1/project/project-id", "metadata", "Google"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d with a 1000/s limit = %d, want 200", i, resp.StatusCode)
+		}
+	}
+	if resp, _ := get(t, s, "/computeMetadata/v1/instance/id", "metadata", "Google"); resp.StatusCode != http.StatusOK {
+		t.Errorf("request without a limit = %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scenario is a timeline of events replayed from the start of the server,
+// eg for scripted chaos runs:
+//
+//	events:
+//	- at: t+30s
+//	  maintenanceEvent: MIGRATE
+//	- at: t+60s
+//	  fault: {path: /instance/service-accounts/default/token, status: 500, duration: 10s}
+//	- at: t+90s
+//	  preempt: true
+//	outages:
+//	- start: t+2m
+//	  duration: 30s
+//	  every: 10m
+//	  paths: [/instance/service-accounts/*]
+//	  hang: true
+type Scenario struct {
+	Events  []ScenarioEvent `json:"events"`
+	Outages []Outage        `json:"outages,omitempty"`
+
+	// start is when the server was started
+	start time.Time
+}
+
+// ScenarioEvent is a point of a Scenario.  Its actions are applied in the
+// order of the fields.
+type ScenarioEvent struct {
+	// At is the offset from the start, eg 30s or t+30s
+	At string `json:"at"`
+	// Set sets values by metadata path, see Server.SetValue
+	Set map[string]interface{} `json:"set,omitempty"`
+	// Fault injects a fault, see Server.InjectFault
+	Fault *FaultRequest `json:"fault,omitempty"`
+	// ClearFaults clears the faults, see Server.ClearFaults
+	ClearFaults bool `json:"clearFaults,omitempty"`
+	// MaintenanceEvent sets the maintenance event; MIGRATE and TERMINATE
+	// stand for the *_ON_HOST_MAINTENANCE events
+	MaintenanceEvent string `json:"maintenanceEvent,omitempty"`
+	// Preempt preempts the instance
+	Preempt bool `json:"preempt,omitempty"`
+	// InvalidateTokens drops the cached tokens
+	InvalidateTokens bool `json:"invalidateTokens,omitempty"`
+
+	offset time.Duration
+}
+
+// Outage is a window of a Scenario during which the metadata server is down:
+// requests for Paths, or all metadata requests if there are none, fail with
+// Status or, with Hang, get no answer until the window is over.
+type Outage struct {
+	// Start is the offset from the start, eg t+5m, or a time (RFC 3339)
+	Start string `json:"start"`
+	// Duration is how long the outage lasts, eg 30s
+	Duration string `json:"duration"`
+	// Every repeats the outage, eg 10m, if set
+	Every string `json:"every,omitempty"`
+	// Paths are matched like faults and may be relative to
+	// /computeMetadata/v1/
+	Paths []string `json:"paths,omitempty"`
+	// Status is the HTTP status of the failed requests, 503 by default
+	Status int `json:"status,omitempty"`
+	// Hang holds the requests until the outage is over (or the client
+	// gives up) and then serves them, instead of failing them
+	Hang bool `json:"hang,omitempty"`
+
+	offset, duration, every time.Duration
+	at                      *time.Time
+}
+
+// LoadScenarioFile reads and checks a YAML (or JSON) Scenario.
+func LoadScenarioFile(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read scenario file %s: %v", path, err)
+	}
+	data, err = yamlToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse scenario file %s: %v", path, err)
+	}
+	sc := &Scenario{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(sc); err != nil {
+		return nil, fmt.Errorf("unable to parse scenario file %s: %v", path, err)
+	}
+	if err := sc.check(); err != nil {
+		return nil, fmt.Errorf("scenario file %s: %v", path, err)
+	}
+	return sc, nil
+}
+
+// check parses the offsets and maintenance events and sorts the events.
+func (sc *Scenario) check() error {
+	for i := range sc.Events {
+		ev := &sc.Events[i]
+		var err error
+		ev.offset, err = time.ParseDuration(strings.TrimPrefix(ev.At, "t+"))
+		if err != nil || ev.offset < 0 {
+			return fmt.Errorf("event %d: invalid offset %q", i, ev.At)
+		}
+		switch strings.ToUpper(ev.MaintenanceEvent) {
+		case "":
+		case "MIGRATE":
+			ev.MaintenanceEvent = MaintenanceMigrate
+		case "TERMINATE":
+			ev.MaintenanceEvent = MaintenanceTerminate
+		case MaintenanceNone, MaintenanceMigrate, MaintenanceTerminate:
+			ev.MaintenanceEvent = strings.ToUpper(ev.MaintenanceEvent)
+		default:
+			return fmt.Errorf("event %d: unknown maintenance event %q", i, ev.MaintenanceEvent)
+		}
+		if ev.Fault != nil && ev.Fault.Duration != "" {
+			if _, err := time.ParseDuration(ev.Fault.Duration); err != nil {
+				return fmt.Errorf("event %d: invalid fault duration %q", i, ev.Fault.Duration)
+			}
+		}
+		if len(ev.Set) == 0 && ev.Fault == nil && !ev.ClearFaults && ev.MaintenanceEvent == "" && !ev.Preempt && !ev.InvalidateTokens {
+			return fmt.Errorf("event %d at %s does nothing", i, ev.At)
+		}
+	}
+	for i := range sc.Outages {
+		if err := sc.Outages[i].check(); err != nil {
+			return fmt.Errorf("outage %d: %v", i, err)
+		}
+	}
+	if len(sc.Events) == 0 && len(sc.Outages) == 0 {
+		return errors.New("no events or outages")
+	}
+	sort.SliceStable(sc.Events, func(i, j int) bool { return sc.Events[i].offset < sc.Events[j].offset })
+	return nil
+}
+
+// check parses the times of the outage and qualifies its paths.
+func (o *Outage) check() error {
+	var err error
+	if t, terr := time.Parse(time.RFC3339, o.Start); terr == nil {
+		o.at = &t
+	} else if o.offset, err = time.ParseDuration(strings.TrimPrefix(o.Start, "t+")); err != nil || o.offset < 0 {
+		return fmt.Errorf("invalid start %q (eg t+5m or 2024-01-02T15:04:05Z)", o.Start)
+	}
+	if o.duration, err = time.ParseDuration(o.Duration); err != nil || o.duration <= 0 {
+		return fmt.Errorf("invalid duration %q", o.Duration)
+	}
+	if o.Every != "" {
+		if o.every, err = time.ParseDuration(o.Every); err != nil || o.every <= o.duration {
+			return fmt.Errorf("invalid period %q, it must be longer than the duration", o.Every)
+		}
+	}
+	if o.Hang && o.Status != 0 {
+		return errors.New("only one of status and hang may be set")
+	}
+	if o.Status == 0 {
+		o.Status = http.StatusServiceUnavailable
+	}
+	if o.Status < 100 || o.Status > 599 {
+		return fmt.Errorf("invalid HTTP status %d", o.Status)
+	}
+	for i, p := range o.Paths {
+		o.Paths[i] = faultPath(p)
+	}
+	return nil
+}
+
+// end returns the end of the outage window in effect at now, if any, for a
+// scenario started at start.
+func (o *Outage) end(start, now time.Time) (time.Time, bool) {
+	from := start.Add(o.offset)
+	if o.at != nil {
+		from = *o.at
+	}
+	if now.Before(from) {
+		return time.Time{}, false
+	}
+	if o.every > 0 {
+		from = from.Add(now.Sub(from) / o.every * o.every)
+	}
+	end := from.Add(o.duration)
+	return end, now.Before(end)
+}
+
+func (o *Outage) matches(path string) bool {
+	if len(o.Paths) == 0 {
+		return true
+	}
+	for _, p := range o.Paths {
+		if pathMatches(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// outage fails or holds the request if an outage of the scenario is in
+// effect for its path, and reports whether it answered it.  A held request
+// is served once the outage is over.
+func (s *Server) outage(w http.ResponseWriter, r *http.Request) bool {
+	if s.scenario == nil {
+		return false
+	}
+	now := time.Now()
+	for i := range s.scenario.Outages {
+		o := &s.scenario.Outages[i]
+		end, ok := o.end(s.scenario.start, now)
+		if !ok || !o.matches(r.URL.Path) {
+			continue
+		}
+		if !o.Hang {
+			s.requestLogger(r).Debugf("Outage until %s: %s %d", end.Format(time.RFC3339), r.URL.Path, o.Status)
+			s.writeError(w, r, o.Status, "")
+			return true
+		}
+		s.requestLogger(r).Debugf("Outage until %s: holding %s", end.Format(time.RFC3339), r.URL.Path)
+		t := time.NewTimer(end.Sub(now))
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return false
+		case <-r.Context().Done():
+			return true
+		case <-s.stop:
+			s.writeError(w, r, http.StatusServiceUnavailable, "")
+			return true
+		}
+	}
+	return false
+}
+
+// runScenario replays the events of the scenario until it ends or the
+// server is shut down.
+func (s *Server) runScenario(sc *Scenario) {
+	if len(sc.Events) == 0 {
+		return
+	}
+	for _, ev := range sc.Events {
+		t := time.NewTimer(time.Until(sc.start.Add(ev.offset)))
+		select {
+		case <-s.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		logger.Infof("Scenario event at %s", ev.At)
+		s.applyScenarioEvent(ev)
+	}
+	logger.Infoln("Scenario completed")
+}
+
+// applyScenarioEvent applies the actions of an event, logging those that
+// fail.
+func (s *Server) applyScenarioEvent(ev ScenarioEvent) {
+	paths := make([]string, 0, len(ev.Set))
+	for path := range ev.Set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := s.SetValue(path, ev.Set[path]); err != nil {
+			logger.Errorf("Scenario: unable to set %s: %v", path, err)
+		}
+	}
+	if ev.Fault != nil {
+		if err := s.injectFault(ev.Fault); err != nil {
+			logger.Errorf("Scenario: %v", err)
+		}
+	}
+	if ev.ClearFaults {
+		s.ClearFaults("")
+	}
+	if ev.MaintenanceEvent != "" {
+		// checked when the scenario was loaded
+		_ = s.SetMaintenanceEvent(ev.MaintenanceEvent)
+	}
+	if ev.Preempt {
+		s.Preempt()
+	}
+	if ev.InvalidateTokens {
+		s.InvalidateTokens()
+	}
+}
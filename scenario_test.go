@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutageCheck(t *testing.T) {
+	o := Outage{Start: "t+5m", Duration: "30s", Paths: []string{"instance/*"}}
+	if err := o.check(); err != nil {
+		t.Fatal(err)
+	}
+	if o.offset != 5*time.Minute || o.duration != 30*time.Second || o.Status != http.StatusServiceUnavailable || o.Paths[0] != "/computeMetadata/v1/instance/*" {
+		t.Errorf("checked outage = %+v", o)
+	}
+	for _, bad := range []Outage{
+		{Start: "soon", Duration: "30s"},
+		{Start: "t+-1m", Duration: "30s"},
+		{Start: "t+1m", Duration: "0s"},
+		{Start: "t+1m", Duration: "30s", Every: "30s"},
+		{Start: "t+1m", Duration: "30s", Hang: true, Status: 500},
+		{Start: "t+1m", Duration: "30s", Status: 42},
+	} {
+		if err := bad.check(); err == nil {
+			t.Errorf("check(%+v) succeeded", bad)
+		}
+	}
+}
+
+func TestOutageEnd(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	at := start.Add(time.Hour)
+	for _, tc := range []struct {
+		name string
+		o    Outage
+		now  time.Duration
+		end  time.Duration
+		ok   bool
+	}{
+		{"before", Outage{offset: time.Minute, duration: time.Minute}, 30 * time.Second, 0, false},
+		{"during", Outage{offset: time.Minute, duration: time.Minute}, 90 * time.Second, 2 * time.Minute, true},
+		{"after", Outage{offset: time.Minute, duration: time.Minute}, 2 * time.Minute, 2 * time.Minute, false},
+		{"repeated", Outage{offset: time.Minute, duration: time.Minute, every: 10 * time.Minute}, 21*time.Minute + 30*time.Second, 22 * time.Minute, true},
+		{"between repeats", Outage{offset: time.Minute, duration: time.Minute, every: 10 * time.Minute}, 25 * time.Minute, 22 * time.Minute, false},
+		{"at a time", Outage{at: &at, duration: time.Minute}, time.Hour + time.Second, time.Hour + time.Minute, true},
+	} {
+		end, ok := tc.o.end(start, start.Add(tc.now))
+		if ok != tc.ok || (ok && !end.Equal(start.Add(tc.end))) {
+			t.Errorf("%s: end = %v %v, want %v %v", tc.name, end, ok, start.Add(tc.end), tc.ok)
+		}
+	}
+}
+
+func TestOutage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scenario.yaml")
+	scenario := `outages:
+- start: t+0s
+  duration: 1h
+  paths: [project/*]
+- start: t+0s
+  duration: 300ms
+  paths: [instance/id]
+  hang: true
+- start: t+1h
+  duration: 1m
+  status: 500
+`
+	if err := ioutil.WriteFile(path, []byte(scenario), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{ScenarioFile: path})
+
+	if resp, _ := get(t, s, "/computeMetadata/v1/project/project-id", "metadata", "Google"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("request during an outage = %d, want 503", resp.StatusCode)
+	}
+	// the outage for all paths hasn't started
+	if resp, _ := get(t, s, "/computeMetadata/v1/instance/name", "metadata", "Google"); resp.StatusCode != http.StatusOK {
+		t.Errorf("request outside of the outages = %d, want 200", resp.StatusCode)
+	}
+	// a held request is served once the outage is over
+	resp, body := get(t, s, "/computeMetadata/v1/instance/id", "metadata", "Google")
+	if resp.StatusCode != http.StatusOK || body == "" {
+		t.Errorf("held request = %d %q, want 200 and the id", resp.StatusCode, body)
+	}
+	if d := time.Since(s.scenario.start); d < 300*time.Millisecond {
+		t.Errorf("held request answered %v after the start, before the outage ended", d)
+	}
+	// and later ones aren't held
+	start := time.Now()
+	get(t, s, "/computeMetadata/v1/instance/id", "metadata", "Google")
+	if d := time.Since(start); d >= 300*time.Millisecond {
+		t.Errorf("request after the outage took %v", d)
+	}
+}
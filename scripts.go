@@ -0,0 +1,49 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// Instance attributes the guest agent runs at boot and shutdown.
+const (
+	startupScriptAttribute    = "startup-script"
+	startupScriptURLAttribute = "startup-script-url"
+	shutdownScriptAttribute   = "shutdown-script"
+)
+
+// scriptAttributes serves the startup and shutdown scripts of the Config
+// unless the metadata config already sets them.  The files are read every
+// time so edits are picked up on Reload.
+func (s *Server) scriptAttributes(t map[string]interface{}) error {
+	attributes := subTree(subTree(t, "instance"), "attributes")
+	for key, file := range map[string]string{
+		startupScriptAttribute:  s.cfg.StartupScriptFile,
+		shutdownScriptAttribute: s.cfg.ShutdownScriptFile,
+	} {
+		if file == "" {
+			continue
+		}
+		script, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read %s %s: %v", key, file, err)
+		}
+		setAttribute(attributes, key, string(script), true)
+	}
+	setAttribute(attributes, startupScriptURLAttribute, s.cfg.StartupScriptURL, s.cfg.StartupScriptURL != "")
+	return nil
+}
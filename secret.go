@@ -0,0 +1,88 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// loadSecretCredentials reads a service account key from Secret Manager using
+// application default credentials and returns the credentials along with the
+// resolved secret version (eg .../versions/3 for .../versions/latest).
+func loadSecretCredentials(ctx context.Context, name string, scopes []string) (*google.Credentials, string, error) {
+	svc, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to create Secret Manager client: %v", err)
+	}
+	resp, err := svc.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to access secret %s: %v", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to decode secret %s: %v", name, err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to parse service account key in secret %s: %v", name, err)
+	}
+	return creds, resp.Name, nil
+}
+
+// refreshSecretCredentials replaces the credentials if the secret has a new
+// version.
+func (s *Server) refreshSecretCredentials(ctx context.Context) error {
+	creds, version, err := loadSecretCredentials(ctx, s.cfg.ServiceAccountSecret, s.cfg.TokenScopes)
+	if err != nil {
+		return err
+	}
+	a := s.configured
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if version == s.secretVersion {
+		return nil
+	}
+	logger.Infof("Using service account key from %s", version)
+	a.creds = creds
+	a.scopedTokenSources = nil
+	if err := a.applyTokenOptions(); err != nil {
+		return err
+	}
+	s.secretVersion = version
+	return nil
+}
+
+// watchSecret polls Secret Manager for a rotated key until the server is
+// shut down.
+func (s *Server) watchSecret(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.refreshSecretCredentials(context.Background()); err != nil {
+				logger.Errorf("Unable to refresh service account key: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
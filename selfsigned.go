@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+)
+
+// selfSignedTokenSource returns self-signed service account JWTs, which most
+// Google APIs accept in place of an access token, without calling the token
+// endpoint.  The JWT is for audience if set (eg https://pubsub.googleapis.com/)
+// or else for the scopes.
+type selfSignedTokenSource struct {
+	email    string
+	keyID    string
+	audience string
+	scopes   []string
+	signer   crypto.Signer
+	// maxLifetime, if set, caps selfSignedLifetime
+	maxLifetime time.Duration
+	// skew shifts the iat and exp claims, see Config.ClockSkew
+	skew time.Duration
+}
+
+// selfSignedLifetime is the lifetime of self-signed JWTs, the longest Google
+// APIs accept.
+const selfSignedLifetime = time.Hour
+
+func (s *selfSignedTokenSource) Token() (*oauth2.Token, error) {
+	iat := time.Now().Add(s.skew)
+	exp := iat.Add(cappedLifetime(selfSignedLifetime, s.maxLifetime))
+	claims := &jws.ClaimSet{
+		Iss: s.email,
+		Sub: s.email,
+		Aud: s.audience,
+		Iat: iat.Unix(),
+		Exp: exp.Unix(),
+	}
+	if s.audience == "" {
+		claims.Scope = strings.Join(s.scopes, " ")
+	}
+	header := &jws.Header{Algorithm: "RS256", Typ: "JWT", KeyID: s.keyID}
+	jwt, err := jws.EncodeWithSigner(header, claims, func(data []byte) ([]byte, error) {
+		h := sha256.Sum256(data)
+		return s.signer.Sign(rand.Reader, h[:], crypto.SHA256)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign JWT: %v", err)
+	}
+	return &oauth2.Token{AccessToken: jwt, TokenType: "Bearer", Expiry: exp.Add(-s.skew)}, nil
+}
+
+// useSelfSignedJWT makes the account serve self-signed JWTs for jwtAudience
+// as access tokens.  They are signed by the account's signer or the private
+// key of its service account key file.  ID tokens are unaffected.
+func (a *account) useSelfSignedJWT() error {
+	signer, keyID := a.signer, a.keyID
+	if signer == nil {
+		var err error
+		signer, keyID, err = a.privateKey()
+		if err != nil {
+			return err
+		}
+	}
+	creds := *a.creds
+	creds.TokenSource = oauth2.ReuseTokenSource(nil, &selfSignedTokenSource{
+		email:       a.email,
+		keyID:       keyID,
+		audience:    a.jwtAudience,
+		scopes:      a.scopes,
+		signer:      signer,
+		maxLifetime: a.maxLifetime,
+		skew:        a.skew,
+	})
+	a.creds = &creds
+	return nil
+}
+
+// privateKey returns the private key of a service_account key file and its
+// id.
+func (a *account) privateKey() (crypto.Signer, string, error) {
+	if a.creds == nil || len(a.creds.JSON) == 0 {
+		return nil, "", errors.New("self-signed JWTs need a service account key or signer")
+	}
+	f, err := parseCredentialsFile(a.creds.JSON)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to parse credentials JSON %v", err)
+	}
+	if f.Type != serviceAccountKey || f.PrivateKey == "" {
+		return nil, "", fmt.Errorf("self-signed JWTs need a service account key, got %s credentials", f.Type)
+	}
+	block, _ := pem.Decode([]byte(f.PrivateKey))
+	if block == nil {
+		return nil, "", errors.New("unable to decode the service account private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to parse the service account private key: %v", err)
+		}
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, "", fmt.Errorf("the service account private key must be an RSA key, got %T", key)
+	}
+	return rsaKey, f.PrivateKeyID, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2/jws"
+)
+
+func TestSelfSignedLifetime(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name        string
+		maxLifetime time.Duration
+		want        time.Duration
+	}{
+		{"default", 0, time.Hour},
+		{"capped", time.Minute, time.Minute},
+		{"longer cap", 2 * time.Hour, time.Hour},
+	} {
+		ts := &selfSignedTokenSource{
+			email:       "test@project.iam.gserviceaccount.com",
+			audience:    "https://pubsub.googleapis.com/",
+			signer:      key,
+			maxLifetime: tc.maxLifetime,
+		}
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := jws.Decode(tok.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := time.Duration(claims.Exp-claims.Iat) * time.Second; got != tc.want {
+			t.Errorf("%s: exp - iat = %v, want %v", tc.name, got, tc.want)
+		}
+		if d := time.Until(tok.Expiry); d > tc.want || d < tc.want-time.Minute {
+			t.Errorf("%s: token expires in %v, want %v", tc.name, d, tc.want)
+		}
+	}
+}
+
+func TestSelfSignedClockSkew(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, skew := range []time.Duration{5 * time.Minute, -5 * time.Minute, -2 * time.Hour} {
+		ts := &selfSignedTokenSource{
+			email:    "test@project.iam.gserviceaccount.com",
+			audience: "https://pubsub.googleapis.com/",
+			signer:   key,
+			skew:     skew,
+		}
+		now := time.Now()
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := jws.Decode(tok.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if iat := time.Unix(claims.Iat, 0); iat.Sub(now.Add(skew)).Abs() > time.Second {
+			t.Errorf("skew %v: iat = %v, want %v", skew, iat, now.Add(skew))
+		}
+		// the server still reuses the token by its own clock
+		if d := tok.Expiry.Sub(now); d.Round(time.Second) != time.Hour {
+			t.Errorf("skew %v: token expires in %v, want 1h", skew, d)
+		}
+	}
+}
@@ -0,0 +1,2013 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mds implements an emulator for the GCE metadata server which can be
+// embedded in other programs (eg, integration tests) or run standalone via cmd/.
+package mds
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"golang.org/x/oauth2"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/grpc"
+)
+
+var (
+	hostHeaders = []string{"metadata", "metadata.google.internal", metadataIP}
+)
+
+const (
+	metadataIP           = "169.254.169.254"
+	defaultInterfaceName = "gcemetadata0"
+
+	googleProjectID        = "GOOGLE_PROJECT_ID"
+	googleNumericProjectID = "GOOGLE_NUMERIC_PROJECT_ID"
+	googleAccessToken      = "GOOGLE_ACCESS_TOKEN"
+	googleIDToken          = "GOOGLE_ID_TOKEN"
+	googleAccountEmail     = "GOOGLE_ACCOUNT_EMAIL"
+
+	quotaProjectAttribute = "quota-project-id"
+	quotaProjectHeader    = "X-Goog-User-Project"
+)
+
+// Config describes how a metadata Server is started and where it gets its
+// credentials and values from.
+type Config struct {
+	// Port is the address the server listens on (eg ":8080")
+	Port string
+	// Listen overrides Port and may also be a unix socket (eg "unix:/run/mds.sock")
+	Listen string
+	// SocketMode and SocketGroup set the permissions of a unix socket
+	SocketMode  os.FileMode
+	SocketGroup string
+	// SetupInterface creates a dummy interface named InterfaceName holding
+	// 169.254.169.254 (linux only, requires CAP_NET_ADMIN) and listens on
+	// 169.254.169.254:80 unless Listen is set.  It is removed on Shutdown.
+	SetupInterface bool
+	InterfaceName  string
+	// TLSCertFile and TLSKeyFile serve HTTPS (and HTTP/2) instead of HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile requires clients to present a certificate signed by one
+	// of the CAs in this PEM file.
+	TLSClientCAFile string
+	// MaxHeaderBytes and MaxRequestBodyBytes limit the size of request
+	// headers (default 64KiB, larger ones get 431) and bodies (default 1MiB,
+	// 413), and RequestReadTimeout how long a client may take to send them
+	// (default 10s): slow headers close the connection, slow bodies get
+	// 408.  They apply to the admin API too.
+	MaxHeaderBytes      int
+	MaxRequestBodyBytes int64
+	RequestReadTimeout  time.Duration
+	// RunAsUser and RunAsGroup (names or numeric ids) switch the process to
+	// an unprivileged account once the listener is bound, eg after binding
+	// port 80 as root.  Not supported on windows.
+	RunAsUser  string
+	RunAsGroup string
+
+	NumericProjectID    string
+	TokenScopes         []string
+	ProjectID           string
+	ServiceAccountEmail string
+	// ServiceAccountFile is a credentials JSON file: a service_account key,
+	// external_account (workload identity federation) or authorized_user
+	// (gcloud application-default) credentials.
+	ServiceAccountFile string
+	// ServiceAccountJSON is the content of a credentials file, raw or base64
+	// encoded, used instead of ServiceAccountFile (eg from a secret injected
+	// as an environment variable).
+	ServiceAccountJSON []byte
+	// CustomAttributeFile is an optional json file of custom attributes ({ key:val})
+	// which replaces CustomAttributes if set.
+	CustomAttributeFile string
+	CustomAttributes    map[string]string
+	// InstanceAttributeFile and InstanceAttributes are the same for the
+	// attributes of the instance, served under /instance/attributes/, which
+	// is where clients look for eg kube-env or startup-script.
+	InstanceAttributeFile string
+	InstanceAttributes    map[string]string
+	// SSHKeys and InstanceSSHKeys are served as the ssh-keys attribute of
+	// the project and instance, for the guest agent's account provisioning.
+	// Each is username:type key [comment].  SSHKeysFile and
+	// InstanceSSHKeysFile, which are re-read on Reload, hold one per line
+	// and replace them if set.  BlockProjectSSHKeys sets the instance's
+	// block-project-ssh-keys attribute.
+	SSHKeys             []string
+	SSHKeysFile         string
+	InstanceSSHKeys     []string
+	InstanceSSHKeysFile string
+	BlockProjectSSHKeys bool
+	// OSLogin and OSLogin2FA set the enable-oslogin and enable-oslogin-2fa
+	// project attributes.
+	OSLogin    bool
+	OSLogin2FA bool
+	// StartupScriptFile and ShutdownScriptFile are served as the
+	// startup-script and shutdown-script instance attributes, and
+	// StartupScriptURL as startup-script-url, for testing bootstrapping
+	// with the guest agent or cloud-init.  The files are re-read on Reload.
+	StartupScriptFile  string
+	StartupScriptURL   string
+	ShutdownScriptFile string
+	// ClusterName, if set, makes the instance a GKE node: the cluster-name,
+	// cluster-location (default the instance's zone) and cluster-uid
+	// (default derived from the project, location and name) instance
+	// attributes are served, as are kube-env, read from KubeEnvFile, and
+	// kube-labels (key=value,...) if set.  KubeEnvFile is re-read on Reload.
+	ClusterName     string
+	ClusterLocation string
+	ClusterUID      string
+	KubeEnvFile     string
+	KubeLabels      map[string]string
+	// ContainerDeclarationFile and UserDataFile are served as the
+	// gce-container-declaration and user-data (cloud-init) instance
+	// attributes of Container-Optimized OS, and COSMetrics sets
+	// cos-metrics-enabled.  The files are re-read on Reload.
+	ContainerDeclarationFile string
+	UserDataFile             string
+	COSMetrics               bool
+	// Impersonate a service Account instead of using the keyfile
+	Impersonate bool
+	// Delegates is the chain of service accounts impersonated on the way to
+	// ServiceAccountEmail, each granted roles/iam.serviceAccountTokenCreator
+	// on the next.  ImpersonatedTokenLifetime overrides the default 1h
+	// lifetime of impersonated access tokens (up to 12h where the
+	// constraints/iam.allowServiceAccountCredentialLifetimeExtension org
+	// policy allows it).
+	Delegates                 []string
+	ImpersonatedTokenLifetime time.Duration
+	// Signer, if set, holds the service account's RSA key (eg in Cloud KMS,
+	// a YubiKey or an HSM); tokens are minted by signing JWT assertions with
+	// it.  ServiceAccountEmail must be set and SignerKeyID is the key's id,
+	// if known.  The Signer isn't closed on Shutdown.
+	Signer      crypto.Signer
+	SignerKeyID string
+	// TPMPath (eg /dev/tpmrm0) and TPMKeyHandle select a service account
+	// key held in a TPM at a persistent handle (eg 0x81008000); tokens are
+	// minted by signing JWTs with it.  ServiceAccountEmail must be set and
+	// TPMKeyID is the key's id, if known.
+	TPMPath      string
+	TPMKeyHandle uint32
+	TPMKeyID     string
+	// VaultAddr, VaultToken and VaultPath read access tokens from a Vault GCP
+	// secrets engine (eg VaultPath "gcp/roleset/my-roleset/token").
+	// ServiceAccountEmail must be set; ID tokens are minted with the
+	// IAM Credentials API so the roleset needs the cloud-platform scope.
+	VaultAddr  string
+	VaultToken string
+	VaultPath  string
+	// ExecCredential is a command (and arguments) run to get access and ID
+	// tokens, like a kubectl exec credential plugin, eg to use an in-house
+	// token broker.  ServiceAccountEmail must be set.  See execProvider
+	// for the contract.
+	ExecCredential []string
+	// WebhookURL is an HTTPS endpoint tokens are read from, eg an internal
+	// token vending service.  A JSON tokenRequest is POSTed with
+	// WebhookHeaders set, and WebhookCertFile/WebhookKeyFile are presented
+	// as a client certificate if set.  WebhookCAFile replaces the system
+	// roots.  ServiceAccountEmail must be set.
+	WebhookURL      string
+	WebhookHeaders  map[string]string
+	WebhookCertFile string
+	WebhookKeyFile  string
+	WebhookCAFile   string
+	// STSAudience selects exchanging a subject token from an identity
+	// provider for a federated access token with Google STS.  It is the
+	// workload or workforce identity pool provider, eg
+	// //iam.googleapis.com/locations/global/workforcePools/<pool>/providers/<provider>.
+	// The subject token is read from STSSubjectTokenFile or printed by
+	// STSSubjectTokenCommand for each exchange, and is of type
+	// STSSubjectTokenType (default urn:ietf:params:oauth:token-type:jwt).
+	// STSUserProject is the workforce pool user project used for quota.
+	// ServiceAccountEmail must be set; ID tokens are minted for it with the
+	// federated token.
+	STSAudience            string
+	STSSubjectTokenFile    string
+	STSSubjectTokenCommand []string
+	STSSubjectTokenType    string
+	STSUserProject         string
+	// QuotaProject is the project billed for API calls, as the
+	// quota_project_id of application default credentials would.  It
+	// defaults to the quota_project_id of the credentials file.  It is served
+	// as the quota-project-id project attribute and with the
+	// X-Goog-User-Project header of token responses, which clients should
+	// send with their API calls, and is billed for the IAM calls the
+	// emulator makes.
+	QuotaProject string
+	// SelfSignedJWT serves self-signed JWTs, which most Google APIs accept,
+	// from the token endpoint instead of access tokens so no call to Google
+	// is made.  They are signed with the service account key or Signer (or
+	// TPM key) and are for SelfSignedJWTAudience (eg
+	// https://storage.googleapis.com/) if set, or else for TokenScopes.
+	SelfSignedJWT         bool
+	SelfSignedJWTAudience string
+	// AccessBoundaryFile is a JSON Credential Access Boundary
+	// ({"accessBoundary": {"accessBoundaryRules": [...]}}).  If set, the
+	// access tokens of all service accounts are downscoped with it through
+	// the STS token exchange.
+	AccessBoundaryFile string
+	// MetricsListen is the address of a separate listener serving counters
+	// (eg of the ID token cache) as JSON at /debug/vars.
+	MetricsListen string
+	// AdminListen is the address of a separate listener serving the admin
+	// API under /admin/v1/, to inspect and change the metadata, trigger
+	// maintenance events and preemption, reload and invalidate cached
+	// tokens.  Unless AdminToken, AdminTokenFile or AdminTLSClientCAFile
+	// is set it has no authentication, so it must be a loopback address.
+	AdminListen string
+	// AdminPprof also serves the net/http/pprof profiles on AdminListen
+	// under /debug/pprof/, with the same authentication.
+	AdminPprof bool
+	// ControlListen is the address of a separate listener serving the gRPC
+	// control service mds.v1.Control defined in mds/v1/control.proto, which
+	// can also stream changes.  It is protected like AdminListen.
+	ControlListen string
+	// AdminToken, or the contents of AdminTokenFile, must be sent to the
+	// admin API as "Authorization: Bearer <token>" and to the control API
+	// with ControlToken.
+	AdminToken     string
+	AdminTokenFile string
+	// AdminTLSCertFile and AdminTLSKeyFile serve the admin and control APIs
+	// over TLS.  AdminTLSClientCAFile requires clients to present a
+	// certificate signed by one of the CAs in this PEM file.
+	AdminTLSCertFile     string
+	AdminTLSKeyFile      string
+	AdminTLSClientCAFile string
+	// PrefetchTokens fetches the default access token of every service
+	// account on Start and refreshes it in the background well before it
+	// expires, instead of on the first request after that.
+	PrefetchTokens bool
+	// TokenCacheFile persists access and ID tokens, encrypted with a key
+	// derived from TokenCachePassphrase, so they are reused after a
+	// restart.  TokenCacheKeyring reads the passphrase from the OS keyring
+	// instead (linux and macOS), creating it on first use.
+	TokenCacheFile       string
+	TokenCachePassphrase string
+	TokenCacheKeyring    bool
+	// Plugins are the commands, with arguments, of out-of-tree providers
+	// built with ServePlugin.  At most one may provide credentials, used
+	// like ExecCredential; the attributes of all of them are added to the
+	// project attributes after CustomAttributes and re-read on Reload.
+	Plugins [][]string
+	// ServiceAccountSecret is a Secret Manager secret version holding the
+	// service account key (eg projects/p/secrets/s/versions/latest), read
+	// with application default credentials.  It is re-read on Reload and
+	// every SecretRefreshInterval, if set, to pick up rotated keys.
+	ServiceAccountSecret  string
+	SecretRefreshInterval time.Duration
+	// Credentials, if set, is used directly instead of ServiceAccountFile or impersonation.
+	Credentials *google.Credentials
+	// ServiceAccounts are served under /instance/service-accounts/<email>/
+	// alongside the default account, each with its own credentials.
+	ServiceAccounts []ServiceAccountConfig
+	// ClientMappingsFile is a JSON or YAML list of ClientMappings which
+	// replaces ClientMappings if set.  Callers from a mapped address only see
+	// their account, served as default, eg to give each container on a
+	// docker network its own identity.
+	ClientMappingsFile string
+	ClientMappings     []ClientMapping
+	// Kubernetes emulates the GKE metadata server's Workload Identity: the
+	// calling pod is looked up by IP with the in-cluster Kubernetes API and
+	// the service account mapped to its Kubernetes service account is served
+	// as with ClientMappings.  KubernetesServiceAccounts maps
+	// "namespace/name" to a service account email; otherwise the
+	// iam.gke.io/gcp-service-account annotation is used.  Pods that aren't
+	// mapped see the default account.
+	Kubernetes                bool
+	KubernetesServiceAccounts map[string]string
+	// MetadataFile is an optional JSON or YAML document describing the instance
+	// and project metadata; it takes precedence over Metadata if both are set.
+	MetadataFile string
+	Metadata     *Metadata
+	// InstanceID, InstanceName and InstanceHostname override the values of
+	// the metadata.  If neither sets them the name is the local host name,
+	// the hostname is <name>.c.<project>.internal and the id is a number
+	// derived from the project and name.
+	InstanceID       string
+	InstanceName     string
+	InstanceHostname string
+	// Zone (default us-central1-a) and MachineType (default e2-medium)
+	// override the values of the metadata.  Short names are served in the
+	// projects/<number>/zones/<zone> form like on GCE.
+	Zone        string
+	MachineType string
+	// CPUPlatform (default Intel Broadwell) and Image (default
+	// projects/debian-cloud/global/images/family/debian-12) override the
+	// values of the metadata, for inventory and licensing agents.
+	CPUPlatform string
+	Image       string
+	// Tags are the instance's network tags, served as a json array, which
+	// replace the tags of the metadata if set.
+	Tags []string
+	// Licenses are the ids of the instance's licenses, served as
+	// instance/licenses/<n>/id, which replace those of the metadata if set.
+	Licenses []string
+	// Preemptible makes the instance a preemptible VM, which also changes
+	// the defaults of the other scheduling values to those of one (no
+	// automatic restart, TERMINATE on host maintenance).
+	Preemptible bool
+	// PreemptAfter, if set, preempts the instance (see Server.Preempt) this
+	// long after the server is started.
+	PreemptAfter time.Duration
+	// ScenarioFile is a YAML Scenario replayed from the start of the server:
+	// a timeline of maintenance events, preemption, faults and values set,
+	// and outage windows.
+	ScenarioFile string
+	// EventWebhooks are URLs every change of the emulator's state (see
+	// Server.Watch), such as a maintenance event, preemption or an
+	// attribute set, is POSTed to as a JSON ChangeEvent so test
+	// orchestrators can follow along.
+	EventWebhooks []string
+	// StatePath is a bbolt database the values set with SetValue, the
+	// maintenance event, preemption and faults are saved to, so a restarted
+	// emulator serves them again.  Reload discards the values.
+	StatePath string
+	// OTLPEndpoint is the base URL of an OpenTelemetry collector the spans of
+	// the requests and of the token fetches are exported to with OTLP/HTTP
+	// (eg http://localhost:4318).  Callers' traceparent headers are honored.
+	OTLPEndpoint string
+	// TraceServiceName is the service.name of the exported spans (default
+	// gce-metadata-server).
+	TraceServiceName string
+	// AccessLogFile, if set, is appended a line for every request, apart
+	// from the application log, in AccessLogFormat: "common" (Common Log
+	// Format, the default) or "json".  The file is rotated when it reaches
+	// AccessLogMaxSize megabytes (default 100) and every
+	// AccessLogRotateInterval if set; AccessLogMaxBackups rotated files are
+	// kept (default all).
+	AccessLogFile           string
+	AccessLogFormat         string
+	AccessLogMaxSize        int
+	AccessLogMaxBackups     int
+	AccessLogRotateInterval time.Duration
+	// TokenAuditFile, if set, is appended a JSON line for every access and
+	// ID token served: when, to whom (the client address and, on linux,
+	// the peer's pid, uid and executable, which needs root for tcp
+	// callers) and with which scopes or audience.
+	TokenAuditFile string
+	// PathLogLevels sets the log level of the requests for paths, relative
+	// to /computeMetadata/v1/ unless they start with /computeMetadata/ or
+	// /0.1/, and ending with * to match a prefix: debug, info, warn, error
+	// or off.  The longest matching path applies; the level may be below
+	// the logger's, eg to silence the token endpoint while logging the
+	// attribute reads at debug.
+	PathLogLevels map[string]string
+	// Latencies delays the requests for paths, which are matched like
+	// PathLogLevels, to test client timeouts and hedging: by a duration
+	// (2s), a uniformly distributed one in a range (2s-5s) or a normally
+	// distributed one with a mean and standard deviation (3s~500ms).
+	Latencies map[string]string
+	// ErrorRates fails a share of the requests for paths, matched like
+	// PathLogLevels, to validate retries under partial failure: comma
+	// separated percentages with an HTTP status (default 500) or reset to
+	// reset the connection, eg 10%:503,5%:reset.
+	ErrorRates map[string]string
+	// RateLimits throttles each client IP's requests for paths, matched
+	// like PathLogLevels, with a token bucket: over the rate (10/s, 600/m)
+	// and burst (10/s:20, by default the rate per second) requests get 429
+	// with Retry-After, like the production server's answer to clients
+	// polling in a tight loop.
+	RateLimits map[string]string
+	// StaticIDTokens maps audiences to files holding pre-generated ID tokens
+	// which are served instead of minting tokens, eg for offline tests.
+	// Other audiences get StaticIDTokenStatus (default 400).  The files are
+	// re-read on Reload.
+	StaticIDTokens      map[string]string
+	StaticIDTokenStatus int
+	// AllowedAudiences, if set, are the only audiences ID tokens are issued
+	// for, and none are issued for DeniedAudiences, so a shared server can't
+	// mint tokens for arbitrary services.  * matches any run of characters
+	// (eg https://*.a.run.app).  Other audiences get a 403.  This includes
+	// StaticIDTokens.
+	AllowedAudiences []string
+	DeniedAudiences  []string
+	// AllowedScopes, if set, are the only scopes access tokens are issued
+	// with, whether configured (TokenScopes, ServiceAccountConfig.Scopes) or
+	// requested with ?scopes=.  * matches any run of characters.  Requests
+	// for other scopes get a 403.
+	AllowedScopes []string
+	// Fake mints locally signed JWT access and ID tokens for every account
+	// and never contacts Google, eg for hermetic tests; no credentials are
+	// needed but ServiceAccountEmail must be set.  Tokens are signed with the
+	// RSA key in FakeKeyFile (PEM) or a key generated on startup, are issued
+	// by FakeIssuer (default https://accounts.google.com) and last
+	// FakeTokenLifetime (default 1h).  FakeClaims are added to ID tokens and
+	// may replace the standard claims; FakeClaimsFile is a JSON object of
+	// claims which replaces FakeClaims if set.  String values may use the
+	// ${name} variables iss, aud, sub, email, iat, exp and the instance's
+	// project_id, project_number, instance_id, instance_name, zone,
+	// instance_creation_timestamp and license_id.
+	Fake              bool
+	FakeKeyFile       string
+	FakeIssuer        string
+	FakeTokenLifetime time.Duration
+	FakeClaims        map[string]interface{}
+	FakeClaimsFile    string
+	// FakeJWKSPath is where the fake signing keys are served as a JWK set so
+	// services under test can verify fake tokens (default /oauth2/v3/certs).
+	FakeJWKSPath string
+	// Deterministic freezes everything a golden-file or record/replay test
+	// would see change between runs, and implies Fake: the fake key is
+	// derived from DeterministicSeed unless FakeKeyFile is set, tokens are
+	// issued at 2020-01-01T00:00:00Z and expire in 2100 (the token endpoint
+	// reports FakeTokenLifetime as expires_in), and the instance's id and
+	// name (and so hostname) and creation time are derived from the seed
+	// unless configured.  ETags follow the content and so are stable too.
+	Deterministic     bool
+	DeterministicSeed string
+	// ClockSkew serves tokens as if the server's clock were off by it (eg
+	// 5m ahead, -5m behind): expires_in is shifted, and so are the iat and
+	// exp claims of the tokens signed locally (fake, self-signed or full
+	// format ID tokens), to test how clients deal with skewed token lifetimes and
+	// tokens that have already expired.  Tokens are still refreshed on time.
+	ClockSkew time.Duration
+	// MaxTokenLifetime, if set, caps the expires_in of served access tokens
+	// and the lifetime of fake, self-signed and impersonated tokens (eg to
+	// 1m) so clients go through their refresh paths often.  Other tokens are
+	// still reused for as long as they are valid.
+	MaxTokenLifetime time.Duration
+	// MaxOutboundCalls, if set, bounds the concurrent calls to Google's token
+	// and IAM endpoints fetching access and ID tokens for all accounts and
+	// tenants; the others wait for a slot, so thousands of parallel client
+	// requests don't become thousands of simultaneous token requests.
+	MaxOutboundCalls int
+	// Tenants are additional emulated projects/instances, each with its own
+	// credentials and metadata, selected by the value of the TenantHeader
+	// request header or, if that is empty, by the Host header (eg
+	// vm1:8080 for tenant vm1).  TenantsFile is a JSON or YAML file of
+	// Tenants which replaces Tenants if set.
+	Tenants      map[string]TenantConfig
+	TenantsFile  string
+	TenantHeader string
+	// Flavor is the metadata server to behave like: FlavorGCE (the default),
+	// FlavorGKE or FlavorCloudRun.
+	Flavor string
+	// LegacyEndpoints serves the v1beta1 and 0.1 endpoints (LegacyServe) or
+	// rejects them with a 403 (LegacyDeny), as VMs did before and after
+	// legacy endpoints were disabled.  By default they are not found.
+	LegacyEndpoints string
+	// CompatTrailingSlash matches the real server's handling of trailing
+	// slashes: directories requested without one are redirected with a 301
+	// and leaf values requested with one return 404.
+	CompatTrailingSlash bool
+	// Strict matches the production server's error pages, content types and
+	// headers as closely as possible.  Implies CompatTrailingSlash.
+	Strict bool
+}
+
+// Server is an emulated GCE metadata server.
+type Server struct {
+	cfg Config
+
+	// configured is the default service account of the Config and primary
+	// the one served, which SwitchServiceAccount replaces.  primaryMu
+	// guards primary.  accounts holds the additional ones by email.
+	configured *account
+	primaryMu  sync.RWMutex
+	primary    *account
+	accounts   map[string]*account
+	// aliases holds the additional accounts by ServiceAccountConfig.Aliases
+	aliases map[string]*account
+	// kube finds the service account of calling pods in Kubernetes mode
+	kube *kubeClient
+	// containers caches the containers of callers for container mappings
+	containers containerCache
+	// tenants are the servers of the emulated tenants by name
+	tenants map[string]*Server
+	// secretVersion is the Secret Manager version the key was read from
+	secretVersion string
+	// plugins are the running Config.Plugins
+	plugins []*pluginClient
+	// tokenCache persists the tokens of all accounts if configured
+	tokenCache *tokenCache
+	// outbound bounds the concurrent token fetches of all accounts
+	outbound *outboundLimiter
+	// fake mints the tokens of all accounts in fake mode
+	fake *fakeIssuer
+	// audiences and scopes restrict the audiences of ID tokens and the
+	// scopes of access tokens if configured
+	audiences *audiencePolicy
+	scopes    scopePolicy
+
+	// mu guards the metadata below; changed is closed and replaced whenever
+	// the metadata is modified to wake up wait_for_change requests.
+	mu             sync.RWMutex
+	tree           map[string]interface{}
+	clientMappings []clientMapping
+	staticIDTokens map[string]string
+	changed        chan struct{}
+	// maintenanceEvent is the event set with SetMaintenanceEvent, if any
+	maintenanceEvent string
+	preempted        bool
+	// scenario is replayed on Start if set
+	scenario *Scenario
+	// state persists the changes made at runtime if StatePath is set
+	state *stateStore
+	// tracer exports spans if OTLPEndpoint is set
+	tracer *tracer
+	// accessLog is written if AccessLogFile is set
+	accessLog *accessLog
+	// readiness is reported on /readyz
+	readiness readiness
+	// audit records the tokens issued if TokenAuditFile is set
+	audit *tokenAudit
+	// pathLogLevels are the parsed PathLogLevels
+	pathLogLevels []pathLogLevel
+	// latencies are the parsed Latencies
+	latencies []latency
+	// errorRates are the parsed ErrorRates
+	errorRates []errorRate
+	rand       *lockedRand
+	// rateLimits are the parsed RateLimits, limiter their buckets
+	rateLimits []rateLimit
+	limiter    rateLimiter
+	// faults are the injected faults by path
+	faults map[string]Fault
+	// watchers receive ChangeEvents, see Watch
+	watchers map[chan ChangeEvent]struct{}
+	// adminToken and adminTLS protect the admin and control APIs
+	adminToken string
+	adminTLS   *tls.Config
+
+	srv               *http.Server
+	listener          net.Listener
+	metricsSrv        *http.Server
+	adminSrv          *http.Server
+	controlSrv        *grpc.Server
+	teardownInterface func() error
+	// stop is closed on Shutdown to end background goroutines
+	stop         chan struct{}
+	shutdownOnce sync.Once
+	// created is reported as the instance creation time in format=full ID
+	// tokens
+	created time.Time
+}
+
+type metadataToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// NewMetadataServer creates a Server from the given Config.  Credentials are
+// resolved here so configuration errors surface before the server is started.
+func NewMetadataServer(ctx context.Context, cfg Config) (*Server, error) {
+	s := &Server{
+		cfg:     cfg,
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+		created: time.Now(),
+		primary: &account{
+			email:        cfg.ServiceAccountEmail,
+			scopes:       cfg.TokenScopes,
+			impersonate:  cfg.Impersonate,
+			delegates:    cfg.Delegates,
+			lifetime:     cappedLifetime(cfg.ImpersonatedTokenLifetime, cfg.MaxTokenLifetime),
+			keyID:        cfg.TPMKeyID,
+			quotaProject: cfg.QuotaProject,
+		},
+		accounts: map[string]*account{},
+		aliases:  map[string]*account{},
+	}
+	a := s.primary
+	s.configured = a
+	s.outbound = newOutboundLimiter(cfg.MaxOutboundCalls)
+	a.outbound = s.outbound
+	if cfg.Strict {
+		s.cfg.CompatTrailingSlash = true
+	}
+	if cfg.Deterministic {
+		cfg.Fake, s.cfg.Fake = true, true
+		s.created = deterministicEpoch
+	}
+	if s.cfg.Flavor == "" {
+		s.cfg.Flavor = FlavorGCE
+	}
+	if err := validFlavor(s.cfg.Flavor); err != nil {
+		return nil, err
+	}
+	if err := validLegacyEndpoints(cfg.LegacyEndpoints); err != nil {
+		return nil, err
+	}
+	if err := s.loadAdminAuth(); err != nil {
+		return nil, err
+	}
+	if cfg.ScenarioFile != "" {
+		sc, err := LoadScenarioFile(cfg.ScenarioFile)
+		if err != nil {
+			return nil, err
+		}
+		s.scenario = sc
+	}
+	if _, err := strconv.ParseUint(cfg.InstanceID, 10, 64); cfg.InstanceID != "" && err != nil {
+		return nil, fmt.Errorf("instance id must be a number: %s", cfg.InstanceID)
+	}
+	audiences, err := newAudiencePolicy(cfg.AllowedAudiences, cfg.DeniedAudiences)
+	if err != nil {
+		return nil, err
+	}
+	s.audiences = audiences
+	s.scopes, err = newScopePolicy(cfg.AllowedScopes)
+	if err != nil {
+		return nil, err
+	}
+	plugins, err := startPlugins(cfg.Plugins)
+	if err != nil {
+		return nil, err
+	}
+	s.plugins = plugins
+	// everything opened below is released if the server isn't returned
+	started := false
+	defer func() {
+		if !started {
+			s.release()
+		}
+	}()
+	credPlugin, err := credentialPlugin(plugins)
+	if err != nil {
+		return nil, err
+	}
+
+	// First check if env-var based overrides are set.  We need all of them to be set for the
+	// client libraries.  We are _not_ going to set a credential object here but read it on request.
+	// TODO: make the credential and runtime source data an adapter: eg, token, projectiD, etc
+	//       gets read in from a variety of sources (args+svcAccountFile, env vars, kubernetes secrets)
+	// serviceAccountFile based credentials isn't necessary if env-var based settings are used.
+	// technically, you could mix and match env var and svc-account values but that makes it
+	// pretty confusing...so I'll just go w/ one or the other
+
+	if isEnvironmentOverrideSet() {
+		logger.Infoln("Using environment variables for credentials")
+	} else if cfg.Fake {
+		logger.Infoln("Minting fake tokens; Google is never contacted")
+		if cfg.ServiceAccountEmail == "" {
+			return nil, errors.New("serviceAccountEmail must be set in fake mode")
+		}
+		if cfg.SelfSignedJWT || cfg.AccessBoundaryFile != "" {
+			return nil, errors.New("fake tokens can't be self-signed JWTs or downscoped")
+		}
+		s.fake, err = newFakeIssuer(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.fake.vars = s.fakeClaimVars
+		a.useFake(s.fake)
+		a.creds.ProjectID = cfg.ProjectID
+	} else if cfg.Credentials != nil {
+		logger.Infoln("Using provided credentials")
+		a.creds = cfg.Credentials
+	} else if cfg.Signer != nil {
+		logger.Infoln("Using the provided signer for credentials")
+		if cfg.ServiceAccountEmail == "" {
+			return nil, errors.New("serviceAccountEmail must be set if a signer is used")
+		}
+		a.keyID = cfg.SignerKeyID
+		if err := a.useSigner(ctx, cfg.Signer); err != nil {
+			return nil, err
+		}
+		a.creds.ProjectID = cfg.ProjectID
+	} else if cfg.TPMPath != "" {
+		logger.Infof("Using TPM key 0x%x for credentials", cfg.TPMKeyHandle)
+		if cfg.ServiceAccountEmail == "" {
+			return nil, errors.New("serviceAccountEmail must be set if a TPM key is used")
+		}
+		signer, err := newTPMSigner(cfg.TPMPath, cfg.TPMKeyHandle)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.useSigner(ctx, signer); err != nil {
+			signer.Close()
+			return nil, err
+		}
+		a.creds.ProjectID = cfg.ProjectID
+	} else if cfg.VaultPath != "" {
+		logger.Infof("Using vault path %s for credentials", cfg.VaultPath)
+		if cfg.VaultAddr == "" || cfg.ServiceAccountEmail == "" {
+			return nil, errors.New("vaultAddr and serviceAccountEmail must be set if vault is used")
+		}
+		a.creds = &google.Credentials{
+			ProjectID: cfg.ProjectID,
+			TokenSource: oauth2.ReuseTokenSource(nil, &vaultTokenSource{
+				ctx:   ctx,
+				addr:  cfg.VaultAddr,
+				path:  cfg.VaultPath,
+				token: cfg.VaultToken,
+			}),
+		}
+	} else if len(cfg.ExecCredential) > 0 {
+		logger.Infof("Using credential command %s", cfg.ExecCredential[0])
+		if cfg.ServiceAccountEmail == "" {
+			return nil, errors.New("serviceAccountEmail must be set if a credential command is used")
+		}
+		a.external = &externalCredential{
+			provider: &execProvider{command: cfg.ExecCredential},
+			email:    cfg.ServiceAccountEmail,
+		}
+		a.creds = &google.Credentials{
+			ProjectID:   cfg.ProjectID,
+			TokenSource: a.external.tokenSource(cfg.TokenScopes),
+		}
+	} else if cfg.WebhookURL != "" {
+		logger.Infof("Using credentials from webhook %s", cfg.WebhookURL)
+		if cfg.ServiceAccountEmail == "" {
+			return nil, errors.New("serviceAccountEmail must be set if a webhook is used")
+		}
+		p, err := newWebhookProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+		a.external = &externalCredential{provider: p, email: cfg.ServiceAccountEmail}
+		a.creds = &google.Credentials{
+			ProjectID:   cfg.ProjectID,
+			TokenSource: a.external.tokenSource(cfg.TokenScopes),
+		}
+	} else if credPlugin != nil {
+		logger.Infof("Using credentials from plugin %s", credPlugin.info.Name)
+		if cfg.ServiceAccountEmail == "" {
+			return nil, errors.New("serviceAccountEmail must be set if a credential plugin is used")
+		}
+		a.external = &externalCredential{provider: credPlugin, email: cfg.ServiceAccountEmail}
+		a.creds = &google.Credentials{
+			ProjectID:   cfg.ProjectID,
+			TokenSource: a.external.tokenSource(cfg.TokenScopes),
+		}
+	} else if cfg.STSAudience != "" {
+		logger.Infof("Using token exchange with %s for credentials", cfg.STSAudience)
+		if cfg.ServiceAccountEmail == "" {
+			return nil, errors.New("serviceAccountEmail must be set if token exchange is used")
+		}
+		if (cfg.STSSubjectTokenFile == "") == (len(cfg.STSSubjectTokenCommand) == 0) {
+			return nil, errors.New("one of stsSubjectTokenFile and stsSubjectTokenCommand must be set if token exchange is used")
+		}
+		tokenType := cfg.STSSubjectTokenType
+		if tokenType == "" {
+			tokenType = defaultSubjectTokenType
+		}
+		a.creds = &google.Credentials{
+			ProjectID: cfg.ProjectID,
+			TokenSource: oauth2.ReuseTokenSource(nil, &stsTokenSource{
+				ctx:         ctx,
+				audience:    cfg.STSAudience,
+				scopes:      cfg.TokenScopes,
+				tokenType:   tokenType,
+				tokenFile:   cfg.STSSubjectTokenFile,
+				command:     cfg.STSSubjectTokenCommand,
+				userProject: cfg.STSUserProject,
+			}),
+		}
+	} else if cfg.ServiceAccountSecret != "" {
+		logger.Infof("Using service account key from secret %s", cfg.ServiceAccountSecret)
+		if err := s.refreshSecretCredentials(ctx); err != nil {
+			return nil, err
+		}
+	} else if cfg.Impersonate {
+		logger.Infoln("Using Service Account Impersonation")
+
+		if cfg.NumericProjectID == "" || cfg.ProjectID == "" || cfg.ServiceAccountEmail == "" {
+			return nil, errors.New("projectId,numericProjectId,serviceAccountEmail must be set if impersonation is used")
+		}
+
+		ts, err := a.impersonatedTokenSource(ctx, cfg.TokenScopes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create Impersonated TokenSource %v ", err)
+		}
+
+		a.creds = &google.Credentials{
+			ProjectID:   cfg.ProjectID,
+			TokenSource: ts,
+		}
+
+	} else {
+
+		if cfg.ServiceAccountFile == "" && len(cfg.ServiceAccountJSON) == 0 {
+			return nil, errors.New("either environment variable overides or serviceAccountFile must be specified")
+		}
+
+		var data []byte
+		var err error
+		if len(cfg.ServiceAccountJSON) > 0 {
+			if cfg.ServiceAccountFile != "" {
+				return nil, errors.New("only one of serviceAccountFile and serviceAccountJSON may be set")
+			}
+			logger.Infoln("Using credentials from the provided JSON")
+			data, err = decodeCredentialsJSON(cfg.ServiceAccountJSON)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			logger.Infof("Using credentials from %s", cfg.ServiceAccountFile)
+			//creds, err = google.FindDefaultCredentials(ctx, tokenScopes)
+			data, err = ioutil.ReadFile(cfg.ServiceAccountFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read serviceAccountFile %v", err)
+			}
+		}
+		a.creds, err = google.CredentialsFromJSON(ctx, data, cfg.TokenScopes...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse serviceAccountFile %v ", err)
+		}
+	}
+
+	f, err := a.parseCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		logger.Infof("Using %s credentials", f.Type)
+		if s.cfg.ServiceAccountEmail == "" {
+			if f.email() == "" {
+				return nil, credentialsError(f)
+			}
+			s.cfg.ServiceAccountEmail = f.email()
+			a.email = f.email()
+		}
+	}
+	if !isEnvironmentOverrideSet() && s.cfg.ServiceAccountEmail == "" {
+		return nil, errors.New("unable to determine serviceAccountEmail; it must be set for these credentials")
+	}
+	if f != nil && s.cfg.QuotaProject == "" {
+		s.cfg.QuotaProject = f.QuotaProjectID
+		a.quotaProject = f.QuotaProjectID
+	}
+	var boundary string
+	if cfg.AccessBoundaryFile != "" {
+		if cfg.SelfSignedJWT {
+			return nil, errors.New("self-signed JWTs can't be downscoped with a credential access boundary")
+		}
+		boundary, err = loadAccessBoundary(cfg.AccessBoundaryFile)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("Downscoping access tokens with %s", cfg.AccessBoundaryFile)
+	}
+	if cfg.SelfSignedJWT {
+		logger.Infoln("Serving self-signed JWTs as access tokens")
+	}
+	a.selfSignedJWT, a.jwtAudience, a.accessBoundary = cfg.SelfSignedJWT, cfg.SelfSignedJWTAudience, boundary
+	a.maxLifetime, a.skew = cfg.MaxTokenLifetime, cfg.ClockSkew
+	if !isEnvironmentOverrideSet() {
+		if err := a.applyTokenOptions(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.TokenCacheFile != "" && !isEnvironmentOverrideSet() {
+		passphrase := []byte(cfg.TokenCachePassphrase)
+		if cfg.TokenCacheKeyring {
+			passphrase, err = keyringPassphrase()
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.tokenCache, err = openTokenCache(cfg.TokenCacheFile, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		a.cache = s.tokenCache
+	}
+
+	for _, c := range cfg.ServiceAccounts {
+		if c.Email == s.getServiceAccountEmail() || s.accounts[c.Email] != nil {
+			return nil, fmt.Errorf("service account %s is configured more than once", c.Email)
+		}
+		var acct *account
+		if s.fake != nil {
+			acct, err = newFakeAccount(c, cfg.TokenScopes, s.fake)
+		} else {
+			acct, err = newAccount(ctx, c, cfg.TokenScopes, s.cfg.QuotaProject, cfg.MaxTokenLifetime)
+		}
+		if err != nil {
+			return nil, err
+		}
+		acct.accessBoundary = boundary
+		acct.cache = s.tokenCache
+		acct.outbound = s.outbound
+		if err := acct.applyTokenOptions(); err != nil {
+			return nil, err
+		}
+		s.accounts[c.Email] = acct
+	}
+	for _, acct := range s.accounts {
+		for _, alias := range acct.aliases {
+			if alias == "default" || alias == s.getServiceAccountEmail() || s.accounts[alias] != nil || s.aliases[alias] != nil {
+				return nil, fmt.Errorf("alias %s of %s is already in use", alias, acct.email)
+			}
+			s.aliases[alias] = acct
+		}
+	}
+	if err := s.scopes.check(cfg.TokenScopes); err != nil {
+		return nil, fmt.Errorf("tokenScopes: %v", err)
+	}
+	for email, acct := range s.accounts {
+		if err := s.scopes.check(acct.scopes); err != nil {
+			return nil, fmt.Errorf("scopes of %s: %v", email, err)
+		}
+	}
+	if cfg.Kubernetes {
+		s.kube, err = newKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		for ksa, gsa := range cfg.KubernetesServiceAccounts {
+			if _, ok := s.accountByEmail(gsa); !ok {
+				return nil, fmt.Errorf("kubernetes service account %s is mapped to %s which is not configured", ksa, gsa)
+			}
+		}
+	}
+
+	s.tree, err = s.loadMetadata()
+	if err != nil {
+		return nil, err
+	}
+	s.clientMappings, err = s.loadClientMappings()
+	if err != nil {
+		return nil, err
+	}
+	s.staticIDTokens, err = s.loadStaticIDTokens()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.newTenants(ctx); err != nil {
+		return nil, err
+	}
+	if cfg.StatePath != "" {
+		s.state, err = openStateStore(cfg.StatePath)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.restoreState(); err != nil {
+			return nil, err
+		}
+	}
+
+	r := mux.NewRouter()
+	r.StrictSlash(!s.cfg.CompatTrailingSlash)
+	if s.cfg.CompatTrailingSlash {
+		r.Handle("/computeMetadata", s.checkMetadataHeaders(http.HandlerFunc(s.redirectSlash))).Methods("GET")
+		r.Handle("/computeMetadata/v1", s.checkMetadataHeaders(http.HandlerFunc(s.redirectSlash))).Methods("GET")
+	}
+	s.routeFlavor(r)
+	s.routeLegacy(r)
+	s.routeFake(r)
+	r.Handle("/computeMetadata/v1/instance/service-accounts/{acct}/{key:identity|token}", s.checkMetadataHeaders(http.HandlerFunc(s.getServiceAccountHandler))).Methods("GET")
+	r.PathPrefix("/computeMetadata/v1/").Handler(s.checkMetadataHeaders(http.HandlerFunc(s.metadataHandler))).Methods("GET")
+	r.Handle("/computeMetadata/", s.checkMetadataHeaders(http.HandlerFunc(s.rootHandler))).Methods("GET")
+	r.Handle("/", s.checkMetadataHeaders(http.HandlerFunc(s.rootHandler))).Methods("GET")
+	r.NotFoundHandler = s.checkMetadataHeaders(http.HandlerFunc(s.notFound))
+	//r.Handle("/", checkMetadataHeaders(http.FileServer(http.Dir("./static"))))
+
+	if cfg.OTLPEndpoint != "" {
+		s.tracer = newTracer(cfg.OTLPEndpoint, cfg.TraceServiceName)
+	}
+	if cfg.AccessLogFile != "" {
+		s.accessLog, err = newAccessLog(&cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.pathLogLevels, err = parsePathLogLevels(cfg.PathLogLevels)
+	if err != nil {
+		return nil, err
+	}
+	s.latencies, err = parseLatencies(cfg.Latencies)
+	if err != nil {
+		return nil, err
+	}
+	s.errorRates, err = parseErrorRates(cfg.ErrorRates)
+	if err != nil {
+		return nil, err
+	}
+	s.rateLimits, err = parseRateLimits(cfg.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+	s.rand = newLockedRand()
+	if cfg.TokenAuditFile != "" {
+		s.audit, err = openTokenAudit(cfg.TokenAuditFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.srv = &http.Server{
+		Addr:              cfg.Port,
+		Handler:           s.probes(s.logRequests(s.traceRequests(s.limitRequests(s.tenantHandler(r), s.writeError)))),
+		ConnContext:       s.connContext,
+		MaxHeaderBytes:    s.maxHeaderBytes(),
+		ReadHeaderTimeout: s.requestReadTimeout(),
+	}
+	s.srv.TLSConfig, err = s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	http2.ConfigureServer(s.srv, &http2.Server{})
+
+	started = true
+	return s, nil
+}
+
+// Start begins listening on the configured port.  It returns once the listener
+// is bound; requests are served in the background until Shutdown is called.
+func (s *Server) Start() error {
+	if s.cfg.SetupInterface {
+		name := s.cfg.InterfaceName
+		if name == "" {
+			name = defaultInterfaceName
+		}
+		teardown, err := setupInterface(name, net.ParseIP(metadataIP))
+		if err != nil {
+			return err
+		}
+		logger.Infof("Created interface %s with address %s", name, metadataIP)
+		s.teardownInterface = teardown
+		if s.cfg.Listen == "" {
+			s.cfg.Listen = metadataIP + ":80"
+		}
+	}
+
+	logger.Infof("Starting GCP metadataserver on port, %v", s.listenAddress())
+	if s.scenario != nil {
+		s.scenario.start = time.Now()
+	}
+	l, err := s.listen()
+	if err != nil {
+		s.removeInterface()
+		return fmt.Errorf("listen: %v", err)
+	}
+	s.listener = l
+	if s.cfg.RunAsUser != "" || s.cfg.RunAsGroup != "" {
+		if err := dropPrivileges(s.cfg.RunAsUser, s.cfg.RunAsGroup); err != nil {
+			l.Close()
+			s.removeInterface()
+			return err
+		}
+		logger.Infof("Running as uid %d gid %d", os.Getuid(), os.Getgid())
+	}
+	// bind the other listeners before anything runs in the background, so
+	// nothing is left running if one of them fails
+	if err := s.startListeners(); err != nil {
+		l.Close()
+		if s.metricsSrv != nil {
+			s.metricsSrv.Close()
+		}
+		if s.adminSrv != nil {
+			s.adminSrv.Close()
+		}
+		s.removeInterface()
+		return err
+	}
+	go func() {
+		serve := s.srv.Serve
+		if s.cfg.TLSCertFile != "" {
+			// the certificate is already loaded into TLSConfig
+			serve = func(l net.Listener) error { return s.srv.ServeTLS(l, "", "") }
+		}
+		if err := serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("serve: %s", err)
+		}
+	}()
+	if s.cfg.ServiceAccountSecret != "" && s.cfg.SecretRefreshInterval > 0 {
+		go s.watchSecret(s.cfg.SecretRefreshInterval)
+	}
+	if s.cfg.PreemptAfter > 0 {
+		go s.preemptAfter(s.cfg.PreemptAfter)
+	}
+	if len(s.cfg.EventWebhooks) > 0 {
+		s.startEventWebhooks()
+	}
+	if s.tracer != nil {
+		go s.tracer.run(s.stop)
+	}
+	if s.accessLog != nil && s.cfg.AccessLogRotateInterval > 0 {
+		go s.accessLog.rotate(s.cfg.AccessLogRotateInterval, s.stop)
+	}
+	if s.scenario != nil {
+		go s.runScenario(s.scenario)
+	}
+	if s.cfg.PrefetchTokens && !isEnvironmentOverrideSet() {
+		s.prefetchTokens()
+	}
+	logger.Infoln("Server Started")
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Errorf("Unable to notify systemd: %v", err)
+	}
+	go s.warmUp()
+	liveServers.Lock()
+	liveServers.m[s] = struct{}{}
+	liveServers.Unlock()
+	return nil
+}
+
+// startListeners serves the metrics, admin and control APIs on their
+// listeners, if set.
+func (s *Server) startListeners() error {
+	if s.cfg.MetricsListen != "" {
+		if err := s.startMetrics(); err != nil {
+			return err
+		}
+	}
+	if s.cfg.AdminListen != "" {
+		if err := s.startAdmin(); err != nil {
+			return err
+		}
+	}
+	if s.cfg.ControlListen != "" {
+		if err := s.startControl(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) listenAddress() string {
+	if s.cfg.Listen != "" {
+		return s.cfg.Listen
+	}
+	return s.cfg.Port
+}
+
+func (s *Server) removeInterface() {
+	if s.teardownInterface == nil {
+		return
+	}
+	if err := s.teardownInterface(); err != nil {
+		logger.Errorf("%v", err)
+	}
+	s.teardownInterface = nil
+}
+
+// Addr returns the address the server is listening on, which is useful if
+// Config.Port was set to an ephemeral port like ":0".
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Shutdown gracefully stops the server.  What the server holds is released
+// even if requests are still running after 10s, which is then returned as
+// an error.  Later calls do nothing.
+func (s *Server) Shutdown() error {
+	var err error
+	s.shutdownOnce.Do(func() { err = s.shutdown() })
+	return err
+}
+
+func (s *Server) shutdown() error {
+	if err := sdNotify("STOPPING=1"); err != nil {
+		logger.Errorf("Unable to notify systemd: %v", err)
+	}
+	s.readiness.set(false, "shutting down")
+	liveServers.Lock()
+	delete(liveServers.m, s)
+	liveServers.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	close(s.stop)
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		// drop the connections of the requests still running
+		s.srv.Close()
+	}
+	// tenants aren't started, they only serve requests passed on by s
+	for _, t := range s.tenants {
+		close(t.stop)
+	}
+	s.release()
+	logger.Infoln("Server Stopped")
+	return err
+}
+
+// release stops the server's other listeners and frees what it and its
+// tenants hold once it no longer serves requests, or if NewMetadataServer
+// fails.
+func (s *Server) release() {
+	s.tracer.export()
+	s.accessLog.close()
+	s.audit.close()
+	if s.metricsSrv != nil {
+		s.metricsSrv.Close()
+	}
+	if s.adminSrv != nil {
+		s.adminSrv.Close()
+	}
+	if s.controlSrv != nil {
+		s.controlSrv.Stop()
+	}
+	s.removeInterface()
+	// a Config.Signer belongs to the caller
+	if c, ok := s.configured.signer.(io.Closer); ok && s.cfg.Signer == nil {
+		c.Close()
+	}
+	closePlugins(s.plugins)
+	s.state.close()
+	for _, t := range s.tenants {
+		t.release()
+	}
+}
+
+// startMetrics serves expvar counters on MetricsListen.
+func (s *Server) startMetrics() error {
+	l, err := net.Listen("tcp", s.cfg.MetricsListen)
+	if err != nil {
+		return fmt.Errorf("metrics listen: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	s.metricsSrv = &http.Server{Handler: mux}
+	go func() {
+		if err := s.metricsSrv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("metrics serve: %s", err)
+		}
+	}()
+	logger.Infof("Serving metrics on %s/debug/vars", l.Addr())
+	return nil
+}
+
+// account returns the service account named in a request path: the one
+// mapped to the caller, one of the additional ServiceAccounts or, for default
+// and any other account, the default one.
+func (s *Server) account(r *http.Request, name string) *account {
+	if a, ok := s.clientAccount(r); ok {
+		return a
+	}
+	if a, ok := s.accounts[name]; ok {
+		return a
+	}
+	if a, ok := s.aliases[name]; ok {
+		return a
+	}
+	return s.defaultAccount()
+}
+
+// getAccessToken returns an access token for the account with the requested
+// scopes, or the account's scopes if none are requested.
+func (s *Server) getAccessToken(ctx context.Context, a *account, scopes []string) (*metadataToken, error) {
+	var tok *oauth2.Token
+	var err error
+	if a == s.configured && isEnvironmentOverrideSet() {
+		// access_token is opaque but you _can_ get the exp
+		// time by calling  curl https://www.googleapis.com/oauth2/v3/tokeninfo?access_token=
+		// ...but i don't see it necessary to populate the expiration field, besides
+		// https://godoc.org/golang.org/x/oauth2#Token
+		tok = &oauth2.Token{
+			AccessToken: os.Getenv(googleAccessToken),
+			//Expiry:      time.Now().Add(time.Hour * 1),
+			TokenType: "Bearer",
+		}
+	} else {
+		tok, err = a.accessToken(ctx, scopes)
+	}
+	if err != nil {
+		logger.Error(err)
+		return &metadataToken{}, err
+	}
+
+	loc, _ := time.LoadLocation("UTC")
+	now := time.Now().In(loc)
+	diff := tok.Expiry.Sub(now)
+	if s.cfg.Deterministic && s.fake != nil {
+		diff = s.fake.lifetime
+	}
+	if max := s.cfg.MaxTokenLifetime; max > 0 && diff > max {
+		diff = max
+	}
+	diff += s.cfg.ClockSkew
+	return &metadataToken{
+		AccessToken: tok.AccessToken,
+		ExpiresIn:   int(diff.Round(time.Second).Seconds()),
+		TokenType:   tok.TokenType,
+	}, nil
+
+}
+
+func (s *Server) getIDToken(ctx context.Context, a *account, targetAudience string) (string, error) {
+	if a == s.configured && isEnvironmentOverrideSet() {
+		return os.Getenv(googleIDToken), nil
+	}
+	tok, err := a.idToken(ctx, targetAudience)
+	if err != nil {
+		logger.Error(err)
+		return "", err
+	}
+	return tok, nil
+}
+
+func (s *Server) getProjectID() string {
+	if isEnvironmentOverrideSet() {
+		return os.Getenv(googleProjectID)
+	} else if s.cfg.ProjectID != "" {
+		return s.cfg.ProjectID
+	}
+	if v := s.configuredValue("project", "project-id"); v != "" {
+		return v
+	}
+	return s.configured.creds.ProjectID
+}
+
+func (s *Server) getNumericProjectID() string {
+	if isEnvironmentOverrideSet() {
+		return os.Getenv(googleNumericProjectID)
+	} else if s.cfg.NumericProjectID != "" {
+		return s.cfg.NumericProjectID
+	}
+	return s.configuredValue("project", "numeric-project-id")
+}
+
+// configuredValue returns the leaf value set in the metadata config, if any.
+func (s *Server) configuredValue(path ...string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := lookupPath(s.tree, path)
+	if !ok {
+		return ""
+	}
+	val, _ := renderLeaf(v)
+	return val
+}
+
+func (s *Server) getServiceAccountEmail() string {
+	if isEnvironmentOverrideSet() {
+		return os.Getenv(googleAccountEmail)
+	}
+	return s.defaultAccount().email
+}
+
+// checkedHandler is next wrapped by checkMetadataHeaders.
+type checkedHandler struct {
+	s    *Server
+	next http.Handler
+}
+
+func (s *Server) checkMetadataHeaders(next http.Handler) http.Handler {
+	return checkedHandler{s: s, next: next}
+}
+
+func (c checkedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s, next := c.s, c.next
+	s.requestLogger(r).Debugw("Got Request", "method", r.Method, "url", r.URL.String(), "remoteAddr", r.RemoteAddr, "headers", logHeaders(r.Header))
+	w.Header().Set("Server", serverHeaders[s.cfg.Flavor])
+	w.Header().Set("Metadata-Flavor", "Google")
+	w.Header().Set("X-XSS-Protection", "0")
+	if s.cfg.Strict {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	} else {
+		w.Header().Set("X-Frame-Options", "0")
+	}
+
+	if !s.validHost(r.Host) {
+		s.writeError(w, r, http.StatusForbidden, "")
+		return
+	}
+	flavor := r.Header.Get("Metadata-Flavor")
+	if flavor == "" && r.RequestURI != "/" {
+		s.writeError(w, r, http.StatusForbidden, "Missing Metadata-Flavor:Google header.")
+		return
+	}
+	if s.throttle(w, r) {
+		return
+	}
+	s.delay(r)
+	if s.fault(w, r) || s.outage(w, r) || s.injectError(w, r) {
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+// validHost reports whether a request's Host header names the metadata
+// server: one of hostHeaders or, as client libraries send it when
+// GCE_METADATA_HOST points at the emulator, the address it listens on (a
+// loopback address if it listens on all of them).  Names other than
+// localhost are rejected so DNS rebinding can't reach the server.
+func (s *Server) validHost(host string) bool {
+	for _, a := range hostHeaders {
+		if a == host {
+			return true
+		}
+	}
+	l, ok := s.Addr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil || port != strconv.Itoa(l.Port) {
+		return false
+	}
+	if h == "localhost" {
+		h = "127.0.0.1"
+	}
+	ip := net.ParseIP(h)
+	if ip == nil {
+		return false
+	}
+	return ip.Equal(l.IP) || l.IP.IsUnspecified() && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// rootHandler answers / with ok, which health checks and scripts probe, and
+// lists the metadata versions served under /computeMetadata/.
+func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) {
+	s.requestLogger(r).Infof("%s called", r.URL.Path)
+
+	var listing string
+	switch r.URL.Path {
+	case "/":
+		fmt.Fprint(w, "ok")
+		return
+	case "/computeMetadata/":
+		listing = "v1/\n"
+		if s.cfg.LegacyEndpoints == LegacyServe {
+			listing += "v1beta1/\n"
+		}
+	default:
+		s.notFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", s.textContentType())
+	if s.notModified(w, r, []byte(listing)) {
+		return
+	}
+	fmt.Fprint(w, listing)
+}
+
+// redirectSlash redirects a directory requested without a trailing slash the
+// same way the metadata server does; the body is the new path.
+func (s *Server) redirectSlash(w http.ResponseWriter, r *http.Request) {
+	location := r.URL.Path + "/"
+	if r.URL.RawQuery != "" {
+		location = location + "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Type", "text/html")
+	if s.cfg.Strict {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	}
+	w.WriteHeader(http.StatusMovedPermanently)
+	fmt.Fprint(w, r.URL.Path+"/")
+}
+
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
+	s.requestLogger(r).Infof("%s called but is not implemented", r.URL.Path)
+	s.writeError(w, r, http.StatusNotFound, "")
+}
+
+// metadataTree returns the configured metadata with the values that are
+// derived from the credentials (project, service accounts) filled in.
+func (s *Server) metadataTree(r *http.Request) map[string]interface{} {
+	s.mu.RLock()
+	t := copyTree(s.tree)
+	s.mu.RUnlock()
+
+	project := subTree(t, "project")
+	project["projectId"] = s.getProjectID()
+	project["numericProjectId"] = s.getNumericProjectID()
+	if _, err := strconv.ParseUint(s.getNumericProjectID(), 10, 64); err == nil {
+		project["numericProjectId"] = json.Number(s.getNumericProjectID())
+	}
+
+	instance := subTree(t, "instance")
+	accounts := subTree(instance, "serviceAccounts")
+	email := s.getServiceAccountEmail()
+	for _, acct := range []string{"default", email} {
+		sa := subTree(accounts, acct)
+		if _, ok := sa["aliases"]; !ok {
+			sa["aliases"] = []string{"default"}
+		}
+		if _, ok := sa["email"]; !ok {
+			sa["email"] = email
+		}
+		if _, ok := sa["scopes"]; !ok {
+			sa["scopes"] = s.cfg.TokenScopes
+		}
+	}
+	for email, a := range s.accounts {
+		sa := subTree(accounts, email)
+		if _, ok := sa["scopes"]; !ok {
+			sa["scopes"] = a.scopes
+		}
+		if _, ok := sa["aliases"]; !ok && len(a.aliases) > 0 {
+			sa["aliases"] = a.aliases
+		}
+		for _, alias := range a.aliases {
+			accounts[alias] = sa
+		}
+	}
+	primary := s.defaultAccount()
+	a, mapped := s.clientAccount(r)
+	if !mapped && s.cfg.Flavor != FlavorGCE {
+		a, mapped = primary, true
+	}
+	if mapped && a == nil {
+		// denied callers see no service accounts, like a VM without one
+		accounts = map[string]interface{}{}
+		instance["serviceAccounts"] = accounts
+	} else if mapped {
+		// mapped callers, pods on GKE and Cloud Run services only see
+		// their own account
+		if a != primary {
+			email = a.email
+		}
+		sa := subTree(accounts, email)
+		sa["aliases"] = []string{"default"}
+		if _, ok := sa["email"]; !ok {
+			sa["email"] = email
+		}
+		accounts = map[string]interface{}{"default": sa, email: sa}
+		instance["serviceAccounts"] = accounts
+	}
+	switch s.cfg.Flavor {
+	case FlavorGKE:
+		delete(subTree(instance, "attributes"), "kube-env")
+	case FlavorCloudRun:
+		serverlessTree(t)
+	}
+	for acct, v := range accounts {
+		sa, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := sa["email"]; !ok {
+			sa["email"] = acct
+		}
+		sa["identity"] = endpoint{}
+		sa["token"] = endpoint{}
+	}
+	return t
+}
+
+func (s *Server) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1/")
+	s.requestLogger(r).Infof("/computeMetadata/v1/%v called", path)
+
+	segments := strings.Split(path, "/")
+	v, ok := lookupPath(s.metadataTree(r), segments)
+	if ok && s.cfg.CompatTrailingSlash {
+		trailing := strings.HasSuffix(r.URL.Path, "/")
+		if isDir(v) && !trailing {
+			s.redirectSlash(w, r)
+			return
+		}
+		if !isDir(v) && trailing {
+			s.notFound(w, r)
+			return
+		}
+	}
+	if strings.EqualFold(r.URL.Query().Get("wait_for_change"), "true") {
+		v, ok = s.waitForChange(r, segments)
+	}
+	if !ok {
+		s.notFound(w, r)
+		return
+	}
+	tag := etag(v, renderFormat(r, v))
+	w.Header().Set("ETag", tag)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	body, contentType, err := s.renderValue(r, v, lastKey(segments))
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// renderOptions returns the alt format a node is rendered in for a request
+// and whether it is rendered recursively.  Recursive requests default to
+// json, everything else to text.
+func renderOptions(r *http.Request, v interface{}) (alt string, recursive bool) {
+	q := r.URL.Query()
+	recursive = strings.EqualFold(q.Get("recursive"), "true") && isDir(v)
+	alt = strings.ToLower(q.Get("alt"))
+	if alt == "" {
+		alt = "text"
+		if recursive {
+			alt = "json"
+		}
+	}
+	return alt, recursive
+}
+
+// renderFormat names the rendering of a node for a request for its etag, eg
+// "json recursive".
+func renderFormat(r *http.Request, v interface{}) string {
+	alt, recursive := renderOptions(r, v)
+	if recursive {
+		return alt + " recursive"
+	}
+	return alt
+}
+
+// renderValue renders a node in the format requested by the alt and recursive
+// query parameters, see renderOptions.
+func (s *Server) renderValue(r *http.Request, v interface{}, name string) ([]byte, string, error) {
+	alt, recursive := renderOptions(r, v)
+	switch alt {
+	case "json":
+		var js []byte
+		var err error
+		if isDir(v) && !recursive {
+			js, err = json.Marshal(dirEntries(v, name))
+		} else {
+			js, err = renderJSON(v)
+		}
+		return js, "application/json", err
+	case "text":
+		if recursive {
+			return []byte(renderText(v, name)), s.textContentType(), nil
+		}
+		if isDir(v) {
+			return []byte(listDir(v, name)), s.textContentType(), nil
+		}
+		val, ok := renderLeaf(v)
+		if !ok {
+			return nil, "", errors.New("unable to render value as text")
+		}
+		return []byte(val), s.textContentType(), nil
+	}
+	return nil, "", fmt.Errorf("invalid value for alt: %s", alt)
+}
+
+func (s *Server) getServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s.requestLogger(r).Infof("/computeMetadata/v1/instance/service-accounts/%v/%v called", vars["acct"], vars["key"])
+
+	if _, ok := lookupPath(s.metadataTree(r), []string{"instance", "service-accounts", vars["acct"]}); !ok {
+		s.notFound(w, r)
+		return
+	}
+
+	switch vars["key"] {
+
+	case "identity":
+		k, ok := r.URL.Query()["audience"]
+		if !ok {
+			s.writeError(w, r, http.StatusBadRequest, "non-empty audience parameter required")
+			return
+		}
+		if err := s.audiences.check(k[0]); err != nil {
+			s.writeError(w, r, http.StatusForbidden, err.Error())
+			return
+		}
+		full, licenses, err := identityFormat(r)
+		if err != nil {
+			s.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		idtok, status, static := s.staticIDToken(k[0])
+		if static && status != 0 {
+			s.writeError(w, r, status, "no static id_token for audience")
+			return
+		}
+		a := s.account(r, vars["acct"])
+		if !static && full {
+			idtok, err = s.getFullIDToken(a, k[0], licenses)
+			if err == errNoSigningKey {
+				s.writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+		} else if !static {
+			idtok, err = s.getIDToken(r.Context(), a, k[0])
+		}
+		if err != nil {
+			s.writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		s.auditToken(r, a, nil, k[0])
+		w.Header().Set("Content-Type", "text/html")
+		if s.cfg.Strict {
+			w.Header().Set("Content-Type", s.textContentType())
+		}
+		if s.notModified(w, r, []byte(idtok)) {
+			return
+		}
+		fmt.Fprint(w, idtok)
+
+	case "token":
+		scopes := requestedScopes(r)
+		if err := s.scopes.check(scopes); err != nil {
+			s.writeError(w, r, http.StatusForbidden, err.Error())
+			return
+		}
+		a := s.account(r, vars["acct"])
+		tok, err := s.getAccessToken(r.Context(), a, scopes)
+		if err != nil {
+			s.writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		s.auditToken(r, a, scopes, "")
+		js, err := json.Marshal(tok)
+		if err != nil {
+			s.writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		contentType := "application/json"
+		switch strings.ToLower(r.URL.Query().Get("alt")) {
+		case "", "json":
+		case "text":
+			js = []byte(fmt.Sprintf("access_token %s\nexpires_in %d\ntoken_type %s\n", tok.AccessToken, tok.ExpiresIn, tok.TokenType))
+			contentType = s.textContentType()
+		default:
+			s.writeError(w, r, http.StatusBadRequest, "invalid value for alt")
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		if s.cfg.QuotaProject != "" {
+			w.Header().Set(quotaProjectHeader, s.cfg.QuotaProject)
+		}
+		if s.notModified(w, r, js) {
+			return
+		}
+		w.Write(js)
+	}
+
+}
+
+// requestedScopes returns the comma separated scopes query parameter.
+func requestedScopes(r *http.Request) []string {
+	var scopes []string
+	for _, sc := range strings.Split(r.URL.Query().Get("scopes"), ",") {
+		if sc = strings.TrimSpace(sc); sc != "" {
+			scopes = append(scopes, sc)
+		}
+	}
+	return scopes
+}
+
+// identityFormat parses the format and licenses query parameters of the
+// identity endpoint.  licenses only applies to the full format.
+func identityFormat(r *http.Request) (full, licenses bool, err error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "", "standard":
+	case "full":
+		full = true
+	default:
+		return false, false, fmt.Errorf("invalid format %q (standard or full)", f)
+	}
+	switch l := r.URL.Query().Get("licenses"); strings.ToUpper(l) {
+	case "", "FALSE":
+	case "TRUE":
+		licenses = full
+	default:
+		return false, false, fmt.Errorf("invalid licenses %q (TRUE or FALSE)", l)
+	}
+	return full, licenses, nil
+}
+
+// notModified sets the ETag for a dynamically generated body and writes a 304
+// if the client already has it.
+func (s *Server) notModified(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	tag := hashEtag(body)
+	w.Header().Set("ETag", tag)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+func isEnvironmentOverrideSet() bool {
+	if os.Getenv(googleAccessToken) != "" && os.Getenv(googleIDToken) != "" && os.Getenv(googleAccountEmail) != "" && os.Getenv(googleNumericProjectID) != "" && os.Getenv(googleProjectID) != "" {
+		return true
+	}
+	return false
+}
+
+// loadMetadata builds the static metadata tree from the configured metadata,
+// custom attributes and plugin attributes.
+func (s *Server) loadMetadata() (map[string]interface{}, error) {
+	m := s.cfg.Metadata
+	if s.cfg.MetadataFile != "" {
+		var err error
+		m, err = LoadMetadataFile(s.cfg.MetadataFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		m = &Metadata{}
+	}
+	t, err := m.tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to render metadata %v", err)
+	}
+	s.instanceDefaults(t)
+
+	customAttributes := s.cfg.CustomAttributes
+	if s.cfg.CustomAttributeFile != "" {
+		customAttributes, err = loadCustomAttributes(s.cfg.CustomAttributeFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	attributes := subTree(subTree(t, "project"), "attributes")
+	for k, v := range customAttributes {
+		// values from the metadata config take precedence
+		if _, ok := attributes[k]; !ok {
+			attributes[k] = v
+		}
+	}
+	instanceAttributes := s.cfg.InstanceAttributes
+	if s.cfg.InstanceAttributeFile != "" {
+		instanceAttributes, err = loadCustomAttributes(s.cfg.InstanceAttributeFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ia := subTree(subTree(t, "instance"), "attributes")
+	for k, v := range instanceAttributes {
+		if _, ok := ia[k]; !ok {
+			ia[k] = v
+		}
+	}
+	if err := s.sshAttributes(t); err != nil {
+		return nil, err
+	}
+	if err := s.scriptAttributes(t); err != nil {
+		return nil, err
+	}
+	if err := s.gkeAttributes(t); err != nil {
+		return nil, err
+	}
+	if err := s.cosAttributes(t); err != nil {
+		return nil, err
+	}
+	if _, ok := attributes[quotaProjectAttribute]; !ok && s.cfg.QuotaProject != "" {
+		attributes[quotaProjectAttribute] = s.cfg.QuotaProject
+	}
+	for _, p := range s.plugins {
+		if !p.info.Attributes {
+			continue
+		}
+		pluginAttributes, err := p.attributes()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range pluginAttributes {
+			if _, ok := attributes[k]; !ok {
+				attributes[k] = v
+			}
+		}
+	}
+	return t, nil
+}
+
+// Reload re-reads the metadata config, custom and instance attribute, client
+// mapping and
+// static ID token files, the attributes of plugins, the service account key
+// if it is read from Secret Manager, and the tenants' files.  Values set with
+// SetValue are discarded but not events such as Preempt.  Pending
+// wait_for_change requests are notified.
+func (s *Server) Reload() error {
+	if s.cfg.ServiceAccountSecret != "" {
+		if err := s.refreshSecretCredentials(context.Background()); err != nil {
+			return err
+		}
+	}
+	t, err := s.loadMetadata()
+	if err != nil {
+		return err
+	}
+	mappings, err := s.loadClientMappings()
+	if err != nil {
+		return err
+	}
+	idTokens, err := s.loadStaticIDTokens()
+	if err != nil {
+		return err
+	}
+	for name, tenant := range s.tenants {
+		if err := tenant.Reload(); err != nil {
+			return fmt.Errorf("tenant %s: %v", name, err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tree = t
+	s.clientMappings = mappings
+	s.staticIDTokens = idTokens
+	s.applyEvents()
+	s.state.clear(stateValues)
+	s.notifyChange()
+	s.publish(ChangeEvent{Kind: ChangeReload})
+	logger.Infoln("Metadata reloaded")
+	return nil
+}
+
+// SetValue sets the value at a metadata path relative to /computeMetadata/v1/
+// (eg, "instance/attributes/foo") and notifies pending wait_for_change requests
+// and watchers.
+func (s *Server) SetValue(path string, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := setPath(s.tree, strings.Split(path, "/"), value); err != nil {
+		return err
+	}
+	s.state.put(stateValues, path, value)
+	s.notifyChange()
+	ev := ChangeEvent{Kind: ChangeSet, Path: path}
+	if v, ok := lookupPath(s.tree, strings.Split(path, "/")); ok {
+		if isDir(v) {
+			js, _ := renderJSON(v)
+			ev.Value = string(js)
+		} else {
+			ev.Value, _ = renderLeaf(v)
+		}
+	}
+	s.publish(ev)
+	return nil
+}
+
+// notifyChange must be called with mu held.
+func (s *Server) notifyChange() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// waitForChange blocks until the value at the path no longer matches
+// last_etag (or changes at all if last_etag isn't set), the timeout_sec
+// expires or the client goes away.  It returns the value at that point.
+func (s *Server) waitForChange(r *http.Request, segments []string) (interface{}, bool) {
+	q := r.URL.Query()
+	lastEtag, haveEtag := q.Get("last_etag"), q.Get("last_etag") != ""
+
+	var timeout <-chan time.Time
+	if sec, err := strconv.Atoi(q.Get("timeout_sec")); err == nil && sec > 0 {
+		t := time.NewTimer(time.Duration(sec) * time.Second)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	for {
+		s.mu.RLock()
+		changed := s.changed
+		s.mu.RUnlock()
+
+		v, ok := lookupPath(s.metadataTree(r), segments)
+		current := ""
+		if ok {
+			current = etag(v, renderFormat(r, v))
+		}
+		if !haveEtag {
+			lastEtag, haveEtag = current, true
+		} else if current != lastEtag {
+			return v, ok
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return v, ok
+		case <-r.Context().Done():
+			return v, ok
+		}
+	}
+}
+
+func loadCustomAttributes(customAttributesFile string) (map[string]string, error) {
+	file, err := os.Open(customAttributesFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't open custom attributes file %s: %v", customAttributesFile, err)
+	}
+	defer file.Close()
+	var data map[string]string
+	if err := json.NewDecoder(file).Decode(&data); err != nil {
+		return nil, fmt.Errorf("can't parse file %s (expected json file): %v", customAttributesFile, err)
+	}
+
+	logger.Debugf("custom attributes %#v", data)
+	return data, nil
+}
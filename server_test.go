@@ -0,0 +1,276 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	SetLogger(zap.NewNop())
+	os.Exit(m.Run())
+}
+
+// newTestServer starts a fake server on a loopback port with cfg.
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	cfg.Fake = true
+	cfg.ServiceAccountEmail = "test@project.iam.gserviceaccount.com"
+	cfg.ProjectID = "project"
+	cfg.NumericProjectID = "123456789"
+	cfg.Port = "127.0.0.1:0"
+	s, err := NewMetadataServer(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewMetadataServer: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { s.Shutdown() })
+	return s
+}
+
+// get requests path from s with the given Host and Metadata-Flavor headers.
+func get(t *testing.T, s *Server, path, host, flavor string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", "http://"+s.Addr().String()+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	if flavor != "" {
+		req.Header.Set("Metadata-Flavor", flavor)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestCheckMetadataHeaders(t *testing.T) {
+	s := newTestServer(t, Config{})
+	port := s.Addr().String()[strings.LastIndex(s.Addr().String(), ":"):]
+	for _, tc := range []struct {
+		name, host, flavor string
+		want               int
+	}{
+		{"metadata", "metadata", "Google", http.StatusOK},
+		{"metadata.google.internal", "metadata.google.internal", "Google", http.StatusOK},
+		{"listen address", s.Addr().String(), "Google", http.StatusOK},
+		{"localhost", "localhost" + port, "Google", http.StatusOK},
+		{"other port", "127.0.0.1:1", "Google", http.StatusForbidden},
+		{"other host", "evil.example.com" + port, "Google", http.StatusForbidden},
+		{"missing flavor", "metadata", "", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := get(t, s, "/computeMetadata/v1/project/project-id", tc.host, tc.flavor)
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status = %d, want %d (%s)", resp.StatusCode, tc.want, body)
+			}
+			if tc.want == http.StatusOK && body != "project" {
+				t.Errorf("body = %q, want project", body)
+			}
+			for _, h := range []string{"Metadata-Flavor", "Server", "X-Frame-Options"} {
+				if v := resp.Header.Values(h); len(v) != 1 {
+					t.Errorf("%s = %q, want one value", h, v)
+				}
+			}
+		})
+	}
+}
+
+func TestRootHandler(t *testing.T) {
+	s := newTestServer(t, Config{})
+	resp, body := get(t, s, "/", "metadata", "")
+	if resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("GET / = %d %q, want 200 ok", resp.StatusCode, body)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if err := s.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	// and once more by the cleanup of newTestServer
+	if err := s.Shutdown(); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
+
+func TestNewMetadataServerReleasesOnError(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		Fake:                true,
+		ServiceAccountEmail: "test@project.iam.gserviceaccount.com",
+		ProjectID:           "project",
+		NumericProjectID:    "123456789",
+		StatePath:           filepath.Join(dir, "state.db"),
+		AccessLogFile:       filepath.Join(dir, "access.log"),
+		TokenAuditFile:      filepath.Join(dir, "audit.log"),
+		// fails once everything else is open
+		TLSCertFile: filepath.Join(dir, "missing.crt"),
+		TLSKeyFile:  filepath.Join(dir, "missing.key"),
+	}
+	if _, err := NewMetadataServer(context.Background(), cfg); err == nil {
+		t.Fatal("NewMetadataServer succeeded without a certificate")
+	}
+	// the state store is locked while it is open
+	st, err := openStateStore(cfg.StatePath)
+	if err != nil {
+		t.Fatalf("state store still open: %v", err)
+	}
+	st.close()
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	s := newTestServer(t, Config{})
+	getTag := func(path, ifNoneMatch string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://"+s.Addr().String()+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "metadata"
+		req.Header.Set("Metadata-Flavor", "Google")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("ETag")
+	}
+
+	const project = "/computeMetadata/v1/project/"
+	_, listing := getTag(project, "")
+	if code, _ := getTag(project, listing); code != http.StatusNotModified {
+		t.Errorf("matching If-None-Match = %d, want 304", code)
+	}
+	if code, _ := getTag(project, `"`+listing+`"`); code != http.StatusNotModified {
+		t.Errorf("quoted matching If-None-Match = %d, want 304", code)
+	}
+	for _, query := range []string{"?recursive=true", "?alt=json", "?recursive=true&alt=text"} {
+		code, tag := getTag(project+query, listing)
+		if code != http.StatusOK {
+			t.Errorf("%s with the etag of the listing = %d, want 200", query, code)
+		}
+		if tag == listing {
+			t.Errorf("%s has the etag of the listing", query)
+		}
+	}
+
+	const attribute = "/computeMetadata/v1/instance/attributes/foo"
+	if err := s.SetValue("instance/attributes/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	_, tag := getTag(attribute, "")
+	if err := s.SetValue("instance/attributes/foo", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := getTag(attribute, tag); code != http.StatusOK {
+		t.Errorf("If-None-Match of a changed value = %d, want 200", code)
+	}
+}
+
+func TestStartListenError(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := l.Addr().String()
+	l.Close()
+
+	s, err := NewMetadataServer(context.Background(), Config{
+		Fake:                true,
+		ServiceAccountEmail: "test@project.iam.gserviceaccount.com",
+		ProjectID:           "project",
+		NumericProjectID:    "123456789",
+		Port:                "127.0.0.1:0",
+		MetricsListen:       metrics,
+		AdminListen:         taken.Addr().String(),
+		PreemptAfter:        10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewMetadataServer: %v", err)
+	}
+	if err := s.Start(); err == nil {
+		s.Shutdown()
+		t.Fatal("Start succeeded with the admin address in use")
+	}
+	// the listeners bound before are closed again
+	if c, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		c.Close()
+		t.Error("metadata listener still open")
+	}
+	if l, err := net.Listen("tcp", metrics); err != nil {
+		t.Errorf("metrics listener still open: %v", err)
+	} else {
+		l.Close()
+	}
+	// and nothing was started in the background
+	time.Sleep(50 * time.Millisecond)
+	s.mu.Lock()
+	preempted := s.preempted
+	s.mu.Unlock()
+	if preempted {
+		t.Error("instance preempted after Start failed")
+	}
+}
+
+func TestSetValueDirectory(t *testing.T) {
+	s := newTestServer(t, Config{})
+	var dir interface{}
+	if err := json.Unmarshal([]byte(`{"my-key":"v","my-list":[{"list-key":"l"}]}`), &dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetValue("project/my-dir", dir); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"project/my-dir/my-key":             "v",
+		"project/my-dir/my-list/0/list-key": "l",
+		"project/my-dir/?recursive=true":    `{"myKey":"v","myList":[{"listKey":"l"}]}`,
+	} {
+		resp, body := get(t, s, "/computeMetadata/v1/"+path, "metadata", "Google")
+		if resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("GET %s = %d %q, want 200 %q", path, resp.StatusCode, body, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/oauth2/google"
+)
+
+// SwitchServiceAccountRequest is the admin and control API request to switch
+// the default service account, see SwitchServiceAccount.
+type SwitchServiceAccountRequest struct {
+	// Credentials is a credentials JSON such as a service account key
+	Credentials json.RawMessage `json:"credentials,omitempty"`
+	// CredentialsFile is a credentials file on the emulator's host
+	CredentialsFile string `json:"credentialsFile,omitempty"`
+	// Email is impersonated if no credentials are set
+	Email string `json:"email,omitempty"`
+}
+
+// switchServiceAccount handles a SwitchServiceAccountRequest.
+func (s *Server) switchServiceAccount(ctx context.Context, r *SwitchServiceAccountRequest) error {
+	c := ServiceAccountConfig{Email: r.Email, CredentialsFile: r.CredentialsFile}
+	if len(r.Credentials) > 0 {
+		if r.CredentialsFile != "" {
+			return errors.New("only one of credentials and credentialsFile may be set")
+		}
+		creds, err := google.CredentialsFromJSON(ctx, r.Credentials, s.cfg.TokenScopes...)
+		if err != nil {
+			return fmt.Errorf("unable to parse credentials: %v", err)
+		}
+		c.Credentials = creds
+	}
+	return s.SwitchServiceAccount(ctx, c)
+}
+
+// defaultAccount returns the default service account currently served.
+func (s *Server) defaultAccount() *account {
+	s.primaryMu.RLock()
+	defer s.primaryMu.RUnlock()
+	return s.primary
+}
+
+// SwitchServiceAccount serves the service account of c as the default
+// account instead of the configured one until RestoreServiceAccount, eg to
+// rotate identities in the middle of a test suite.  Its tokens come from
+// Credentials, CredentialsFile or Signer like those of an additional
+// account, whose email is read from the credentials if not set, or else
+// from impersonating Email; in fake mode they are minted for Email.  Client
+// mappings to the default account follow it.  The project and the token
+// options like SelfSignedJWT stay the same; switched accounts aren't
+// prefetched.
+func (s *Server) SwitchServiceAccount(ctx context.Context, c ServiceAccountConfig) error {
+	if isEnvironmentOverrideSet() {
+		return errors.New("the service account can't be switched when it is set with environment variables")
+	}
+	if c.Email == "" && s.fake == nil {
+		var data []byte
+		switch {
+		case c.Credentials != nil:
+			data = c.Credentials.JSON
+		case c.CredentialsFile != "":
+			var err error
+			data, err = ioutil.ReadFile(c.CredentialsFile)
+			if err != nil {
+				return fmt.Errorf("unable to read credentials: %v", err)
+			}
+		}
+		if len(data) > 0 {
+			f, err := parseCredentialsFile(data)
+			if err != nil {
+				return fmt.Errorf("unable to parse credentials: %v", err)
+			}
+			if c.Email = f.email(); c.Email == "" {
+				return credentialsError(f)
+			}
+		}
+	}
+	if c.Email == "" {
+		return errors.New("the email of the service account must be set")
+	}
+	if s.accounts[c.Email] != nil || s.aliases[c.Email] != nil {
+		return fmt.Errorf("%s is already served as an additional service account", c.Email)
+	}
+	c.Aliases = nil
+	var a *account
+	var err error
+	if s.fake != nil {
+		a, err = newFakeAccount(c, s.cfg.TokenScopes, s.fake)
+	} else {
+		a, err = newAccount(ctx, c, s.cfg.TokenScopes, s.cfg.QuotaProject, s.cfg.MaxTokenLifetime)
+	}
+	if err != nil {
+		return err
+	}
+	a.selfSignedJWT, a.jwtAudience, a.accessBoundary = s.configured.selfSignedJWT, s.configured.jwtAudience, s.configured.accessBoundary
+	a.maxLifetime, a.skew = s.configured.maxLifetime, s.configured.skew
+	a.cache = s.tokenCache
+	a.outbound = s.outbound
+	if err := a.applyTokenOptions(); err != nil {
+		return err
+	}
+	s.setDefaultAccount(a)
+	logger.Infof("Switched the default service account to %s", a.email)
+	return nil
+}
+
+// RestoreServiceAccount serves the configured default service account again
+// after SwitchServiceAccount.
+func (s *Server) RestoreServiceAccount() {
+	s.setDefaultAccount(s.configured)
+	logger.Infof("Restored the default service account %s", s.configured.email)
+}
+
+// setDefaultAccount replaces the default account, repoints the client
+// mappings to it and notifies wait_for_change requests and watchers since
+// the served email changes.
+func (s *Server) setDefaultAccount(a *account) {
+	s.primaryMu.Lock()
+	old := s.primary
+	s.primary = a
+	s.primaryMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// clientAccount may still be reading the old slice
+	mappings := append([]clientMapping{}, s.clientMappings...)
+	for i := range mappings {
+		if mappings[i].account == old {
+			mappings[i].account = a
+		}
+	}
+	s.clientMappings = mappings
+	s.notifyChange()
+	s.publish(ChangeEvent{Kind: ChangeServiceAccount, Path: "instance/service-accounts/default/email", Value: a.email})
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// googleTokenTransport answers the refresh token requests of authorized_user
+// credentials with switched-token and passes other requests on.  Like a real
+// transport, it fails requests whose context is done.
+type googleTokenTransport struct {
+	next http.RoundTripper
+}
+
+func (t googleTokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.String() != google.Endpoint.TokenURL {
+		return t.next.RoundTrip(r)
+	}
+	if err := r.Context().Err(); err != nil {
+		return nil, err
+	}
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteString(`{"access_token":"switched-token","token_type":"Bearer","expires_in":3600}`)
+	return w.Result(), nil
+}
+
+func TestAdminSwitchServiceAccount(t *testing.T) {
+	transport := http.DefaultTransport
+	http.DefaultTransport = googleTokenTransport{next: transport}
+	t.Cleanup(func() { http.DefaultTransport = transport })
+
+	s, err := NewMetadataServer(context.Background(), Config{
+		Port:                "127.0.0.1:0",
+		ServiceAccountEmail: "test@project.iam.gserviceaccount.com",
+		ProjectID:           "project",
+		NumericProjectID:    "123456789",
+		Credentials: &google.Credentials{
+			TokenSource: oauth2.StaticTokenSource(&oauth2.Token{
+				AccessToken: "configured-token",
+				TokenType:   "Bearer",
+				Expiry:      time.Now().Add(time.Hour),
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewMetadataServer: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { s.Shutdown() })
+
+	body, err := json.Marshal(SwitchServiceAccountRequest{
+		Email:       "user@example.com",
+		Credentials: json.RawMessage(`{"type":"authorized_user","client_id":"id","client_secret":"secret","refresh_token":"refresh"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("PUT", adminPrefix+"/service-account", strings.NewReader(string(body))).WithContext(ctx)
+	w := httptest.NewRecorder()
+	s.adminSwitchServiceAccount(w, r)
+	// the admin request is over
+	cancel()
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "user@example.com" {
+		t.Fatalf("switch = %d %q, want 200 user@example.com", w.Code, w.Body.String())
+	}
+
+	resp, got := get(t, s, "/computeMetadata/v1/instance/service-accounts/default/token", "metadata", "Google")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("token = %d %q, want 200", resp.StatusCode, got)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(got), &tok); err != nil {
+		t.Fatalf("token response %q: %v", got, err)
+	}
+	if tok.AccessToken != "switched-token" {
+		t.Errorf("access_token = %q, want switched-token", tok.AccessToken)
+	}
+
+	s.RestoreServiceAccount()
+	_, got = get(t, s, "/computeMetadata/v1/instance/service-accounts/default/email", "metadata", "Google")
+	if got != "test@project.iam.gserviceaccount.com" {
+		t.Errorf("email after restore = %q", got)
+	}
+}
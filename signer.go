@@ -0,0 +1,135 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
+)
+
+// signerTokenSource exchanges a JWT assertion signed by the service account's
+// key for a token using the OAuth2 JWT bearer grant, as a service account key
+// file would, but the key is only reachable through a crypto.Signer (eg, a
+// key held in a TPM).  If audience is set an ID token is returned instead of
+// an access token.
+type signerTokenSource struct {
+	ctx      context.Context
+	email    string
+	keyID    string
+	scopes   []string
+	audience string
+	signer   crypto.Signer
+}
+
+type jwtBearerResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+}
+
+func (s *signerTokenSource) Token() (*oauth2.Token, error) {
+	iat := time.Now()
+	claims := &jws.ClaimSet{
+		Iss: s.email,
+		Aud: google.JWTTokenURL,
+		Iat: iat.Unix(),
+		Exp: iat.Add(time.Hour).Unix(),
+	}
+	if s.audience != "" {
+		claims.PrivateClaims = map[string]interface{}{"target_audience": s.audience}
+	} else {
+		claims.Scope = strings.Join(s.scopes, " ")
+	}
+	header := &jws.Header{Algorithm: "RS256", Typ: "JWT", KeyID: s.keyID}
+	assertion, err := jws.EncodeWithSigner(header, claims, func(data []byte) ([]byte, error) {
+		h := sha256.Sum256(data)
+		return s.signer.Sign(rand.Reader, h[:], crypto.SHA256)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign assertion: %v", err)
+	}
+
+	v := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	resp, err := oauth2.NewClient(s.ctx, nil).PostForm(google.JWTTokenURL, v)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch token: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch token: %s %s", resp.Status, body)
+	}
+	r := &jwtBearerResponse{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("unable to parse token response: %v", err)
+	}
+
+	if s.audience != "" {
+		if r.IDToken == "" {
+			return nil, errors.New("token response did not include an id_token")
+		}
+		exp, err := jwtExpiry(r.IDToken)
+		if err != nil {
+			return nil, err
+		}
+		return &oauth2.Token{AccessToken: r.IDToken, TokenType: "Bearer", Expiry: exp}, nil
+	}
+	return &oauth2.Token{
+		AccessToken: r.AccessToken,
+		TokenType:   r.TokenType,
+		Expiry:      iat.Add(time.Duration(r.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// jwtExpiry returns the exp claim of a JWT without verifying it.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("malformed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed JWT: %v", err)
+	}
+	var c struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return time.Time{}, fmt.Errorf("malformed JWT: %v", err)
+	}
+	return time.Unix(c.Exp, 0), nil
+}
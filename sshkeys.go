@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// OS Login and ssh key attributes read by the guest agent's account
+// provisioning.
+const (
+	sshKeysAttribute             = "ssh-keys"
+	blockProjectSSHKeysAttribute = "block-project-ssh-keys"
+	osLoginAttribute             = "enable-oslogin"
+	osLogin2FAAttribute          = "enable-oslogin-2fa"
+)
+
+// loadSSHKeys reads a file of ssh keys, one username:key per line like the
+// ssh-keys attribute.  Blank lines and # comments are skipped.
+func loadSSHKeys(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ssh keys file %s: %v", path, err)
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, nil
+}
+
+// checkSSHKey checks a key is in the username:type key [comment] form the
+// guest agent expects.
+func checkSSHKey(key string) error {
+	i := strings.Index(key, ":")
+	if i <= 0 || len(strings.Fields(key[i+1:])) < 2 {
+		return fmt.Errorf("ssh key must be username:type key [comment]: %s", key)
+	}
+	return nil
+}
+
+// sshKeys returns the keys of the file if set, or else the configured ones.
+func sshKeys(keys []string, file string) ([]string, error) {
+	if file != "" {
+		var err error
+		keys, err = loadSSHKeys(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range keys {
+		if err := checkSSHKey(k); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// sshAttributes sets the ssh-keys and OS Login attributes of the project and
+// instance unless the metadata config already does.
+func (s *Server) sshAttributes(t map[string]interface{}) error {
+	project := subTree(subTree(t, "project"), "attributes")
+	instance := subTree(subTree(t, "instance"), "attributes")
+	keys, err := sshKeys(s.cfg.SSHKeys, s.cfg.SSHKeysFile)
+	if err != nil {
+		return err
+	}
+	setAttribute(project, sshKeysAttribute, strings.Join(keys, "\n"), len(keys) > 0)
+	keys, err = sshKeys(s.cfg.InstanceSSHKeys, s.cfg.InstanceSSHKeysFile)
+	if err != nil {
+		return err
+	}
+	setAttribute(instance, sshKeysAttribute, strings.Join(keys, "\n"), len(keys) > 0)
+	setAttribute(instance, blockProjectSSHKeysAttribute, "TRUE", s.cfg.BlockProjectSSHKeys)
+	setAttribute(project, osLoginAttribute, "TRUE", s.cfg.OSLogin)
+	setAttribute(project, osLogin2FAAttribute, "TRUE", s.cfg.OSLogin2FA)
+	return nil
+}
+
+// setAttribute sets an attribute if set is true and it isn't set already.
+func setAttribute(attributes map[string]interface{}, key, value string, set bool) {
+	if _, ok := attributes[key]; set && !ok {
+		attributes[key] = value
+	}
+}
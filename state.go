@@ -0,0 +1,183 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the state store.
+const (
+	// stateValues holds the values set with SetValue by path
+	stateValues = "values"
+	// stateEvents holds the maintenance event and preemption
+	stateEvents = "events"
+	// stateFaults holds the injected faults by path
+	stateFaults = "faults"
+)
+
+// stateStore persists the changes made at runtime in a bbolt database so a
+// restarted emulator picks up where it left off.  A nil store persists
+// nothing.  Failed writes are logged; the change is still served.
+type stateStore struct {
+	db *bolt.DB
+}
+
+func openStateStore(path string) (*stateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("state store %s is locked by another process", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open state store %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range []string{stateValues, stateEvents, stateFaults} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialize state store %s: %v", path, err)
+	}
+	return &stateStore{db: db}, nil
+}
+
+// put saves v as JSON.
+func (st *stateStore) put(bucket, key string, v interface{}) {
+	if st == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = st.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(bucket)).Put([]byte(key), data)
+		})
+	}
+	if err != nil {
+		logger.Errorf("Unable to save state %s/%s: %v", bucket, key, err)
+	}
+}
+
+func (st *stateStore) delete(bucket, key string) {
+	if st == nil {
+		return
+	}
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete([]byte(key))
+	})
+	if err != nil {
+		logger.Errorf("Unable to save state %s/%s: %v", bucket, key, err)
+	}
+}
+
+// clear deletes everything in the bucket.
+func (st *stateStore) clear(bucket string) {
+	if st == nil {
+		return
+	}
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		logger.Errorf("Unable to save state %s: %v", bucket, err)
+	}
+}
+
+// load calls fn for each key in the bucket in byte order, so parents of
+// metadata paths come before their children.
+func (st *stateStore) load(bucket string, fn func(key string, dec *json.Decoder) error) error {
+	return st.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			dec := json.NewDecoder(bytes.NewReader(v))
+			dec.UseNumber()
+			if err := fn(string(k), dec); err != nil {
+				return fmt.Errorf("state %s/%s: %v", bucket, k, err)
+			}
+			return nil
+		})
+	})
+}
+
+func (st *stateStore) close() {
+	if st == nil {
+		return
+	}
+	if err := st.db.Close(); err != nil {
+		logger.Errorf("Unable to close state store: %v", err)
+	}
+}
+
+// restoreState applies the values, events and faults of the state store to
+// a new server.
+func (s *Server) restoreState() error {
+	values := 0
+	err := s.state.load(stateValues, func(path string, dec *json.Decoder) error {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		values++
+		return setPath(s.tree, strings.Split(path, "/"), v)
+	})
+	if err != nil {
+		return err
+	}
+	err = s.state.load(stateEvents, func(key string, dec *json.Decoder) error {
+		switch key {
+		case "maintenanceEvent":
+			return dec.Decode(&s.maintenanceEvent)
+		case "preempted":
+			return dec.Decode(&s.preempted)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.applyEvents()
+	now := time.Now()
+	err = s.state.load(stateFaults, func(path string, dec *json.Decoder) error {
+		var f Fault
+		if err := dec.Decode(&f); err != nil {
+			return err
+		}
+		if f.Expires != nil && !now.Before(*f.Expires) {
+			return nil
+		}
+		if s.faults == nil {
+			s.faults = map[string]Fault{}
+		}
+		s.faults[path] = f
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Infof("Restored %d values and %d faults from %s", values, len(s.faults), s.cfg.StatePath)
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// loadStaticIDTokens reads the StaticIDTokens files.
+func (s *Server) loadStaticIDTokens() (map[string]string, error) {
+	if len(s.cfg.StaticIDTokens) == 0 {
+		return nil, nil
+	}
+	tokens := map[string]string{}
+	for aud, file := range s.cfg.StaticIDTokens {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read id_token for %s: %v", aud, err)
+		}
+		tokens[aud] = strings.TrimSpace(string(data))
+	}
+	return tokens, nil
+}
+
+// staticIDToken returns the static ID token for the audience.  ok is false if
+// static ID tokens aren't configured; status is the error to return if they
+// are but the audience has none.
+func (s *Server) staticIDToken(audience string) (token string, status int, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.staticIDTokens == nil {
+		return "", 0, false
+	}
+	token, found := s.staticIDTokens[audience]
+	if !found {
+		status = s.cfg.StaticIDTokenStatus
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+	}
+	return token, status, true
+}
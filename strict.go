@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// errorPage is the error document the production metadata server returns;
+// only served in strict mode.
+const errorPage = `<!DOCTYPE html>
+<html lang=en>
+  <meta charset=utf-8>
+  <meta name=viewport content="initial-scale=1, minimum-scale=1, width=device-width">
+  <title>Error %d (%s)!!1</title>
+  <style>
+    *{margin:0;padding:0}html,code{font:15px/22px arial,sans-serif}html{background:#fff;color:#222;padding:15px}body{margin:7%% auto 0;max-width:390px;min-height:180px;padding:30px 0 15px}* > body{background:url(//www.google.com/images/errors/robot.png) 100%% 5px no-repeat;padding-right:205px}p{margin:11px 0 22px;overflow:hidden}ins{color:#777;text-decoration:none}a img{border:0}@media screen and (max-width:772px){body{background:none;margin-top:0;max-width:none;padding-right:0}}#logo{background:url(//www.google.com/images/branding/googlelogo/1x/googlelogo_color_150x54dp.png) no-repeat;margin-left:-5px}@media only screen and (min-resolution:192dpi){#logo{background:url(//www.google.com/images/branding/googlelogo/2x/googlelogo_color_150x54dp.png) no-repeat 0%% 0%%/100%% 100%%;-moz-border-image:url(//www.google.com/images/branding/googlelogo/2x/googlelogo_color_150x54dp.png) 0}}@media only screen and (-webkit-min-device-pixel-ratio:2){#logo{background:url(//www.google.com/images/branding/googlelogo/2x/googlelogo_color_150x54dp.png) no-repeat;-webkit-background-size:100%% 100%%}}#logo{display:inline-block;height:54px;width:150px}
+  </style>
+  <a href=//www.google.com/><span id=logo aria-label=Google></span></a>
+  <p><b>%d.</b> <ins>That’s an error.</ins>
+  <p>%s  <ins>That’s all we know.</ins>
+`
+
+// errorMessages are the explanations used in the error page, keyed by status.
+// The request path is substituted for %s.
+var errorMessages = map[int]string{
+	http.StatusBadRequest:            "Your client has issued a malformed or illegal request.",
+	http.StatusForbidden:             "Your client does not have permission to get URL <code>%s</code> from this server.",
+	http.StatusNotFound:              "The requested URL <code>%s</code> was not found on this server.",
+	http.StatusRequestTimeout:        "Your client has taken too long to issue its request.",
+	http.StatusRequestEntityTooLarge: "Your client issued a request that was too large.",
+	http.StatusTooManyRequests:       "We're sorry, but you have sent too many requests to us recently. Please try again later.",
+	http.StatusInternalServerError:   "The server encountered an error and could not complete your request.",
+	http.StatusServiceUnavailable:    "The service you requested is not available at this time.",
+}
+
+// writeError writes an error response.  In strict mode this is the html page
+// the metadata server returns and detail is appended to the explanation;
+// otherwise it is the plain status text (or detail if set).
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	if !s.cfg.Strict {
+		msg := http.StatusText(code)
+		if detail != "" {
+			msg = detail
+		}
+		http.Error(w, msg, code)
+		return
+	}
+	msg, ok := errorMessages[code]
+	if !ok {
+		msg = html.EscapeString(http.StatusText(code)) + "."
+	}
+	if code == http.StatusForbidden || code == http.StatusNotFound {
+		msg = fmt.Sprintf(msg, html.EscapeString(r.URL.Path))
+	}
+	if detail != "" {
+		msg = msg + " " + html.EscapeString(detail)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Del("ETag")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, errorPage, code, http.StatusText(code), code, msg)
+}
+
+// textContentType is the content type of plain text values.
+func (s *Server) textContentType() string {
+	if s.cfg.Strict {
+		return "text/plain"
+	}
+	return "application/text"
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStrictErrors(t *testing.T) {
+	s := newTestServer(t, Config{Strict: true})
+	for _, tc := range []struct {
+		name, path, host, flavor string
+		want                     int
+		message                  string
+	}{
+		{"not found", "/computeMetadata/v1/instance/missing", "metadata", "Google", http.StatusNotFound,
+			"The requested URL <code>/computeMetadata/v1/instance/missing</code> was not found on this server."},
+		{"missing flavor", "/computeMetadata/v1/project/project-id", "metadata", "", http.StatusForbidden,
+			"Your client does not have permission to get URL <code>/computeMetadata/v1/project/project-id</code> from this server. Missing Metadata-Flavor:Google header."},
+		{"wrong host", "/computeMetadata/v1/project/project-id", "evil.example.com", "Google", http.StatusForbidden,
+			"Your client does not have permission to get URL"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := get(t, s, tc.path, tc.host, tc.flavor)
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.want)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=UTF-8" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			if resp.Header.Get("ETag") != "" {
+				t.Errorf("error page has an ETag")
+			}
+			if !strings.HasPrefix(body, "<!DOCTYPE html>") || !strings.Contains(body, tc.message) {
+				t.Errorf("body = %q, want the error page with %q", body, tc.message)
+			}
+		})
+	}
+}
+
+func TestStrictHeaders(t *testing.T) {
+	s := newTestServer(t, Config{Strict: true})
+	resp, body := get(t, s, "/computeMetadata/v1/project/project-id", "metadata", "Google")
+	if resp.StatusCode != http.StatusOK || body != "project" {
+		t.Fatalf("GET = %d %q, want 200 project", resp.StatusCode, body)
+	}
+	for h, want := range map[string]string{
+		"Content-Type":    "text/plain",
+		"X-Frame-Options": "SAMEORIGIN",
+		"Metadata-Flavor": "Google",
+	} {
+		if got := resp.Header.Get(h); got != want {
+			t.Errorf("%s = %q, want %q", h, got, want)
+		}
+	}
+
+	// strict implies the trailing slash handling of the real server
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	req, err := http.NewRequest("GET", "http://"+s.Addr().String()+"/computeMetadata/v1/project", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "metadata"
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/computeMetadata/v1/project/" {
+		t.Errorf("GET project = %d %q, want 301 to project/", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp, _ := get(t, s, "/computeMetadata/v1/project/project-id/", "metadata", "Google"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET project-id/ = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestWriteErrorNotStrict(t *testing.T) {
+	s := &Server{}
+	w := httptest.NewRecorder()
+	s.writeError(w, httptest.NewRequest("GET", "/computeMetadata/v1/x", nil), http.StatusBadRequest, "bad audience")
+	if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != "bad audience" {
+		t.Errorf("writeError = %d %q, want 400 bad audience", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
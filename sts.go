@@ -0,0 +1,147 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	stsTokenURL = "https://sts.googleapis.com/v1/token"
+
+	tokenExchangeGrant      = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType         = "urn:ietf:params:oauth:token-type:access_token"
+	defaultSubjectTokenType = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+type stsResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+}
+
+// stsExchange performs an RFC 8693 token exchange with Google STS.
+func stsExchange(ctx context.Context, v url.Values) (*stsResponse, error) {
+	v.Set("grant_type", tokenExchangeGrant)
+	v.Set("requested_token_type", accessTokenType)
+	resp, err := oauth2.NewClient(ctx, nil).PostForm(stsTokenURL, v)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token exchange failed: %s %s", resp.Status, body)
+	}
+	r := &stsResponse{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("unable to parse token exchange response: %v", err)
+	}
+	if r.AccessToken == "" {
+		return nil, errors.New("token exchange response did not include an access_token")
+	}
+	if r.TokenType == "" {
+		r.TokenType = "Bearer"
+	}
+	return r, nil
+}
+
+// stsTokenSource exchanges a subject token from an identity provider, read
+// from a file or printed by a command, for a federated access token.  This
+// covers workload and workforce identity pools and providers which can't be
+// described by an external_account credentials file.
+type stsTokenSource struct {
+	ctx         context.Context
+	audience    string
+	scopes      []string
+	tokenType   string
+	tokenFile   string
+	command     []string
+	userProject string
+}
+
+// subjectToken re-reads the subject token on every exchange since it is
+// usually short lived and rotated by something else.
+func (s *stsTokenSource) subjectToken() (string, error) {
+	var token []byte
+	if len(s.command) > 0 {
+		ctx, cancel := context.WithTimeout(s.ctx, execTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("subject token command %s failed: %v %s", s.command[0], err, strings.TrimSpace(stderr.String()))
+		}
+		token = out
+	} else {
+		var err error
+		token, err = ioutil.ReadFile(s.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read subject token: %v", err)
+		}
+	}
+	t := strings.TrimSpace(string(token))
+	if t == "" {
+		return "", errors.New("subject token is empty")
+	}
+	return t, nil
+}
+
+func (s *stsTokenSource) Token() (*oauth2.Token, error) {
+	subject, err := s.subjectToken()
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{
+		"audience":           {s.audience},
+		"scope":              {strings.Join(s.scopes, " ")},
+		"subject_token_type": {s.tokenType},
+		"subject_token":      {subject},
+	}
+	if s.userProject != "" {
+		options, err := json.Marshal(map[string]string{"userProject": s.userProject})
+		if err != nil {
+			return nil, err
+		}
+		v.Set("options", string(options))
+	}
+	r, err := stsExchange(s.ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: r.AccessToken,
+		TokenType:   r.TokenType,
+		Expiry:      time.Now().Add(time.Duration(r.ExpiresIn) * time.Second),
+	}, nil
+}
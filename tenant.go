@@ -0,0 +1,145 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// TenantConfig describes an emulated project/instance served alongside the
+// default one, eg one per service of a docker-compose stack.  Unset
+// TokenScopes default to the server's.
+type TenantConfig struct {
+	ProjectID           string   `json:"projectId"`
+	NumericProjectID    string   `json:"numericProjectId"`
+	ServiceAccountEmail string   `json:"serviceAccountEmail,omitempty"`
+	ServiceAccountFile  string   `json:"serviceAccountFile,omitempty"`
+	Impersonate         bool     `json:"impersonate,omitempty"`
+	TokenScopes         []string `json:"tokenScopes,omitempty"`
+	// MetadataFile is the tenant's metadata config file, as Config.MetadataFile
+	MetadataFile string `json:"config,omitempty"`
+}
+
+// LoadTenantsFile reads a JSON or YAML object of TenantConfigs keyed by
+// tenant name.  YAML is selected by a .yaml or .yml extension.
+func LoadTenantsFile(path string) (map[string]TenantConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read tenants file %s: %v", path, err)
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse tenants file %s: %v", path, err)
+		}
+	}
+	var t map[string]TenantConfig
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("unable to parse tenants file %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// newTenants creates a Server for each tenant.  They share the server's
+// behavior settings but have their own credentials and metadata.
+func (s *Server) newTenants(ctx context.Context) error {
+	tenants := s.cfg.Tenants
+	if s.cfg.TenantsFile != "" {
+		var err error
+		tenants, err = LoadTenantsFile(s.cfg.TenantsFile)
+		if err != nil {
+			return err
+		}
+	}
+	s.tenants = map[string]*Server{}
+	for name, t := range tenants {
+		scopes := t.TokenScopes
+		if len(scopes) == 0 {
+			scopes = s.cfg.TokenScopes
+		}
+		ts, err := NewMetadataServer(ctx, Config{
+			ProjectID:           t.ProjectID,
+			NumericProjectID:    t.NumericProjectID,
+			ServiceAccountEmail: t.ServiceAccountEmail,
+			ServiceAccountFile:  t.ServiceAccountFile,
+			Impersonate:         t.Impersonate,
+			TokenScopes:         scopes,
+			MetadataFile:        t.MetadataFile,
+			Flavor:              s.cfg.Flavor,
+			LegacyEndpoints:     s.cfg.LegacyEndpoints,
+			CompatTrailingSlash: s.cfg.CompatTrailingSlash,
+			Strict:              s.cfg.Strict,
+			AllowedAudiences:    s.cfg.AllowedAudiences,
+			DeniedAudiences:     s.cfg.DeniedAudiences,
+			AllowedScopes:       s.cfg.AllowedScopes,
+			Fake:                s.cfg.Fake,
+			FakeKeyFile:         s.cfg.FakeKeyFile,
+			FakeIssuer:          s.cfg.FakeIssuer,
+			FakeTokenLifetime:   s.cfg.FakeTokenLifetime,
+			FakeClaims:          s.cfg.FakeClaims,
+			FakeClaimsFile:      s.cfg.FakeClaimsFile,
+			FakeJWKSPath:        s.cfg.FakeJWKSPath,
+			Deterministic:       s.cfg.Deterministic,
+			DeterministicSeed:   s.cfg.DeterministicSeed + "/" + name,
+			ClockSkew:           s.cfg.ClockSkew,
+			MaxTokenLifetime:    s.cfg.MaxTokenLifetime,
+		})
+		if err != nil {
+			return fmt.Errorf("tenant %s: %v", name, err)
+		}
+		ts.shareOutbound(s.outbound)
+		logger.Infof("Serving tenant %s (project %s)", name, ts.getProjectID())
+		s.tenants[name] = ts
+	}
+	return nil
+}
+
+// tenantHandler sends requests for a tenant, selected by TenantHeader or
+// else the Host header, to the tenant's Server.  Other requests are served by
+// next.
+func (s *Server) tenantHandler(next http.Handler) http.Handler {
+	if len(s.tenants) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(s.cfg.TenantHeader)
+		if s.cfg.TenantHeader == "" {
+			name = r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				name = h
+			}
+		}
+		t, ok := s.tenants[name]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.cfg.TenantHeader == "" || s.validHost(r.Host) {
+			// the tenant's host name, or the address of the server, which
+			// the tenant doesn't listen on, stands in for
+			// metadata.google.internal
+			r.Host = "metadata"
+		}
+		t.srv.Handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	tokenCacheVersion = 1
+
+	// tokenCacheLeeway is how long a cached token must still be valid to be
+	// served.
+	tokenCacheLeeway = time.Minute
+)
+
+// tokenCache persists access and ID tokens so a restarted emulator serves them
+// until they expire instead of asking Google again.  The file is encrypted
+// with AES-GCM using a key derived from a passphrase with scrypt.
+type tokenCache struct {
+	path string
+	salt []byte
+	key  []byte
+
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+type cachedToken struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// tokenCacheFile is the format of the file; byte slices are base64 encoded.
+type tokenCacheFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// openTokenCache reads the cache at path, if it exists.
+func openTokenCache(path string, passphrase []byte) (*tokenCache, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("a passphrase is required for the token cache")
+	}
+	c := &tokenCache{path: path, tokens: map[string]cachedToken{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		c.salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, c.salt); err != nil {
+			return nil, err
+		}
+		c.key, err = deriveCacheKey(passphrase, c.salt)
+		return c, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token cache %s: %v", path, err)
+	}
+	f := &tokenCacheFile{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("unable to parse token cache %s: %v", path, err)
+	}
+	if f.Version != tokenCacheVersion {
+		return nil, fmt.Errorf("token cache %s has unsupported version %d", path, f.Version)
+	}
+	c.salt = f.Salt
+	c.key, err = deriveCacheKey(passphrase, c.salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := c.gcm()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, f.Nonce, f.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt token cache %s (wrong passphrase?)", path)
+	}
+	if err := json.Unmarshal(plain, &c.tokens); err != nil {
+		return nil, fmt.Errorf("unable to parse token cache %s: %v", path, err)
+	}
+	logger.Infof("Loaded %d tokens from %s", len(c.tokens), path)
+	return c, nil
+}
+
+func deriveCacheKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+}
+
+func (c *tokenCache) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// get returns the token cached under key if it is still valid.  A nil cache
+// is empty.
+func (c *tokenCache) get(key string) *oauth2.Token {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.tokens[key]
+	if !ok || time.Now().Add(tokenCacheLeeway).After(t.Expiry) {
+		return nil
+	}
+	return &oauth2.Token{AccessToken: t.AccessToken, TokenType: t.TokenType, Expiry: t.Expiry}
+}
+
+// put caches tok, if it expires, and rewrites the file.  Errors are only
+// logged since the cache is an optimization.
+func (c *tokenCache) put(key string, tok *oauth2.Token) {
+	if c == nil || tok.Expiry.IsZero() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.tokens[key]; ok && t.AccessToken == tok.AccessToken {
+		return
+	}
+	c.tokens[key] = cachedToken{AccessToken: tok.AccessToken, TokenType: tok.TokenType, Expiry: tok.Expiry}
+	if err := c.save(); err != nil {
+		logger.Errorf("Unable to write token cache %s: %v", c.path, err)
+	}
+}
+
+// drop removes the tokens of an account.
+func (c *tokenCache) drop(email string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.tokens {
+		if strings.HasPrefix(k, email+"/") {
+			delete(c.tokens, k)
+		}
+	}
+	if err := c.save(); err != nil {
+		logger.Errorf("Unable to write token cache %s: %v", c.path, err)
+	}
+}
+
+// save drops expired tokens and atomically replaces the file.  Must be called
+// with mu held.
+func (c *tokenCache) save() error {
+	now := time.Now()
+	for k, t := range c.tokens {
+		if now.After(t.Expiry) {
+			delete(c.tokens, k)
+		}
+	}
+	plain, err := json.Marshal(c.tokens)
+	if err != nil {
+		return err
+	}
+	gcm, err := c.gcm()
+	if err != nil {
+		return err
+	}
+	f := &tokenCacheFile{Version: tokenCacheVersion, Salt: c.salt, Nonce: make([]byte, gcm.NonceSize())}
+	if _, err := io.ReadFull(rand.Reader, f.Nonce); err != nil {
+		return err
+	}
+	f.Data = gcm.Seal(nil, f.Nonce, plain, nil)
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".tokencache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// tokenCacheKey identifies a token of an account: the sorted scopes of an
+// access token or the audience of an ID token.
+func tokenCacheKey(email, tokenType string, values []string) string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return email + "/" + tokenType + "/" + strings.Join(sorted, ",")
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// accessTokenMetrics counts access token requests answered with the token
+// already held (hits) or a new one (misses), fetch errors, refreshes by the
+// background prefetcher and invalidations, which force new tokens.
+var accessTokenMetrics = expvar.NewMap("access_token_cache")
+
+// liveServers are the started servers whose cached tokens are reported.
+var liveServers = struct {
+	sync.Mutex
+	m map[*Server]struct{}
+}{m: map[*Server]struct{}{}}
+
+func init() {
+	expvar.Publish("token_lifetimes", expvar.Func(tokenLifetimes))
+}
+
+// tokenLifetimes returns the seconds left before each cached token of the
+// live servers expires, by service account then scopes or audience:
+//
+//	{"sa@p.iam.gserviceaccount.com": {"access_token": {"scope": 3540},
+//	 "id_token": {"https://aud": 3100}}}
+func tokenLifetimes() interface{} {
+	liveServers.Lock()
+	defer liveServers.Unlock()
+	lifetimes := map[string]interface{}{}
+	for s := range liveServers.m {
+		s.addTokenLifetimes(lifetimes)
+	}
+	return lifetimes
+}
+
+func (s *Server) addTokenLifetimes(lifetimes map[string]interface{}) {
+	accounts := []*account{s.defaultAccount(), s.configured}
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	for _, a := range accounts {
+		if a == nil {
+			continue
+		}
+		lifetimes[a.email] = map[string]interface{}{
+			"access_token": a.accessTokenLifetimes(),
+			"id_token":     a.idTokens.lifetimes(),
+		}
+	}
+	for _, t := range s.tenants {
+		t.addTokenLifetimes(lifetimes)
+	}
+}
+
+// recordAccessToken counts a token returned for the scopes as a hit if it
+// was returned before, and keeps it for the lifetime gauges.  Must be called
+// with mu held.
+func (a *account) recordAccessToken(scopes []string, tok *oauth2.Token) {
+	key := strings.Join(scopes, " ")
+	if prev, ok := a.issued[key]; ok && prev.AccessToken == tok.AccessToken {
+		accessTokenMetrics.Add("hits", 1)
+		return
+	}
+	accessTokenMetrics.Add("misses", 1)
+	if a.issued == nil {
+		a.issued = map[string]*oauth2.Token{}
+	}
+	a.issued[key] = tok
+}
+
+func (a *account) accessTokenLifetimes() map[string]float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m := map[string]float64{}
+	for scopes, tok := range a.issued {
+		if !tok.Expiry.IsZero() {
+			m[scopes] = time.Until(tok.Expiry).Round(time.Second).Seconds()
+		}
+	}
+	return m
+}
+
+func (c *idTokenCache) lifetimes() map[string]float64 {
+	c.init()
+	m := map[string]float64{}
+	for _, k := range c.tokens.Keys() {
+		if v, ok := c.tokens.Peek(k); ok {
+			m[k.(string)] = time.Until(v.(*oauth2.Token).Expiry).Round(time.Second).Seconds()
+		}
+	}
+	return m
+}
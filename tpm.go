@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// tpmSigner is a crypto.Signer for an RSA key persisted in a TPM.  Only
+// RS256 (RSASSA-PKCS1-v1_5 with SHA256) signatures are supported, which is
+// what Google's token endpoint expects.
+type tpmSigner struct {
+	mu     sync.Mutex
+	rwc    io.ReadWriteCloser
+	handle tpmutil.Handle
+	public crypto.PublicKey
+}
+
+// newTPMSigner opens the TPM at path and loads the public part of the key at
+// the persistent handle (eg 0x81008000).
+func newTPMSigner(path string, handle uint32) (*tpmSigner, error) {
+	rwc, err := openTPM(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open TPM %s: %v", path, err)
+	}
+	pub, _, _, err := tpm2.ReadPublic(rwc, tpmutil.Handle(handle))
+	if err != nil {
+		rwc.Close()
+		return nil, fmt.Errorf("unable to read TPM key 0x%x: %v", handle, err)
+	}
+	if pub.Type != tpm2.AlgRSA {
+		rwc.Close()
+		return nil, fmt.Errorf("TPM key 0x%x is not an RSA key", handle)
+	}
+	k, err := pub.Key()
+	if err != nil {
+		rwc.Close()
+		return nil, fmt.Errorf("unable to read TPM key 0x%x: %v", handle, err)
+	}
+	return &tpmSigner{rwc: rwc, handle: tpmutil.Handle(handle), public: k}, nil
+}
+
+func (t *tpmSigner) Public() crypto.PublicKey {
+	return t.public
+}
+
+func (t *tpmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.New("TPM signer only supports SHA256")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sig, err := tpm2.Sign(t.rwc, t.handle, "", digest, nil, &tpm2.SigScheme{
+		Alg:  tpm2.AlgRSASSA,
+		Hash: tpm2.AlgSHA256,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("TPM sign: %v", err)
+	}
+	return sig.RSA.Signature, nil
+}
+
+func (t *tpmSigner) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rwc.Close()
+}
@@ -0,0 +1,337 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds and status codes of OTLP.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+
+	statusOK    = 1
+	statusError = 2
+)
+
+const (
+	// traceBatchSize and traceInterval bound how long spans are held before
+	// they are exported.
+	traceBatchSize = 512
+	traceInterval  = 5 * time.Second
+	// traceMaxPending drops spans if the collector can't keep up.
+	traceMaxPending = 8192
+	// traceScope is the instrumentation scope of the spans.
+	traceScope = "github.com/salrashid123/gce_metadata_server"
+)
+
+// tracer records spans of the handled requests and token fetches and
+// exports them in batches to an OpenTelemetry collector with OTLP/HTTP,
+// JSON encoded.  Incoming W3C traceparent headers are honored so the spans
+// join the caller's trace.
+type tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []*span
+	flush   chan struct{}
+}
+
+func newTracer(endpoint, service string) *tracer {
+	if service == "" {
+		service = "gce-metadata-server"
+	}
+	return &tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		flush:    make(chan struct{}, 1),
+	}
+}
+
+// span is an operation in a trace.  A nil span records nothing.
+type span struct {
+	t        *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	status   int
+	message  string
+}
+
+type spanKey struct{}
+
+// startSpan starts a child of the span in ctx, if there is one.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return ctx, nil
+	}
+	sp := parent.t.newSpan(name, kind)
+	sp.traceID, sp.parentID = parent.traceID, parent.spanID
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+func (t *tracer) newSpan(name string, kind int) *span {
+	sp := &span{t: t, name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	rand.Read(sp.traceID[:])
+	rand.Read(sp.spanID[:])
+	return sp
+}
+
+func (sp *span) set(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.attrs[key] = value
+}
+
+// finish ends the span, as failed if err is set.
+func (sp *span) finish(err error) {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	if err != nil {
+		sp.status, sp.message = statusError, err.Error()
+	}
+	t := sp.t
+	t.mu.Lock()
+	if len(t.pending) < traceMaxPending {
+		t.pending = append(t.pending, sp)
+	}
+	full := len(t.pending) >= traceBatchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// parseTraceparent returns the trace and parent span ids of a W3C
+// traceparent header (00-<trace id>-<span id>-<flags>).
+func parseTraceparent(h string) (traceID [16]byte, spanID [8]byte, ok bool) {
+	f := strings.Split(strings.TrimSpace(h), "-")
+	if len(f) < 4 || f[0] == "ff" || len(f[1]) != 32 || len(f[2]) != 16 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(f[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(f[2])); err != nil {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, traceID != [16]byte{} && spanID != [8]byte{}
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Hijack lets handlers take over the connection (see resetConnection).
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", w.ResponseWriter)
+	}
+	return hj.Hijack()
+}
+
+// traceRequests records a server span for each request.
+func (s *Server) traceRequests(next http.Handler) http.Handler {
+	if s.tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sp := s.tracer.newSpan(r.Method+" "+r.URL.Path, spanServer)
+		if traceID, parentID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			sp.traceID, sp.parentID = traceID, parentID
+		}
+		sp.set("http.method", r.Method)
+		sp.set("http.target", r.URL.RequestURI())
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			sp.set("net.peer.ip", host)
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, sp)))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		sp.set("http.status_code", sw.status)
+		var err error
+		if sw.status >= 500 {
+			err = fmt.Errorf("%d %s", sw.status, http.StatusText(sw.status))
+		}
+		sp.finish(err)
+	})
+}
+
+// run exports the spans until stop is closed.  The spans of the last requests
+// are exported by Shutdown.
+func (t *tracer) run(stop <-chan struct{}) {
+	tick := time.NewTicker(traceInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.flush:
+		case <-stop:
+			return
+		}
+		t.export()
+	}
+}
+
+// otlpValue is an OTLP AnyValue.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	l := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		var a otlpValue
+		switch v := v.(type) {
+		case int:
+			i := strconv.Itoa(v)
+			a.IntValue = &i
+		case bool:
+			a.BoolValue = &v
+		default:
+			str := fmt.Sprint(v)
+			a.StringValue = &str
+		}
+		l = append(l, otlpAttribute{Key: k, Value: a})
+	}
+	return l
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// export posts the pending spans as an OTLP ExportTraceServiceRequest.
+func (t *tracer) export() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	spans := make([]otlpSpan, len(pending))
+	for i, sp := range pending {
+		o := &spans[i]
+		o.TraceID, o.SpanID = hex.EncodeToString(sp.traceID[:]), hex.EncodeToString(sp.spanID[:])
+		if sp.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+		}
+		o.Name, o.Kind = sp.name, sp.kind
+		o.StartTimeUnixNano = strconv.FormatInt(sp.start.UnixNano(), 10)
+		o.EndTimeUnixNano = strconv.FormatInt(sp.end.UnixNano(), 10)
+		o.Attributes = otlpAttributes(sp.attrs)
+		o.Status.Code, o.Status.Message = sp.status, sp.message
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": traceScope},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		logger.Errorf("Unable to encode spans: %v", err)
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Errorf("Unable to export %d spans: %v", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logger.Errorf("Unable to export %d spans: %s", len(spans), resp.Status)
+		return
+	}
+	logger.Debugf("Exported %d spans", len(spans))
+}
@@ -0,0 +1,538 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The metadata tree is a set of nested map[string]interface{} keyed by the
+// camelCase names used in the recursive json output.  Values are either
+// directories (maps, or lists of maps which are indexed by position) or leaf
+// values (string, json.Number, bool or lists of those).
+
+// endpoint marks a leaf which is served by a dedicated handler (eg token and
+// identity); it is shown in directory listings but has no static value.
+type endpoint struct{}
+
+// jsonLeaf is a leaf the metadata server returns as json even as text (eg
+// instance/tags is ["http-server"]).
+type jsonLeaf struct {
+	v interface{}
+}
+
+func (l jsonLeaf) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.v)
+}
+
+// indexedList is a list of values served as a directory of indexed leaves
+// (eg, forwarded-ips/0) rather than as a multi-valued leaf.
+type indexedList []string
+
+// userKeyedDirs are directories whose children are named by the user and are
+// never converted between kebab-case and camelCase.
+var userKeyedDirs = map[string]bool{
+	"attributes":      true,
+	"serviceAccounts": true,
+}
+
+// lookupPath walks the tree using metadata server path segments (eg,
+// network-interfaces/0/ip).
+func lookupPath(node interface{}, segments []string) (interface{}, bool) {
+	parent := ""
+	for _, seg := range segments {
+		if seg == "" {
+			continue
+		}
+		switch t := node.(type) {
+		case map[string]interface{}:
+			key := seg
+			if !userKeyedDirs[parent] {
+				key = kebabToCamel(seg)
+			}
+			v, ok := t[key]
+			if !ok {
+				return nil, false
+			}
+			node = v
+			parent = key
+		case []interface{}:
+			if !isDirList(t) {
+				return nil, false
+			}
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			node = t[i]
+			parent = seg
+		case indexedList:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			node = t[i]
+			parent = seg
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// isDir reports whether the node is served as a directory listing.
+func isDir(v interface{}) bool {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return true
+	case []interface{}:
+		return isDirList(t)
+	case indexedList:
+		return true
+	}
+	return false
+}
+
+// isDirList reports whether a list is a directory of indexed entries (eg,
+// network-interfaces/0/) rather than a multi-valued leaf (eg, scopes).
+func isDirList(l []interface{}) bool {
+	for _, e := range l {
+		if _, ok := e.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return len(l) > 0
+}
+
+// dirEntries returns the sorted children of a directory; child directories
+// have a trailing slash.
+func dirEntries(v interface{}, name string) []string {
+	entries := []string{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if !userKeyedDirs[name] {
+				k = camelToKebab(k)
+			}
+			if isDir(e) {
+				k = k + "/"
+			}
+			entries = append(entries, k)
+		}
+		sort.Strings(entries)
+	case []interface{}:
+		for i := range t {
+			entries = append(entries, strconv.Itoa(i)+"/")
+		}
+	case indexedList:
+		for i := range t {
+			entries = append(entries, strconv.Itoa(i))
+		}
+	}
+	return entries
+}
+
+// listDir returns the newline separated children of a directory.
+func listDir(v interface{}, name string) string {
+	var b strings.Builder
+	for _, e := range dirEntries(v, name) {
+		b.WriteString(e + "\n")
+	}
+	return b.String()
+}
+
+// renderText returns the recursive alt=text form of a directory: one
+// "path value" line per leaf value, with multi-valued leaves repeated.
+func renderText(v interface{}, name string) string {
+	var b strings.Builder
+	flattenText(&b, "", v, name)
+	return b.String()
+}
+
+func flattenText(b *strings.Builder, prefix string, v interface{}, name string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			e := t[k]
+			if _, ok := e.(endpoint); ok {
+				continue
+			}
+			display := k
+			if !userKeyedDirs[name] {
+				display = camelToKebab(k)
+			}
+			if isDir(e) {
+				flattenText(b, prefix+display+"/", e, k)
+				continue
+			}
+			writeTextLeaf(b, prefix+display, e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			flattenText(b, prefix+strconv.Itoa(i)+"/", e, "")
+		}
+	case indexedList:
+		for i, e := range t {
+			writeTextLeaf(b, prefix+strconv.Itoa(i), e)
+		}
+	}
+}
+
+func writeTextLeaf(b *strings.Builder, path string, v interface{}) {
+	switch t := v.(type) {
+	case []interface{}:
+		for _, e := range t {
+			writeTextLeaf(b, path, e)
+		}
+	case []string:
+		for _, e := range t {
+			writeTextLeaf(b, path, e)
+		}
+	default:
+		val, _ := renderLeaf(v)
+		b.WriteString(path + " " + val + "\n")
+	}
+}
+
+// renderLeaf returns the text value of a leaf; lists of scalars are newline
+// separated like the scopes and dns-servers endpoints.
+func renderLeaf(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case json.Number:
+		return t.String(), true
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(t)), true
+	case []interface{}:
+		var b strings.Builder
+		for _, e := range t {
+			s, ok := renderLeaf(e)
+			if !ok {
+				return "", false
+			}
+			b.WriteString(s + "\n")
+		}
+		return b.String(), true
+	case []string:
+		return strings.Join(t, "\n") + "\n", true
+	case jsonLeaf:
+		js, err := json.Marshal(t.v)
+		return string(js), err == nil
+	}
+	return "", false
+}
+
+// renderJSON returns the recursive json form of a node, leaving out the
+// dynamic endpoints.
+func renderJSON(v interface{}) ([]byte, error) {
+	return json.Marshal(pruneEndpoints(v))
+}
+
+func pruneEndpoints(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			if _, ok := e.(endpoint); ok {
+				continue
+			}
+			m[k] = pruneEndpoints(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = pruneEndpoints(e)
+		}
+		return l
+	}
+	return v
+}
+
+// etag returns a stable hash of a node's value as rendered in format (eg
+// "text" or "json recursive"), which is included since each form is a
+// different body.  The recursive json form of the node is hashed so that
+// directories change whenever any of their children do.
+func etag(v interface{}, format string) string {
+	js, err := renderJSON(v)
+	if err != nil {
+		return ""
+	}
+	return hashEtag(append([]byte(format+"\n"), js...))
+}
+
+// hashEtag returns the etag for a response body.
+func hashEtag(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:8])
+}
+
+// etagMatches reports whether an If-None-Match header matches the etag.  Both
+// quoted and unquoted (as sent by the metadata server) etags are accepted.
+func etagMatches(ifNoneMatch, tag string) bool {
+	if ifNoneMatch == "" || tag == "" {
+		return false
+	}
+	for _, e := range strings.Split(ifNoneMatch, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" {
+			return true
+		}
+		e = strings.TrimPrefix(e, "W/")
+		if strings.Trim(e, `"`) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// setPath sets the value at the path segments, creating directories as
+// needed.  The keys of directories in value are converted with camelKeys so
+// they can be requested in kebab-case.
+func setPath(t map[string]interface{}, segments []string, value interface{}) error {
+	var keys []string
+	for _, seg := range segments {
+		if seg != "" {
+			keys = append(keys, seg)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("empty metadata path")
+	}
+	var node interface{} = t
+	parent := ""
+	for i, seg := range keys {
+		last := i == len(keys)-1
+		switch n := node.(type) {
+		case map[string]interface{}:
+			key := seg
+			if !userKeyedDirs[parent] {
+				key = kebabToCamel(seg)
+			}
+			if last {
+				v, err := camelNode(value, key)
+				if err != nil {
+					return err
+				}
+				n[key] = v
+				return nil
+			}
+			if _, ok := n[key]; !ok || !isDir(n[key]) {
+				n[key] = map[string]interface{}{}
+			}
+			node = n[key]
+			parent = key
+		case []interface{}:
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(n) {
+				return fmt.Errorf("invalid index %q in metadata path", seg)
+			}
+			if last {
+				v, err := camelNode(value, "")
+				if err != nil {
+					return err
+				}
+				n[idx] = v
+				return nil
+			}
+			node = n[idx]
+			parent = seg
+		case indexedList:
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(n) {
+				return fmt.Errorf("invalid index %q in metadata path", seg)
+			}
+			v, ok := value.(string)
+			if !last || !ok {
+				return fmt.Errorf("%q only holds values", keys[i-1])
+			}
+			n[idx] = v
+			return nil
+		default:
+			return fmt.Errorf("%q is not a directory", seg)
+		}
+	}
+	return nil
+}
+
+// lastKey returns the tree key of the final path segment, used to decide how
+// a directory's children are named.
+func lastKey(segments []string) string {
+	parent := ""
+	for _, seg := range segments {
+		if seg == "" {
+			continue
+		}
+		if userKeyedDirs[parent] {
+			parent = seg
+		} else {
+			parent = kebabToCamel(seg)
+		}
+	}
+	return parent
+}
+
+// copyTree returns a deep copy of the directories in a tree so it can be
+// modified without affecting the original.  Leaf values are shared.
+func copyTree(t map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(t))
+	for k, v := range t {
+		c[k] = copyNode(v)
+	}
+	return c
+}
+
+func copyNode(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return copyTree(t)
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = copyNode(e)
+		}
+		return l
+	case indexedList:
+		return append(indexedList{}, t...)
+	}
+	return v
+}
+
+// camelKeys returns a copy of the directories in a tree with their keys
+// converted from kebab-case to camelCase the way lookupPath converts request
+// path segments, so that values written the way they are requested (eg
+// "my-key") can be reached.  The children of userKeyedDirs are kept as is.
+func camelKeys(t map[string]interface{}, name string) (map[string]interface{}, error) {
+	c := make(map[string]interface{}, len(t))
+	for k, v := range t {
+		key := k
+		if !userKeyedDirs[name] {
+			key = kebabToCamel(k)
+		}
+		if _, ok := c[key]; ok {
+			return nil, fmt.Errorf("metadata key %q is set more than once (as kebab-case and camelCase)", camelToKebab(key))
+		}
+		n, err := camelNode(v, key)
+		if err != nil {
+			return nil, err
+		}
+		c[key] = n
+	}
+	return c, nil
+}
+
+func camelNode(v interface{}, name string) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return camelKeys(t, name)
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			n, err := camelNode(e, "")
+			if err != nil {
+				return nil, err
+			}
+			l[i] = n
+		}
+		return l, nil
+	}
+	return v, nil
+}
+
+// mergeTree copies src into dst; directories are merged recursively and
+// everything else in src replaces the value in dst.
+func mergeTree(dst, src map[string]interface{}) map[string]interface{} {
+	if dst == nil {
+		dst = map[string]interface{}{}
+	}
+	for k, v := range src {
+		dst[k] = mergeNode(dst[k], v)
+	}
+	return dst
+}
+
+func mergeNode(dst, src interface{}) interface{} {
+	switch s := src.(type) {
+	case map[string]interface{}:
+		dm, ok := dst.(map[string]interface{})
+		if !ok {
+			dm = map[string]interface{}{}
+		}
+		return mergeTree(dm, s)
+	case []interface{}:
+		dl, ok := dst.([]interface{})
+		if !ok || !isDirList(s) || !isDirList(dl) {
+			return src
+		}
+		l := make([]interface{}, len(s))
+		for i, e := range s {
+			if i < len(dl) {
+				l[i] = mergeNode(dl[i], e)
+			} else {
+				l[i] = e
+			}
+		}
+		return l
+	}
+	return src
+}
+
+// subTree returns the directory at key, creating it if needed.
+func subTree(t map[string]interface{}, key string) map[string]interface{} {
+	if m, ok := t[key].(map[string]interface{}); ok {
+		return m
+	}
+	m := map[string]interface{}{}
+	t[key] = m
+	return m
+}
+
+func kebabToCamel(s string) string {
+	parts := strings.Split(s, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func camelToKebab(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteRune('-')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,364 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKebabCamel(t *testing.T) {
+	for _, tc := range []struct{ kebab, camel string }{
+		{"id", "id"},
+		{"machine-type", "machineType"},
+		{"network-interfaces", "networkInterfaces"},
+		{"numeric-project-id", "numericProjectId"},
+	} {
+		if got := kebabToCamel(tc.kebab); got != tc.camel {
+			t.Errorf("kebabToCamel(%q) = %q, want %q", tc.kebab, got, tc.camel)
+		}
+		if got := camelToKebab(tc.camel); got != tc.kebab {
+			t.Errorf("camelToKebab(%q) = %q, want %q", tc.camel, got, tc.kebab)
+		}
+	}
+}
+
+// testTree is a small metadata tree in the form served by the handlers.
+func testTree() map[string]interface{} {
+	return map[string]interface{}{
+		"instance": map[string]interface{}{
+			"machineType": "e2-small",
+			"attributes": map[string]interface{}{
+				"enable-oslogin": "TRUE",
+			},
+			"networkInterfaces": []interface{}{
+				map[string]interface{}{
+					"ip":           "10.128.0.2",
+					"forwardedIps": indexedList{"10.0.0.1"},
+				},
+			},
+			"serviceAccounts": map[string]interface{}{
+				"default": map[string]interface{}{"token": endpoint{}},
+			},
+		},
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	tree := testTree()
+	for _, tc := range []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{"instance/machine-type", "e2-small", true},
+		{"instance/machineType", "e2-small", true},
+		{"instance/attributes/enable-oslogin", "TRUE", true},
+		{"instance/attributes/enableOslogin", nil, false},
+		{"instance/network-interfaces/0/ip", "10.128.0.2", true},
+		{"instance/network-interfaces/0/forwarded-ips/0", "10.0.0.1", true},
+		{"instance/network-interfaces/1/ip", nil, false},
+		{"instance/network-interfaces/x", nil, false},
+		{"instance/missing", nil, false},
+		{"instance/machine-type/foo", nil, false},
+	} {
+		got, ok := lookupPath(tree, strings.Split(tc.path, "/"))
+		if ok != tc.ok || (ok && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("lookupPath(%s) = %v, %v, want %v, %v", tc.path, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestDirEntries(t *testing.T) {
+	tree := testTree()
+	instance := tree["instance"]
+	want := []string{"attributes/", "machine-type", "network-interfaces/", "service-accounts/"}
+	if got := dirEntries(instance, "instance"); !reflect.DeepEqual(got, want) {
+		t.Errorf("dirEntries(instance) = %q, want %q", got, want)
+	}
+	attributes, _ := lookupPath(tree, []string{"instance", "attributes"})
+	if got := dirEntries(attributes, "attributes"); !reflect.DeepEqual(got, []string{"enable-oslogin"}) {
+		t.Errorf("dirEntries(attributes) = %q", got)
+	}
+	nics, _ := lookupPath(tree, []string{"instance", "network-interfaces"})
+	if got := dirEntries(nics, "networkInterfaces"); !reflect.DeepEqual(got, []string{"0/"}) {
+		t.Errorf("dirEntries(network-interfaces) = %q", got)
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	tree := testTree()
+	if err := setPath(tree, []string{"instance", "cpu-platform"}, "Intel Broadwell"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPath(tree, []string{"instance", "attributes", "foo-bar"}, "baz"); err != nil {
+		t.Fatal(err)
+	}
+	instance := tree["instance"].(map[string]interface{})
+	if instance["cpuPlatform"] != "Intel Broadwell" {
+		t.Errorf("cpuPlatform = %v", instance["cpuPlatform"])
+	}
+	if v := instance["attributes"].(map[string]interface{})["foo-bar"]; v != "baz" {
+		t.Errorf("attributes/foo-bar = %v", v)
+	}
+	if err := setPath(tree, []string{"instance", "network-interfaces", "3", "ip"}, "x"); err == nil {
+		t.Error("setting a missing index succeeded")
+	}
+	// directories are stored the way they are looked up
+	dir := map[string]interface{}{
+		"my-key":     "v",
+		"attributes": map[string]interface{}{"my-attr": "a"},
+	}
+	if err := setPath(tree, []string{"instance", "my-dir"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"instance/my-dir/my-key":             "v",
+		"instance/my-dir/attributes/my-attr": "a",
+	} {
+		if v, ok := lookupPath(tree, strings.Split(path, "/")); !ok || v != want {
+			t.Errorf("%s = %v %v, want %s", path, v, ok, want)
+		}
+	}
+	dup := map[string]interface{}{"my-key": "a", "myKey": "b"}
+	if err := setPath(tree, []string{"instance", "my-dir"}, dup); err == nil {
+		t.Error("setting a directory with a key in both cases succeeded")
+	}
+}
+
+func TestExtraKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	if err := ioutil.WriteFile(path, []byte(`{
+		"instance": {
+			"my-key": {"sub-key": "kebab"},
+			"otherKey": "camel",
+			"attributes": {"my-attribute": "kept"}
+		}
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{MetadataFile: path})
+	for path, want := range map[string]string{
+		"instance/my-key/sub-key":          "kebab",
+		"instance/other-key":               "camel",
+		"instance/attributes/my-attribute": "kept",
+	} {
+		resp, body := get(t, s, "/computeMetadata/v1/"+path, "metadata", "Google")
+		if resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("GET %s = %d %q, want %q", path, resp.StatusCode, body, want)
+		}
+	}
+
+	m := &Metadata{Extra: map[string]interface{}{
+		"instance": map[string]interface{}{"my-key": "a", "myKey": "b"},
+	}}
+	if _, err := m.tree(); err == nil {
+		t.Error("tree accepted my-key and myKey")
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"abc", true},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{"*", true},
+		{"xyz", false},
+	} {
+		if got := etagMatches(tc.header, "abc"); got != tc.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestEtag(t *testing.T) {
+	dir := testTree()["instance"]
+	if etag(dir, "text") != etag(testTree()["instance"], "text") {
+		t.Error("etag of the same value differs")
+	}
+	formats := map[string]bool{}
+	for _, f := range []string{"text", "json", "text recursive", "json recursive"} {
+		formats[etag(dir, f)] = true
+	}
+	if len(formats) != 4 {
+		t.Errorf("etags of the renderings of a directory aren't distinct: %v", formats)
+	}
+	changed := testTree()
+	if err := setPath(changed, []string{"instance", "network-interfaces", "0", "ip"}, "10.128.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if etag(dir, "json recursive") == etag(changed["instance"], "json recursive") {
+		t.Error("etag of a directory didn't change with a child")
+	}
+}
+
+func TestInstanceDefaults(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"shutdown.sh":  "#!/bin/sh\nsync\n",
+		"spec.yaml":    "spec:\n  containers:\n  - image: busybox\n",
+		"cloud-config": "#cloud-config\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		want map[string]string
+	}{
+		{"derived", Config{InstanceName: "vm-1"}, map[string]string{
+			"instance/name":                                "vm-1",
+			"instance/hostname":                            "vm-1.c.project.internal",
+			"instance/id":                                  string(instanceID("project/vm-1")),
+			"instance/zone":                                "projects/123456789/zones/us-central1-a",
+			"instance/machine-type":                        "projects/123456789/machineTypes/e2-medium",
+			"instance/cpu-platform":                        defaultCPUPlatform,
+			"instance/image":                               defaultImage,
+			"instance/tags":                                "[]",
+			"instance/disks/":                              "0/\n",
+			"instance/disks/0/device-name":                 "persistent-disk-0",
+			"instance/disks/0/index":                       "0",
+			"instance/disks/0/interface":                   "SCSI",
+			"instance/disks/0/mode":                        "READ_WRITE",
+			"instance/disks/0/type":                        "PERSISTENT",
+			"instance/network-interfaces/0/ip":             defaultIP,
+			"instance/network-interfaces/0/network":        "projects/123456789/networks/default",
+			"instance/network-interfaces/0/subnetmask":     defaultSubnetmask,
+			"instance/network-interfaces/0/gateway":        "10.128.0.1",
+			"instance/network-interfaces/0/mac":            "42:01:0a:80:00:02",
+			"instance/network-interfaces/0/mtu":            defaultMTU,
+			"instance/network-interfaces/0/dns-servers":    metadataIP + "\n",
+			"instance/network-interfaces/0/forwarded-ips/": "",
+			"instance/network-interfaces/0/ip-aliases/":    "",
+			"instance/scheduling/preemptible":              "FALSE",
+			"instance/scheduling/automatic-restart":        "TRUE",
+			"instance/scheduling/on-host-maintenance":      "MIGRATE",
+			"instance/maintenance-event":                   MaintenanceNone,
+			"instance/preempted":                           "FALSE",
+		}},
+		{"metadata", Config{Metadata: &Metadata{Instance: InstanceMetadata{
+			Disks: []Disk{{DeviceName: "boot"}, {Mode: "READ_ONLY", Type: "SCRATCH"}},
+			NetworkInterfaces: []NetworkInterface{
+				{IP: "10.0.1.5", Subnetmask: "255.255.255.0", MTU: "8896"},
+				{
+					IP: "192.168.7.20", Network: "projects/other/networks/shared", Gateway: "192.168.0.254",
+					AccessConfigs: []AccessConfig{{ExternalIP: "34.1.2.3"}},
+					ForwardedIPs:  []string{"35.1.1.1"},
+					IPAliases:     []string{"10.4.0.0/24"},
+				},
+			},
+		}}}, map[string]string{
+			"instance/disks/0/device-name":                               "boot",
+			"instance/disks/0/mode":                                      "READ_WRITE",
+			"instance/disks/1/device-name":                               "persistent-disk-1",
+			"instance/disks/1/index":                                     "1",
+			"instance/disks/1/mode":                                      "READ_ONLY",
+			"instance/disks/1/type":                                      "SCRATCH",
+			"instance/network-interfaces/0/gateway":                      "10.0.1.1",
+			"instance/network-interfaces/0/mac":                          "42:01:0a:00:01:05",
+			"instance/network-interfaces/0/mtu":                          "8896",
+			"instance/network-interfaces/1/network":                      "projects/other/networks/shared",
+			"instance/network-interfaces/1/gateway":                      "192.168.0.254",
+			"instance/network-interfaces/1/mac":                          "42:01:c0:a8:07:14",
+			"instance/network-interfaces/1/access-configs/0/external-ip": "34.1.2.3",
+			"instance/network-interfaces/1/access-configs/0/type":        "ONE_TO_ONE_NAT",
+			"instance/network-interfaces/1/forwarded-ips/0":              "35.1.1.1",
+			"instance/network-interfaces/1/ip-aliases/0":                 "10.4.0.0/24",
+		}},
+		{"gke node", Config{ClusterName: "cluster-1", KubeLabels: map[string]string{"pool": "default", "env": "test"}}, map[string]string{
+			"instance/attributes/cluster-name":     "cluster-1",
+			"instance/attributes/cluster-location": defaultZone,
+			"instance/attributes/cluster-uid":      fmt.Sprintf("%x", sha256.Sum256([]byte("project/"+defaultZone+"/cluster-1"))),
+			"instance/attributes/kube-labels":      "env=test,pool=default",
+		}},
+		{"cos", Config{
+			ContainerDeclarationFile: filepath.Join(dir, "spec.yaml"),
+			UserDataFile:             filepath.Join(dir, "cloud-config"),
+			COSMetrics:               true,
+		}, map[string]string{
+			"instance/attributes/gce-container-declaration": files["spec.yaml"],
+			"instance/attributes/user-data":                 files["cloud-config"],
+			"instance/attributes/cos-metrics-enabled":       "true",
+		}},
+		{"local name", Config{}, map[string]string{
+			"instance/name":     localInstanceName(),
+			"instance/hostname": localInstanceName() + ".c.project.internal",
+		}},
+		{"overridden", Config{
+			InstanceName:        "vm-1",
+			InstanceHostname:    "vm-1.example.com",
+			InstanceID:          "1234567890123456789",
+			Zone:                "europe-west1-b",
+			MachineType:         "projects/other/machineTypes/n2-standard-2",
+			CPUPlatform:         "AMD Milan",
+			Image:               "projects/cos-cloud/global/images/cos-stable",
+			Tags:                []string{"http-server", "ssh"},
+			Licenses:            []string{"1000201", "1000202"},
+			Preemptible:         true,
+			InstanceAttributes:  map[string]string{"startup-script": "echo hi"},
+			SSHKeys:             []string{"alice:ssh-ed25519 AAAA alice@host", "bob:ssh-rsa BBBB"},
+			InstanceSSHKeys:     []string{"carol:ssh-ed25519 CCCC"},
+			BlockProjectSSHKeys: true,
+			OSLogin:             true,
+			ShutdownScriptFile:  filepath.Join(dir, "shutdown.sh"),
+			StartupScriptURL:    "gs://bucket/startup.sh",
+		}, map[string]string{
+			"instance/name":                              "vm-1",
+			"instance/hostname":                          "vm-1.example.com",
+			"instance/id":                                "1234567890123456789",
+			"instance/zone":                              "projects/123456789/zones/europe-west1-b",
+			"instance/machine-type":                      "projects/other/machineTypes/n2-standard-2",
+			"instance/cpu-platform":                      "AMD Milan",
+			"instance/image":                             "projects/cos-cloud/global/images/cos-stable",
+			"instance/tags":                              `["http-server","ssh"]`,
+			"instance/licenses/":                         "0/\n1/\n",
+			"instance/licenses/1/id":                     "1000202",
+			"instance/scheduling/preemptible":            "TRUE",
+			"instance/scheduling/automatic-restart":      "FALSE",
+			"instance/scheduling/on-host-maintenance":    "TERMINATE",
+			"instance/attributes/startup-script":         "echo hi",
+			"instance/attributes/ssh-keys":               "carol:ssh-ed25519 CCCC",
+			"instance/attributes/block-project-ssh-keys": "TRUE",
+			"project/attributes/ssh-keys":                "alice:ssh-ed25519 AAAA alice@host\nbob:ssh-rsa BBBB",
+			"project/attributes/enable-oslogin":          "TRUE",
+			"instance/attributes/shutdown-script":        files["shutdown.sh"],
+			"instance/attributes/startup-script-url":     "gs://bucket/startup.sh",
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, tc.cfg)
+			for path, want := range tc.want {
+				resp, body := get(t, s, "/computeMetadata/v1/"+path, "metadata", "Google")
+				if resp.StatusCode != http.StatusOK || body != want {
+					t.Errorf("GET %s = %d %q, want %q", path, resp.StatusCode, body, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// vaultTokenSource reads access tokens from a HashiCorp Vault GCP secrets
+// engine path, eg gcp/roleset/my-roleset/token or
+// gcp/static-account/my-account/token.
+type vaultTokenSource struct {
+	ctx   context.Context
+	addr  string
+	path  string
+	token string
+}
+
+type vaultTokenResponse struct {
+	Data struct {
+		Token            string `json:"token"`
+		ExpiresAtSeconds int64  `json:"expires_at_seconds"`
+		TokenTTL         int64  `json:"token_ttl"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+func (v *vaultTokenSource) Token() (*oauth2.Token, error) {
+	u := strings.TrimSuffix(v.addr, "/") + "/v1/" + strings.TrimPrefix(v.path, "/")
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := http.DefaultClient.Do(req.WithContext(v.ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token from vault: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token from vault: %v", err)
+	}
+	r := &vaultTokenResponse{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("unable to parse vault response: %s %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to read token from vault: %s %s", resp.Status, strings.Join(r.Errors, ", "))
+	}
+	if r.Data.Token == "" {
+		return nil, fmt.Errorf("vault path %s did not return a token", v.path)
+	}
+
+	exp := time.Now().Add(time.Duration(r.Data.TokenTTL) * time.Second)
+	if r.Data.ExpiresAtSeconds > 0 {
+		exp = time.Unix(r.Data.ExpiresAtSeconds, 0)
+	}
+	return &oauth2.Token{AccessToken: r.Data.Token, TokenType: "Bearer", Expiry: exp}, nil
+}
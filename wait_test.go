@@ -0,0 +1,147 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const waitPath = "/computeMetadata/v1/instance/attributes/foo"
+
+// waitResult is the outcome of a wait_for_change request.
+type waitResult struct {
+	resp *http.Response
+	body string
+	err  error
+}
+
+// waitFor starts a wait_for_change request for waitPath with the query.
+func waitFor(t *testing.T, s *Server, query string) <-chan waitResult {
+	done := make(chan waitResult, 1)
+	req, err := http.NewRequest("GET", "http://"+s.Addr().String()+waitPath+"?wait_for_change=true"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "metadata"
+	req.Header.Set("Metadata-Flavor", "Google")
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- waitResult{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		done <- waitResult{resp, string(body), err}
+	}()
+	return done
+}
+
+// result fails the test if the wait_for_change request failed.
+func (r waitResult) result(t *testing.T) waitResult {
+	t.Helper()
+	if r.err != nil {
+		t.Fatalf("wait_for_change: %v", r.err)
+	}
+	return r
+}
+
+func TestWaitForChange(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if err := s.SetValue("instance/attributes/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	done := waitFor(t, s, "")
+	select {
+	case r := <-done:
+		t.Fatalf("wait_for_change returned %q before a change", r.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := s.SetValue("instance/attributes/foo", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-done:
+		r = r.result(t)
+		if r.resp.StatusCode != http.StatusOK || r.body != "baz" {
+			t.Errorf("wait_for_change = %d %q, want 200 baz", r.resp.StatusCode, r.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait_for_change didn't return after a change")
+	}
+}
+
+func TestWaitForChangeIgnoresOtherPaths(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if err := s.SetValue("instance/attributes/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	done := waitFor(t, s, "&timeout_sec=1")
+	time.Sleep(100 * time.Millisecond)
+	if err := s.SetValue("instance/attributes/other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-done:
+		r = r.result(t)
+		if r.body != "bar" {
+			t.Errorf("wait_for_change = %q, want bar", r.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait_for_change didn't return after timeout_sec")
+	}
+}
+
+func TestWaitForChangeLastEtag(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if err := s.SetValue("instance/attributes/foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := get(t, s, waitPath, "metadata", "Google")
+	tag := resp.Header.Get("ETag")
+	if tag == "" {
+		t.Fatal("no ETag")
+	}
+	// a change made before the wait starts is returned right away
+	if err := s.SetValue("instance/attributes/foo", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-waitFor(t, s, "&last_etag="+tag):
+		r = r.result(t)
+		if r.body != "baz" {
+			t.Errorf("wait_for_change = %q, want baz", r.body)
+		}
+		if r.resp.Header.Get("ETag") == tag {
+			t.Error("the ETag didn't change")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait_for_change with a stale last_etag blocked")
+	}
+
+	// an up to date last_etag waits until timeout_sec
+	resp, _ = get(t, s, waitPath, "metadata", "Google")
+	start := time.Now()
+	r := (<-waitFor(t, s, "&timeout_sec=1&last_etag="+resp.Header.Get("ETag"))).result(t)
+	if r.body != "baz" {
+		t.Errorf("wait_for_change = %q, want baz", r.body)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("wait_for_change returned after %v, want timeout_sec=1", d)
+	}
+}
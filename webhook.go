@@ -0,0 +1,100 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mds
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhookProvider gets tokens by POSTing a TokenRequest JSON document to an
+// HTTPS endpoint, eg an internal token vending service, which responds with
+// a TokenResponse.
+type webhookProvider struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newWebhookProvider(cfg Config) (*webhookProvider, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.WebhookCAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.WebhookCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read webhook CA: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.WebhookCAFile)
+		}
+	}
+	if cfg.WebhookCertFile != "" || cfg.WebhookKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.WebhookCertFile, cfg.WebhookKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load webhook client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &webhookProvider{
+		url:     cfg.WebhookURL,
+		headers: cfg.WebhookHeaders,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+func (p *webhookProvider) fetchToken(req *TokenRequest) (*TokenResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range p.headers {
+		r.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get token from webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get token from webhook: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get token from webhook: %s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	out := &TokenResponse{}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, fmt.Errorf("unable to parse webhook response: %v", err)
+	}
+	if out.Token == "" {
+		return nil, fmt.Errorf("webhook did not return a token")
+	}
+	return out, nil
+}